@@ -3,3 +3,8 @@
 apm.datadoghq.com/env: '{"DD_SERVICE":"kuberpult-rollout-service","DD_ENV":"{{ .Values.datadogTracing.environment }}","DD_VERSION":"{{ .Values.rollout.tag }}"}'
 {{- end }}
 {{- end }}
+
+{{- /* argocd.sendWebhook is the old name of argocd.sendWebhooks and still works */}}
+{{- define "argocd-sendWebhooks" }}
+{{- if or .Values.argocd.sendWebhooks .Values.argocd.sendWebhook }}true{{ end }}
+{{- end }}
@@ -33,6 +33,10 @@ git:
   # Timeout used for network operations
   networkTimeout: 1m
 
+  # If this is greater than 0, only the last fetchDepth commits of the branch are fetched on startup.
+  # Older commits are fetched when they are needed. This requires `cd.enableSqlite: false`.
+  fetchDepth: 0
+
 hub: europe-west3-docker.pkg.dev/fdc-public-docker-registry/kuberpult
 
 log:
@@ -91,6 +95,43 @@ rollout:
       memory: 250Mi
   # annotations given here will take precedence over the defaults defined in _helpers.tpl
   podAnnotations: {}
+  # Embed the rollout status in the overview of the cd-service, so that GetOverview and StreamOverview contain it.
+  statusInOverview: false
+  history:
+    # Persist the changes of the rollout status in a PersistentVolumeClaim, so that GetRolloutHistory keeps working after restarts.
+    enabled: false
+    size: 1Gi
+    # Empty uses the default storage class of the cluster.
+    storageClassName: ""
+  dora:
+    # The time span that GetDoraMetrics covers, e.g. "720h" for 30 days.
+    window: 720h
+  notifications:
+    # Send messages about successful, failed and stuck rollouts to webhooks, Slack or Microsoft Teams.
+    enabled: false
+    # Rollouts that are progressing for longer than this are reported as stuck.
+    stuckAfter: 15m
+    # Each route sends the matching events to one webhook. Empty teams, environments or events match everything.
+    # The team is the one in the com.freiheit.kuberpult/team annotation of the application.
+    # routes:
+    # - type: slack # one of webhook, slack or teams
+    #   url: https://hooks.slack.com/services/...
+    #   teams: ["team-a"]
+    #   environments: ["production"]
+    #   events: ["failure", "stuck"] # any of success, failure or stuck
+    #   template: "{{.Application}} is broken in {{.Environment}}: {{.Reason}}" # optional
+    routes: []
+  rollback:
+    # Automatically deploy the previous healthy version when a rollout fails, and lock the application so that the release train doesn't deploy the failed version again.
+    # Each rule enables rollbacks for the matching environments and applications, empty lists match everything but at least one of them must be set.
+    # rules:
+    # - environments: ["production"]
+    #   applications: ["checkout"]
+    #   failedFor: 5m # how long a version has to stay in error, defaults to 5m
+    #   deadline: 30m # optional, how long a new version can take to become healthy
+    rules: []
+    # With Dex enabled, the rollout service needs a role that is allowed to deploy and to create application locks.
+    role: ""
 
 ingress:
   # The simplest setup involves an ingress, to make kuberpult available outside the cluster.
@@ -136,8 +177,24 @@ argocd:
   server: ""
   # Disables tls verification. This is useful when running in the same cluster as argocd and using a self-signed certificate.
   insecure: false
-  # Enable sending webhooks to argocd
+  # Enable sending webhooks to argocd. The old name "sendWebhook" still works.
   sendWebhooks: false
+  webhook:
+    # The git provider that kuberpult pretends to be when sending webhooks.
+    # One of "github", "gitlab", "bitbucket" or "bitbucket-server".
+    flavour: github
+    # The shared secret that argocd uses to validate webhooks. It must match the secret of the flavour in the argocd-secret
+    # e.g. "webhook.github.secret" for github or "webhook.bitbucket.uuid" for bitbucket.
+    secret: ""
+
+  sync:
+    # Enable syncing the changed applications directly after every change of the manifest repo.
+    # The cd-service then uses the token and needs the permission to sync applications, e.g.
+    #    p, role:kuberpult, applications, sync, */*, allow
+    # Applications that are blocked by a sync window of their environment are only refreshed.
+    enabled: false
+    # Send up to that many parallel sync requests to argocd.
+    concurrency: 20
 
   refresh:
     # Enable sending refresh requests to argocd
@@ -146,6 +203,24 @@ argocd:
     # The number is determined by the power of the deployed argocd.
     concurrency: 50
 
+  # Additional argocd instances that the rollout service watches, e.g. one per region.
+  # Each instance only reports and refreshes its environments, argocd.server (if set) handles all other environments.
+  # instances:
+  # - name: eu
+  #   server: https://argocd-eu.example.com:443
+  #   token: ""
+  #   insecure: false
+  #   environments: ["production-eu"]
+  instances: []
+
+flux:
+  # Enable watching the Flux Kustomizations rendered for environments with a "flux" config.
+  # The rollout service then reports the status of Flux deployments in the same way as for argocd.
+  # If argocd.server is empty, the rollout service only uses Flux.
+  enabled: false
+  # The namespace of the Kustomizations, this must match the "namespace" in the flux config of the environments.
+  namespace: flux-system
+
 datadogTracing:
   enabled: false
   debugging: false
@@ -205,8 +280,8 @@ dex:
   # Defines the rbac policy when using Dex.
   # The permissions are added using the following format (<ROLE>, <ACTION>, <ENVIRONMENT_GROUP>:<ENVIRONMENT>, <APPLICATION>, allow).
   #
-  # Available actions are: CreateLock, DeleteLock, CreateRelease, DeployRelease, CreateUndeploy, DeployUndeploy, CreateEnvironment, CreateEnvironmentApplication and DeployReleaseTrain.
-  # The actions CreateUndeploy, DeployUndeploy and CreateEnvironmentApplication are environment independent meaning that the environment specified on the permission
+  # Available actions are: CreateLock, DeleteLock, CreateRelease, DeployRelease, CreateUndeploy, DeployUndeploy, CreateEnvironment, CreateEnvironmentApplication, DeployReleaseTrain, ExportSnapshot and RestoreSnapshot.
+  # The actions CreateUndeploy, DeployUndeploy, CreateEnvironmentApplication, ExportSnapshot and RestoreSnapshot are environment independent meaning that the environment specified on the permission
   # needs to follow the following format <ENVIRONMENT_GROUP>:*, otherwise an error will be thrown.
   #
   # Example permission: Developer, CreateLock, development:development, *, allow
@@ -39,6 +39,8 @@ const (
 	PermissionCreateEnvironment            = "CreateEnvironment"
 	PermissionDeleteEnvironmentApplication = "DeleteEnvironmentApplication"
 	PermissionDeployReleaseTrain           = "DeployReleaseTrain"
+	PermissionExportSnapshot               = "ExportSnapshot"
+	PermissionRestoreSnapshot              = "RestoreSnapshot"
 	// The default permission template.
 	PermissionTemplate = "%s,%s,%s:%s,%s,allow"
 )
@@ -64,7 +66,9 @@ func initPolicyConfig() policyConfig {
 			PermissionDeployUndeploy,
 			PermissionCreateEnvironment,
 			PermissionDeleteEnvironmentApplication,
-			PermissionDeployReleaseTrain},
+			PermissionDeployReleaseTrain,
+			PermissionExportSnapshot,
+			PermissionRestoreSnapshot},
 	}
 }
 
@@ -124,7 +128,7 @@ func (c *policyConfig) validateApplication(app string) error {
 // followed <ENVIRONMENT_GROUP:*>.
 func isEnvironmentIndependent(action string) bool {
 	switch action {
-	case PermissionCreateUndeploy, PermissionDeployUndeploy, PermissionCreateRelease:
+	case PermissionCreateUndeploy, PermissionDeployUndeploy, PermissionCreateRelease, PermissionExportSnapshot, PermissionRestoreSnapshot:
 		return true
 	}
 	return false
@@ -37,3 +37,7 @@ func ToUint64(u *uint64) uint64 {
 	}
 	return *u
 }
+
+func Int64(i int64) *int64 {
+	return &i
+}
@@ -17,6 +17,7 @@ Copyright 2023 freiheit.com*/
 package argocd
 
 import (
+	"encoding/json"
 	"fmt"
 	"path/filepath"
 	"strings"
@@ -34,6 +35,10 @@ const V1Alpha1 ApiVersion = "v1alpha1"
 type AppData struct {
 	AppName  string
 	TeamName string
+	// Overrides are the argocd settings of the deployed release
+	Overrides *config.ArgoCdApplicationOverrides
+	// Source is the helm or kustomize source of the deployed release, nil for plain manifests
+	Source *config.ReleaseSource
 }
 
 var ApiVersions []ApiVersion = []ApiVersion{V1Alpha1}
@@ -52,16 +57,13 @@ func Render(gitUrl string, gitBranch string, config config.EnvironmentConfig, en
 }
 
 func RenderV1Alpha1(gitUrl string, gitBranch string, config config.EnvironmentConfig, env string, appsData []AppData) ([]byte, error) {
-	applicationNs := ""
-	if config.ArgoCd.Destination.Namespace != nil {
-		applicationNs = *config.ArgoCd.Destination.Namespace
-	} else if config.ArgoCd.Destination.ApplicationNamespace != nil {
-		applicationNs = *config.ArgoCd.Destination.ApplicationNamespace
-	}
-	applicationDestination := v1alpha1.ApplicationDestination{
-		Name:      config.ArgoCd.Destination.Name,
-		Namespace: applicationNs,
-		Server:    config.ArgoCd.Destination.Server,
+	// With a list of destinations, every application is rendered once per destination and the names get the id of the destination as suffix.
+	// A single destination keeps the names without suffix.
+	multiDestination := len(config.ArgoCd.Destinations) > 0
+	destinations := config.ArgoCd.AllDestinations()
+	appProjectDestinations := make([]v1alpha1.ApplicationDestination, 0, len(destinations))
+	for _, d := range destinations {
+		appProjectDestinations = append(appProjectDestinations, appProjectDestination(d))
 	}
 	buf := []string{}
 	syncWindows := v1alpha1.SyncWindows{}
@@ -78,22 +80,10 @@ func RenderV1Alpha1(gitUrl string, gitBranch string, config config.EnvironmentCo
 			ManualSync:   true,
 		})
 	}
-	accessEntries := []v1alpha1.AccessEntry{}
-	for _, w := range config.ArgoCd.ClusterResourceWhitelist {
-		accessEntries = append(accessEntries, v1alpha1.AccessEntry{
-			Kind:  w.Kind,
-			Group: w.Group,
-		})
-	}
-
-	appProjectNs := ""
-	appProjectDestination := applicationDestination
-	if config.ArgoCd.Destination.Namespace != nil {
-		appProjectNs = *config.ArgoCd.Destination.Namespace
-	} else if config.ArgoCd.Destination.AppProjectNamespace != nil {
-		appProjectNs = *config.ArgoCd.Destination.AppProjectNamespace
+	sourceRepos := config.ArgoCd.SourceRepos
+	if len(sourceRepos) == 0 {
+		sourceRepos = []string{gitUrl}
 	}
-	appProjectDestination.Namespace = appProjectNs
 
 	project := v1alpha1.AppProject{
 		TypeMeta: v1alpha1.AppProjectTypeMeta,
@@ -101,11 +91,15 @@ func RenderV1Alpha1(gitUrl string, gitBranch string, config config.EnvironmentCo
 			Name: env,
 		},
 		Spec: v1alpha1.AppProjectSpec{
-			Description:              env,
-			SourceRepos:              []string{"*"},
-			Destinations:             []v1alpha1.ApplicationDestination{appProjectDestination},
-			SyncWindows:              syncWindows,
-			ClusterResourceWhitelist: accessEntries,
+			Description:                env,
+			SourceRepos:                sourceRepos,
+			Destinations:               appProjectDestinations,
+			SyncWindows:                syncWindows,
+			ClusterResourceWhitelist:   accessEntries(config.ArgoCd.ClusterResourceWhitelist),
+			NamespaceResourceBlacklist: accessEntries(config.ArgoCd.NamespaceResourceBlacklist),
+			NamespaceResourceWhitelist: accessEntries(config.ArgoCd.NamespaceResourceWhitelist),
+			Roles:                      projectRoles(env, config.ArgoCd.Roles),
+			OrphanedResources:          orphanedResources(config.ArgoCd.OrphanedResources),
 		},
 	}
 	if content, err := yaml.Marshal(&project); err != nil {
@@ -118,17 +112,281 @@ func RenderV1Alpha1(gitUrl string, gitBranch string, config config.EnvironmentCo
 		ignoreDifferences[index] = v1alpha1.ResourceIgnoreDifferences(value)
 	}
 	syncOptions := config.ArgoCd.SyncOptions
+	if config.ArgoCd.ApplicationSet {
+		for _, d := range destinations {
+			appSet, err := RenderApplicationSet(gitUrl, gitBranch, config.ArgoCd, env, applicationDestination(d), destinationId(multiDestination, d), ignoreDifferences, syncOptions)
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, appSet)
+		}
+	}
 	for _, appData := range appsData {
-		appManifest, err := RenderAppEnv(gitUrl, gitBranch, config.ArgoCd.ApplicationAnnotations, env, appData, applicationDestination, ignoreDifferences, syncOptions)
-		if err != nil {
-			return nil, err
+		if config.ArgoCd.ApplicationSet && !hasOwnApplication(config.ArgoCd, appData) {
+			// the application is generated by the ApplicationSet
+			continue
+		}
+		for _, d := range destinations {
+			appManifest, err := RenderAppEnv(gitUrl, gitBranch, config.ArgoCd.ApplicationAnnotations, env, appData, applicationDestination(d), destinationId(multiDestination, d), ignoreDifferences, syncOptions, config.ArgoCd.SyncPolicyForApp(appData.AppName))
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, appManifest)
 		}
-		buf = append(buf, appManifest)
 	}
 	return ([]byte)(strings.Join(buf, "---\n")), nil
 }
 
-func RenderAppEnv(gitUrl string, gitBranch string, applicationAnnotations map[string]string, env string, appData AppData, destination v1alpha1.ApplicationDestination, ignoreDifferences []v1alpha1.ResourceIgnoreDifferences, syncOptions v1alpha1.SyncOptions) (string, error) {
+func accessEntries(entries []config.AccessEntry) []v1alpha1.AccessEntry {
+	result := []v1alpha1.AccessEntry{}
+	for _, e := range entries {
+		result = append(result, v1alpha1.AccessEntry{
+			Kind:  e.Kind,
+			Group: e.Group,
+		})
+	}
+	return result
+}
+
+func projectRoles(env string, roles []config.ArgoCdProjectRole) []v1alpha1.ProjectRole {
+	result := []v1alpha1.ProjectRole{}
+	for _, r := range roles {
+		policies := []string{}
+		for _, p := range r.Policies {
+			object := p.Object
+			if object == "" {
+				object = fmt.Sprintf("%s/*", env)
+			}
+			permission := p.Permission
+			if permission == "" {
+				permission = "allow"
+			}
+			policies = append(policies, fmt.Sprintf("p, proj:%s:%s, %s, %s, %s, %s", env, r.Name, p.Resource, p.Action, object, permission))
+		}
+		result = append(result, v1alpha1.ProjectRole{
+			Name:        r.Name,
+			Description: r.Description,
+			Policies:    policies,
+			Groups:      r.Groups,
+		})
+	}
+	return result
+}
+
+func orphanedResources(settings *config.ArgoCdOrphanedResources) *v1alpha1.OrphanedResourcesMonitorSettings {
+	if settings == nil {
+		return nil
+	}
+	ignore := []v1alpha1.OrphanedResourceKey{}
+	for _, k := range settings.Ignore {
+		ignore = append(ignore, v1alpha1.OrphanedResourceKey(k))
+	}
+	return &v1alpha1.OrphanedResourcesMonitorSettings{
+		Warn:   settings.Warn,
+		Ignore: ignore,
+	}
+}
+
+func applicationDestination(d config.ArgoCdDestination) v1alpha1.ApplicationDestination {
+	applicationNs := ""
+	if d.Namespace != nil {
+		applicationNs = *d.Namespace
+	} else if d.ApplicationNamespace != nil {
+		applicationNs = *d.ApplicationNamespace
+	}
+	return v1alpha1.ApplicationDestination{
+		Name:      d.Name,
+		Namespace: applicationNs,
+		Server:    d.Server,
+	}
+}
+
+func appProjectDestination(d config.ArgoCdDestination) v1alpha1.ApplicationDestination {
+	appProjectNs := ""
+	if d.Namespace != nil {
+		appProjectNs = *d.Namespace
+	} else if d.AppProjectNamespace != nil {
+		appProjectNs = *d.AppProjectNamespace
+	}
+	return v1alpha1.ApplicationDestination{
+		Name:      d.Name,
+		Namespace: appProjectNs,
+		Server:    d.Server,
+	}
+}
+
+func destinationId(multiDestination bool, d config.ArgoCdDestination) string {
+	if !multiDestination {
+		return ""
+	}
+	return d.Id
+}
+
+// withDestination appends the destination id to the name, if there is one
+func withDestination(name string, destinationId string) string {
+	if destinationId == "" {
+		return name
+	}
+	return fmt.Sprintf("%s-%s", name, destinationId)
+}
+
+// ApplicationNames returns the names of the argocd applications of an application in an environment, one per destination.
+func ApplicationNames(argoConfig *config.EnvironmentConfigArgoCd, env string, app string) []string {
+	multiDestination := len(argoConfig.Destinations) > 0
+	result := []string{}
+	for _, d := range argoConfig.AllDestinations() {
+		result = append(result, withDestination(fmt.Sprintf("%s-%s", env, app), destinationId(multiDestination, d)))
+	}
+	return result
+}
+
+// hasOwnApplication returns true for applications that have their own sync policy, overrides or source, because those can't be generated by an ApplicationSet.
+func hasOwnApplication(argoConfig *config.EnvironmentConfigArgoCd, appData AppData) bool {
+	_, ok := argoConfig.ApplicationSyncPolicies[appData.AppName]
+	return ok || !appData.Overrides.IsEmpty() || appData.Source != nil
+}
+
+// ApplicationSetParametersFileName is the file that the git files generator of the ApplicationSet looks for.
+// It's written to environments/<env>/applications/<app>/ for every application that is generated by the ApplicationSet.
+const ApplicationSetParametersFileName = "argocd-application-set.json"
+
+type applicationSetParameters struct {
+	Team string `json:"team"`
+}
+
+// RenderApplicationSetParameters returns the content of the parameters file of an application,
+// or nil if the application is not generated by the ApplicationSet of the environment.
+func RenderApplicationSetParameters(argoConfig *config.EnvironmentConfigArgoCd, appData AppData) ([]byte, error) {
+	if argoConfig == nil || !argoConfig.ApplicationSet || hasOwnApplication(argoConfig, appData) {
+		return nil, nil
+	}
+	return json.Marshal(applicationSetParameters{Team: appData.TeamName})
+}
+
+// RenderApplicationSet renders one ApplicationSet for all applications of an environment.
+// The git files generator creates an Application for every application with a parameters file, so the ApplicationSet doesn't change when applications are added or removed.
+// The generated Applications have the same names as the ones rendered by RenderAppEnv. The ApplicationSet preserves the resources when it deletes an Application,
+// so that an application can get its own Application without deleting its resources.
+func RenderApplicationSet(gitUrl string, gitBranch string, argoConfig *config.EnvironmentConfigArgoCd, env string, destination v1alpha1.ApplicationDestination, destinationId string, ignoreDifferences []v1alpha1.ResourceIgnoreDifferences, syncOptions v1alpha1.SyncOptions) (string, error) {
+	syncPolicy := config.ArgoCdSyncPolicy{}
+	if argoConfig.SyncPolicy != nil {
+		syncPolicy = *argoConfig.SyncPolicy
+	}
+	if err := syncPolicy.Validate(); err != nil {
+		return "", fmt.Errorf("sync policy of %q: %w", env, err)
+	}
+	annotations := map[string]string{}
+	for k, v := range argoConfig.ApplicationAnnotations {
+		annotations[k] = v
+	}
+	// The path is environments/<env>/applications/<app>, so path[3] is the name of the application. The team comes from the parameters file.
+	annotations["com.freiheit.kuberpult/application"] = "{{path[3]}}"
+	annotations["com.freiheit.kuberpult/environment"] = env
+	annotations["com.freiheit.kuberpult/team"] = "{{team}}"
+	annotations["argocd.argoproj.io/manifest-generate-paths"] = "/{{path}}/manifests"
+	if destinationId != "" {
+		annotations["com.freiheit.kuberpult/destination"] = destinationId
+	}
+	appSet := v1alpha1.ApplicationSet{
+		TypeMeta: v1alpha1.ApplicationSetTypeMeta,
+		ObjectMeta: v1alpha1.ObjectMeta{
+			Name: withDestination(env, destinationId),
+		},
+		Spec: v1alpha1.ApplicationSetSpec{
+			Generators: []v1alpha1.ApplicationSetGenerator{
+				{
+					Git: &v1alpha1.GitGenerator{
+						RepoURL:  gitUrl,
+						Revision: gitBranch,
+						Files: []v1alpha1.GitFileGeneratorItem{
+							{
+								Path: filepath.Join("environments", env, "applications", "*", ApplicationSetParametersFileName),
+							},
+						},
+					},
+				},
+			},
+			Template: v1alpha1.ApplicationSetTemplate{
+				ObjectMeta: v1alpha1.ObjectMeta{
+					Name:        withDestination(fmt.Sprintf("%s-{{path[3]}}", env), destinationId),
+					Annotations: annotations,
+					Labels: map[string]string{
+						"com.freiheit.kuberpult/team": "{{team}}",
+					},
+					Finalizers: calculateFinalizers(syncPolicy.Finalizer),
+				},
+				Spec: v1alpha1.ApplicationSpec{
+					Project: env,
+					Source: &v1alpha1.ApplicationSource{
+						RepoURL:        gitUrl,
+						Path:           "{{path}}/manifests",
+						TargetRevision: gitBranch,
+					},
+					Destination:       destination,
+					SyncPolicy:        renderSyncPolicy(syncPolicy, syncOptions),
+					IgnoreDifferences: ignoreDifferences,
+				},
+			},
+			SyncPolicy: &v1alpha1.ApplicationSetSyncPolicy{
+				PreserveResourcesOnDeletion: true,
+			},
+		},
+	}
+	if content, err := yaml.Marshal(&appSet); err != nil {
+		return "", err
+	} else {
+		return string(content), nil
+	}
+}
+
+// applicationSources returns either one source or several sources for the application.
+// Plain manifests and kustomizations are read from the manifests directory.
+// A helm chart is read from its repository and the values from the manifests directory, which needs a second source.
+func applicationSources(gitUrl string, gitBranch string, manifestPath string, appData AppData) (*v1alpha1.ApplicationSource, []v1alpha1.ApplicationSource, error) {
+	manifests := &v1alpha1.ApplicationSource{
+		RepoURL:        gitUrl,
+		Path:           manifestPath,
+		TargetRevision: gitBranch,
+	}
+	if appData.Source == nil {
+		return manifests, nil, nil
+	}
+	if err := appData.Source.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if k := appData.Source.Kustomize; k != nil {
+		manifests.Kustomize = &v1alpha1.ApplicationSourceKustomize{
+			NamePrefix:   k.NamePrefix,
+			NameSuffix:   k.NameSuffix,
+			Images:       k.Images,
+			CommonLabels: k.CommonLabels,
+		}
+		return manifests, nil, nil
+	}
+	h := appData.Source.Helm
+	releaseName := h.ReleaseName
+	if releaseName == "" {
+		releaseName = appData.AppName
+	}
+	return nil, []v1alpha1.ApplicationSource{
+		{
+			RepoURL:        h.RepoURL,
+			Chart:          h.Chart,
+			TargetRevision: h.Version,
+			Helm: &v1alpha1.ApplicationSourceHelm{
+				ReleaseName: releaseName,
+				ValueFiles:  []string{fmt.Sprintf("$values/%s/%s", manifestPath, config.HelmValuesFileName)},
+			},
+		},
+		{
+			RepoURL:        gitUrl,
+			TargetRevision: gitBranch,
+			Ref:            "values",
+		},
+	}, nil
+}
+
+func RenderAppEnv(gitUrl string, gitBranch string, applicationAnnotations map[string]string, env string, appData AppData, destination v1alpha1.ApplicationDestination, destinationId string, ignoreDifferences []v1alpha1.ResourceIgnoreDifferences, syncOptions v1alpha1.SyncOptions, syncPolicy config.ArgoCdSyncPolicy) (string, error) {
 	name := appData.AppName
 	annotations := map[string]string{}
 	labels := map[string]string{}
@@ -136,6 +394,27 @@ func RenderAppEnv(gitUrl string, gitBranch string, applicationAnnotations map[st
 	for k, v := range applicationAnnotations {
 		annotations[k] = v
 	}
+	if overrides := appData.Overrides; overrides != nil {
+		if err := overrides.Validate(); err != nil {
+			return "", fmt.Errorf("argocd overrides of %q in %q: %w", name, env, err)
+		}
+		for k, v := range overrides.Annotations {
+			annotations[k] = v
+		}
+		for k, v := range overrides.Labels {
+			labels[k] = v
+		}
+		merged := make([]v1alpha1.ResourceIgnoreDifferences, 0, len(ignoreDifferences)+len(overrides.IgnoreDifferences))
+		merged = append(merged, ignoreDifferences...)
+		for _, value := range overrides.IgnoreDifferences {
+			merged = append(merged, v1alpha1.ResourceIgnoreDifferences(value))
+		}
+		ignoreDifferences = merged
+		syncOptions = mergeSyncOptions(syncOptions, overrides.SyncOptions)
+		if overrides.DestinationNamespace != nil {
+			destination.Namespace = *overrides.DestinationNamespace
+		}
+	}
 	annotations["com.freiheit.kuberpult/team"] = appData.TeamName
 	annotations["com.freiheit.kuberpult/application"] = name
 	annotations["com.freiheit.kuberpult/environment"] = env
@@ -143,32 +422,31 @@ func RenderAppEnv(gitUrl string, gitBranch string, applicationAnnotations map[st
 	// It has to start with a "/" to be absolute to the git repo.
 	// See https://argo-cd.readthedocs.io/en/stable/operator-manual/high_availability/#webhook-and-manifest-paths-annotation
 	annotations["argocd.argoproj.io/manifest-generate-paths"] = "/" + manifestPath
+	if destinationId != "" {
+		annotations["com.freiheit.kuberpult/destination"] = destinationId
+	}
 	labels["com.freiheit.kuberpult/team"] = appData.TeamName
+	if err := syncPolicy.Validate(); err != nil {
+		return "", fmt.Errorf("sync policy of %q in %q: %w", name, env, err)
+	}
+	source, sources, err := applicationSources(gitUrl, gitBranch, manifestPath, appData)
+	if err != nil {
+		return "", fmt.Errorf("source of %q in %q: %w", name, env, err)
+	}
 	app := v1alpha1.Application{
 		TypeMeta: v1alpha1.ApplicationTypeMeta,
 		ObjectMeta: v1alpha1.ObjectMeta{
-			Name:        fmt.Sprintf("%s-%s", env, name),
+			Name:        withDestination(fmt.Sprintf("%s-%s", env, name), destinationId),
 			Annotations: annotations,
 			Labels:      labels,
-			Finalizers:  calculateFinalizers(),
+			Finalizers:  calculateFinalizers(syncPolicy.Finalizer),
 		},
 		Spec: v1alpha1.ApplicationSpec{
-			Project: env,
-			Source: v1alpha1.ApplicationSource{
-				RepoURL:        gitUrl,
-				Path:           manifestPath,
-				TargetRevision: gitBranch,
-			},
-			Destination: destination,
-			SyncPolicy: &v1alpha1.SyncPolicy{
-				Automated: &v1alpha1.SyncPolicyAutomated{
-					Prune:    true,
-					SelfHeal: true,
-					// We always allow empty, because it makes it easier to delete apps/environments
-					AllowEmpty: true,
-				},
-				SyncOptions: syncOptions,
-			},
+			Project:           env,
+			Source:            source,
+			Sources:           sources,
+			Destination:       destination,
+			SyncPolicy:        renderSyncPolicy(syncPolicy, syncOptions),
 			IgnoreDifferences: ignoreDifferences,
 		},
 	}
@@ -179,8 +457,93 @@ func RenderAppEnv(gitUrl string, gitBranch string, applicationAnnotations map[st
 	}
 }
 
-func calculateFinalizers() []string {
-	return []string{
-		"resources-finalizer.argocd.argoproj.io",
+// mergeSyncOptions replaces the options of the environment with the overrides that have the same key and appends the rest
+func mergeSyncOptions(base v1alpha1.SyncOptions, overrides []string) v1alpha1.SyncOptions {
+	if len(overrides) == 0 {
+		return base
+	}
+	byKey := map[string]string{}
+	for _, opt := range overrides {
+		byKey[syncOptionKey(opt)] = opt
+	}
+	result := make(v1alpha1.SyncOptions, 0, len(base)+len(overrides))
+	used := map[string]bool{}
+	for _, opt := range base {
+		key := syncOptionKey(opt)
+		if override, ok := byKey[key]; ok {
+			if !used[key] {
+				result = append(result, override)
+				used[key] = true
+			}
+			continue
+		}
+		result = append(result, opt)
+	}
+	for _, opt := range overrides {
+		key := syncOptionKey(opt)
+		if !used[key] {
+			result = append(result, byKey[key])
+			used[key] = true
+		}
+	}
+	return result
+}
+
+func syncOptionKey(opt string) string {
+	key, _, _ := strings.Cut(opt, "=")
+	return key
+}
+
+func renderSyncPolicy(policy config.ArgoCdSyncPolicy, syncOptions v1alpha1.SyncOptions) *v1alpha1.SyncPolicy {
+	result := &v1alpha1.SyncPolicy{
+		SyncOptions: syncOptions,
+	}
+	if policy.IsAutomated() {
+		result.Automated = &v1alpha1.SyncPolicyAutomated{
+			Prune:    boolOrDefault(policy.Prune, true),
+			SelfHeal: boolOrDefault(policy.SelfHeal, true),
+			// We always allow empty, because it makes it easier to delete apps/environments
+			AllowEmpty: true,
+		}
+	}
+	if policy.Retry != nil {
+		result.Retry = &v1alpha1.RetryStrategy{
+			Limit: policy.Retry.Limit,
+		}
+		if policy.Retry.Backoff != nil {
+			result.Retry.Backoff = &v1alpha1.Backoff{
+				Duration:    policy.Retry.Backoff.Duration,
+				Factor:      policy.Retry.Backoff.Factor,
+				MaxDuration: policy.Retry.Backoff.MaxDuration,
+			}
+		}
+	}
+	return result
+}
+
+func boolOrDefault(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+func calculateFinalizers(finalizer *string) []string {
+	if finalizer == nil {
+		return []string{
+			"resources-finalizer.argocd.argoproj.io",
+		}
+	}
+	switch *finalizer {
+	case config.ArgoCdFinalizerNone:
+		return nil
+	case config.ArgoCdFinalizerBackground:
+		return []string{
+			"resources-finalizer.argocd.argoproj.io/background",
+		}
+	default:
+		return []string{
+			"resources-finalizer.argocd.argoproj.io",
+		}
 	}
 }
@@ -24,6 +24,7 @@ import (
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
 	"github.com/google/go-cmp/cmp"
 	godebug "github.com/kylelemons/godebug/diff"
+	"sigs.k8s.io/yaml"
 )
 
 func TestRender(t *testing.T) {
@@ -187,7 +188,7 @@ spec:
 				syncOptions = []string{"ApplyOutOfSyncOnly=true"}
 			)
 
-			actualResult, err := RenderAppEnv(GitUrl, gitBranch, annotations, env, appData, destination, ignoreDifferences, syncOptions)
+			actualResult, err := RenderAppEnv(GitUrl, gitBranch, annotations, env, appData, destination, "", ignoreDifferences, syncOptions, config.ArgoCdSyncPolicy{})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -198,6 +199,130 @@ spec:
 	}
 }
 
+func TestRenderSyncPolicy(t *testing.T) {
+	tcs := []struct {
+		Name               string
+		Config             config.EnvironmentConfigArgoCd
+		ExpectedSyncPolicy *v1alpha1.SyncPolicy
+		ExpectedFinalizers []string
+		ExpectedError      string
+	}{
+		{
+			Name:   "defaults",
+			Config: config.EnvironmentConfigArgoCd{},
+			ExpectedSyncPolicy: &v1alpha1.SyncPolicy{
+				Automated: &v1alpha1.SyncPolicyAutomated{Prune: true, SelfHeal: true, AllowEmpty: true},
+			},
+			ExpectedFinalizers: []string{"resources-finalizer.argocd.argoproj.io"},
+		},
+		{
+			Name: "environment policy",
+			Config: config.EnvironmentConfigArgoCd{
+				SyncPolicy: &config.ArgoCdSyncPolicy{
+					Prune:     ptr.Bool(false),
+					Finalizer: ptr.FromString(config.ArgoCdFinalizerBackground),
+					Retry: &config.ArgoCdRetry{
+						Limit: 5,
+						Backoff: &config.ArgoCdBackoff{
+							Duration:    "5s",
+							Factor:      ptr.Int64(2),
+							MaxDuration: "3m",
+						},
+					},
+				},
+			},
+			ExpectedSyncPolicy: &v1alpha1.SyncPolicy{
+				Automated: &v1alpha1.SyncPolicyAutomated{Prune: false, SelfHeal: true, AllowEmpty: true},
+				Retry: &v1alpha1.RetryStrategy{
+					Limit: 5,
+					Backoff: &v1alpha1.Backoff{
+						Duration:    "5s",
+						Factor:      ptr.Int64(2),
+						MaxDuration: "3m",
+					},
+				},
+			},
+			ExpectedFinalizers: []string{"resources-finalizer.argocd.argoproj.io/background"},
+		},
+		{
+			Name: "manual sync for one application",
+			Config: config.EnvironmentConfigArgoCd{
+				SyncPolicy: &config.ArgoCdSyncPolicy{
+					SelfHeal: ptr.Bool(false),
+				},
+				ApplicationSyncPolicies: map[string]config.ArgoCdSyncPolicy{
+					"app1": {
+						Automated: ptr.Bool(false),
+						Finalizer: ptr.FromString(config.ArgoCdFinalizerNone),
+					},
+				},
+			},
+			ExpectedSyncPolicy: &v1alpha1.SyncPolicy{},
+			ExpectedFinalizers: nil,
+		},
+		{
+			Name: "override of another application",
+			Config: config.EnvironmentConfigArgoCd{
+				ApplicationSyncPolicies: map[string]config.ArgoCdSyncPolicy{
+					"app2": {
+						Automated: ptr.Bool(false),
+					},
+				},
+			},
+			ExpectedSyncPolicy: &v1alpha1.SyncPolicy{
+				Automated: &v1alpha1.SyncPolicyAutomated{Prune: true, SelfHeal: true, AllowEmpty: true},
+			},
+			ExpectedFinalizers: []string{"resources-finalizer.argocd.argoproj.io"},
+		},
+		{
+			Name: "invalid finalizer",
+			Config: config.EnvironmentConfigArgoCd{
+				SyncPolicy: &config.ArgoCdSyncPolicy{
+					Finalizer: ptr.FromString("sometimes"),
+				},
+			},
+			ExpectedError: `sync policy of "app1" in "dev": invalid finalizer "sometimes", must be one of "foreground", "background" or "none"`,
+		},
+		{
+			Name: "invalid backoff",
+			Config: config.EnvironmentConfigArgoCd{
+				SyncPolicy: &config.ArgoCdSyncPolicy{
+					Retry: &config.ArgoCdRetry{
+						Backoff: &config.ArgoCdBackoff{Duration: "soon"},
+					},
+				},
+			},
+			ExpectedError: `sync policy of "app1" in "dev": invalid backoff duration "soon": time: invalid duration "soon"`,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			actualResult, err := RenderAppEnv("example.com/github", "main", nil, "dev", AppData{AppName: "app1"}, v1alpha1.ApplicationDestination{}, "", nil, nil, tc.Config.SyncPolicyForApp("app1"))
+			if tc.ExpectedError != "" {
+				if err == nil || err.Error() != tc.ExpectedError {
+					t.Fatalf("expected error %q, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var app v1alpha1.Application
+			if err := yaml.Unmarshal([]byte(actualResult), &app); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.ExpectedSyncPolicy, app.Spec.SyncPolicy); d != "" {
+				t.Errorf("unexpected sync policy:\n%s", d)
+			}
+			if d := cmp.Diff(tc.ExpectedFinalizers, app.Finalizers); d != "" {
+				t.Errorf("unexpected finalizers:\n%s", d)
+			}
+		})
+	}
+}
+
 func TestRenderV1Alpha1(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -222,7 +347,7 @@ spec:
   destinations:
   - {}
   sourceRepos:
-  - '*'
+  - https://git.example.com/
 `,
 		},
 		{
@@ -248,7 +373,7 @@ spec:
   destinations:
   - {}
   sourceRepos:
-  - '*'
+  - https://git.example.com/
   syncWindows:
   - applications:
     - '*'
@@ -283,7 +408,7 @@ spec:
   destinations:
   - {}
   sourceRepos:
-  - '*'
+  - https://git.example.com/
   syncWindows:
   - applications:
     - app*
@@ -291,6 +416,67 @@ spec:
     kind: neither deny nor allow
     manualSync: true
     schedule: not a valid crontab entry
+`,
+		},
+		{
+			name: "with project restrictions",
+			config: config.EnvironmentConfig{
+				ArgoCd: &config.EnvironmentConfigArgoCd{
+					SourceRepos: []string{"https://git.example.com/", "https://charts.example.com/"},
+					NamespaceResourceBlacklist: []config.AccessEntry{
+						{Group: "", Kind: "ResourceQuota"},
+					},
+					NamespaceResourceWhitelist: []config.AccessEntry{
+						{Group: "apps", Kind: "Deployment"},
+					},
+					Roles: []config.ArgoCdProjectRole{
+						{
+							Name:        "deployer",
+							Description: "may sync",
+							Policies: []config.ArgoCdProjectRolePolicy{
+								{Resource: "applications", Action: "sync"},
+								{Resource: "applications", Action: "delete", Object: "test-env/app1", Permission: "deny"},
+							},
+							Groups: []string{"team-a"},
+						},
+					},
+					OrphanedResources: &config.ArgoCdOrphanedResources{
+						Warn: ptr.Bool(true),
+						Ignore: []config.ArgoCdOrphanedResourceKey{
+							{Kind: "ConfigMap", Name: "kube-root-ca.crt"},
+						},
+					},
+				},
+			},
+			want: `apiVersion: argoproj.io/v1alpha1
+kind: AppProject
+metadata:
+  name: test-env
+spec:
+  description: test-env
+  destinations:
+  - {}
+  namespaceResourceBlacklist:
+  - kind: ResourceQuota
+  namespaceResourceWhitelist:
+  - group: apps
+    kind: Deployment
+  orphanedResources:
+    ignore:
+    - kind: ConfigMap
+      name: kube-root-ca.crt
+    warn: true
+  roles:
+  - description: may sync
+    groups:
+    - team-a
+    name: deployer
+    policies:
+    - p, proj:test-env:deployer, applications, sync, test-env/*, allow
+    - p, proj:test-env:deployer, applications, delete, test-env/app1, deny
+  sourceRepos:
+  - https://git.example.com/
+  - https://charts.example.com/
 `,
 		},
 		{
@@ -318,7 +504,7 @@ spec:
   destinations:
   - namespace: bar1
   sourceRepos:
-  - '*'
+  - https://git.example.com/
 ---
 apiVersion: argoproj.io/v1alpha1
 kind: Application
@@ -373,7 +559,7 @@ spec:
   destinations:
   - namespace: bar1
   sourceRepos:
-  - '*'
+  - https://git.example.com/
 ---
 apiVersion: argoproj.io/v1alpha1
 kind: Application
@@ -422,7 +608,7 @@ spec:
   destinations:
   - namespace: bar1
   sourceRepos:
-  - '*'
+  - https://git.example.com/
 `,
 		},
 		{
@@ -445,7 +631,7 @@ spec:
   destinations:
   - namespace: foo
   sourceRepos:
-  - '*'
+  - https://git.example.com/
 `,
 		},
 		{
@@ -468,7 +654,7 @@ spec:
   destinations:
   - namespace: foo
   sourceRepos:
-  - '*'
+  - https://git.example.com/
 `,
 		},
 		{
@@ -497,7 +683,76 @@ spec:
   destinations:
   - namespace: bar1
   sourceRepos:
-  - '*'
+  - https://git.example.com/
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  annotations:
+    argocd.argoproj.io/manifest-generate-paths: /environments/test-env/applications/app1/manifests
+    com.freiheit.kuberpult/application: app1
+    com.freiheit.kuberpult/environment: test-env
+    com.freiheit.kuberpult/team: some-team
+  finalizers:
+  - resources-finalizer.argocd.argoproj.io
+  labels:
+    com.freiheit.kuberpult/team: some-team
+  name: test-env-app1
+spec:
+  destination: {}
+  project: test-env
+  source:
+    path: environments/test-env/applications/app1/manifests
+    repoURL: https://git.example.com/
+    targetRevision: branch-name
+  syncPolicy:
+    automated:
+      allowEmpty: true
+      prune: true
+      selfHeal: true
+`,
+		},
+		{
+			name: "helm and kustomize sources",
+			config: config.EnvironmentConfig{
+				ArgoCd: &config.EnvironmentConfigArgoCd{
+					SourceRepos: []string{"https://git.example.com/", "https://charts.example.com"},
+				},
+			},
+			appData: []AppData{
+				{
+					AppName:  "app1",
+					TeamName: "some-team",
+					Source: &config.ReleaseSource{
+						Helm: &config.HelmSource{
+							RepoURL: "https://charts.example.com",
+							Chart:   "app1-chart",
+							Version: "1.2.3",
+						},
+					},
+				},
+				{
+					AppName:  "app2",
+					TeamName: "some-team",
+					Source: &config.ReleaseSource{
+						Kustomize: &config.KustomizeSource{
+							NamePrefix: "prefix-",
+							Images:     []string{"app2=app2:1.0"},
+						},
+					},
+				},
+			},
+			want: `apiVersion: argoproj.io/v1alpha1
+kind: AppProject
+metadata:
+  name: test-env
+spec:
+  description: test-env
+  destinations:
+  - {}
+  sourceRepos:
+  - https://git.example.com/
+  - https://charts.example.com
 ---
 apiVersion: argoproj.io/v1alpha1
 kind: Application
@@ -515,6 +770,245 @@ metadata:
 spec:
   destination: {}
   project: test-env
+  sources:
+  - chart: app1-chart
+    helm:
+      releaseName: app1
+      valueFiles:
+      - $values/environments/test-env/applications/app1/manifests/values.yaml
+    repoURL: https://charts.example.com
+    targetRevision: 1.2.3
+  - ref: values
+    repoURL: https://git.example.com/
+    targetRevision: branch-name
+  syncPolicy:
+    automated:
+      allowEmpty: true
+      prune: true
+      selfHeal: true
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  annotations:
+    argocd.argoproj.io/manifest-generate-paths: /environments/test-env/applications/app2/manifests
+    com.freiheit.kuberpult/application: app2
+    com.freiheit.kuberpult/environment: test-env
+    com.freiheit.kuberpult/team: some-team
+  finalizers:
+  - resources-finalizer.argocd.argoproj.io
+  labels:
+    com.freiheit.kuberpult/team: some-team
+  name: test-env-app2
+spec:
+  destination: {}
+  project: test-env
+  source:
+    kustomize:
+      images:
+      - app2=app2:1.0
+      namePrefix: prefix-
+    path: environments/test-env/applications/app2/manifests
+    repoURL: https://git.example.com/
+    targetRevision: branch-name
+  syncPolicy:
+    automated:
+      allowEmpty: true
+      prune: true
+      selfHeal: true
+`,
+		},
+		{
+			name: "invalid source",
+			config: config.EnvironmentConfig{
+				ArgoCd: &config.EnvironmentConfigArgoCd{},
+			},
+			appData: []AppData{
+				{
+					AppName: "app1",
+					Source:  &config.ReleaseSource{Helm: &config.HelmSource{Chart: "app1-chart"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "multiple destinations",
+			config: config.EnvironmentConfig{
+				ArgoCd: &config.EnvironmentConfigArgoCd{
+					Destination: config.ArgoCdDestination{
+						Name: "ignored",
+					},
+					Destinations: []config.ArgoCdDestination{
+						{
+							Id:        "eu",
+							Name:      "cluster-eu",
+							Namespace: ptr.FromString("prod"),
+						},
+						{
+							Id:                   "us",
+							Server:               "https://us.example.com",
+							AppProjectNamespace:  ptr.FromString("prod-project"),
+							ApplicationNamespace: ptr.FromString("prod-app"),
+						},
+					},
+				},
+			},
+			appData: []AppData{
+				{
+					AppName:  "app1",
+					TeamName: "some-team",
+				},
+			},
+			want: `apiVersion: argoproj.io/v1alpha1
+kind: AppProject
+metadata:
+  name: test-env
+spec:
+  description: test-env
+  destinations:
+  - name: cluster-eu
+    namespace: prod
+  - namespace: prod-project
+    server: https://us.example.com
+  sourceRepos:
+  - https://git.example.com/
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  annotations:
+    argocd.argoproj.io/manifest-generate-paths: /environments/test-env/applications/app1/manifests
+    com.freiheit.kuberpult/application: app1
+    com.freiheit.kuberpult/destination: eu
+    com.freiheit.kuberpult/environment: test-env
+    com.freiheit.kuberpult/team: some-team
+  finalizers:
+  - resources-finalizer.argocd.argoproj.io
+  labels:
+    com.freiheit.kuberpult/team: some-team
+  name: test-env-app1-eu
+spec:
+  destination:
+    name: cluster-eu
+    namespace: prod
+  project: test-env
+  source:
+    path: environments/test-env/applications/app1/manifests
+    repoURL: https://git.example.com/
+    targetRevision: branch-name
+  syncPolicy:
+    automated:
+      allowEmpty: true
+      prune: true
+      selfHeal: true
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  annotations:
+    argocd.argoproj.io/manifest-generate-paths: /environments/test-env/applications/app1/manifests
+    com.freiheit.kuberpult/application: app1
+    com.freiheit.kuberpult/destination: us
+    com.freiheit.kuberpult/environment: test-env
+    com.freiheit.kuberpult/team: some-team
+  finalizers:
+  - resources-finalizer.argocd.argoproj.io
+  labels:
+    com.freiheit.kuberpult/team: some-team
+  name: test-env-app1-us
+spec:
+  destination:
+    namespace: prod-app
+    server: https://us.example.com
+  project: test-env
+  source:
+    path: environments/test-env/applications/app1/manifests
+    repoURL: https://git.example.com/
+    targetRevision: branch-name
+  syncPolicy:
+    automated:
+      allowEmpty: true
+      prune: true
+      selfHeal: true
+`,
+		},
+		{
+			name: "application overrides",
+			config: config.EnvironmentConfig{
+				ArgoCd: &config.EnvironmentConfigArgoCd{
+					Destination: config.ArgoCdDestination{
+						Namespace: ptr.FromString("prod"),
+					},
+					ApplicationAnnotations: map[string]string{
+						"notifications.argoproj.io/subscribe": "slack",
+					},
+					SyncOptions: []string{"ApplyOutOfSyncOnly=true", "PruneLast=true"},
+				},
+			},
+			appData: []AppData{
+				{
+					AppName:  "app1",
+					TeamName: "some-team",
+					Overrides: &config.ArgoCdApplicationOverrides{
+						Annotations: map[string]string{
+							"notifications.argoproj.io/subscribe": "teams",
+							"example.com/tier":                    "backend",
+						},
+						Labels: map[string]string{
+							"example.com/tier": "backend",
+						},
+						IgnoreDifferences: []config.ArgoCdIgnoreDifference{
+							{
+								Group:        "apps",
+								Kind:         "Deployment",
+								JSONPointers: []string{"/spec/replicas"},
+							},
+						},
+						SyncOptions:          []string{"PruneLast=false", "ServerSideApply=true"},
+						DestinationNamespace: ptr.FromString("special"),
+					},
+				},
+				{
+					AppName:  "app2",
+					TeamName: "some-team",
+				},
+			},
+			want: `apiVersion: argoproj.io/v1alpha1
+kind: AppProject
+metadata:
+  name: test-env
+spec:
+  description: test-env
+  destinations:
+  - namespace: prod
+  sourceRepos:
+  - https://git.example.com/
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  annotations:
+    argocd.argoproj.io/manifest-generate-paths: /environments/test-env/applications/app1/manifests
+    com.freiheit.kuberpult/application: app1
+    com.freiheit.kuberpult/environment: test-env
+    com.freiheit.kuberpult/team: some-team
+    example.com/tier: backend
+    notifications.argoproj.io/subscribe: teams
+  finalizers:
+  - resources-finalizer.argocd.argoproj.io
+  labels:
+    com.freiheit.kuberpult/team: some-team
+    example.com/tier: backend
+  name: test-env-app1
+spec:
+  destination:
+    namespace: special
+  ignoreDifferences:
+  - group: apps
+    jsonPointers:
+    - /spec/replicas
+    kind: Deployment
+  project: test-env
   source:
     path: environments/test-env/applications/app1/manifests
     repoURL: https://git.example.com/
@@ -524,6 +1018,133 @@ spec:
       allowEmpty: true
       prune: true
       selfHeal: true
+    syncOptions:
+    - ApplyOutOfSyncOnly=true
+    - PruneLast=false
+    - ServerSideApply=true
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  annotations:
+    argocd.argoproj.io/manifest-generate-paths: /environments/test-env/applications/app2/manifests
+    com.freiheit.kuberpult/application: app2
+    com.freiheit.kuberpult/environment: test-env
+    com.freiheit.kuberpult/team: some-team
+    notifications.argoproj.io/subscribe: slack
+  finalizers:
+  - resources-finalizer.argocd.argoproj.io
+  labels:
+    com.freiheit.kuberpult/team: some-team
+  name: test-env-app2
+spec:
+  destination:
+    namespace: prod
+  project: test-env
+  source:
+    path: environments/test-env/applications/app2/manifests
+    repoURL: https://git.example.com/
+    targetRevision: branch-name
+  syncPolicy:
+    automated:
+      allowEmpty: true
+      prune: true
+      selfHeal: true
+    syncOptions:
+    - ApplyOutOfSyncOnly=true
+    - PruneLast=true
+`,
+		},
+		{
+			name: "application set",
+			config: config.EnvironmentConfig{
+				ArgoCd: &config.EnvironmentConfigArgoCd{
+					ApplicationSet: true,
+					ApplicationSyncPolicies: map[string]config.ArgoCdSyncPolicy{
+						"app2": {Automated: ptr.Bool(false)},
+					},
+				},
+			},
+			appData: []AppData{
+				{
+					AppName:  "app1",
+					TeamName: "some-team",
+				},
+				{
+					AppName:  "app2",
+					TeamName: "some-team",
+				},
+			},
+			want: `apiVersion: argoproj.io/v1alpha1
+kind: AppProject
+metadata:
+  name: test-env
+spec:
+  description: test-env
+  destinations:
+  - {}
+  sourceRepos:
+  - https://git.example.com/
+---
+apiVersion: argoproj.io/v1alpha1
+kind: ApplicationSet
+metadata:
+  name: test-env
+spec:
+  generators:
+  - git:
+      files:
+      - path: environments/test-env/applications/*/argocd-application-set.json
+      repoURL: https://git.example.com/
+      revision: branch-name
+  syncPolicy:
+    preserveResourcesOnDeletion: true
+  template:
+    metadata:
+      annotations:
+        argocd.argoproj.io/manifest-generate-paths: /{{path}}/manifests
+        com.freiheit.kuberpult/application: '{{path[3]}}'
+        com.freiheit.kuberpult/environment: test-env
+        com.freiheit.kuberpult/team: '{{team}}'
+      finalizers:
+      - resources-finalizer.argocd.argoproj.io
+      labels:
+        com.freiheit.kuberpult/team: '{{team}}'
+      name: test-env-{{path[3]}}
+    spec:
+      destination: {}
+      project: test-env
+      source:
+        path: '{{path}}/manifests'
+        repoURL: https://git.example.com/
+        targetRevision: branch-name
+      syncPolicy:
+        automated:
+          allowEmpty: true
+          prune: true
+          selfHeal: true
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  annotations:
+    argocd.argoproj.io/manifest-generate-paths: /environments/test-env/applications/app2/manifests
+    com.freiheit.kuberpult/application: app2
+    com.freiheit.kuberpult/environment: test-env
+    com.freiheit.kuberpult/team: some-team
+  finalizers:
+  - resources-finalizer.argocd.argoproj.io
+  labels:
+    com.freiheit.kuberpult/team: some-team
+  name: test-env-app2
+spec:
+  destination: {}
+  project: test-env
+  source:
+    path: environments/test-env/applications/app2/manifests
+    repoURL: https://git.example.com/
+    targetRevision: branch-name
+  syncPolicy: {}
 `,
 		},
 	}
@@ -545,3 +1166,59 @@ spec:
 		})
 	}
 }
+
+func TestRenderApplicationSetParameters(t *testing.T) {
+	tcs := []struct {
+		Name     string
+		Config   *config.EnvironmentConfigArgoCd
+		AppData  AppData
+		Expected string
+	}{
+		{
+			Name:     "without application set",
+			Config:   &config.EnvironmentConfigArgoCd{},
+			AppData:  AppData{AppName: "app1", TeamName: "some-team"},
+			Expected: "",
+		},
+		{
+			Name:     "generated application",
+			Config:   &config.EnvironmentConfigArgoCd{ApplicationSet: true},
+			AppData:  AppData{AppName: "app1", TeamName: "some-team"},
+			Expected: `{"team":"some-team"}`,
+		},
+		{
+			Name: "application with its own sync policy",
+			Config: &config.EnvironmentConfigArgoCd{
+				ApplicationSet: true,
+				ApplicationSyncPolicies: map[string]config.ArgoCdSyncPolicy{
+					"app1": {Automated: ptr.Bool(false)},
+				},
+			},
+			AppData:  AppData{AppName: "app1", TeamName: "some-team"},
+			Expected: "",
+		},
+		{
+			Name:   "application with overrides",
+			Config: &config.EnvironmentConfigArgoCd{ApplicationSet: true},
+			AppData: AppData{
+				AppName:   "app1",
+				TeamName:  "some-team",
+				Overrides: &config.ArgoCdApplicationOverrides{SyncOptions: []string{"ServerSideApply=true"}},
+			},
+			Expected: "",
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			got, err := RenderApplicationSetParameters(tc.Config, tc.AppData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.Expected, string(got)); d != "" {
+				t.Errorf("mismatch:\n%s", d)
+			}
+		})
+	}
+}
@@ -46,7 +46,9 @@ type Application struct {
 
 type ApplicationSpec struct {
 	// Source is a reference to the location ksonnet application definition
-	Source ApplicationSource `json:"source" protobuf:"bytes,1,opt,name=source"`
+	Source *ApplicationSource `json:"source,omitempty" protobuf:"bytes,1,opt,name=source"`
+	// Sources is a reference to the location of the application's manifests or chart. It is used instead of Source.
+	Sources []ApplicationSource `json:"sources,omitempty" protobuf:"bytes,8,opt,name=sources"`
 	// Destination overrides the kubernetes server and namespace defined in the environment ksonnet app.yaml
 	Destination ApplicationDestination `json:"destination" protobuf:"bytes,2,name=destination"`
 	// Project is a application project name. Empty name means that application belongs to 'default' project.
@@ -66,6 +68,34 @@ type ApplicationSource struct {
 	// TargetRevision defines the commit, tag, or branch in which to sync the application to.
 	// If omitted, will sync to HEAD
 	TargetRevision string `json:"targetRevision,omitempty" protobuf:"bytes,4,opt,name=targetRevision"`
+	// Helm holds helm specific options
+	Helm *ApplicationSourceHelm `json:"helm,omitempty" protobuf:"bytes,7,opt,name=helm"`
+	// Kustomize holds kustomize specific options
+	Kustomize *ApplicationSourceKustomize `json:"kustomize,omitempty" protobuf:"bytes,8,opt,name=kustomize"`
+	// Chart is a Helm chart name, and must be specified for applications sourced from a Helm repo.
+	Chart string `json:"chart,omitempty" protobuf:"bytes,12,opt,name=chart"`
+	// Ref is reference to another source within sources field. This field will not be used if used with a `source` tag.
+	Ref string `json:"ref,omitempty" protobuf:"bytes,13,opt,name=ref"`
+}
+
+// ApplicationSourceHelm holds helm specific options
+type ApplicationSourceHelm struct {
+	// ValuesFiles is a list of Helm value files to use when generating a template
+	ValueFiles []string `json:"valueFiles,omitempty" protobuf:"bytes,1,opt,name=valueFiles"`
+	// ReleaseName is the Helm release name to use. If omitted it will use the application name
+	ReleaseName string `json:"releaseName,omitempty" protobuf:"bytes,3,opt,name=releaseName"`
+}
+
+// ApplicationSourceKustomize holds options specific to an Application source specific to Kustomize
+type ApplicationSourceKustomize struct {
+	// NamePrefix is a prefix appended to resources for Kustomize apps
+	NamePrefix string `json:"namePrefix,omitempty" protobuf:"bytes,1,opt,name=namePrefix"`
+	// NameSuffix is a suffix appended to resources for Kustomize apps
+	NameSuffix string `json:"nameSuffix,omitempty" protobuf:"bytes,2,opt,name=nameSuffix"`
+	// Images is a list of Kustomize image override specifications
+	Images []string `json:"images,omitempty" protobuf:"bytes,3,opt,name=images"`
+	// CommonLabels is a list of additional labels to add to rendered manifests
+	CommonLabels map[string]string `json:"commonLabels,omitempty" protobuf:"bytes,4,opt,name=commonLabels"`
 }
 
 type ApplicationDestination struct {
@@ -82,6 +112,25 @@ type SyncPolicy struct {
 	Automated *SyncPolicyAutomated `json:"automated,omitempty" protobuf:"bytes,1,opt,name=automated"`
 	// SyncOptions provide per-sync sync-options, e.g. Validate=false
 	SyncOptions SyncOptions `json:"syncOptions,omitempty" protobuf:"bytes,9,opt,name=syncOptions"`
+	// Retry controls failed sync retry behavior
+	Retry *RetryStrategy `json:"retry,omitempty" protobuf:"bytes,3,opt,name=retry"`
+}
+
+type RetryStrategy struct {
+	// Limit is the maximum number of attempts when retrying a container
+	Limit int64 `json:"limit,omitempty" protobuf:"bytes,1,opt,name=limit"`
+	// Backoff is a backoff strategy
+	Backoff *Backoff `json:"backoff,omitempty" protobuf:"bytes,2,opt,name=backoff,casttype=Backoff"`
+}
+
+// Backoff is a backoff strategy to use within retryStrategy
+type Backoff struct {
+	// Duration is the amount to back off. Default unit is seconds, but could also be a duration (e.g. "2m", "1h")
+	Duration string `json:"duration,omitempty" protobuf:"bytes,1,opt,name=duration"`
+	// Factor is a factor to multiply the base duration after each failed retry
+	Factor *int64 `json:"factor,omitempty" protobuf:"bytes,2,name=factor"`
+	// MaxDuration is the maximum amount of time allowed for the backoff strategy
+	MaxDuration string `json:"maxDuration,omitempty" protobuf:"bytes,3,opt,name=maxDuration"`
 }
 
 type SyncPolicyAutomated struct {
@@ -124,6 +173,41 @@ type AppProjectSpec struct {
 	SyncWindows SyncWindows `json:"syncWindows,omitempty" protobuf:"bytes,8,opt,name=syncWindows"`
 	// By default, cluster wide resources are forbidden in argo. With this whitelist we can allow them
 	ClusterResourceWhitelist []AccessEntry `json:"clusterResourceWhitelist,omitempty" protobuf:"bytes,9,opt,name=clusterResourceWhitelist"`
+	// NamespaceResourceBlacklist contains list of blacklisted namespace level resources
+	NamespaceResourceBlacklist []AccessEntry `json:"namespaceResourceBlacklist,omitempty" protobuf:"bytes,5,opt,name=namespaceResourceBlacklist"`
+	// NamespaceResourceWhitelist contains list of whitelisted namespace level resources
+	NamespaceResourceWhitelist []AccessEntry `json:"namespaceResourceWhitelist,omitempty" protobuf:"bytes,9,opt,name=namespaceResourceWhitelist"`
+	// Roles are user defined RBAC roles associated with this project
+	Roles []ProjectRole `json:"roles,omitempty" protobuf:"bytes,4,rep,name=roles"`
+	// OrphanedResources specifies if controller should monitor orphaned resources of apps in this project
+	OrphanedResources *OrphanedResourcesMonitorSettings `json:"orphanedResources,omitempty" protobuf:"bytes,7,opt,name=orphanedResources"`
+}
+
+// ProjectRole represents a role that has access to a project
+type ProjectRole struct {
+	// Name is a name for this role
+	Name string `json:"name" protobuf:"bytes,1,opt,name=name"`
+	// Description is a description of the role
+	Description string `json:"description,omitempty" protobuf:"bytes,2,opt,name=description"`
+	// Policies Stores a list of casbin formatted strings that define access policies for the role in the project
+	Policies []string `json:"policies,omitempty" protobuf:"bytes,3,rep,name=policies"`
+	// Groups are a list of OIDC group claims bound to this role
+	Groups []string `json:"groups,omitempty" protobuf:"bytes,5,rep,name=groups"`
+}
+
+// OrphanedResourcesMonitorSettings holds settings of orphaned resources monitoring
+type OrphanedResourcesMonitorSettings struct {
+	// Warn indicates if warning condition should be created for apps which have orphaned resources
+	Warn *bool `json:"warn,omitempty" protobuf:"bytes,1,name=warn"`
+	// Ignore contains a list of resources that are to be excluded from orphaned resources monitoring
+	Ignore []OrphanedResourceKey `json:"ignore,omitempty" protobuf:"bytes,2,opt,name=ignore"`
+}
+
+// OrphanedResourceKey is a reference to a resource to be ignored from
+type OrphanedResourceKey struct {
+	Group string `json:"group,omitempty" protobuf:"bytes,1,opt,name=group"`
+	Kind  string `json:"kind,omitempty" protobuf:"bytes,2,opt,name=kind"`
+	Name  string `json:"name,omitempty" protobuf:"bytes,3,opt,name=name"`
 }
 
 // SyncWindows is a collection of sync windows in this project
@@ -164,6 +248,51 @@ type ResourceIgnoreDifferences struct {
 	ManagedFieldsManagers []string `json:"managedFieldsManagers,omitempty" protobuf:"bytes,7,opt,name=managedFieldsManagers"`
 }
 
+var ApplicationSetTypeMeta metav1.TypeMeta = metav1.TypeMeta{
+	APIVersion: "argoproj.io/v1alpha1",
+	Kind:       "ApplicationSet",
+}
+
+// This is a subset of https://github.com/argoproj/argo-cd/blob/v2.6.0/pkg/apis/application/v1alpha1/applicationset_types.go
+type ApplicationSet struct {
+	metav1.TypeMeta `json:",inline"`
+	ObjectMeta      `json:"metadata" protobuf:"bytes,1,opt,name=metadata"`
+	Spec            ApplicationSetSpec `json:"spec" protobuf:"bytes,2,opt,name=spec"`
+}
+
+type ApplicationSetSpec struct {
+	Generators []ApplicationSetGenerator `json:"generators" protobuf:"bytes,2,name=generators"`
+	Template   ApplicationSetTemplate    `json:"template" protobuf:"bytes,3,name=template"`
+	SyncPolicy *ApplicationSetSyncPolicy `json:"syncPolicy,omitempty" protobuf:"bytes,4,name=syncPolicy"`
+}
+
+// ApplicationSetSyncPolicy configures how generated Applications will relate to their ApplicationSet.
+type ApplicationSetSyncPolicy struct {
+	// PreserveResourcesOnDeletion will preserve resources on deletion. If PreserveResourcesOnDeletion is set to true, these Applications will not be deleted.
+	PreserveResourcesOnDeletion bool `json:"preserveResourcesOnDeletion,omitempty" protobuf:"bytes,1,name=syncPolicy"`
+}
+
+// ApplicationSetTemplate represents argocd ApplicationSpec
+type ApplicationSetTemplate struct {
+	ObjectMeta `json:"metadata" protobuf:"bytes,1,name=metadata"`
+	Spec       ApplicationSpec `json:"spec" protobuf:"bytes,2,name=spec"`
+}
+
+// ApplicationSetGenerator represents a generator at the top level of an ApplicationSet.
+type ApplicationSetGenerator struct {
+	Git *GitGenerator `json:"git,omitempty" protobuf:"bytes,3,name=git"`
+}
+
+type GitGenerator struct {
+	RepoURL  string                 `json:"repoURL" protobuf:"bytes,1,name=repoURL"`
+	Files    []GitFileGeneratorItem `json:"files,omitempty" protobuf:"bytes,3,name=files"`
+	Revision string                 `json:"revision" protobuf:"bytes,4,name=revision"`
+}
+
+type GitFileGeneratorItem struct {
+	Path string `json:"path" protobuf:"bytes,1,name=path"`
+}
+
 // Types for Git Webhooks
 
 type Repository struct {
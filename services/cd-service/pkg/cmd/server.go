@@ -18,20 +18,27 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/interceptors"
 
 	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient"
+	argoio "github.com/argoproj/argo-cd/v2/util/io"
 	"github.com/freiheit-com/kuberpult/pkg/api"
 	"github.com/freiheit-com/kuberpult/pkg/auth"
 	"github.com/freiheit-com/kuberpult/pkg/logger"
 	"github.com/freiheit-com/kuberpult/pkg/setup"
 	"github.com/freiheit-com/kuberpult/pkg/tracing"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/repository"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/rollout"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/service"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/syncer"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	"github.com/kelseyhightower/envconfig"
 	"go.uber.org/zap"
@@ -44,27 +51,43 @@ import (
 
 type Config struct {
 	// these will be mapped to "KUBERPULT_GIT_URL", etc.
-	GitUrl            string        `required:"true" split_words:"true"`
-	GitBranch         string        `default:"master" split_words:"true"`
-	BootstrapMode     bool          `default:"false" split_words:"true"`
-	GitCommitterEmail string        `default:"kuberpult@freiheit.com" split_words:"true"`
-	GitCommitterName  string        `default:"kuberpult" split_words:"true"`
-	GitSshKey         string        `default:"/etc/ssh/identity" split_words:"true"`
-	GitSshKnownHosts  string        `default:"/etc/ssh/ssh_known_hosts" split_words:"true"`
-	GitNetworkTimeout time.Duration `default:"1m" split_words:"true"`
-	PgpKeyRing        string        `split_words:"true"`
-	AzureEnableAuth   bool          `default:"false" split_words:"true"`
-	DexEnabled        bool          `default:"false" split_words:"true"`
-	DexRbacPolicy     string        `split_words:"true"`
-	EnableTracing     bool          `default:"false" split_words:"true"`
-	EnableMetrics     bool          `default:"false" split_words:"true"`
-	DogstatsdAddr     string        `default:"127.0.0.1:8125" split_words:"true"`
-	EnableSqlite      bool          `default:"true" split_words:"true"`
-	DexMock           bool          `default:"false" split_words:"true"`
-	DexMockRole       string        `default:"Developer" split_words:"true"`
-	ArgoCdServer      string        `default:"" split_words:"true"`
-	ArgoCdInsecure    bool          `default:"false" split_words:"true"`
-	GitWebUrl         string        `default:"" split_words:"true"`
+	GitUrl                string        `required:"true" split_words:"true"`
+	GitBranch             string        `default:"master" split_words:"true"`
+	BootstrapMode         bool          `default:"false" split_words:"true"`
+	GitCommitterEmail     string        `default:"kuberpult@freiheit.com" split_words:"true"`
+	GitCommitterName      string        `default:"kuberpult" split_words:"true"`
+	GitSshKey             string        `default:"/etc/ssh/identity" split_words:"true"`
+	GitSshKnownHosts      string        `default:"/etc/ssh/ssh_known_hosts" split_words:"true"`
+	GitNetworkTimeout     time.Duration `default:"1m" split_words:"true"`
+	PgpKeyRing            string        `split_words:"true"`
+	AzureEnableAuth       bool          `default:"false" split_words:"true"`
+	DexEnabled            bool          `default:"false" split_words:"true"`
+	DexRbacPolicy         string        `split_words:"true"`
+	EnableTracing         bool          `default:"false" split_words:"true"`
+	EnableMetrics         bool          `default:"false" split_words:"true"`
+	DogstatsdAddr         string        `default:"127.0.0.1:8125" split_words:"true"`
+	EnableSqlite          bool          `default:"true" split_words:"true"`
+	DexMock               bool          `default:"false" split_words:"true"`
+	DexMockRole           string        `default:"Developer" split_words:"true"`
+	ArgoCdServer          string        `default:"" split_words:"true"`
+	ArgoCdInsecure        bool          `default:"false" split_words:"true"`
+	ArgoCdWebhookSecret   string        `default:"" split_words:"true"`
+	ArgoCdWebhookFlavour  string        `default:"github" split_words:"true"`
+	ArgoCdSendWebhooks    bool          `default:"true" split_words:"true"`
+	ArgoCdSyncEnabled     bool          `default:"false" split_words:"true"`
+	ArgoCdSyncConcurrency int           `default:"20" split_words:"true"`
+	ArgoCdToken           string        `default:"" split_words:"true"`
+	RolloutServer         string        `default:"" split_words:"true"`
+	// RolloutStatusInOverview embeds the rollout status of the rollout-service in the overview, it requires RolloutServer
+	RolloutStatusInOverview bool          `default:"false" split_words:"true"`
+	GitWebUrl               string        `default:"" split_words:"true"`
+	Fsck                    string        `default:"off" split_words:"true"`
+	ReadOnly                bool          `default:"false" split_words:"true"`
+	GitFetchInterval        time.Duration `default:"1m" split_words:"true"`
+	// GitFetchDepth requires EnableSqlite=false
+	GitFetchDepth  int           `default:"0" split_words:"true"`
+	GitGcFrequency uint          `default:"20" split_words:"true"`
+	GitGcInterval  time.Duration `default:"0" split_words:"true"`
 }
 
 func (c *Config) storageBackend() repository.StorageBackend {
@@ -75,6 +98,34 @@ func (c *Config) storageBackend() repository.StorageBackend {
 	}
 }
 
+func (c *Config) argoCdClientOptions() (apiclient.ClientOptions, error) {
+	var opts apiclient.ClientOptions
+	opts.ConfigPath = ""
+	u, err := url.ParseRequestURI(c.ArgoCdServer)
+	if err != nil {
+		return opts, fmt.Errorf("invalid argocd server url: %w", err)
+	}
+	opts.ServerAddr = u.Host
+	opts.PlainText = u.Scheme == "http"
+	opts.UserAgent = "kuberpult"
+	opts.Insecure = c.ArgoCdInsecure
+	opts.AuthToken = c.ArgoCdToken
+	return opts, nil
+}
+
+// argoSyncer connects the repository with the argocd syncer
+type argoSyncer struct {
+	syncer *syncer.Syncer
+}
+
+func (a argoSyncer) SyncApps(ctx context.Context, configs map[string]config.EnvironmentConfig, apps []repository.AppEnv) {
+	appEnvs := make([]syncer.AppEnv, 0, len(apps))
+	for _, app := range apps {
+		appEnvs = append(appEnvs, syncer.AppEnv{Environment: app.Env, Application: app.App})
+	}
+	a.syncer.SyncApps(ctx, configs, appEnvs)
+}
+
 func RunServer() {
 	logger.Wrap(context.Background(), func(ctx context.Context) error {
 
@@ -146,6 +197,29 @@ func RunServer() {
 		// If the tracer is not started, calling this function is a no-op.
 		span, ctx := tracer.StartSpanFromContext(ctx, "Start server")
 
+		var appSyncer repository.AppSyncer
+		if c.ArgoCdSyncEnabled {
+			opts, err := c.argoCdClientOptions()
+			if err != nil {
+				logger.FromContext(ctx).Fatal("argocd.config.error", zap.Error(err))
+			}
+			logger.FromContext(ctx).Info("argocd.connecting", zap.String("argocd.addr", opts.ServerAddr))
+			client, err := apiclient.NewClient(&opts)
+			if err != nil {
+				logger.FromContext(ctx).Fatal("argocd.connect.error", zap.Error(err))
+			}
+			closer, appClient, err := client.NewApplicationClient()
+			if err != nil {
+				logger.FromContext(ctx).Fatal("argocd.connect.error", zap.Error(err))
+			}
+			defer argoio.Close(closer)
+			appSyncer = argoSyncer{syncer.New(appClient, c.ArgoCdSyncConcurrency)}
+		}
+		argoWebhookUrl := ""
+		if c.ArgoCdSendWebhooks {
+			argoWebhookUrl = c.ArgoCdServer
+		}
+
 		repo, err := repository.New(ctx, repository.RepositoryConfig{
 			URL:            c.GitUrl,
 			Path:           "./repository",
@@ -158,14 +232,22 @@ func RunServer() {
 				KnownHostsFile: c.GitSshKnownHosts,
 			},
 			Branch:                 c.GitBranch,
-			GcFrequency:            20,
+			GcFrequency:            c.GitGcFrequency,
+			GcInterval:             c.GitGcInterval,
 			BootstrapMode:          c.BootstrapMode,
 			EnvironmentConfigsPath: "./environment_configs.json",
 			StorageBackend:         c.storageBackend(),
 			ArgoInsecure:           c.ArgoCdInsecure,
-			ArgoWebhookUrl:         c.ArgoCdServer,
+			ArgoWebhookUrl:         argoWebhookUrl,
+			ArgoWebhookSecret:      c.ArgoCdWebhookSecret,
+			ArgoWebhookFlavour:     repository.WebhookFlavour(c.ArgoCdWebhookFlavour),
+			AppSyncer:              appSyncer,
 			WebURL:                 c.GitWebUrl,
 			NetworkTimeout:         c.GitNetworkTimeout,
+			Fsck:                   repository.FsckMode(c.Fsck),
+			ReadOnly:               c.ReadOnly,
+			FetchInterval:          c.GitFetchInterval,
+			FetchDepth:             c.GitFetchDepth,
 		})
 		if err != nil {
 			logger.FromContext(ctx).Fatal("repository.new.error", zap.Error(err), zap.String("git.url", c.GitUrl), zap.String("git.branch", c.GitBranch))
@@ -175,6 +257,29 @@ func RunServer() {
 			Repository: repo,
 		}
 
+		var backgroundTasks []setup.BackgroundTaskConfig
+		var upstreamHealth repository.UpstreamHealth
+		var rolloutStatus service.RolloutStatus
+		if c.RolloutServer != "" {
+			con, err := grpc.Dial(c.RolloutServer, grpc.WithInsecure())
+			if err != nil {
+				logger.FromContext(ctx).Fatal("rollout.dial.error", zap.Error(err), zap.String("rollout.server", c.RolloutServer))
+			}
+			health := rollout.New()
+			upstreamHealth = health
+			if c.RolloutStatusInOverview {
+				rolloutStatus = health
+			}
+			backgroundTasks = append(backgroundTasks, setup.BackgroundTaskConfig{
+				Name: "consume rollout status",
+				Run: func(ctx context.Context) error {
+					return health.Subscribe(ctx, api.NewRolloutServiceClient(con))
+				},
+			})
+		} else if c.RolloutStatusInOverview {
+			logger.FromContext(ctx).Warn("rollout.overview.disabled", zap.String("reason", "the rollout status can only be shown in the overview if KUBERPULT_ROLLOUT_SERVER is set"))
+		}
+
 		span.Finish()
 
 		wg.Add(1)
@@ -183,6 +288,7 @@ func RunServer() {
 		// Shutdown channel is used to terminate server side streams.
 		shutdownCh := make(chan struct{})
 		setup.Run(ctx, setup.ServerConfig{
+			Background: backgroundTasks,
 			HTTP: []setup.HTTPConfig{
 				{
 					Port: "8080",
@@ -208,11 +314,21 @@ func RunServer() {
 							DexEnabled: c.DexEnabled,
 							Policy:     dexRbacPolicy,
 						},
+						UpstreamHealth: upstreamHealth,
 					})
 
-					overviewSrv := &service.OverviewServiceServer{
+					api.RegisterSnapshotServiceServer(srv, &service.SnapshotServer{
 						Repository: repo,
-						Shutdown:   shutdownCh,
+						RBACConfig: auth.RBACConfig{
+							DexEnabled: c.DexEnabled,
+							Policy:     dexRbacPolicy,
+						},
+					})
+
+					overviewSrv := &service.OverviewServiceServer{
+						Repository:    repo,
+						Shutdown:      shutdownCh,
+						RolloutStatus: rolloutStatus,
 					}
 					api.RegisterOverviewServiceServer(srv, overviewSrv)
 					reflection.Register(srv)
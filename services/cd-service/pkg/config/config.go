@@ -16,15 +16,77 @@ Copyright 2023 freiheit.com*/
 
 package config
 
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/valid"
+)
+
 type EnvironmentConfig struct {
 	Upstream         *EnvironmentConfigUpstream `json:"upstream,omitempty"`
 	ArgoCd           *EnvironmentConfigArgoCd   `json:"argocd,omitempty"`
 	EnvironmentGroup *string                    `json:"environmentGroup,omitempty"`
+	Flux             *EnvironmentConfigFlux     `json:"flux,omitempty"`
 }
 
 type EnvironmentConfigUpstream struct {
 	Environment string `json:"environment,omitempty"`
 	Latest      bool   `json:"latest,omitempty"`
+	// HealthGate only lets release trains promote versions that are healthy in the upstream environment
+	HealthGate *EnvironmentConfigHealthGate `json:"healthGate,omitempty"`
+}
+
+// EnvironmentConfigHealthGate requires that a version is healthy and synced in the upstream environment before a release train promotes it.
+type EnvironmentConfigHealthGate struct {
+	// SoakTime is how long the version must be healthy and synced in the upstream environment, e.g. "30m". Defaults to 0.
+	SoakTime string `json:"soakTime,omitempty"`
+}
+
+func (u *EnvironmentConfigUpstream) Validate() error {
+	if u.HealthGate == nil {
+		return nil
+	}
+	if u.Environment == "" {
+		return fmt.Errorf("healthGate requires an upstream environment")
+	}
+	if _, err := u.HealthGate.SoakDuration(); err != nil {
+		return fmt.Errorf("healthGate: %w", err)
+	}
+	return nil
+}
+
+func (g *EnvironmentConfigHealthGate) SoakDuration() (time.Duration, error) {
+	if g.SoakTime == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(g.SoakTime)
+	if err != nil {
+		return 0, fmt.Errorf("invalid soakTime %q: %w", g.SoakTime, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid soakTime %q: must not be negative", g.SoakTime)
+	}
+	return d, nil
+}
+
+// EnvironmentConfigFlux configures Flux CD as an alternative to Argo CD.
+// All fields are optional.
+type EnvironmentConfigFlux struct {
+	// Namespace of the GitRepository and the Kustomizations, defaults to "flux-system"
+	Namespace string `json:"namespace,omitempty"`
+	// Interval in which the manifest repo is fetched and the Kustomizations are reconciled, defaults to "1m"
+	Interval string `json:"interval,omitempty"`
+	// TargetNamespace is the default namespace for resources without a namespace
+	TargetNamespace string `json:"targetNamespace,omitempty"`
+	// KubeConfigSecret is the name of a secret with a kubeconfig for deployments to a remote cluster
+	KubeConfigSecret string `json:"kubeConfigSecret,omitempty"`
+	// GitSecret is the name of a secret with the credentials for the manifest repo
+	GitSecret string `json:"gitSecret,omitempty"`
+	// Prune deletes resources that were removed from the manifests, defaults to true
+	Prune *bool `json:"prune,omitempty"`
 }
 
 type AccessEntry struct {
@@ -33,18 +95,72 @@ type AccessEntry struct {
 }
 
 type EnvironmentConfigArgoCd struct {
-	Destination              ArgoCdDestination        `json:"destination"`
+	Destination ArgoCdDestination `json:"destination"`
+	// Destinations deploys the environment to several clusters at once. If it is set, Destination is ignored.
+	Destinations             []ArgoCdDestination      `json:"destinations,omitempty"`
 	SyncWindows              []ArgoCdSyncWindow       `json:"syncWindows,omitempty"`
 	ClusterResourceWhitelist []AccessEntry            `json:"accessList,omitempty"`
 	ApplicationAnnotations   map[string]string        `json:"applicationAnnotations,omitempty"`
 	IgnoreDifferences        []ArgoCdIgnoreDifference `json:"ignoreDifferences,omitempty"`
 	SyncOptions              []string                 `json:"syncOptions,omitempty"`
+	SyncPolicy               *ArgoCdSyncPolicy        `json:"syncPolicy,omitempty"`
+	// ApplicationSyncPolicies overrides the SyncPolicy for single applications. Only the fields that are set are overridden.
+	ApplicationSyncPolicies map[string]ArgoCdSyncPolicy `json:"applicationSyncPolicies,omitempty"`
+	// ApplicationSet=true renders one ApplicationSet for the whole environment instead of one Application per application
+	ApplicationSet bool `json:"applicationSet,omitempty"`
+	// SourceRepos restricts the repositories that applications of the AppProject can use. It defaults to the manifest repo.
+	// Helm releases can only be deployed if their repository is listed here.
+	SourceRepos []string `json:"sourceRepos,omitempty"`
+	// NamespaceResourceBlacklist forbids these namespaced resources in the AppProject
+	NamespaceResourceBlacklist []AccessEntry `json:"namespaceResourceBlacklist,omitempty"`
+	// NamespaceResourceWhitelist only allows these namespaced resources in the AppProject. If it's empty, all are allowed.
+	NamespaceResourceWhitelist []AccessEntry            `json:"namespaceResourceWhitelist,omitempty"`
+	Roles                      []ArgoCdProjectRole      `json:"roles,omitempty"`
+	OrphanedResources          *ArgoCdOrphanedResources `json:"orphanedResources,omitempty"`
+}
+
+// ArgoCdProjectRole is rendered as role of the AppProject of the environment.
+// See https://argo-cd.readthedocs.io/en/stable/user-guide/projects/#project-roles
+type ArgoCdProjectRole struct {
+	Name        string                    `json:"name"`
+	Description string                    `json:"description,omitempty"`
+	Policies    []ArgoCdProjectRolePolicy `json:"policies,omitempty"`
+	// Groups are the OIDC groups that are bound to the role
+	Groups []string `json:"groups,omitempty"`
+}
+
+// ArgoCdProjectRolePolicy is rendered as "p, proj:<environment>:<role>, <resource>, <action>, <object>, <permission>"
+type ArgoCdProjectRolePolicy struct {
+	// e.g. "applications"
+	Resource string `json:"resource"`
+	// e.g. "get" or "sync"
+	Action string `json:"action"`
+	// defaults to all applications of the project: "<environment>/*"
+	Object string `json:"object,omitempty"`
+	// "allow" (default) or "deny"
+	Permission string `json:"permission,omitempty"`
+}
+
+// ArgoCdOrphanedResources enables argocd's monitoring of resources that don't belong to any application.
+// See https://argo-cd.readthedocs.io/en/stable/user-guide/orphaned-resources/
+type ArgoCdOrphanedResources struct {
+	// Warn creates a warning condition for applications with orphaned resources
+	Warn   *bool                       `json:"warn,omitempty"`
+	Ignore []ArgoCdOrphanedResourceKey `json:"ignore,omitempty"`
+}
+
+type ArgoCdOrphanedResourceKey struct {
+	Group string `json:"group,omitempty"`
+	Kind  string `json:"kind,omitempty"`
+	Name  string `json:"name,omitempty"`
 }
 
 // ArgoCdDestination
 // Namespace takes precedence over AppProjectNamespace and ApplicationNamespace. To use the latter attributes, omit the
 // Namespace attribute.
 type ArgoCdDestination struct {
+	// Id distinguishes the entries of Destinations, it's part of the name of the generated applications
+	Id                   string  `json:"id,omitempty"`
 	Name                 string  `json:"name"`
 	Server               string  `json:"server"`
 	Namespace            *string `json:"namespace,omitempty"`
@@ -68,3 +184,311 @@ type ArgoCdIgnoreDifference struct {
 	JqPathExpressions     []string `json:"jqPathExpressions,omitempty"`
 	ManagedFieldsManagers []string `json:"managedFieldsManagers,omitempty"`
 }
+
+// ArgoCdApplicationOverrides are the argocd settings of a single release. They are merged on top of the settings of the environment.
+type ArgoCdApplicationOverrides struct {
+	Annotations       map[string]string        `json:"annotations,omitempty"`
+	Labels            map[string]string        `json:"labels,omitempty"`
+	IgnoreDifferences []ArgoCdIgnoreDifference `json:"ignoreDifferences,omitempty"`
+	// SyncOptions replace the sync options of the environment with the same key, e.g. "ServerSideApply=true"
+	SyncOptions []string `json:"syncOptions,omitempty"`
+	// DestinationNamespace replaces the namespace of the application destination
+	DestinationNamespace *string `json:"destinationNamespace,omitempty"`
+}
+
+func (o *ArgoCdApplicationOverrides) IsEmpty() bool {
+	return o == nil || (len(o.Annotations) == 0 && len(o.Labels) == 0 && len(o.IgnoreDifferences) == 0 && len(o.SyncOptions) == 0 && o.DestinationNamespace == nil)
+}
+
+func (o *ArgoCdApplicationOverrides) Validate() error {
+	for k := range o.Annotations {
+		if strings.HasPrefix(k, "com.freiheit.kuberpult/") {
+			return fmt.Errorf("annotation %q is reserved for kuberpult", k)
+		}
+	}
+	for k := range o.Labels {
+		if strings.HasPrefix(k, "com.freiheit.kuberpult/") {
+			return fmt.Errorf("label %q is reserved for kuberpult", k)
+		}
+	}
+	for _, opt := range o.SyncOptions {
+		if !strings.Contains(opt, "=") {
+			return fmt.Errorf("invalid sync option %q, expected <key>=<value>", opt)
+		}
+	}
+	for i, d := range o.IgnoreDifferences {
+		if d.Kind == "" {
+			return fmt.Errorf("ignoreDifferences[%d]: kind must not be empty", i)
+		}
+	}
+	if o.DestinationNamespace != nil && *o.DestinationNamespace == "" {
+		return fmt.Errorf("destinationNamespace must not be empty")
+	}
+	return nil
+}
+
+// ReleaseSource describes how the manifests of a release are rendered. Without a source, the manifests of a release are plain yaml.
+// Exactly one of Helm and Kustomize must be set.
+type ReleaseSource struct {
+	Helm      *HelmSource      `json:"helm,omitempty"`
+	Kustomize *KustomizeSource `json:"kustomize,omitempty"`
+}
+
+// HelmSource references a helm chart. The manifests of the release are the values for the chart in each environment.
+type HelmSource struct {
+	// RepoURL of the helm repository, e.g. "https://charts.example.com"
+	RepoURL string `json:"repoURL"`
+	Chart   string `json:"chart"`
+	Version string `json:"version"`
+	// ReleaseName defaults to the name of the application
+	ReleaseName string `json:"releaseName,omitempty"`
+}
+
+// KustomizeSource means that the manifests of the release are a kustomization.yaml in each environment, e.g. an overlay of a remote base.
+type KustomizeSource struct {
+	NamePrefix   string            `json:"namePrefix,omitempty"`
+	NameSuffix   string            `json:"nameSuffix,omitempty"`
+	CommonLabels map[string]string `json:"commonLabels,omitempty"`
+	// Images overrides images in the format of "kustomize edit set image", e.g. "nginx=nginx:1.25"
+	Images []string `json:"images,omitempty"`
+}
+
+const (
+	PlainManifestsFileName = "manifests.yaml"
+	HelmValuesFileName     = "values.yaml"
+	KustomizationFileName  = "kustomization.yaml"
+)
+
+// ManifestsFileName is the name of the file of a deployed release in the manifests directory of the application. The source may be nil.
+func (s *ReleaseSource) ManifestsFileName() string {
+	switch {
+	case s == nil:
+		return PlainManifestsFileName
+	case s.Helm != nil:
+		return HelmValuesFileName
+	case s.Kustomize != nil:
+		return KustomizationFileName
+	}
+	return PlainManifestsFileName
+}
+
+func (s *ReleaseSource) Validate() error {
+	if (s.Helm == nil) == (s.Kustomize == nil) {
+		return fmt.Errorf("exactly one of helm and kustomize must be set")
+	}
+	if h := s.Helm; h != nil {
+		if h.RepoURL == "" || h.Chart == "" || h.Version == "" {
+			return fmt.Errorf("helm: repoURL, chart and version must not be empty")
+		}
+	}
+	if s.Kustomize != nil {
+		for k := range s.Kustomize.CommonLabels {
+			if strings.HasPrefix(k, "com.freiheit.kuberpult/") {
+				return fmt.Errorf("kustomize: label %q is reserved for kuberpult", k)
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	ArgoCdFinalizerForeground = "foreground"
+	ArgoCdFinalizerBackground = "background"
+	ArgoCdFinalizerNone       = "none"
+)
+
+// ArgoCdSyncPolicy
+// All fields are optional. The defaults are an automated sync with prune and self-heal, no retries and the foreground finalizer.
+type ArgoCdSyncPolicy struct {
+	// Automated=false means that applications are only synced manually
+	Automated *bool        `json:"automated,omitempty"`
+	Prune     *bool        `json:"prune,omitempty"`
+	SelfHeal  *bool        `json:"selfHeal,omitempty"`
+	Retry     *ArgoCdRetry `json:"retry,omitempty"`
+	// Finalizer is one of "foreground", "background" or "none"
+	Finalizer *string `json:"finalizer,omitempty"`
+}
+
+type ArgoCdRetry struct {
+	Limit   int64          `json:"limit,omitempty"`
+	Backoff *ArgoCdBackoff `json:"backoff,omitempty"`
+}
+
+type ArgoCdBackoff struct {
+	Duration    string `json:"duration,omitempty"`
+	Factor      *int64 `json:"factor,omitempty"`
+	MaxDuration string `json:"maxDuration,omitempty"`
+}
+
+// IsAutomated returns true unless the policy disables the automated sync.
+func (p ArgoCdSyncPolicy) IsAutomated() bool {
+	return p.Automated == nil || *p.Automated
+}
+
+// Merge returns a copy of the policy where all fields that are set in the override are replaced.
+func (p ArgoCdSyncPolicy) Merge(override ArgoCdSyncPolicy) ArgoCdSyncPolicy {
+	if override.Automated != nil {
+		p.Automated = override.Automated
+	}
+	if override.Prune != nil {
+		p.Prune = override.Prune
+	}
+	if override.SelfHeal != nil {
+		p.SelfHeal = override.SelfHeal
+	}
+	if override.Retry != nil {
+		p.Retry = override.Retry
+	}
+	if override.Finalizer != nil {
+		p.Finalizer = override.Finalizer
+	}
+	return p
+}
+
+func (p ArgoCdSyncPolicy) Validate() error {
+	if p.Finalizer != nil {
+		switch *p.Finalizer {
+		case ArgoCdFinalizerForeground, ArgoCdFinalizerBackground, ArgoCdFinalizerNone:
+		default:
+			return fmt.Errorf("invalid finalizer %q, must be one of %q, %q or %q", *p.Finalizer, ArgoCdFinalizerForeground, ArgoCdFinalizerBackground, ArgoCdFinalizerNone)
+		}
+	}
+	if p.Retry == nil {
+		return nil
+	}
+	if p.Retry.Limit < -1 {
+		return fmt.Errorf("invalid retry limit %d, must be -1 (unlimited) or greater", p.Retry.Limit)
+	}
+	if b := p.Retry.Backoff; b != nil {
+		for _, d := range []string{b.Duration, b.MaxDuration} {
+			if d == "" {
+				continue
+			}
+			if _, err := time.ParseDuration(d); err != nil {
+				return fmt.Errorf("invalid backoff duration %q: %w", d, err)
+			}
+		}
+		if b.Factor != nil && *b.Factor < 1 {
+			return fmt.Errorf("invalid backoff factor %d, must be at least 1", *b.Factor)
+		}
+	}
+	return nil
+}
+
+// AllowsSourceRepo returns true if one of the SourceRepos matches the repo. A trailing "*" matches any suffix.
+func (c *EnvironmentConfigArgoCd) AllowsSourceRepo(repo string) bool {
+	for _, pattern := range c.SourceRepos {
+		if pattern == repo || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(repo, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncPolicyForApp returns the SyncPolicy of the environment merged with the override of the application.
+func (c *EnvironmentConfigArgoCd) SyncPolicyForApp(app string) ArgoCdSyncPolicy {
+	policy := ArgoCdSyncPolicy{}
+	if c.SyncPolicy != nil {
+		policy = *c.SyncPolicy
+	}
+	if override, ok := c.ApplicationSyncPolicies[app]; ok {
+		policy = policy.Merge(override)
+	}
+	return policy
+}
+
+// AllDestinations returns the Destinations, or the single Destination if there is no list
+func (c *EnvironmentConfigArgoCd) AllDestinations() []ArgoCdDestination {
+	if len(c.Destinations) > 0 {
+		return c.Destinations
+	}
+	return []ArgoCdDestination{c.Destination}
+}
+
+func (c *EnvironmentConfigArgoCd) Validate() error {
+	if err := c.ValidateSyncPolicies(); err != nil {
+		return err
+	}
+	if err := c.ValidateRoles(); err != nil {
+		return err
+	}
+	return c.ValidateDestinations()
+}
+
+// same as in argocd
+var projectRoleNameRx = regexp.MustCompile(`^[a-zA-Z0-9]([-_a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+
+func (c *EnvironmentConfigArgoCd) ValidateRoles() error {
+	seen := map[string]bool{}
+	for i, r := range c.Roles {
+		if !projectRoleNameRx.MatchString(r.Name) {
+			return fmt.Errorf("roles[%d]: invalid name %q", i, r.Name)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("roles[%d]: duplicate name %q", i, r.Name)
+		}
+		seen[r.Name] = true
+		for j, p := range r.Policies {
+			if p.Resource == "" || p.Action == "" {
+				return fmt.Errorf("roles[%d].policies[%d]: resource and action must not be empty", i, j)
+			}
+			for _, field := range []string{p.Resource, p.Action, p.Object, p.Permission} {
+				if strings.Contains(field, ",") {
+					return fmt.Errorf("roles[%d].policies[%d]: %q must not contain a comma", i, j, field)
+				}
+			}
+			switch p.Permission {
+			case "", "allow", "deny":
+			default:
+				return fmt.Errorf("roles[%d].policies[%d]: invalid permission %q, must be \"allow\" or \"deny\"", i, j, p.Permission)
+			}
+		}
+		for j, g := range r.Groups {
+			if g == "" {
+				return fmt.Errorf("roles[%d].groups[%d]: group must not be empty", i, j)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *EnvironmentConfigArgoCd) ValidateDestinations() error {
+	seen := map[string]bool{}
+	for i, d := range c.Destinations {
+		if d.Id == "" {
+			return fmt.Errorf("destinations[%d]: id must not be empty", i)
+		}
+		if !valid.EnvironmentName(d.Id) {
+			return fmt.Errorf("destinations[%d]: invalid id %q", i, d.Id)
+		}
+		if seen[d.Id] {
+			return fmt.Errorf("destinations[%d]: duplicate id %q", i, d.Id)
+		}
+		seen[d.Id] = true
+	}
+	return nil
+}
+
+func (c *EnvironmentConfigArgoCd) ValidateSyncPolicies() error {
+	if c.SyncPolicy != nil {
+		if err := c.SyncPolicy.Validate(); err != nil {
+			return fmt.Errorf("syncPolicy: %w", err)
+		}
+	}
+	for app, p := range c.ApplicationSyncPolicies {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("applicationSyncPolicies[%q]: %w", app, err)
+		}
+	}
+	return nil
+}
+
+func (c *EnvironmentConfigFlux) Validate() error {
+	if c.Interval == "" {
+		return nil
+	}
+	if _, err := time.ParseDuration(c.Interval); err != nil {
+		return fmt.Errorf("invalid interval %q: %w", c.Interval, err)
+	}
+	return nil
+}
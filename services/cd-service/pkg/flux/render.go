@@ -0,0 +1,166 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package flux
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
+)
+
+type ApiVersion string
+
+const V1 ApiVersion = "v1"
+
+const (
+	defaultNamespace = "flux-system"
+	defaultInterval  = "1m"
+)
+
+type AppData struct {
+	AppName  string
+	TeamName string
+	// Source is the helm or kustomize source of the deployed release, nil for plain manifests
+	Source *config.ReleaseSource
+}
+
+func Render(gitUrl string, gitBranch string, config config.EnvironmentConfig, env string, appsData []AppData) (map[ApiVersion][]byte, error) {
+	if config.Flux == nil {
+		return nil, fmt.Errorf("no Flux configured for environment %s", env)
+	}
+	result := map[ApiVersion][]byte{}
+	if content, err := RenderV1(gitUrl, gitBranch, config, env, appsData); err != nil {
+		return nil, err
+	} else {
+		result[V1] = content
+	}
+	return result, nil
+}
+
+// RenderV1 renders one GitRepository for the environment and one Kustomization per application.
+func RenderV1(gitUrl string, gitBranch string, config config.EnvironmentConfig, env string, appsData []AppData) ([]byte, error) {
+	if err := config.Flux.Validate(); err != nil {
+		return nil, fmt.Errorf("flux config of %q: %w", env, err)
+	}
+	namespace := config.Flux.Namespace
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	interval := config.Flux.Interval
+	if interval == "" {
+		interval = defaultInterval
+	}
+	// The source controller only needs the manifests of this environment:
+	ignore := strings.Join([]string{
+		"/*",
+		"!/environments",
+		"/environments/*",
+		fmt.Sprintf("!/environments/%s", env),
+	}, "\n")
+	repo := GitRepository{
+		TypeMeta: GitRepositoryTypeMeta,
+		ObjectMeta: ObjectMeta{
+			Name:      env,
+			Namespace: namespace,
+			Annotations: map[string]string{
+				"com.freiheit.kuberpult/environment": env,
+			},
+		},
+		Spec: GitRepositorySpec{
+			URL:      gitUrl,
+			Interval: interval,
+			Reference: &GitRepositoryRef{
+				Branch: gitBranch,
+			},
+			Ignore: &ignore,
+		},
+	}
+	if config.Flux.GitSecret != "" {
+		repo.Spec.SecretRef = &LocalObjectReference{Name: config.Flux.GitSecret}
+	}
+	buf := []string{}
+	if content, err := yaml.Marshal(&repo); err != nil {
+		return nil, err
+	} else {
+		buf = append(buf, string(content))
+	}
+	prune := true
+	if config.Flux.Prune != nil {
+		prune = *config.Flux.Prune
+	}
+	for _, appData := range appsData {
+		if err := checkSource(appData.Source); err != nil {
+			return nil, fmt.Errorf("application %q in %q: %w", appData.AppName, env, err)
+		}
+		manifestPath := filepath.Join("environments", env, "applications", appData.AppName, "manifests")
+		kustomization := Kustomization{
+			TypeMeta: KustomizationTypeMeta,
+			ObjectMeta: ObjectMeta{
+				Name:      fmt.Sprintf("%s-%s", env, appData.AppName),
+				Namespace: namespace,
+				Annotations: map[string]string{
+					"com.freiheit.kuberpult/team":        appData.TeamName,
+					"com.freiheit.kuberpult/application": appData.AppName,
+					"com.freiheit.kuberpult/environment": env,
+				},
+				Labels: map[string]string{
+					"com.freiheit.kuberpult/team": appData.TeamName,
+				},
+			},
+			Spec: KustomizationSpec{
+				Interval: interval,
+				// flux generates a kustomization.yaml, unless the release has a kustomize source that brings its own
+				Path:  "./" + manifestPath,
+				Prune: prune,
+				SourceRef: CrossNamespaceSourceReference{
+					Kind: GitRepositoryTypeMeta.Kind,
+					Name: env,
+				},
+				TargetNamespace: config.Flux.TargetNamespace,
+			},
+		}
+		if config.Flux.KubeConfigSecret != "" {
+			kustomization.Spec.KubeConfig = &KubeConfigReference{
+				SecretRef: LocalObjectReference{Name: config.Flux.KubeConfigSecret},
+			}
+		}
+		if content, err := yaml.Marshal(&kustomization); err != nil {
+			return nil, err
+		} else {
+			buf = append(buf, string(content))
+		}
+	}
+	return ([]byte)(strings.Join(buf, "---\n")), nil
+}
+
+// checkSource returns an error for sources that flux can't render from the manifests directory
+func checkSource(source *config.ReleaseSource) error {
+	if source == nil {
+		return nil
+	}
+	if source.Helm != nil {
+		return fmt.Errorf("helm releases are not supported with flux")
+	}
+	if k := source.Kustomize; k != nil && (k.NamePrefix != "" || k.NameSuffix != "" || len(k.CommonLabels) > 0 || len(k.Images) > 0) {
+		return fmt.Errorf("kustomize options are not supported with flux, they must be part of the kustomization.yaml")
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package flux
+
+import (
+	"testing"
+
+	"github.com/freiheit-com/kuberpult/pkg/ptr"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRenderV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  config.EnvironmentConfig
+		appData []AppData
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "defaults without apps",
+			config: config.EnvironmentConfig{
+				Flux: &config.EnvironmentConfigFlux{},
+			},
+			want: `apiVersion: source.toolkit.fluxcd.io/v1
+kind: GitRepository
+metadata:
+  annotations:
+    com.freiheit.kuberpult/environment: test-env
+  name: test-env
+  namespace: flux-system
+spec:
+  ignore: |-
+    /*
+    !/environments
+    /environments/*
+    !/environments/test-env
+  interval: 1m
+  ref:
+    branch: branch-name
+  url: https://git.example.com/
+`,
+		},
+		{
+			name: "all settings with one app",
+			config: config.EnvironmentConfig{
+				Flux: &config.EnvironmentConfigFlux{
+					Namespace:        "flux",
+					Interval:         "5m",
+					TargetNamespace:  "apps",
+					KubeConfigSecret: "remote",
+					GitSecret:        "git-creds",
+					Prune:            ptr.Bool(false),
+				},
+			},
+			appData: []AppData{
+				{
+					AppName:  "app1",
+					TeamName: "some-team",
+				},
+			},
+			want: `apiVersion: source.toolkit.fluxcd.io/v1
+kind: GitRepository
+metadata:
+  annotations:
+    com.freiheit.kuberpult/environment: test-env
+  name: test-env
+  namespace: flux
+spec:
+  ignore: |-
+    /*
+    !/environments
+    /environments/*
+    !/environments/test-env
+  interval: 5m
+  ref:
+    branch: branch-name
+  secretRef:
+    name: git-creds
+  url: https://git.example.com/
+---
+apiVersion: kustomize.toolkit.fluxcd.io/v1
+kind: Kustomization
+metadata:
+  annotations:
+    com.freiheit.kuberpult/application: app1
+    com.freiheit.kuberpult/environment: test-env
+    com.freiheit.kuberpult/team: some-team
+  labels:
+    com.freiheit.kuberpult/team: some-team
+  name: test-env-app1
+  namespace: flux
+spec:
+  interval: 5m
+  kubeConfig:
+    secretRef:
+      name: remote
+  path: ./environments/test-env/applications/app1/manifests
+  prune: false
+  sourceRef:
+    kind: GitRepository
+    name: test-env
+  targetNamespace: apps
+`,
+		},
+		{
+			name: "helm release",
+			config: config.EnvironmentConfig{
+				Flux: &config.EnvironmentConfigFlux{},
+			},
+			appData: []AppData{
+				{
+					AppName: "app1",
+					Source: &config.ReleaseSource{
+						Helm: &config.HelmSource{RepoURL: "https://charts.example.com", Chart: "app1", Version: "1.0.0"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid interval",
+			config: config.EnvironmentConfig{
+				Flux: &config.EnvironmentConfigFlux{
+					Interval: "often",
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const (
+				gitUrl    = "https://git.example.com/"
+				gitBranch = "branch-name"
+				env       = "test-env"
+			)
+			got, err := RenderV1(gitUrl, gitBranch, tt.config, env, tt.appData)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if d := cmp.Diff(tt.want, string(got)); d != "" {
+				t.Errorf("mismatch: %s", d)
+			}
+		})
+	}
+}
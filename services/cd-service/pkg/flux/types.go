@@ -0,0 +1,100 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package flux
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// This file is a subset of https://github.com/fluxcd/source-controller/blob/v1.0.0/api/v1/gitrepository_types.go
+// and https://github.com/fluxcd/kustomize-controller/blob/v1.0.0/api/v1/kustomization_types.go
+// Importing the flux projects directly would drag in a huge number of dependencies.
+
+// See https://pkg.go.dev/k8s.io/apimachinery/pkg/apis/meta/v1#ObjectMeta for more fields, if necessary
+type ObjectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+var GitRepositoryTypeMeta metav1.TypeMeta = metav1.TypeMeta{
+	APIVersion: "source.toolkit.fluxcd.io/v1",
+	Kind:       "GitRepository",
+}
+
+type GitRepository struct {
+	metav1.TypeMeta `json:",inline"`
+	ObjectMeta      `json:"metadata"`
+	Spec            GitRepositorySpec `json:"spec"`
+}
+
+type GitRepositorySpec struct {
+	// URL specifies the Git repository URL, it can be an HTTP/S or SSH address.
+	URL string `json:"url"`
+	// SecretRef specifies the Secret containing authentication credentials for the GitRepository.
+	SecretRef *LocalObjectReference `json:"secretRef,omitempty"`
+	// Interval at which to check the GitRepository for updates.
+	Interval string `json:"interval"`
+	// Reference specifies the Git reference to resolve and monitor for changes.
+	Reference *GitRepositoryRef `json:"ref,omitempty"`
+	// Ignore overrides the set of excluded patterns in the .sourceignore format (which is the same as .gitignore).
+	Ignore *string `json:"ignore,omitempty"`
+}
+
+type GitRepositoryRef struct {
+	Branch string `json:"branch,omitempty"`
+}
+
+type LocalObjectReference struct {
+	Name string `json:"name"`
+}
+
+var KustomizationTypeMeta metav1.TypeMeta = metav1.TypeMeta{
+	APIVersion: "kustomize.toolkit.fluxcd.io/v1",
+	Kind:       "Kustomization",
+}
+
+type Kustomization struct {
+	metav1.TypeMeta `json:",inline"`
+	ObjectMeta      `json:"metadata"`
+	Spec            KustomizationSpec `json:"spec"`
+}
+
+type KustomizationSpec struct {
+	// The interval at which to reconcile the Kustomization.
+	Interval string `json:"interval"`
+	// Path to the directory containing the kustomization.yaml file, or the set of plain YAMLs.
+	Path string `json:"path,omitempty"`
+	// Prune enables garbage collection.
+	Prune bool `json:"prune"`
+	// Reference of the source where the kustomization file is.
+	SourceRef CrossNamespaceSourceReference `json:"sourceRef"`
+	// TargetNamespace sets or overrides the namespace in the kustomization.yaml file.
+	TargetNamespace string `json:"targetNamespace,omitempty"`
+	// The KubeConfig for reconciling the Kustomization on a remote cluster.
+	KubeConfig *KubeConfigReference `json:"kubeConfig,omitempty"`
+}
+
+type CrossNamespaceSourceReference struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type KubeConfigReference struct {
+	SecretRef LocalObjectReference `json:"secretRef"`
+}
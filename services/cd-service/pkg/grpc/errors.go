@@ -48,3 +48,8 @@ func AuthError(ctx context.Context, err error) error {
 func AlreadyExistsError(err error) error {
 	return status.Error(codes.AlreadyExists, "error: "+err.Error())
 }
+
+// ReadOnlyError is returned for writes to a cd-service that runs in read-only mode
+func ReadOnlyError(err error) error {
+	return status.Error(codes.FailedPrecondition, "error: "+err.Error())
+}
@@ -45,6 +45,7 @@ func MapEnvironmentsToGroups(envs map[string]config.EnvironmentConfig) []*api.En
 			Name: envName,
 			Config: &api.EnvironmentConfig{
 				Upstream:         TransformUpstream(env.Upstream),
+				Argocd:           TransformArgoCdDestinations(env.ArgoCd),
 				EnvironmentGroup: &groupNameCopy,
 			},
 			Locks:        map[string]*api.Lock{},
@@ -225,13 +226,39 @@ func TransformUpstream(upstream *config.EnvironmentConfigUpstream) *api.Environm
 		}
 	}
 	if upstream.Environment != "" {
-		return &api.EnvironmentConfig_Upstream{
+		result := &api.EnvironmentConfig_Upstream{
 			Environment: &upstream.Environment,
 		}
+		if upstream.HealthGate != nil {
+			result.HealthGate = &api.EnvironmentConfig_Upstream_HealthGate{
+				SoakTime: upstream.HealthGate.SoakTime,
+			}
+		}
+		return result
 	}
 	return nil
 }
 
+// TransformArgoCdDestinations only returns the list of destinations, so that the rollout-service knows which destinations will report a status.
+// It returns nil for environments with a single destination.
+func TransformArgoCdDestinations(argocd *config.EnvironmentConfigArgoCd) *api.EnvironmentConfig_ArgoCD {
+	if argocd == nil || len(argocd.Destinations) == 0 {
+		return nil
+	}
+	result := &api.EnvironmentConfig_ArgoCD{}
+	for _, d := range argocd.Destinations {
+		result.Destinations = append(result.Destinations, &api.EnvironmentConfig_ArgoCD_Destination{
+			Id:                   d.Id,
+			Name:                 d.Name,
+			Server:               d.Server,
+			Namespace:            d.Namespace,
+			AppProjectNamespace:  d.AppProjectNamespace,
+			ApplicationNamespace: d.ApplicationNamespace,
+		})
+	}
+	return result
+}
+
 func TransformSyncWindows(syncWindows []config.ArgoCdSyncWindow, appName string) ([]*api.Environment_Application_ArgoCD_SyncWindow, error) {
 	var envAppSyncWindows []*api.Environment_Application_ArgoCD_SyncWindow
 	for _, syncWindow := range syncWindows {
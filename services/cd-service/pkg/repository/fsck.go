@@ -0,0 +1,309 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package repository
+
+/**
+Fsck walks the manifest repository and reports everything that would make the State accessors (and therefore GetOverview) fail.
+This mostly happens when the manifest repository was edited by hand.
+Some of the problems can be repaired automatically with the RepairRepository transformer, the others have to be fixed by hand.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/auth"
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"go.uber.org/zap"
+)
+
+type FsckMode string
+
+const (
+	FsckOff    FsckMode = "off"
+	FsckCheck  FsckMode = "check"
+	FsckRepair FsckMode = "repair"
+)
+
+type FsckProblemKind string
+
+const (
+	FsckDanglingVersion       FsckProblemKind = "dangling_version"
+	FsckDanglingQueuedVersion FsckProblemKind = "dangling_queued_version"
+	FsckMissingManifest       FsckProblemKind = "missing_manifest"
+	FsckLockWithoutCreatedAt  FsckProblemKind = "lock_without_created_at"
+	FsckInvalidConfig         FsckProblemKind = "invalid_config"
+)
+
+type FsckProblem struct {
+	Kind    FsckProblemKind
+	Path    string
+	Message string
+	// repair is nil if the problem cannot be repaired automatically
+	repair func(ctx context.Context, fs billy.Filesystem) error
+	// changes is set if the repair touches files that argocd reads
+	changes *AppEnv
+}
+
+func (p *FsckProblem) Repairable() bool {
+	return p.repair != nil
+}
+
+func (p *FsckProblem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.Kind, p.Path, p.Message)
+}
+
+// Fsck checks the consistency of the manifest repository. It returns an error only if the repository can't be read at all.
+func (s *State) Fsck(ctx context.Context) ([]FsckProblem, error) {
+	problems := []FsckProblem{}
+	envs, err := names(s.Filesystem, "environments")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return problems, nil
+		}
+		return nil, err
+	}
+	sort.Strings(envs)
+	if !s.BootstrapMode {
+		problems = append(problems, s.fsckEnvironmentConfigs(ctx, envs)...)
+	}
+	for _, env := range envs {
+		problems = append(problems, s.fsckLocks(environmentDirectory(s.Filesystem, env))...)
+		apps, err := s.GetEnvironmentApplications(env)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		sort.Strings(apps)
+		for _, app := range apps {
+			problems = append(problems, s.fsckLocks(environmentApplicationDirectory(s.Filesystem, env, app))...)
+			problems = append(problems, s.fsckSymlink(env, app, queueFileName, FsckDanglingQueuedVersion)...)
+			versionProblems := s.fsckDanglingVersion(env, app)
+			problems = append(problems, versionProblems...)
+			if len(versionProblems) == 0 {
+				problems = append(problems, s.fsckManifest(env, app)...)
+			}
+		}
+	}
+	return problems, nil
+}
+
+func (s *State) fsckEnvironmentConfigs(ctx context.Context, envs []string) []FsckProblem {
+	problems := []FsckProblem{}
+	for _, env := range envs {
+		fileName := s.Filesystem.Join(environmentDirectory(s.Filesystem, env), "config.json")
+		var cfg config.EnvironmentConfig
+		if err := decodeJsonFile(s.Filesystem, fileName, &cfg); err != nil && !errors.Is(err, os.ErrNotExist) {
+			problems = append(problems, FsckProblem{
+				Kind:    FsckInvalidConfig,
+				Path:    fileName,
+				Message: err.Error(),
+			})
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	// all files are readable, but the combination of them can still be invalid:
+	if _, err := s.GetEnvironmentConfigsAndValidate(ctx); err != nil {
+		problems = append(problems, FsckProblem{
+			Kind:    FsckInvalidConfig,
+			Path:    "environments",
+			Message: err.Error(),
+		})
+	}
+	return problems
+}
+
+func (s *State) fsckLocks(dir string) []FsckProblem {
+	problems := []FsckProblem{}
+	locksDir := s.Filesystem.Join(dir, "locks")
+	locks, err := s.Filesystem.ReadDir(locksDir)
+	if err != nil {
+		// no locks directory means no locks
+		return problems
+	}
+	for _, lock := range locks {
+		if !lock.IsDir() {
+			continue
+		}
+		createdAt := s.Filesystem.Join(locksDir, lock.Name(), "created_at")
+		if _, err := s.Filesystem.Stat(createdAt); err != nil {
+			problems = append(problems, FsckProblem{
+				Kind:    FsckLockWithoutCreatedAt,
+				Path:    s.Filesystem.Join(locksDir, lock.Name()),
+				Message: "lock has no created_at file",
+				repair: func(ctx context.Context, fs billy.Filesystem) error {
+					// the real creation date is lost, the best we can do is to use the time of the repair:
+					return util.WriteFile(fs, createdAt, []byte(getTimeNow(ctx).Format(time.RFC3339)), 0666)
+				},
+			})
+		}
+	}
+	return problems
+}
+
+func (s *State) fsckSymlink(env, app, symlinkName string, kind FsckProblemKind) []FsckProblem {
+	if _, err := s.readSymlink(env, app, symlinkName); err != nil {
+		link := s.Filesystem.Join(environmentApplicationDirectory(s.Filesystem, env, app), symlinkName)
+		return []FsckProblem{
+			{
+				Kind:    kind,
+				Path:    link,
+				Message: err.Error(),
+				repair: func(_ context.Context, fs billy.Filesystem) error {
+					return fs.Remove(link)
+				},
+			},
+		}
+	}
+	return nil
+}
+
+func (s *State) fsckDanglingVersion(env, app string) []FsckProblem {
+	problems := s.fsckSymlink(env, app, "version", FsckDanglingVersion)
+	for i := range problems {
+		removeLink := problems[i].repair
+		manifestsDir := s.Filesystem.Join(environmentApplicationDirectory(s.Filesystem, env, app), "manifests")
+		// the manifests belong to the version that no longer exists, so argocd must stop syncing them as well:
+		problems[i].repair = func(ctx context.Context, fs billy.Filesystem) error {
+			if err := removeLink(ctx, fs); err != nil {
+				return err
+			}
+			if err := fs.Remove(manifestsDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+		problems[i].changes = &AppEnv{App: app, Env: env}
+	}
+	return problems
+}
+
+func (s *State) fsckManifest(env, app string) []FsckProblem {
+	version, _ := s.readSymlink(env, app, "version")
+	if version == nil {
+		return nil
+	}
+	manifest := s.Filesystem.Join(releasesDirectoryWithVersion(s.Filesystem, app, *version), "environments", env, "manifests.yaml")
+	if _, err := s.Filesystem.Stat(manifest); err == nil {
+		return nil
+	}
+	problem := FsckProblem{
+		Kind:    FsckMissingManifest,
+		Path:    manifest,
+		Message: fmt.Sprintf("version %d of %q is deployed to %q, but the release has no manifest for it", *version, app, env),
+	}
+	// the manifest that argocd uses is a copy of the release manifest, so we can restore the release from there:
+	source, _ := s.GetApplicationReleaseSource(app, *version)
+	deployed := s.Filesystem.Join(environmentApplicationDirectory(s.Filesystem, env, app), "manifests", source.ManifestsFileName())
+	if content, err := readFile(s.Filesystem, deployed); err == nil {
+		problem.repair = func(_ context.Context, fs billy.Filesystem) error {
+			if err := fs.MkdirAll(fs.Join(releasesDirectoryWithVersion(fs, app, *version), "environments", env), 0777); err != nil {
+				return err
+			}
+			return util.WriteFile(fs, manifest, content, 0666)
+		}
+	}
+	return []FsckProblem{problem}
+}
+
+// RepairRepository repairs all problems reported by Fsck that can be repaired automatically.
+type RepairRepository struct {
+}
+
+func (r *RepairRepository) Transform(ctx context.Context, state *State) (string, *TransformerResult, error) {
+	problems, err := state.Fsck(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	repaired := []string{}
+	// most repairs only touch metadata, argocd only needs to know about the ones that change the deployed manifests
+	changes := &TransformerResult{}
+	for _, p := range problems {
+		if !p.Repairable() {
+			continue
+		}
+		if err := p.repair(ctx, state.Filesystem); err != nil {
+			return "", nil, fmt.Errorf("repairing %s: %w", p.String(), err)
+		}
+		if p.changes != nil {
+			changes.AddAppEnv(p.changes.App, p.changes.Env)
+		}
+		repaired = append(repaired, p.String())
+	}
+	return fmt.Sprintf("repaired %d problems in the manifest repository\n%s", len(repaired), strings.Join(repaired, "\n")), changes, nil
+}
+
+func logFsckProblems(ctx context.Context, problems []FsckProblem) {
+	l := logger.FromContext(ctx)
+	for _, p := range problems {
+		l.Warn("fsck.problem",
+			zap.String("kind", string(p.Kind)),
+			zap.String("path", p.Path),
+			zap.String("message", p.Message),
+			zap.Bool("repairable", p.Repairable()),
+		)
+	}
+	l.Info("fsck.done", zap.Int("problems", len(problems)))
+}
+
+func (r *repository) fsck(ctx context.Context, state *State) error {
+	problems, err := state.Fsck(ctx)
+	if err != nil {
+		return fmt.Errorf("fsck: %w", err)
+	}
+	logFsckProblems(ctx, problems)
+	if r.config.Fsck != FsckRepair {
+		return nil
+	}
+	repairable := 0
+	for _, p := range problems {
+		if p.Repairable() {
+			repairable++
+		}
+	}
+	if repairable == 0 {
+		return nil
+	}
+	// the repair commit is not triggered by any user, so we attribute it to kuberpult itself:
+	ctx = auth.WriteUserToContext(ctx, auth.User{
+		Name:  r.config.CommitterName,
+		Email: r.config.CommitterEmail,
+	})
+	result := make(chan error, 1)
+	r.ProcessQueueOnce(ctx, element{
+		ctx:          ctx,
+		transformers: []Transformer{&RepairRepository{}},
+		result:       result,
+	}, defaultPushUpdate, DefaultPushActionCallback)
+	if err := <-result; err != nil {
+		return fmt.Errorf("fsck repair: %w", err)
+	}
+	logger.FromContext(ctx).Info("fsck.repaired", zap.Int("problems", repairable))
+	return nil
+}
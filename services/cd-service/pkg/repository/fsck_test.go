@@ -0,0 +1,255 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package repository
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/pkg/testutil"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/google/go-cmp/cmp"
+)
+
+type fsckResult struct {
+	Kind       FsckProblemKind
+	Path       string
+	Repairable bool
+}
+
+func toFsckResults(problems []FsckProblem) []fsckResult {
+	result := []fsckResult{}
+	for _, p := range problems {
+		result = append(result, fsckResult{
+			Kind:       p.Kind,
+			Path:       p.Path,
+			Repairable: p.Repairable(),
+		})
+	}
+	return result
+}
+
+func TestFsck(t *testing.T) {
+	setup := []Transformer{
+		&CreateEnvironment{
+			Environment: "production",
+			Config:      config.EnvironmentConfig{Upstream: &config.EnvironmentConfigUpstream{Latest: true}},
+		},
+		&CreateApplicationVersion{
+			Application: "foo",
+			Manifests: map[string]string{
+				"production": "manifest 1",
+			},
+		},
+		&CreateEnvironmentLock{
+			Environment: "production",
+			LockId:      "l1",
+			Message:     "don't deploy",
+		},
+		&CreateApplicationVersion{
+			Application: "foo",
+			Manifests: map[string]string{
+				"production": "manifest 2",
+			},
+		},
+		&DeployApplicationVersion{
+			Environment:   "production",
+			Application:   "foo",
+			Version:       2,
+			LockBehaviour: api.LockBehavior_Record,
+		},
+	}
+	tcs := []struct {
+		Name                string
+		Break               func(t *testing.T, s *State)
+		ExpectedProblems    []fsckResult
+		ExpectedAfter       []fsckResult
+		ExpectedChangedApps []AppEnv
+		ExpectedRemoved     []string
+	}{
+		{
+			Name:             "consistent repository has no problems",
+			Break:            func(t *testing.T, s *State) {},
+			ExpectedProblems: []fsckResult{},
+			ExpectedAfter:    []fsckResult{},
+		},
+		{
+			Name: "dangling version",
+			Break: func(t *testing.T, s *State) {
+				if err := s.Filesystem.Remove("applications/foo/releases/1"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			ExpectedProblems: []fsckResult{
+				{
+					Kind:       FsckDanglingVersion,
+					Path:       "environments/production/applications/foo/version",
+					Repairable: true,
+				},
+			},
+			ExpectedAfter: []fsckResult{},
+			ExpectedChangedApps: []AppEnv{
+				{App: "foo", Env: "production"},
+			},
+			ExpectedRemoved: []string{
+				"environments/production/applications/foo/version",
+				"environments/production/applications/foo/manifests",
+			},
+		},
+		{
+			Name: "dangling queued version",
+			Break: func(t *testing.T, s *State) {
+				if err := s.Filesystem.Remove("applications/foo/releases/2"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			ExpectedProblems: []fsckResult{
+				{
+					Kind:       FsckDanglingQueuedVersion,
+					Path:       "environments/production/applications/foo/queued_version",
+					Repairable: true,
+				},
+			},
+			ExpectedAfter: []fsckResult{},
+		},
+		{
+			Name: "missing manifest",
+			Break: func(t *testing.T, s *State) {
+				if err := s.Filesystem.Remove("applications/foo/releases/1/environments/production/manifests.yaml"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			ExpectedProblems: []fsckResult{
+				{
+					Kind:       FsckMissingManifest,
+					Path:       "applications/foo/releases/1/environments/production/manifests.yaml",
+					Repairable: true,
+				},
+			},
+			ExpectedAfter: []fsckResult{},
+		},
+		{
+			Name: "missing manifest without deployed copy",
+			Break: func(t *testing.T, s *State) {
+				if err := s.Filesystem.Remove("applications/foo/releases/1/environments/production/manifests.yaml"); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.Filesystem.Remove("environments/production/applications/foo/manifests"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			ExpectedProblems: []fsckResult{
+				{
+					Kind:       FsckMissingManifest,
+					Path:       "applications/foo/releases/1/environments/production/manifests.yaml",
+					Repairable: false,
+				},
+			},
+			ExpectedAfter: []fsckResult{
+				{
+					Kind:       FsckMissingManifest,
+					Path:       "applications/foo/releases/1/environments/production/manifests.yaml",
+					Repairable: false,
+				},
+			},
+		},
+		{
+			Name: "lock without created_at",
+			Break: func(t *testing.T, s *State) {
+				if err := s.Filesystem.Remove("environments/production/locks/l1/created_at"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			ExpectedProblems: []fsckResult{
+				{
+					Kind:       FsckLockWithoutCreatedAt,
+					Path:       "environments/production/locks/l1",
+					Repairable: true,
+				},
+			},
+			ExpectedAfter: []fsckResult{},
+		},
+		{
+			Name: "invalid config",
+			Break: func(t *testing.T, s *State) {
+				if err := util.WriteFile(s.Filesystem, "environments/production/config.json", []byte("{"), 0666); err != nil {
+					t.Fatal(err)
+				}
+			},
+			ExpectedProblems: []fsckResult{
+				{
+					Kind:       FsckInvalidConfig,
+					Path:       "environments/production/config.json",
+					Repairable: false,
+				},
+			},
+			ExpectedAfter: []fsckResult{
+				{
+					Kind:       FsckInvalidConfig,
+					Path:       "environments/production/config.json",
+					Repairable: false,
+				},
+			},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			repo := setupRepositoryTest(t)
+			ctx := testutil.MakeTestContext()
+			if err := repo.Apply(ctx, setup...); err != nil {
+				t.Fatal(err)
+			}
+			state := repo.State()
+			tc.Break(t, state)
+
+			problems, err := state.Fsck(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.ExpectedProblems, toFsckResults(problems)); d != "" {
+				t.Errorf("unexpected problems:\n%s", d)
+			}
+
+			repair := &RepairRepository{}
+			_, changes, err := repair.Transform(withTimeNow(ctx, time.Now()), state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.ExpectedChangedApps, changes.ChangedApps); d != "" {
+				t.Errorf("unexpected changed apps:\n%s", d)
+			}
+			for _, path := range tc.ExpectedRemoved {
+				if _, err := state.Filesystem.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("expected %q to be removed, but got %v", path, err)
+				}
+			}
+			problems, err = state.Fsck(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.ExpectedAfter, toFsckResults(problems)); d != "" {
+				t.Errorf("unexpected problems after repair:\n%s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package repository
+
+/**
+The garbage collection keeps the local copy of the manifest repo small.
+With the git backend, all reachable objects are packed into one new pack, and all other packs and loose objects are deleted.
+With the sqlite backend, all unreachable objects are deleted from the sqlite database, which is then vacuumed.
+Only the writer goroutine (ProcessQueue or FetchRegularly) runs the gc, so there are no concurrent writes.
+Deepening a shallow clone fetches from request goroutines though, so the gc holds the shallowLock to not delete objects that are being fetched.
+*/
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/sqlitestore"
+	git "github.com/libgit2/git2go/v34"
+	"go.uber.org/zap"
+)
+
+type GcStats struct {
+	Backend StorageBackend
+	// objects that are reachable from any branch and are therefore kept
+	Reachable uint64
+	// objects that were deleted, because they were unreachable or are now packed
+	Removed  uint64
+	Duration time.Duration
+	// size of the local repository after the gc in bytes
+	DiskSize uint64
+}
+
+func (s *GcStats) backendTag() string {
+	if s.Backend == SqliteBackend {
+		return "backend:sqlite"
+	}
+	return "backend:git"
+}
+
+func (s *GcStats) sendDatadogMetrics() {
+	if ddMetrics == nil {
+		return
+	}
+	tags := []string{s.backendTag()}
+	ddMetrics.Gauge("gc_reachable_objects", float64(s.Reachable), tags, 1)
+	ddMetrics.Gauge("gc_removed_objects", float64(s.Removed), tags, 1)
+	ddMetrics.Gauge("gc_duration_seconds", s.Duration.Seconds(), tags, 1)
+	ddMetrics.Gauge("repository_disk_size_bytes", float64(s.DiskSize), tags, 1)
+}
+
+// maybeGc runs the gc if GcFrequency writes were done or GcInterval passed since the last gc.
+// Read-only repositories never write, so they are only collected every GcInterval.
+func (r *repository) maybeGc(ctx context.Context, now time.Time) {
+	// counting writes only makes sense for the git backend, because every write creates loose objects there
+	dueToWrites := !r.config.ReadOnly && r.config.StorageBackend == GitBackend && r.config.GcFrequency != 0 && r.writesDone >= r.config.GcFrequency
+	dueToTime := r.config.GcInterval != 0 && now.Sub(r.lastGc) >= r.config.GcInterval
+	if !dueToWrites && !dueToTime {
+		return
+	}
+	log := logger.FromContext(ctx)
+	r.writesDone = 0
+	r.lastGc = now
+	stats, err := r.gc(ctx)
+	if err != nil {
+		// the repository is still usable, it's just bigger than necessary
+		log.Error("git.gc", zap.Error(err))
+		return
+	}
+	log.Info("git.gc",
+		zap.Duration("duration", stats.Duration),
+		zap.Uint64("reachable", stats.Reachable),
+		zap.Uint64("collected", stats.Removed),
+		zap.Uint64("disk.size", stats.DiskSize),
+	)
+	stats.sendDatadogMetrics()
+}
+
+// gcTicker fires every GcInterval, or never if the time based gc is disabled.
+func (r *repository) gcTicker() (<-chan time.Time, func()) {
+	if r.config.GcInterval == 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(r.config.GcInterval)
+	return ticker.C, ticker.Stop
+}
+
+func (r *repository) gc(ctx context.Context) (GcStats, error) {
+	timeBefore := time.Now()
+	stats := GcStats{Backend: r.config.StorageBackend}
+	r.shallowLock.Lock()
+	defer r.shallowLock.Unlock()
+	var err error
+	if r.config.StorageBackend == SqliteBackend {
+		err = r.compactSqlite(ctx, &stats)
+	} else {
+		err = r.repack(ctx, &stats)
+	}
+	if err != nil {
+		return stats, err
+	}
+	if odb, err := r.repository.Odb(); err != nil {
+		return stats, err
+	} else if err := odb.Refresh(); err != nil {
+		return stats, fmt.Errorf("refreshing odb: %w", err)
+	}
+	stats.Duration = time.Since(timeBefore)
+	stats.DiskSize, err = diskSize(r.config.Path)
+	return stats, err
+}
+
+// reachableCommits returns all commits that are reachable from a local or remote branch.
+// It doesn't use a revwalk, because libgit2 can't walk the history of shallow repositories.
+func (r *repository) reachableCommits() ([]*git.Commit, error) {
+	shallow, err := r.shallowCommits()
+	if err != nil {
+		return nil, err
+	}
+	todo := []*git.Oid{}
+	for _, glob := range []string{"refs/heads/*", "refs/remotes/*"} {
+		it, err := r.repository.NewReferenceIteratorGlob(glob)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			ref, err := it.Next()
+			if isIterOver(err) {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			resolved, err := ref.Resolve()
+			if err != nil {
+				return nil, err
+			}
+			todo = append(todo, resolved.Target())
+		}
+	}
+	seen := map[git.Oid]struct{}{}
+	result := []*git.Commit{}
+	for len(todo) > 0 {
+		oid := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if _, ok := seen[*oid]; ok {
+			continue
+		}
+		seen[*oid] = struct{}{}
+		commit, err := r.repository.LookupCommit(oid)
+		if err != nil {
+			return nil, fmt.Errorf("looking up commit %s: %w", oid, err)
+		}
+		result = append(result, commit)
+		if _, ok := shallow[*oid]; ok {
+			// the parents were never fetched
+			continue
+		}
+		for i := uint(0); i < commit.ParentCount(); i++ {
+			todo = append(todo, commit.ParentId(i))
+		}
+	}
+	return result, nil
+}
+
+func isIterOver(err error) bool {
+	var gerr *git.GitError
+	return errors.As(err, &gerr) && gerr.Code == git.ErrorCodeIterOver
+}
+
+func (r *repository) repack(ctx context.Context, stats *GcStats) error {
+	packDir := filepath.Join(r.repository.Path(), "objects", "pack")
+	oldPacks, err := filepath.Glob(filepath.Join(packDir, "pack-*.pack"))
+	if err != nil {
+		return err
+	}
+	commits, err := r.reachableCommits()
+	if err != nil {
+		return err
+	}
+	pb, err := r.repository.NewPackbuilder()
+	if err != nil {
+		return err
+	}
+	defer pb.Free()
+	for _, commit := range commits {
+		// this inserts the commit and its whole tree
+		if err := pb.InsertCommit(commit.Id()); err != nil {
+			return fmt.Errorf("packing commit %s: %w", commit.Id(), err)
+		}
+	}
+	stats.Reachable = uint64(pb.ObjectCount())
+	if stats.Reachable == 0 {
+		// empty repository, nothing to do
+		return nil
+	}
+	if err := os.MkdirAll(packDir, 0777); err != nil {
+		return err
+	}
+	if err := pb.WriteToFile(packDir, 0); err != nil {
+		return fmt.Errorf("writing pack: %w", err)
+	}
+	newPacks, err := filepath.Glob(filepath.Join(packDir, "pack-*.pack"))
+	if err != nil {
+		return err
+	}
+	if len(newPacks) == len(oldPacks) {
+		// the new pack is identical to an existing one. We don't know which one it is, so we have to keep all of them.
+		logger.FromContext(ctx).Info("git.gc.pack.unchanged")
+	} else {
+		for _, pack := range oldPacks {
+			removed, err := removePack(pack)
+			if err != nil {
+				return err
+			}
+			stats.Removed += removed
+		}
+	}
+	// all reachable objects are packed now, so all loose objects can go:
+	removed, err := removeLooseObjects(filepath.Join(r.repository.Path(), "objects"))
+	stats.Removed += removed
+	return err
+}
+
+// removePack removes a pack with all its auxiliary files and returns the number of objects in it.
+func removePack(pack string) (uint64, error) {
+	base := strings.TrimSuffix(pack, ".pack")
+	if _, err := os.Stat(base + ".keep"); err == nil {
+		return 0, nil
+	}
+	objects, err := packObjectCount(base + ".idx")
+	if err != nil {
+		return 0, err
+	}
+	files, err := filepath.Glob(base + ".*")
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return 0, err
+		}
+	}
+	return objects, nil
+}
+
+// packObjectCount reads the number of objects from the last entry of the fan-out table of a version 2 pack index.
+func packObjectCount(idx string) (uint64, error) {
+	f, err := os.Open(idx)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// 4 bytes magic number, 4 bytes version and 255 fan-out entries:
+	var count [4]byte
+	if _, err := f.ReadAt(count[:], 8+255*4); err != nil {
+		return 0, fmt.Errorf("reading pack index %s: %w", idx, err)
+	}
+	return uint64(binary.BigEndian.Uint32(count[:])), nil
+}
+
+// removeLooseObjects removes all objects in the two-letter fan-out directories.
+func removeLooseObjects(objectsDir string) (uint64, error) {
+	dirs, err := filepath.Glob(filepath.Join(objectsDir, "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return 0, err
+	}
+	var removed uint64
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return removed, err
+		}
+		for _, e := range entries {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+		if err := os.Remove(dir); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func (r *repository) compactSqlite(ctx context.Context, stats *GcStats) error {
+	reachable, err := r.reachableObjects()
+	if err != nil {
+		return err
+	}
+	keep := make([]git.Oid, 0, len(reachable))
+	for oid := range reachable {
+		keep = append(keep, oid)
+	}
+	stats.Reachable = uint64(len(keep))
+	removed, err := sqlitestore.Compact(filepath.Join(r.config.Path, "odb.sqlite"), keep)
+	if err != nil {
+		return err
+	}
+	stats.Removed = uint64(removed)
+	return nil
+}
+
+// reachableObjects returns the ids of all commits, trees and blobs that are reachable from a local or remote branch.
+func (r *repository) reachableObjects() (map[git.Oid]struct{}, error) {
+	commits, err := r.reachableCommits()
+	if err != nil {
+		return nil, err
+	}
+	result := map[git.Oid]struct{}{}
+	for _, commit := range commits {
+		result[*commit.Id()] = struct{}{}
+		treeId := commit.TreeId()
+		if _, ok := result[*treeId]; ok {
+			continue
+		}
+		result[*treeId] = struct{}{}
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, err
+		}
+		err = tree.Walk(func(_ string, entry *git.TreeEntry) error {
+			if _, ok := result[*entry.Id]; ok {
+				// subtrees are identical in many commits, there is no need to walk them again
+				return git.TreeWalkSkip
+			}
+			result[*entry.Id] = struct{}{}
+			return nil
+		})
+		tree.Free()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func diskSize(path string) (uint64, error) {
+	var size uint64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += uint64(info.Size())
+		return nil
+	})
+	return size, err
+}
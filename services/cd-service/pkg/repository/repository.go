@@ -20,16 +20,13 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
-	v1alpha1 "github.com/freiheit-com/kuberpult/services/cd-service/pkg/argocd/v1alpha1"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/grpc"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/mapper"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -44,6 +41,7 @@ import (
 	"github.com/freiheit-com/kuberpult/pkg/auth"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/argocd"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/flux"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/fs"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/notify"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/sqlitestore"
@@ -64,6 +62,8 @@ type Repository interface {
 	State() *State
 	StateAt(oid *git.Oid) (*State, error)
 	Notify() *notify.Notify
+	// Fetch asks a read-only repository to fetch the manifest repo as soon as possible. It's a no-op for writable repositories.
+	Fetch()
 }
 
 func defaultBackOffProvider() backoff.BackOff {
@@ -84,14 +84,11 @@ const (
 	SqliteBackend  StorageBackend = iota
 )
 
-const (
-	maxArgoRequests = 3 // note that this happens inside a request, we cannot retry too much!
-)
-
 type repository struct {
 	// Mutex gurading the writer
 	writeLock    sync.Mutex
 	writesDone   uint
+	lastGc       time.Time
 	queue        queue
 	config       *RepositoryConfig
 	credentials  *credentialsStore
@@ -104,7 +101,19 @@ type repository struct {
 
 	notify notify.Notify
 
+	// only used in read-only mode
+	fetchTrigger chan struct{}
+	// serializes fetches with the git cli and the gc
+	shallowLock sync.Mutex
+	// Mutex guarding unknownCommits, requests for old commits wait here for the running deepening
+	deepenLock sync.Mutex
+	// commits that couldn't be found by deepening, with the time until they are not looked up again
+	unknownCommits map[git.Oid]time.Time
+
 	backOffProvider func() backoff.BackOff
+
+	// only set if ArgoWebhookUrl is configured
+	webhooks *webhookOutbox
 }
 
 type RepositoryConfig struct {
@@ -121,8 +130,10 @@ type RepositoryConfig struct {
 	Branch string
 	// network timeout
 	NetworkTimeout time.Duration
-	//
-	GcFrequency    uint
+	// number of writes after which the git backend runs a gc (0 disables it)
+	GcFrequency uint
+	// time after which both backends run a gc (0 disables it)
+	GcInterval     time.Duration
 	StorageBackend StorageBackend
 	// Bootstrap mode controls where configurations are read from
 	// true: read from json file at EnvironmentConfigsPath
@@ -132,8 +143,25 @@ type RepositoryConfig struct {
 	ArgoInsecure           bool
 	// if set, kuberpult will generate push events to argoCd whenever it writes to the manifest repo:
 	ArgoWebhookUrl string
+	// the shared secret of the argoCd webhook. Depending on the flavour, it's used to sign the payload or sent as token.
+	ArgoWebhookSecret string
+	// the git provider kuberpult pretends to be when sending webhooks, defaults to github
+	ArgoWebhookFlavour WebhookFlavour
+	// directory in which webhooks are stored until argoCd accepted them, defaults to a directory in Path
+	ArgoWebhookOutbox string
+	// if set, it's told about all applications that changed with a successful push
+	AppSyncer AppSyncer
 	// the url to the git repo, like the browser requires it (https protocol)
 	WebURL string
+	// check (and optionally repair) the consistency of the manifest repo on startup
+	Fsck FsckMode
+	// read-only repositories never write to the manifest repo, they only fetch it every FetchInterval
+	ReadOnly      bool
+	FetchInterval time.Duration
+	// fetches that are triggered with Fetch (e.g. by the unauthenticated /fetch endpoint) run at most once per MinTriggeredFetchInterval
+	MinTriggeredFetchInterval time.Duration
+	// if set, only the last FetchDepth commits are fetched. Older revisions are fetched when they are needed.
+	FetchDepth int
 }
 
 func openOrCreate(path string, storageBackend StorageBackend) (*git.Repository, error) {
@@ -197,6 +225,39 @@ func New(ctx context.Context, cfg RepositoryConfig) (Repository, error) {
 	if cfg.NetworkTimeout == 0 {
 		cfg.NetworkTimeout = time.Minute
 	}
+	switch cfg.Fsck {
+	case "":
+		cfg.Fsck = FsckOff
+	case FsckOff, FsckCheck, FsckRepair:
+	default:
+		return nil, fmt.Errorf("invalid fsck mode %q, must be one of %q, %q or %q", cfg.Fsck, FsckOff, FsckCheck, FsckRepair)
+	}
+	if cfg.ReadOnly && cfg.Fsck == FsckRepair {
+		return nil, fmt.Errorf("fsck mode %q is not possible in a read-only repository", FsckRepair)
+	}
+	if cfg.FetchInterval == 0 {
+		cfg.FetchInterval = time.Minute
+	}
+	if cfg.MinTriggeredFetchInterval == 0 {
+		cfg.MinTriggeredFetchInterval = 10 * time.Second
+	}
+	if cfg.FetchDepth < 0 {
+		return nil, fmt.Errorf("invalid fetch depth %d, must not be negative", cfg.FetchDepth)
+	}
+	if cfg.FetchDepth > 0 && cfg.StorageBackend == SqliteBackend {
+		// the git cli fetches into the object directory and can't see objects in the sqlite odb
+		return nil, fmt.Errorf("fetch depth %d is not possible with the sqlite storage backend", cfg.FetchDepth)
+	}
+	switch cfg.ArgoWebhookFlavour {
+	case "":
+		cfg.ArgoWebhookFlavour = WebhookFlavourGitHub
+	case WebhookFlavourGitHub, WebhookFlavourGitLab, WebhookFlavourBitbucket, WebhookFlavourBitbucketServer:
+	default:
+		return nil, fmt.Errorf("invalid argocd webhook flavour %q, must be one of %q, %q, %q or %q", cfg.ArgoWebhookFlavour, WebhookFlavourGitHub, WebhookFlavourGitLab, WebhookFlavourBitbucket, WebhookFlavourBitbucketServer)
+	}
+	if cfg.ArgoWebhookOutbox == "" {
+		cfg.ArgoWebhookOutbox = filepath.Join(cfg.Path, "argocd-webhooks")
+	}
 	var credentials *credentialsStore
 	var certificates *certificateStore
 	var err error
@@ -226,26 +287,32 @@ func New(ctx context.Context, cfg RepositoryConfig) (Repository, error) {
 				certificates:    certificates,
 				repository:      repo2,
 				queue:           makeQueue(),
+				fetchTrigger:    make(chan struct{}, 1),
+				lastGc:          time.Now(),
 				backOffProvider: defaultBackOffProvider,
 			}
 			result.headLock.Lock()
 
 			defer result.headLock.Unlock()
-			fetchSpec := fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", cfg.Branch, cfg.Branch)
-			fetchOptions := git.FetchOptions{
-				RemoteCallbacks: git.RemoteCallbacks{
-					UpdateTipsCallback: func(refname string, a *git.Oid, b *git.Oid) error {
-						logger.Debug("git.fetched",
-							zap.String("refname", refname),
-							zap.String("revision.new", b.String()),
-						)
-						return nil
+			if cfg.FetchDepth > 0 {
+				err = result.shallowFetch(ctx, fmt.Sprintf("--depth=%d", cfg.FetchDepth))
+			} else {
+				fetchOptions := git.FetchOptions{
+					RemoteCallbacks: git.RemoteCallbacks{
+						UpdateTipsCallback: func(refname string, a *git.Oid, b *git.Oid) error {
+							logger.Debug("git.fetched",
+								zap.String("refname", refname),
+								zap.String("revision.new", b.String()),
+							)
+							return nil
+						},
+						CredentialsCallback:      credentials.CredentialsCallback(ctx),
+						CertificateCheckCallback: certificates.CertificateCheckCallback(ctx),
+						TransferProgressCallback: newFetchProgress(ctx).callback(),
 					},
-					CredentialsCallback:      credentials.CredentialsCallback(ctx),
-					CertificateCheckCallback: certificates.CertificateCheckCallback(ctx),
-				},
+				}
+				err = remote.Fetch([]string{result.fetchSpec()}, &fetchOptions, "fetching")
 			}
-			err := remote.Fetch([]string{fetchSpec}, &fetchOptions, "fetching")
 			if err != nil {
 				return nil, err
 			}
@@ -272,12 +339,34 @@ func New(ctx context.Context, cfg RepositoryConfig) (Repository, error) {
 				return nil, err
 			}
 
+			if cfg.Fsck != FsckOff {
+				if err := result.fsck(ctx, state); err != nil {
+					return nil, err
+				}
+				// the repair may have created a new commit
+				state, err = result.StateAt(nil)
+				if err != nil {
+					return nil, err
+				}
+			}
+
 			// Check configuration for errors and abort early if any:
 			_, err = state.GetEnvironmentConfigsAndValidate(ctx)
 			if err != nil {
 				return nil, err
 			}
-			go result.ProcessQueue(ctx)
+			if cfg.ReadOnly {
+				go result.FetchRegularly(ctx)
+			} else {
+				if cfg.ArgoWebhookUrl != "" {
+					result.webhooks, err = newWebhookOutbox(result.config)
+					if err != nil {
+						return nil, err
+					}
+					go result.webhooks.run(ctx)
+				}
+				go result.ProcessQueue(ctx)
+			}
 			return result, nil
 		}
 	}
@@ -290,16 +379,85 @@ func (r *repository) ProcessQueue(ctx context.Context) {
 			e.result <- ctx.Err()
 		}
 	}()
+	gcTick, stopGcTicker := r.gcTicker()
+	defer stopGcTicker()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case e := <-r.queue.elements:
 			r.ProcessQueueOnce(ctx, e, defaultPushUpdate, DefaultPushActionCallback)
+			r.maybeGc(ctx, time.Now())
+		case now := <-gcTick:
+			r.maybeGc(ctx, now)
+		}
+	}
+}
+
+// FetchRegularly keeps a read-only repository up to date with the remote.
+func (r *repository) FetchRegularly(ctx context.Context) {
+	ticker := time.NewTicker(r.config.FetchInterval)
+	defer ticker.Stop()
+	gcTick, stopGcTicker := r.gcTicker()
+	defer stopGcTicker()
+	var lastFetch time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-gcTick:
+			r.maybeGc(ctx, now)
+			continue
+		case <-ticker.C:
+		case <-r.fetchTrigger:
+			// anyone can trigger fetches, so they are delayed instead of hitting the remote for every trigger.
+			// Triggers that arrive in the meantime are merged into this fetch.
+			if wait := time.Until(lastFetch.Add(r.config.MinTriggeredFetchInterval)); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+				select {
+				case <-r.fetchTrigger:
+				default:
+				}
+			}
+		}
+		lastFetch = time.Now()
+		if err := r.fetchOnce(ctx); err != nil {
+			// the next fetch may work again, so we just keep on serving the old state
+			logger.FromContext(ctx).Warn("git.fetch.error", zap.Error(err))
 		}
 	}
 }
 
+func (r *repository) fetchOnce(ctx context.Context) error {
+	before, err := r.StateAt(nil)
+	if err != nil {
+		return err
+	}
+	if err := r.FetchAndReset(ctx); err != nil {
+		return err
+	}
+	after, err := r.StateAt(nil)
+	if err != nil {
+		return err
+	}
+	if after.Commit != nil && (before.Commit == nil || !before.Commit.Id().Equal(after.Commit.Id())) {
+		r.notify.Notify()
+	}
+	return nil
+}
+
+func (r *repository) Fetch() {
+	select {
+	case r.fetchTrigger <- struct{}{}:
+	default:
+		// a fetch is already pending
+	}
+}
+
 func (r *repository) applyElements(elements []element, allowFetchAndReset bool) ([]element, error, *TransformerResult) {
 	var changes = &TransformerResult{}
 	for i := 0; i < len(elements); {
@@ -329,6 +487,8 @@ func (r *repository) applyElements(elements []element, allowFetchAndReset bool)
 
 var panicError = errors.New("Panic")
 
+var readOnlyError = errors.New("the cd-service runs in read-only mode, writes must go to the writing instance")
+
 func (r *repository) useRemote(ctx context.Context, callback func(*git.Remote) error) error {
 	remote, err := r.repository.Remotes.CreateAnonymous(r.config.URL)
 	if err != nil {
@@ -398,6 +558,7 @@ func (r *repository) ProcessQueueOnce(ctx context.Context, e element, callback P
 	elements := []element{e}
 	defer func() {
 		for _, el := range elements {
+			r.writesDone = r.writesDone + uint(len(el.transformers))
 			el.result <- err
 		}
 	}()
@@ -460,205 +621,20 @@ func (r *repository) ProcessQueueOnce(ctx context.Context, e element, callback P
 			err = fmt.Errorf("failed to push - this indicates that branch protection is enabled in '%s' on branch '%s'", r.config.URL, r.config.Branch)
 		}
 	}
+	if err == nil && r.config.AppSyncer != nil && len(changes.ChangedApps) > 0 {
+		// the syncs outlive the request, so they use the context of the queue
+		r.syncApps(ctx, changes)
+	}
 	span, ctx := tracer.StartSpanFromContext(e.ctx, "PostPush")
 	defer span.Finish()
 
-	if r.config.ArgoWebhookUrl != "" {
-		r.sendWebhookToArgoCd(ctx, logger, changes)
+	if err == nil && r.webhooks != nil {
+		r.webhooks.enqueue(ctx, r.argoWebhookData(changes))
 	}
 
 	r.notify.Notify()
 }
 
-func (r *repository) sendWebhookToArgoCd(ctx context.Context, logger *zap.Logger, changes *TransformerResult) {
-	var modified = []string{}
-	for i := range changes.ChangedApps {
-		change := changes.ChangedApps[i]
-		// we may need to add the root app in some circumstances - so far it doesn't seem necessary, so we just add the manifest.yaml:
-		manifestFilename := fmt.Sprintf("environments/%s/applications/%s/manifests/manifests.yaml", change.Env, change.App)
-		modified = append(modified, manifestFilename)
-		logger.Info(fmt.Sprintf("ArgoWebhookUrl: adding modified: %s", manifestFilename))
-	}
-	var deleted = []string{}
-	for i := range changes.DeletedRootApps {
-		change := changes.DeletedRootApps[i]
-		// we may need to add the root app in some circumstances - so far it doesn't seem necessary, so we just add the manifest.yaml:
-		rootAppFilename := fmt.Sprintf("argocd/%s/%s.yaml", "v1alpha1", change.Env)
-		deleted = append(deleted, rootAppFilename)
-		logger.Info(fmt.Sprintf("ArgoWebhookUrl: adding modified: %s", rootAppFilename))
-	}
-
-	argoResult := ArgoWebhookData{
-		htmlUrl:  r.config.WebURL, // if this does not match, argo will completely ignore the request and return 200
-		revision: "refs/heads/" + r.config.Branch,
-		change: changeInfo{
-			payloadAfter: changes.Commits.Current.String(),
-		},
-		defaultBranch: r.config.Branch, // this is questionable, because we don't actually know the default branch, but it seems to work fine in practice
-		Commits: []commit{
-			{
-				Added:    []string{},
-				Modified: modified,
-				Removed:  deleted,
-			},
-		},
-	}
-	if changes.Commits.Previous != nil {
-		argoResult.change.payloadBefore = changes.Commits.Previous.String()
-	}
-
-	span, ctx := tracer.StartSpanFromContext(ctx, "Webhook-Retries")
-	defer span.Finish()
-	success := false
-	var err error = nil
-	for i := 1; i <= maxArgoRequests; i++ {
-		err, shouldRetry := doWebhookPostRequest(ctx, argoResult, r.config, i)
-		if err != nil && shouldRetry {
-			logger.Warn(fmt.Sprintf("ProcessQueueOnce: error sending webhook on try %d: %v", i, err))
-			if shouldRetry {
-				// we're still in a request here, we can't wait too long:
-				time.Sleep(time.Duration(100*i) * time.Millisecond)
-			} else {
-				break
-			}
-		} else {
-			logger.Info(fmt.Sprintf("ProcessQueueOnce: argo webhook was send successfully on try %d!", i))
-			success = true
-			break
-		}
-	}
-	span.SetTag("success", success)
-	if !success {
-		logger.Error(fmt.Sprintf("ProcessQueueOnce: error sending webhook after all %d tries: %v", maxArgoRequests, err))
-	}
-}
-
-func contains(s []int, e int) bool {
-	for _, a := range s {
-		if a == e {
-			return true
-		}
-	}
-	return false
-}
-
-func doWebhookPostRequest(ctx context.Context, data ArgoWebhookData, repoConfig *RepositoryConfig, retryCounter int) (error, bool) {
-	span, ctx := tracer.StartSpanFromContext(ctx, "Webhook")
-	span.SetTag("changeAfter", data.change.payloadAfter)
-	span.SetTag("changeBefore", data.change.payloadBefore)
-	span.SetTag("try", retryCounter)
-	defer span.Finish()
-	url := repoConfig.ArgoWebhookUrl + "/api/webhook"
-	l := logger.FromContext(ctx)
-	l.Info(fmt.Sprintf("doWebhookPostRequest: URL: %s", url))
-
-	var argoFormat = v1alpha1.PushPayload{
-		Ref:    data.revision,
-		Before: data.change.payloadBefore,
-		After:  data.change.payloadAfter,
-		Repository: v1alpha1.Repository{
-			HTMLURL:       data.htmlUrl,
-			DefaultBranch: data.defaultBranch,
-		},
-		Commits: toArgoCommits(data.Commits),
-	}
-
-	jsonBytes, err := json.MarshalIndent(argoFormat, " ", " ")
-	if err != nil {
-		return err, false
-	}
-	l.Info(fmt.Sprintf("doWebhookPostRequest argo format: %s", string(jsonBytes)))
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBytes))
-	req.Header.Set("Content-Type", "application/json")
-
-	// now pretend that we are GitHub by adding this header, otherwise argo will ignore our request:
-	req.Header.Set("X-GitHub-Event", "push")
-
-	tr := &http.Transport{
-		// we reach argo from within the cluster, so there's no ssl:
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: repoConfig.ArgoInsecure,
-		},
-	}
-	client := &http.Client{Transport: tr}
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.New(fmt.Sprintf("doWebhookPostRequest: could not send request to '%s': %s", url, err.Error())), false
-	}
-	defer resp.Body.Close()
-
-	//l.Warn(fmt.Sprintf("response Status: %d", resp.StatusCode))
-	l.Info(fmt.Sprintf("response headers: %s", resp.Header))
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		// weird but we kinda do not care about the body:
-		l.Warn(fmt.Sprintf("doWebhookPostRequest: could not read body: %s - continuing anyway", err.Error()))
-	}
-	validResponseCodes := []int{200}
-	if resp.StatusCode >= 500 {
-		return errors.New(fmt.Sprintf("doWebhookPostRequest: invalid status code from argo: %d", resp.StatusCode)), true
-	}
-
-	if contains(validResponseCodes, resp.StatusCode) {
-		l.Info(fmt.Sprintf("doWebhookPostRequest: response Body: %s", string(body)))
-		return nil, false
-	}
-	// in any other case we should not do a retry (e.g. status 4xx):
-	l.Warn(fmt.Sprintf("doWebhookPostRequest: response Body: %s", string(body)))
-	return errors.New(fmt.Sprintf("doWebhookPostRequest: invalid status code from argo: %d", resp.StatusCode)), false
-}
-
-func toArgoCommits(commits []commit) []v1alpha1.Commit {
-	var result = []v1alpha1.Commit{}
-	for i := range commits {
-		c := commits[i]
-		result = append(result, v1alpha1.Commit{
-			// ArgoCd ignores most fields, so we can ignore them too.
-			// Source: function "affectedRevisionInfo" in https://github.com/argoproj/argo-cd/blob/master/util/webhook/webhook.go#L141
-			Sha:       "",
-			ID:        "",
-			NodeID:    "",
-			TreeID:    "",
-			Distinct:  false,
-			Message:   "",
-			Timestamp: "",
-			URL:       "",
-			Author: struct {
-				Name     string `json:"name"`
-				Email    string `json:"email"`
-				Username string `json:"username"`
-			}{},
-			Committer: struct {
-				Name     string `json:"name"`
-				Email    string `json:"email"`
-				Username string `json:"username"`
-			}{},
-			Added:    c.Added,
-			Removed:  c.Removed,
-			Modified: c.Modified,
-		})
-	}
-	return result
-}
-
-type changeInfo struct {
-	payloadBefore string
-	payloadAfter  string
-}
-type commit struct {
-	Added    []string
-	Modified []string
-	Removed  []string
-}
-
-type ArgoWebhookData struct {
-	htmlUrl       string
-	revision      string // aka "ref"
-	change        changeInfo
-	defaultBranch string
-	Commits       []commit
-}
-
 func (r *repository) ApplyTransformersInternal(ctx context.Context, transformers ...Transformer) ([]string, *State, []*TransformerResult, error) {
 	if state, err := r.StateAt(nil); err != nil {
 		return nil, nil, nil, grpc.InternalError(ctx, fmt.Errorf("%s: %w", "failure in StateAt", err))
@@ -683,6 +659,20 @@ type AppEnv struct {
 	Env string
 }
 
+// AppSyncer is used to let the gitops tool apply changes right away instead of waiting until it notices them.
+type AppSyncer interface {
+	SyncApps(ctx context.Context, configs map[string]config.EnvironmentConfig, apps []AppEnv)
+}
+
+func (r *repository) syncApps(ctx context.Context, changes *TransformerResult) {
+	configs, err := r.State().GetEnvironmentConfigs()
+	if err != nil {
+		logger.FromContext(ctx).Error("argocd.sync.configs", zap.Error(err))
+		return
+	}
+	r.config.AppSyncer.SyncApps(ctx, configs, changes.ChangedApps)
+}
+
 type RootApp struct {
 	Env string
 	//argocd/v1alpha1/development2.yaml
@@ -802,24 +792,32 @@ func (r *repository) ApplyTransformers(ctx context.Context, transformers ...Tran
 }
 
 func (r *repository) FetchAndReset(ctx context.Context) error {
-	fetchSpec := fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", r.config.Branch, r.config.Branch)
-	logger := logger.FromContext(ctx)
-	fetchOptions := git.FetchOptions{
-		RemoteCallbacks: git.RemoteCallbacks{
-			UpdateTipsCallback: func(refname string, a *git.Oid, b *git.Oid) error {
-				logger.Debug("git.fetched",
-					zap.String("refname", refname),
-					zap.String("revision.new", b.String()),
-				)
-				return nil
+	var err error
+	if r.config.FetchDepth > 0 {
+		// a plain fetch keeps the repository as shallow as it is
+		timeoutCtx, cancel := context.WithTimeout(ctx, r.config.NetworkTimeout)
+		defer cancel()
+		err = r.shallowFetch(timeoutCtx)
+	} else {
+		logger := logger.FromContext(ctx)
+		fetchOptions := git.FetchOptions{
+			RemoteCallbacks: git.RemoteCallbacks{
+				UpdateTipsCallback: func(refname string, a *git.Oid, b *git.Oid) error {
+					logger.Debug("git.fetched",
+						zap.String("refname", refname),
+						zap.String("revision.new", b.String()),
+					)
+					return nil
+				},
+				CredentialsCallback:      r.credentials.CredentialsCallback(ctx),
+				CertificateCheckCallback: r.certificates.CertificateCheckCallback(ctx),
+				TransferProgressCallback: newFetchProgress(ctx).callback(),
 			},
-			CredentialsCallback:      r.credentials.CredentialsCallback(ctx),
-			CertificateCheckCallback: r.certificates.CertificateCheckCallback(ctx),
-		},
+		}
+		err = r.useRemote(ctx, func(remote *git.Remote) error {
+			return remote.Fetch([]string{r.fetchSpec()}, &fetchOptions, "fetching")
+		})
 	}
-	err := r.useRemote(ctx, func(remote *git.Remote) error {
-		return remote.Fetch([]string{fetchSpec}, &fetchOptions, "fetching")
-	})
 	if err != nil {
 		return &InternalError{inner: err}
 	}
@@ -855,10 +853,9 @@ func (r *repository) FetchAndReset(ctx context.Context) error {
 }
 
 func (r *repository) Apply(ctx context.Context, transformers ...Transformer) error {
-	defer func() {
-		r.writesDone = r.writesDone + uint(len(transformers))
-		r.maybeGc(ctx)
-	}()
+	if r.config.ReadOnly {
+		return grpc.ReadOnlyError(readOnlyError)
+	}
 	eCh := r.applyDeferred(ctx, transformers...)
 	select {
 	case err := <-eCh:
@@ -911,43 +908,115 @@ func (r *repository) afterTransform(ctx context.Context, state State) error {
 				return err
 			}
 		}
+		if config.Flux != nil {
+			err := r.updateFluxApps(ctx, &state, env, config)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deployedApps returns all applications that have a version deployed to the environment.
+type deployedApp struct {
+	Name    string
+	Version uint64
+}
+
+func deployedApps(state *State, env string) ([]deployedApp, error) {
+	apps, err := state.GetEnvironmentApplications(env)
+	if err != nil {
+		return nil, err
+	}
+	result := []deployedApp{}
+	sort.Strings(apps)
+	for _, appName := range apps {
+		version, err := state.GetEnvironmentApplicationVersion(env, appName)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// if the app does not exist, we skip it
+				// (It may not exist at all, or just hasn't been deployed to this environment yet)
+				continue
+			}
+			return nil, err
+		}
+		if version == nil || *version == 0 {
+			// if nothing is deployed, ignore it
+			continue
+		}
+		result = append(result, deployedApp{Name: appName, Version: *version})
+	}
+	return result, nil
+}
+
+func (r *repository) updateFluxApps(ctx context.Context, state *State, env string, config config.EnvironmentConfig) error {
+	fs := state.Filesystem
+	apps, err := deployedApps(state, env)
+	if err != nil {
+		return err
+	}
+	appData := []flux.AppData{}
+	for _, app := range apps {
+		team, err := state.GetApplicationTeamOwner(app.Name)
+		if err != nil {
+			return err
+		}
+		source, err := state.GetApplicationReleaseSource(app.Name, app.Version)
+		if err != nil {
+			return err
+		}
+		appData = append(appData, flux.AppData{
+			AppName:  app.Name,
+			TeamName: team,
+			Source:   source,
+		})
+	}
+	if manifests, err := flux.Render(r.config.URL, r.config.Branch, config, env, appData); err != nil {
+		return err
+	} else {
+		for apiVersion, content := range manifests {
+			if err := fs.MkdirAll(fs.Join("flux", string(apiVersion)), 0777); err != nil {
+				return err
+			}
+			target := fs.Join("flux", string(apiVersion), fmt.Sprintf("%s.yaml", env))
+			if err := util.WriteFile(fs, target, content, 0666); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
 func (r *repository) updateArgoCdApps(ctx context.Context, state *State, env string, config config.EnvironmentConfig) error {
 	fs := state.Filesystem
-	if apps, err := state.GetEnvironmentApplications(env); err != nil {
+	if apps, err := deployedApps(state, env); err != nil {
 		return err
 	} else {
 		appData := []argocd.AppData{}
-		sort.Strings(apps)
-		for _, appName := range apps {
+		for _, app := range apps {
+			team, err := state.GetApplicationTeamOwner(app.Name)
 			if err != nil {
 				return err
 			}
-			team, err := state.GetApplicationTeamOwner(appName)
+			overrides, err := state.GetApplicationReleaseArgoCdOverrides(app.Name, app.Version)
 			if err != nil {
 				return err
 			}
-			version, err := state.GetEnvironmentApplicationVersion(env, appName)
+			source, err := state.GetApplicationReleaseSource(app.Name, app.Version)
 			if err != nil {
-				if errors.Is(err, os.ErrNotExist) {
-					// if the app does not exist, we skip it
-					// (It may not exist at all, or just hasn't been deployed to this environment yet)
-					continue
-				}
 				return err
 			}
-			if version == nil || *version == 0 {
-				// if nothing is deployed, ignore it
-				continue
-			}
 			appData = append(appData, argocd.AppData{
-				AppName:  appName,
-				TeamName: team,
+				AppName:   app.Name,
+				TeamName:  team,
+				Overrides: overrides,
+				Source:    source,
 			})
 		}
+		if err := updateApplicationSetParameters(state, env, config, appData); err != nil {
+			return err
+		}
 		if manifests, err := argocd.Render(r.config.URL, r.config.Branch, config, env, appData); err != nil {
 			return err
 		} else {
@@ -965,6 +1034,36 @@ func (r *repository) updateArgoCdApps(ctx context.Context, state *State, env str
 	return nil
 }
 
+// updateApplicationSetParameters writes the parameters file for every application that is generated by the ApplicationSet of the environment and removes it for all other applications.
+func updateApplicationSetParameters(state *State, env string, config config.EnvironmentConfig, appsData []argocd.AppData) error {
+	fs := state.Filesystem
+	apps, err := state.GetEnvironmentApplications(env)
+	if err != nil {
+		return err
+	}
+	generated := map[string][]byte{}
+	for _, appData := range appsData {
+		content, err := argocd.RenderApplicationSetParameters(config.ArgoCd, appData)
+		if err != nil {
+			return err
+		}
+		if content != nil {
+			generated[appData.AppName] = content
+		}
+	}
+	for _, app := range apps {
+		file := fs.Join("environments", env, "applications", app, argocd.ApplicationSetParametersFileName)
+		if content, ok := generated[app]; ok {
+			if err := util.WriteFile(fs, file, content, 0666); err != nil {
+				return err
+			}
+		} else if err := fs.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
 func (r *repository) State() *State {
 	s, err := r.StateAt(nil)
 	if err != nil {
@@ -996,7 +1095,7 @@ func (r *repository) StateAt(oid *git.Oid) (*State, error) {
 		}
 	} else {
 		var err error
-		commit, err = r.repository.LookupCommit(oid)
+		commit, err = r.lookupCommitDeepening(oid)
 		if err != nil {
 			return nil, err
 		}
@@ -1071,25 +1170,6 @@ func (r *repository) countObjects(ctx context.Context) (ObjectCount, error) {
 	return stats, nil
 }
 
-func (r *repository) maybeGc(ctx context.Context) {
-	if r.config.StorageBackend == SqliteBackend || r.config.GcFrequency == 0 || r.writesDone < r.config.GcFrequency {
-		return
-	}
-	log := logger.FromContext(ctx)
-	r.writesDone = 0
-	timeBefore := time.Now()
-	statsBefore, _ := r.countObjects(ctx)
-	cmd := exec.CommandContext(ctx, "git", "repack", "-a", "-d")
-	cmd.Dir = r.config.Path
-	err := cmd.Run()
-	if err != nil {
-		log.Fatal("git.repack", zap.Error(err))
-		return
-	}
-	statsAfter, _ := r.countObjects(ctx)
-	log.Info("git.repack", zap.Duration("duration", time.Now().Sub(timeBefore)), zap.Uint64("collected", statsBefore.Count-statsAfter.Count))
-}
-
 type State struct {
 	Filesystem             billy.Filesystem
 	Commit                 *git.Commit
@@ -1434,6 +1514,32 @@ type Release struct {
 	DisplayVersion  string
 }
 
+// GetApplicationReleaseArgoCdOverrides returns nil if the release has no argocd overrides
+func (s *State) GetApplicationReleaseArgoCdOverrides(application string, version uint64) (*config.ArgoCdApplicationOverrides, error) {
+	fileName := s.Filesystem.Join(releasesDirectoryWithVersion(s.Filesystem, application, version), "argocd.json")
+	var overrides config.ArgoCdApplicationOverrides
+	if err := decodeJsonFile(s.Filesystem, fileName, &overrides); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s : %w", fileName, invalidJson)
+	}
+	return &overrides, nil
+}
+
+// GetApplicationReleaseSource returns nil if the release consists of plain manifests
+func (s *State) GetApplicationReleaseSource(application string, version uint64) (*config.ReleaseSource, error) {
+	fileName := s.Filesystem.Join(releasesDirectoryWithVersion(s.Filesystem, application, version), "source.json")
+	var source config.ReleaseSource
+	if err := decodeJsonFile(s.Filesystem, fileName, &source); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s : %w", fileName, invalidJson)
+	}
+	return &source, nil
+}
+
 func (s *State) IsUndeployVersion(application string, version uint64) (bool, error) {
 	base := releasesDirectoryWithVersion(s.Filesystem, application, version)
 	_, err := s.Filesystem.Stat(base)
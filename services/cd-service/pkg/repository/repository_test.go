@@ -30,12 +30,17 @@ import (
 	"time"
 
 	"github.com/freiheit-com/kuberpult/pkg/testutil"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/repository/testssh"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/syncer"
 
+	argoapplication "github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	argoappv1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
 	"github.com/cenkalti/backoff/v4"
 	"github.com/go-git/go-billy/v5/util"
 	"github.com/google/go-cmp/cmp"
 	git "github.com/libgit2/git2go/v34"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -789,6 +794,354 @@ func TestGc(t *testing.T) {
 	}
 }
 
+func TestGcScheduling(t *testing.T) {
+	tcs := []struct {
+		Name        string
+		ReadOnly    bool
+		GcFrequency uint
+		GcInterval  time.Duration
+		WritesDone  uint
+		After       time.Duration
+		ExpectedGc  bool
+	}{
+		{
+			Name:       "interval not over",
+			GcInterval: time.Hour,
+			After:      59 * time.Minute,
+			ExpectedGc: false,
+		},
+		{
+			Name:       "interval over",
+			GcInterval: time.Hour,
+			After:      time.Hour,
+			ExpectedGc: true,
+		},
+		{
+			Name:       "interval disabled",
+			GcInterval: 0,
+			After:      1000 * time.Hour,
+			ExpectedGc: false,
+		},
+		{
+			Name:        "enough writes",
+			GcFrequency: 10,
+			WritesDone:  10,
+			ExpectedGc:  true,
+		},
+		{
+			Name:        "read-only ignores writes",
+			ReadOnly:    true,
+			GcFrequency: 10,
+			WritesDone:  10,
+			ExpectedGc:  false,
+		},
+		{
+			Name:       "read-only interval over",
+			ReadOnly:   true,
+			GcInterval: time.Hour,
+			After:      time.Hour,
+			ExpectedGc: true,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(testutil.MakeTestContext())
+			defer cancel()
+			dir := t.TempDir()
+			remoteDir := path.Join(dir, "remote")
+			cmd := exec.Command("git", "init", "--bare", remoteDir)
+			cmd.Run()
+			writer, err := New(ctx, RepositoryConfig{
+				URL:  "file://" + remoteDir,
+				Path: path.Join(dir, "writer"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Apply(ctx, &CreateEnvironment{Environment: "development"}); err != nil {
+				t.Fatal(err)
+			}
+			repo, err := New(ctx, RepositoryConfig{
+				URL:           "file://" + remoteDir,
+				Path:          path.Join(dir, "repo"),
+				ReadOnly:      tc.ReadOnly,
+				FetchInterval: time.Hour,
+				GcFrequency:   tc.GcFrequency,
+				GcInterval:    tc.GcInterval,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := repo.(*repository)
+			tick, stop := r.gcTicker()
+			defer stop()
+			if (tick != nil) != (tc.GcInterval != 0) {
+				t.Errorf("expected a gc ticker only if the interval is set, but got %v", tick)
+			}
+
+			lastGc := r.lastGc
+			r.writesDone = tc.WritesDone
+			now := lastGc.Add(tc.After)
+			r.maybeGc(ctx, now)
+			if gcDone := !r.lastGc.Equal(lastGc); gcDone != tc.ExpectedGc {
+				t.Errorf("expected gc %t, but got %t", tc.ExpectedGc, gcDone)
+			}
+		})
+	}
+}
+
+func TestGcRemovesUnreachableObjects(t *testing.T) {
+	tcs := []struct {
+		Name           string
+		StorageBackend StorageBackend
+	}{
+		{
+			Name:           "git",
+			StorageBackend: GitBackend,
+		},
+		{
+			Name:           "sqlite",
+			StorageBackend: SqliteBackend,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			remoteDir := path.Join(dir, "remote")
+			localDir := path.Join(dir, "local")
+			cmd := exec.Command("git", "init", "--bare", remoteDir)
+			cmd.Run()
+			ctx := testutil.MakeTestContext()
+			repo, err := New(
+				ctx,
+				RepositoryConfig{
+					URL:            "file://" + remoteDir,
+					Path:           localDir,
+					StorageBackend: tc.StorageBackend,
+				},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = repo.Apply(ctx, &CreateEnvironment{
+				Environment: "test",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := repo.(*repository)
+			odb, err := r.repository.Odb()
+			if err != nil {
+				t.Fatal(err)
+			}
+			unreachable, err := odb.Write([]byte("nobody points to me"), git.ObjectBlob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, err := r.gc(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Reachable == 0 {
+				t.Errorf("expected reachable objects, but got none")
+			}
+			if stats.Removed == 0 {
+				t.Errorf("expected removed objects, but got none")
+			}
+			// open the repository again to make sure that nothing is served from a cache
+			reopened, err := openOrCreate(localDir, tc.StorageBackend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			odb, err = reopened.Odb()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if odb.Exists(unreachable) {
+				t.Errorf("expected %s to be removed", unreachable)
+			}
+			// everything that is reachable must still be readable
+			if _, err := repo.State().GetEnvironmentConfigs(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestShallowFetch(t *testing.T) {
+	dir := t.TempDir()
+	remoteDir := path.Join(dir, "remote")
+	cmd := exec.Command("git", "init", "--bare", remoteDir)
+	cmd.Run()
+	ctx := testutil.MakeTestContext()
+	writer, err := New(ctx, RepositoryConfig{
+		URL:  "file://" + remoteDir,
+		Path: path.Join(dir, "writer"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revisions := []git.Oid{}
+	for _, env := range []string{"development", "staging", "production", "canary"} {
+		if err := writer.Apply(ctx, &CreateEnvironment{Environment: env}); err != nil {
+			t.Fatal(err)
+		}
+		revisions = append(revisions, *writer.State().Commit.Id())
+	}
+
+	if _, err := New(ctx, RepositoryConfig{
+		URL:        "file://" + remoteDir,
+		Path:       path.Join(dir, "sqlite"),
+		FetchDepth: 1,
+	}); err == nil {
+		t.Fatal("expected fetch depth to be rejected with the sqlite storage backend")
+	}
+
+	repo, err := New(ctx, RepositoryConfig{
+		URL:            "file://" + remoteDir,
+		Path:           path.Join(dir, "shallow"),
+		FetchDepth:     1,
+		StorageBackend: GitBackend,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shallow, err := repo.(*repository).repository.IsShallow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !shallow {
+		t.Fatal("expected a shallow repository")
+	}
+	if _, err := repo.StateAt(&revisions[len(revisions)-1]); err != nil {
+		t.Fatal(err)
+	}
+	// older revisions are not part of the shallow history and have to be fetched, even if they are requested one after the other:
+	if _, err := repo.StateAt(&revisions[len(revisions)-2]); err != nil {
+		t.Fatal(err)
+	}
+	state, err := repo.StateAt(&revisions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	envs, err := state.GetEnvironmentConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff([]string{"development"}, sortedKeys(envs)); d != "" {
+		t.Errorf("unexpected environments in the oldest revision:\n%s", d)
+	}
+	// unknown commits are only looked up in the remote once
+	unknown, err := git.NewOid("0123456789abcdef0123456789abcdef01234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := repo.(*repository)
+	if _, err := repo.StateAt(unknown); err == nil {
+		t.Fatal("expected an error for an unknown commit")
+	}
+	until, ok := r.unknownCommits[*unknown]
+	if !ok {
+		t.Fatal("expected the unknown commit to be remembered")
+	}
+	if _, err := repo.StateAt(unknown); err == nil {
+		t.Fatal("expected an error for an unknown commit")
+	}
+	if r.unknownCommits[*unknown] != until {
+		t.Error("expected no deepening for a remembered unknown commit")
+	}
+	// writing still works in a shallow repository
+	if err := repo.Apply(ctx, &CreateEnvironment{Environment: "testing"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGcDuringDeepen(t *testing.T) {
+	dir := t.TempDir()
+	remoteDir := path.Join(dir, "remote")
+	cmd := exec.Command("git", "init", "--bare", remoteDir)
+	cmd.Run()
+	ctx := testutil.MakeTestContext()
+	writer, err := New(ctx, RepositoryConfig{
+		URL:  "file://" + remoteDir,
+		Path: path.Join(dir, "writer"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revisions := []git.Oid{}
+	for _, env := range []string{"development", "staging", "production", "canary"} {
+		if err := writer.Apply(ctx, &CreateEnvironment{Environment: env}); err != nil {
+			t.Fatal(err)
+		}
+		revisions = append(revisions, *writer.State().Commit.Id())
+	}
+	repo, err := New(ctx, RepositoryConfig{
+		URL:            "file://" + remoteDir,
+		Path:           path.Join(dir, "shallow"),
+		FetchDepth:     1,
+		StorageBackend: GitBackend,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := repo.(*repository)
+
+	// the gc waits for running fetches
+	r.shallowLock.Lock()
+	gcDone := make(chan error, 1)
+	go func() {
+		_, err := r.gc(ctx)
+		gcDone <- err
+	}()
+	select {
+	case err := <-gcDone:
+		t.Fatalf("expected the gc to wait for the shallow lock, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	r.shallowLock.Unlock()
+	if err := <-gcDone; err != nil {
+		t.Fatal(err)
+	}
+
+	// deepening while the gc runs must not lose any objects
+	deepened := make(chan error, 1)
+	go func() {
+		_, err := r.lookupCommitDeepening(&revisions[0])
+		deepened <- err
+	}()
+	for i := 0; i < 3; i++ {
+		if _, err := r.gc(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-deepened; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.gc(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, rev := range revisions {
+		rev := rev
+		state, err := repo.StateAt(&rev)
+		if err != nil {
+			t.Fatalf("revision %s: %v", rev.String(), err)
+		}
+		if _, err := state.GetEnvironmentConfigs(); err != nil {
+			t.Fatalf("revision %s: %v", rev.String(), err)
+		}
+	}
+	fsck := exec.Command("git", "fsck", "--connectivity-only")
+	fsck.Dir = r.repository.Path()
+	if out, err := fsck.CombinedOutput(); err != nil {
+		t.Fatalf("git fsck: %v: %s", err, out)
+	}
+}
+
 func TestRetrySsh(t *testing.T) {
 	tcs := []struct {
 		Name              string
@@ -1516,6 +1869,90 @@ func TestProcessQueueOnce(t *testing.T) {
 	}
 }
 
+// blockingArgoClient never finishes a sync until it's released
+type blockingArgoClient struct {
+	release chan struct{}
+}
+
+func (b *blockingArgoClient) Get(ctx context.Context, in *argoapplication.ApplicationQuery, opts ...grpc.CallOption) (*argoappv1.Application, error) {
+	<-b.release
+	return nil, nil
+}
+
+func (b *blockingArgoClient) Sync(ctx context.Context, in *argoapplication.ApplicationSyncRequest, opts ...grpc.CallOption) (*argoappv1.Application, error) {
+	<-b.release
+	return nil, nil
+}
+
+type testAppSyncer struct {
+	syncer *syncer.Syncer
+}
+
+func (s testAppSyncer) SyncApps(ctx context.Context, configs map[string]config.EnvironmentConfig, apps []AppEnv) {
+	appEnvs := make([]syncer.AppEnv, 0, len(apps))
+	for _, app := range apps {
+		appEnvs = append(appEnvs, syncer.AppEnv{Environment: app.Env, Application: app.App})
+	}
+	s.syncer.SyncApps(ctx, configs, appEnvs)
+}
+
+func TestProcessQueueOnceDoesntWaitForSyncs(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	remoteDir := path.Join(dir, "remote")
+	cmd := exec.Command("git", "init", "--bare", remoteDir)
+	cmd.Start()
+	cmd.Wait()
+	client := &blockingArgoClient{release: make(chan struct{})}
+	defer close(client.release)
+	repo, err := New(
+		testutil.MakeTestContext(),
+		RepositoryConfig{
+			URL:  "file://" + remoteDir,
+			Path: path.Join(dir, "local"),
+			// a single worker is busy with the first sync
+			AppSyncer: testAppSyncer{syncer.New(client, 1)},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Apply(testutil.MakeTestContext(), &CreateEnvironment{
+		Environment: "development",
+		Config:      config.EnvironmentConfig{ArgoCd: &config.EnvironmentConfigArgoCd{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformers := []Transformer{}
+	for _, app := range []string{"a", "b", "c", "d"} {
+		transformers = append(transformers, &CreateApplicationVersion{
+			Application: app,
+			Manifests: map[string]string{
+				"development": app,
+			},
+		})
+	}
+	e := element{
+		ctx:          testutil.MakeTestContext(),
+		transformers: transformers,
+		result:       make(chan error, 1),
+	}
+	done := make(chan struct{})
+	go func() {
+		repo.(*repository).ProcessQueueOnce(testutil.MakeTestContext(), e, defaultPushUpdate, DefaultPushActionCallback)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("ProcessQueueOnce waited for the syncs")
+	}
+	if err := <-e.result; err != nil {
+		t.Errorf("expected no error, got %q", err)
+	}
+}
+
 func TestGitPushDoesntGetStuck(t *testing.T) {
 	tcs := []struct {
 		Name string
@@ -1583,3 +2020,69 @@ func TestGitPushDoesntGetStuck(t *testing.T) {
 		})
 	}
 }
+
+func TestReadOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(testutil.MakeTestContext())
+	defer cancel()
+	dir := t.TempDir()
+	remoteDir := path.Join(dir, "remote")
+	cmd := exec.Command("git", "init", "--bare", remoteDir)
+	cmd.Run()
+	writer, err := New(ctx, RepositoryConfig{
+		URL:  "file://" + remoteDir,
+		Path: path.Join(dir, "writer"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Apply(ctx, &CreateEnvironment{Environment: "development"}); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := New(ctx, RepositoryConfig{
+		URL:                       "file://" + remoteDir,
+		Path:                      path.Join(dir, "reader"),
+		ReadOnly:                  true,
+		FetchInterval:             time.Hour,
+		MinTriggeredFetchInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reader.Apply(ctx, &CreateEnvironment{Environment: "staging"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected status code failed precondition, but got %q", status.Code(err))
+	}
+
+	ch, unsubscribe := reader.Notify().Subscribe()
+	defer unsubscribe()
+	// the first notification is sent on subscription
+	<-ch
+	if err := writer.Apply(ctx, &CreateEnvironment{Environment: "staging"}); err != nil {
+		t.Fatal(err)
+	}
+	reader.Fetch()
+	select {
+	case <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatal("read-only repository wasn't notified after fetching")
+	}
+	envs, err := reader.State().GetEnvironmentConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := envs["staging"]; !ok {
+		t.Errorf("expected the read-only repository to know about staging, but got %v", envs)
+	}
+
+	// the next triggered fetch has to wait for MinTriggeredFetchInterval
+	if err := writer.Apply(ctx, &CreateEnvironment{Environment: "production"}); err != nil {
+		t.Fatal(err)
+	}
+	reader.Fetch()
+	reader.Fetch()
+	select {
+	case <-ch:
+		t.Fatal("read-only repository fetched again before MinTriggeredFetchInterval")
+	case <-time.After(time.Second):
+	}
+}
@@ -0,0 +1,270 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package repository
+
+/**
+Shallow fetches keep cold starts fast for manifest repos with a long history.
+libgit2 can't fetch shallow, so the git cli does the fetching in that case. Everything else (reading, committing and pushing) still goes through libgit2.
+Blob filtering (partial clones) is not supported, because libgit2 refuses to open repositories with the partialclone extension and can't fetch missing blobs on demand.
+If StateAt needs a revision that is older than the shallow history, the history is deepened step by step.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	git "github.com/libgit2/git2go/v34"
+	"go.uber.org/zap"
+)
+
+const (
+	// every round doubles the number of commits that are fetched additionally
+	maxDeepenRounds = 5
+	// revisions come from api requests, so unknown commits must not trigger a fetch every time
+	unknownCommitTTL = 10 * time.Minute
+)
+
+func (r *repository) fetchSpec() string {
+	return fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", r.config.Branch, r.config.Branch)
+}
+
+// shallowFetch fetches the branch with the git cli. args are passed to `git fetch`, e.g. "--depth=10".
+func (r *repository) shallowFetch(ctx context.Context, args ...string) error {
+	r.shallowLock.Lock()
+	defer r.shallowLock.Unlock()
+	fetchArgs := append([]string{"fetch", "--progress", "--no-tags"}, args...)
+	fetchArgs = append(fetchArgs, r.config.URL, r.fetchSpec())
+	cmd := exec.CommandContext(ctx, "git", fetchArgs...)
+	cmd.Dir = r.repository.Path()
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if r.credentials != nil {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_SSH_COMMAND=%s", r.sshCommand()))
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	progress := newFetchProgress(ctx)
+	scanner := bufio.NewScanner(stderr)
+	scanner.Split(scanProgressLines)
+	output := []string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !progress.parse(line) {
+			output = append(output, line)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.Join(output, "\n"))
+	}
+	progress.done()
+	return nil
+}
+
+func (r *repository) sshCommand() string {
+	sshCommand := []string{"ssh", "-o", "IdentitiesOnly=yes", "-o", "BatchMode=yes"}
+	if r.config.Credentials.SshKey != "" {
+		sshCommand = append(sshCommand, "-i", r.config.Credentials.SshKey)
+	}
+	if r.config.Certificates.KnownHostsFile != "" {
+		sshCommand = append(sshCommand, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+r.config.Certificates.KnownHostsFile)
+	}
+	return strings.Join(sshCommand, " ")
+}
+
+// scanProgressLines splits at \n and \r, because git redraws progress lines with \r.
+func scanProgressLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// fetchProgress reports the progress of a fetch in logs and metrics. It's used for libgit2 and the git cli.
+type fetchProgress struct {
+	ctx             context.Context
+	lastPercent     uint
+	receivedObjects uint
+	totalObjects    uint
+	receivedBytes   uint
+}
+
+func newFetchProgress(ctx context.Context) *fetchProgress {
+	return &fetchProgress{ctx: ctx}
+}
+
+var gitProgressLine = regexp.MustCompile(`^Receiving objects:\s+(\d+)% \((\d+)/(\d+)\)`)
+
+// parse reads a line of `git fetch --progress`, it returns false if the line doesn't contain progress information.
+func (p *fetchProgress) parse(line string) bool {
+	m := gitProgressLine.FindStringSubmatch(line)
+	if m == nil {
+		// other progress lines (counting, compressing, resolving) are not interesting enough
+		return strings.HasPrefix(line, "remote:") || strings.Contains(line, "objects:") || strings.Contains(line, "deltas:")
+	}
+	received, _ := strconv.ParseUint(m[2], 10, 64)
+	total, _ := strconv.ParseUint(m[3], 10, 64)
+	p.update(uint(received), uint(total), 0)
+	return true
+}
+
+func (p *fetchProgress) callback() git.TransferProgressCallback {
+	return func(stats git.TransferProgress) error {
+		p.update(stats.ReceivedObjects, stats.TotalObjects, stats.ReceivedBytes)
+		return nil
+	}
+}
+
+func (p *fetchProgress) update(received, total, bytes uint) {
+	p.receivedObjects = received
+	p.totalObjects = total
+	if bytes != 0 {
+		p.receivedBytes = bytes
+	}
+	if total == 0 {
+		return
+	}
+	// log every 10 percent, everything else would flood the logs for big repositories
+	percent := received * 100 / total
+	if percent/10 == p.lastPercent/10 {
+		return
+	}
+	p.lastPercent = percent
+	logger.FromContext(p.ctx).Info("git.fetch.progress",
+		zap.Uint("percent", percent),
+		zap.Uint("objects.received", received),
+		zap.Uint("objects.total", total),
+		zap.Uint("bytes.received", p.receivedBytes),
+	)
+	p.sendDatadogMetrics()
+}
+
+func (p *fetchProgress) done() {
+	logger.FromContext(p.ctx).Debug("git.fetch.done",
+		zap.Uint("objects.received", p.receivedObjects),
+		zap.Uint("bytes.received", p.receivedBytes),
+	)
+	p.sendDatadogMetrics()
+}
+
+func (p *fetchProgress) sendDatadogMetrics() {
+	if ddMetrics == nil {
+		return
+	}
+	ddMetrics.Gauge("git_fetch_received_objects", float64(p.receivedObjects), []string{}, 1)
+	ddMetrics.Gauge("git_fetch_total_objects", float64(p.totalObjects), []string{}, 1)
+	ddMetrics.Gauge("git_fetch_received_bytes", float64(p.receivedBytes), []string{}, 1)
+}
+
+// shallowCommits returns the commits whose parents were not fetched.
+func (r *repository) shallowCommits() (map[git.Oid]struct{}, error) {
+	result := map[git.Oid]struct{}{}
+	content, err := os.ReadFile(filepath.Join(r.repository.Path(), "shallow"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return result, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Fields(string(content)) {
+		oid, err := git.NewOid(line)
+		if err != nil {
+			return nil, fmt.Errorf("reading shallow file: %w", err)
+		}
+		result[*oid] = struct{}{}
+	}
+	return result, nil
+}
+
+// lookupCommitDeepening looks up a commit and deepens the history if the commit is older than the shallow history.
+func (r *repository) lookupCommitDeepening(oid *git.Oid) (*git.Commit, error) {
+	commit, err := r.repository.LookupCommit(oid)
+	if r.config.FetchDepth == 0 || !isNotFound(err) {
+		return commit, err
+	}
+	r.deepenLock.Lock()
+	defer r.deepenLock.Unlock()
+	// another request may have deepened the history while waiting for the lock
+	commit, err = r.repository.LookupCommit(oid)
+	if !isNotFound(err) {
+		return commit, err
+	}
+	now := time.Now()
+	if until, ok := r.unknownCommits[*oid]; ok && now.Before(until) {
+		return nil, err
+	}
+	// StateAt doesn't have a context, so this runs in the background of the request:
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.NetworkTimeout)
+	defer cancel()
+	deepenBy := r.config.FetchDepth
+	for i := 0; i < maxDeepenRounds; i++ {
+		if shallow, err := r.repository.IsShallow(); err != nil {
+			return nil, err
+		} else if !shallow {
+			// we already have the complete history
+			break
+		}
+		if err := r.shallowFetch(ctx, fmt.Sprintf("--deepen=%d", deepenBy)); err != nil {
+			return nil, err
+		}
+		commit, err = r.repository.LookupCommit(oid)
+		if !isNotFound(err) {
+			return commit, err
+		}
+		deepenBy *= 2
+	}
+	r.rememberUnknownCommit(oid, now)
+	return nil, err
+}
+
+// rememberUnknownCommit must be called with deepenLock held.
+func (r *repository) rememberUnknownCommit(oid *git.Oid, now time.Time) {
+	if r.unknownCommits == nil {
+		r.unknownCommits = map[git.Oid]time.Time{}
+	}
+	for o, until := range r.unknownCommits {
+		if now.After(until) {
+			delete(r.unknownCommits, o)
+		}
+	}
+	r.unknownCommits[*oid] = now.Add(unknownCommitTTL)
+}
+
+func isNotFound(err error) bool {
+	var gerr *git.GitError
+	return errors.As(err, &gerr) && gerr.Code == git.ErrNotFound
+}
@@ -0,0 +1,439 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package repository
+
+/**
+A snapshot contains the complete logical state of kuberpult: environments, releases, deployments and locks.
+It doesn't contain the git history, so it can be used to move kuberpult to a new manifest repo, or to recover from a broken one.
+Snapshots are written as indented json with sorted keys, so two snapshots can be compared with any diff tool.
+RestoreSnapshot replays a snapshot with the regular transformers, so the restored repository looks exactly like one that was created by kuberpult.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/pkg/auth"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// SnapshotFormatVersion is increased whenever the snapshot format changes incompatibly.
+const SnapshotFormatVersion = 1
+
+type Snapshot struct {
+	Version      int                            `json:"version"`
+	Environments map[string]SnapshotEnvironment `json:"environments"`
+	Applications map[string]SnapshotApplication `json:"applications"`
+}
+
+type SnapshotEnvironment struct {
+	Config config.EnvironmentConfig `json:"config"`
+	Locks  map[string]SnapshotLock  `json:"locks"`
+	// Applications contains all applications that are deployed or locked in this environment
+	Applications map[string]SnapshotDeployment `json:"applications"`
+}
+
+type SnapshotDeployment struct {
+	Version         *uint64                 `json:"version,omitempty"`
+	QueuedVersion   *uint64                 `json:"queuedVersion,omitempty"`
+	DeployedBy      string                  `json:"deployedBy,omitempty"`
+	DeployedByEmail string                  `json:"deployedByEmail,omitempty"`
+	DeployedAt      time.Time               `json:"deployedAt"`
+	Locks           map[string]SnapshotLock `json:"locks"`
+}
+
+type SnapshotApplication struct {
+	Team          string `json:"team,omitempty"`
+	SourceRepoUrl string `json:"sourceRepoUrl,omitempty"`
+	// Releases are sorted by version
+	Releases []SnapshotRelease `json:"releases"`
+}
+
+type SnapshotRelease struct {
+	Version        uint64    `json:"version"`
+	Undeploy       bool      `json:"undeploy,omitempty"`
+	SourceCommitId string    `json:"sourceCommitId,omitempty"`
+	SourceAuthor   string    `json:"sourceAuthor,omitempty"`
+	SourceMessage  string    `json:"sourceMessage,omitempty"`
+	DisplayVersion string    `json:"displayVersion,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	// Manifests maps environment names to manifests
+	Manifests       map[string]string                  `json:"manifests"`
+	ArgoCdOverrides *config.ArgoCdApplicationOverrides `json:"argocdOverrides,omitempty"`
+	Source          *config.ReleaseSource              `json:"source,omitempty"`
+}
+
+type SnapshotLock struct {
+	Message   string        `json:"message"`
+	CreatedBy SnapshotActor `json:"createdBy"`
+	CreatedAt time.Time     `json:"createdAt"`
+}
+
+type SnapshotActor struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Snapshot exports the complete logical state of the repository.
+func (s *State) Snapshot(ctx context.Context) (*Snapshot, error) {
+	result := &Snapshot{
+		Version:      SnapshotFormatVersion,
+		Environments: map[string]SnapshotEnvironment{},
+		Applications: map[string]SnapshotApplication{},
+	}
+	configs, err := s.GetEnvironmentConfigs()
+	if err != nil {
+		return nil, err
+	}
+	for envName, envConfig := range configs {
+		env, err := s.snapshotEnvironment(envName, envConfig)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot of environment %q: %w", envName, err)
+		}
+		result.Environments[envName] = *env
+	}
+	apps, err := s.GetApplications()
+	if err != nil {
+		return nil, err
+	}
+	for _, appName := range apps {
+		app, err := s.snapshotApplication(appName)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot of application %q: %w", appName, err)
+		}
+		result.Applications[appName] = *app
+	}
+	return result, nil
+}
+
+func (s *State) snapshotEnvironment(envName string, envConfig config.EnvironmentConfig) (*SnapshotEnvironment, error) {
+	locks, err := s.GetEnvironmentLocks(envName)
+	if err != nil {
+		return nil, err
+	}
+	env := &SnapshotEnvironment{
+		Config:       envConfig,
+		Locks:        snapshotLocks(locks),
+		Applications: map[string]SnapshotDeployment{},
+	}
+	apps, err := s.GetEnvironmentApplications(envName)
+	if err != nil {
+		return nil, err
+	}
+	for _, appName := range apps {
+		deployment := SnapshotDeployment{}
+		if deployment.Version, err = s.GetEnvironmentApplicationVersion(envName, appName); err != nil {
+			return nil, err
+		}
+		if deployment.QueuedVersion, err = s.GetQueuedVersion(envName, appName); err != nil {
+			return nil, err
+		}
+		if deployment.Version != nil {
+			if deployment.DeployedBy, deployment.DeployedAt, err = s.GetDeploymentMetaData(context.Background(), envName, appName); err != nil {
+				return nil, err
+			}
+			email, err := readFile(s.Filesystem, s.Filesystem.Join(environmentApplicationDirectory(s.Filesystem, envName, appName), "deployed_by_email"))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			deployment.DeployedByEmail = string(email)
+		}
+		appLocks, err := s.GetEnvironmentApplicationLocks(envName, appName)
+		if err != nil {
+			return nil, err
+		}
+		deployment.Locks = snapshotLocks(appLocks)
+		env.Applications[appName] = deployment
+	}
+	return env, nil
+}
+
+func (s *State) snapshotApplication(appName string) (*SnapshotApplication, error) {
+	app := &SnapshotApplication{
+		Releases: []SnapshotRelease{},
+	}
+	var err error
+	if app.Team, err = s.GetApplicationTeamOwner(appName); err != nil {
+		return nil, err
+	}
+	if app.SourceRepoUrl, err = s.GetApplicationSourceRepoUrl(appName); err != nil {
+		return nil, err
+	}
+	versions, err := s.GetApplicationReleases(appName)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		release, err := s.GetApplicationRelease(appName, version)
+		if err != nil {
+			return nil, err
+		}
+		manifests, err := s.ReleaseManifests(appName, version)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if manifests == nil {
+			manifests = map[string]string{}
+		}
+		overrides, err := s.GetApplicationReleaseArgoCdOverrides(appName, version)
+		if err != nil {
+			return nil, err
+		}
+		source, err := s.GetApplicationReleaseSource(appName, version)
+		if err != nil {
+			return nil, err
+		}
+		app.Releases = append(app.Releases, SnapshotRelease{
+			Version:         version,
+			Undeploy:        release.UndeployVersion,
+			SourceCommitId:  release.SourceCommitId,
+			SourceAuthor:    release.SourceAuthor,
+			SourceMessage:   release.SourceMessage,
+			DisplayVersion:  release.DisplayVersion,
+			CreatedAt:       release.CreatedAt,
+			Manifests:       manifests,
+			ArgoCdOverrides: overrides,
+			Source:          source,
+		})
+	}
+	return app, nil
+}
+
+func snapshotLocks(locks map[string]Lock) map[string]SnapshotLock {
+	result := make(map[string]SnapshotLock, len(locks))
+	for id, lock := range locks {
+		result[id] = SnapshotLock{
+			Message:   lock.Message,
+			CreatedBy: SnapshotActor(lock.CreatedBy),
+			CreatedAt: lock.CreatedAt,
+		}
+	}
+	return result
+}
+
+// RestoreSnapshot replays a snapshot into an empty repository.
+// The original authors and timestamps of deployments and locks are kept.
+type RestoreSnapshot struct {
+	Authentication
+	Snapshot *Snapshot
+}
+
+func (c *RestoreSnapshot) Transform(ctx context.Context, state *State) (string, *TransformerResult, error) {
+	if err := state.checkUserPermissionsEnvGroup(ctx, "*", "*", auth.PermissionRestoreSnapshot, "", c.RBACConfig); err != nil {
+		return "", nil, err
+	}
+	if c.Snapshot.Version != SnapshotFormatVersion {
+		return "", nil, fmt.Errorf("unsupported snapshot version %d, expected %d", c.Snapshot.Version, SnapshotFormatVersion)
+	}
+	if envs, err := state.GetEnvironmentConfigs(); err != nil {
+		return "", nil, err
+	} else if len(envs) > 0 && !state.BootstrapMode {
+		return "", nil, fmt.Errorf("snapshots can only be restored into an empty repository, but it contains %d environments", len(envs))
+	}
+	if apps, err := state.GetApplications(); err != nil {
+		return "", nil, err
+	} else if len(apps) > 0 {
+		return "", nil, fmt.Errorf("snapshots can only be restored into an empty repository, but it contains %d applications", len(apps))
+	}
+	changes := &TransformerResult{}
+	for _, step := range c.steps(ctx, state.BootstrapMode) {
+		_, subChanges, err := step.transformer.Transform(step.ctx, state)
+		if err != nil {
+			return "", nil, err
+		}
+		changes.Combine(subChanges)
+	}
+	return fmt.Sprintf("restored snapshot with %d environments and %d applications", len(c.Snapshot.Environments), len(c.Snapshot.Applications)), changes, nil
+}
+
+type restoreStep struct {
+	ctx         context.Context
+	transformer Transformer
+}
+
+// steps returns the transformers in the order in which they have to be applied:
+// Releases are created before the environments, so that nothing is deployed automatically.
+// Deployments are applied from the oldest to the newest version, so that the cleanup never removes a release that is deployed later.
+// Queued versions come after the deployments, because a deployment removes the queued version.
+// Locks come last, because they would block the deployments.
+func (c *RestoreSnapshot) steps(ctx context.Context, bootstrapMode bool) []restoreStep {
+	steps := []restoreStep{}
+	for _, appName := range sortedKeys(c.Snapshot.Applications) {
+		app := c.Snapshot.Applications[appName]
+		for _, release := range app.Releases {
+			steps = append(steps, restoreStep{
+				ctx: withRestoredTime(ctx, release.CreatedAt),
+				transformer: &CreateApplicationVersion{
+					Version:         release.Version,
+					Application:     appName,
+					Manifests:       release.Manifests,
+					SourceCommitId:  release.SourceCommitId,
+					SourceAuthor:    release.SourceAuthor,
+					SourceMessage:   release.SourceMessage,
+					SourceRepoUrl:   app.SourceRepoUrl,
+					Team:            app.Team,
+					DisplayVersion:  release.DisplayVersion,
+					ArgoCdOverrides: release.ArgoCdOverrides,
+					Source:          release.Source,
+				},
+			})
+			if release.Undeploy {
+				steps = append(steps, restoreStep{
+					ctx:         ctx,
+					transformer: markUndeployVersion(appName, release.Version),
+				})
+			}
+		}
+	}
+	type deployment struct {
+		env, app string
+		SnapshotDeployment
+	}
+	deployments := []deployment{}
+	for _, envName := range sortedKeys(c.Snapshot.Environments) {
+		env := c.Snapshot.Environments[envName]
+		envConfig := env.Config
+		if bootstrapMode {
+			// the configuration is taken from the config map in bootstrap mode
+			envConfig = config.EnvironmentConfig{}
+		}
+		steps = append(steps, restoreStep{
+			ctx: ctx,
+			transformer: &CreateEnvironment{
+				Environment: envName,
+				Config:      envConfig,
+			},
+		})
+		for _, appName := range sortedKeys(env.Applications) {
+			deployments = append(deployments, deployment{envName, appName, env.Applications[appName]})
+		}
+	}
+	sort.SliceStable(deployments, func(i, j int) bool {
+		return deploymentOrder(deployments[i].Version) < deploymentOrder(deployments[j].Version)
+	})
+	for _, d := range deployments {
+		if d.Version == nil {
+			continue
+		}
+		steps = append(steps, restoreStep{
+			ctx: withRestoredActor(ctx, d.DeployedBy, d.DeployedByEmail, d.DeployedAt),
+			transformer: &DeployApplicationVersion{
+				Environment:   d.env,
+				Application:   d.app,
+				Version:       *d.Version,
+				LockBehaviour: api.LockBehavior_Ignore,
+			},
+		})
+	}
+	for _, d := range deployments {
+		if d.QueuedVersion == nil {
+			continue
+		}
+		steps = append(steps, restoreStep{
+			ctx: ctx,
+			transformer: &QueueApplicationVersion{
+				Environment: d.env,
+				Application: d.app,
+				Version:     *d.QueuedVersion,
+			},
+		})
+	}
+	for _, envName := range sortedKeys(c.Snapshot.Environments) {
+		env := c.Snapshot.Environments[envName]
+		for _, lockId := range sortedKeys(env.Locks) {
+			lock := env.Locks[lockId]
+			steps = append(steps, restoreStep{
+				ctx: withRestoredActor(ctx, lock.CreatedBy.Name, lock.CreatedBy.Email, lock.CreatedAt),
+				transformer: &CreateEnvironmentLock{
+					Environment: envName,
+					LockId:      lockId,
+					Message:     lock.Message,
+				},
+			})
+		}
+	}
+	for _, d := range deployments {
+		for _, lockId := range sortedKeys(d.Locks) {
+			lock := d.Locks[lockId]
+			steps = append(steps, restoreStep{
+				ctx: withRestoredActor(ctx, lock.CreatedBy.Name, lock.CreatedBy.Email, lock.CreatedAt),
+				transformer: &CreateEnvironmentApplicationLock{
+					Environment: d.env,
+					Application: d.app,
+					LockId:      lockId,
+					Message:     lock.Message,
+				},
+			})
+		}
+	}
+	return steps
+}
+
+// markUndeployVersion turns a release into an undeploy version.
+// CreateUndeployApplicationVersion can't be used for this, because it always creates a new version.
+func markUndeployVersion(application string, version uint64) Transformer {
+	return TransformerFunc(func(ctx context.Context, state *State) (string, *TransformerResult, error) {
+		fs := state.Filesystem
+		marker := fs.Join(releasesDirectoryWithVersion(fs, application, version), "undeploy")
+		if err := util.WriteFile(fs, marker, []byte(""), 0666); err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("marked version %d of %q as undeploy version", version, application), &TransformerResult{}, nil
+	})
+}
+
+func deploymentOrder(version *uint64) uint64 {
+	if version == nil {
+		return 0
+	}
+	return *version
+}
+
+// withRestoredTime replaces the time of the context. Zero times (e.g. metadata that didn't exist in old versions of kuberpult) are ignored.
+func withRestoredTime(ctx context.Context, t time.Time) context.Context {
+	if t.IsZero() {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxMarkerKey, t)
+}
+
+// withRestoredActor replaces the user and time of the context. The user of the context is kept if the name is unknown.
+func withRestoredActor(ctx context.Context, name, email string, t time.Time) context.Context {
+	if strings.TrimSpace(name) != "" {
+		ctx = auth.WriteUserToContext(ctx, auth.User{
+			Name:  name,
+			Email: email,
+		})
+	}
+	return withRestoredTime(ctx, t)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
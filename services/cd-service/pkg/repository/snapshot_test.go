@@ -0,0 +1,179 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package repository
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/pkg/auth"
+	"github.com/freiheit-com/kuberpult/pkg/testutil"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx := testutil.MakeTestContext()
+	alice := auth.WriteUserToContext(ctx, auth.User{Name: "alice", Email: "alice@example.com"})
+	bob := auth.WriteUserToContext(ctx, auth.User{Name: "bob", Email: "bob@example.com"})
+	group := "prod-group"
+	steps := []struct {
+		User         string
+		Transformers []Transformer
+	}{
+		{
+			Transformers: []Transformer{
+				&CreateEnvironment{
+					Environment: "development",
+					Config:      config.EnvironmentConfig{Upstream: &config.EnvironmentConfigUpstream{Latest: true}},
+				},
+				&CreateEnvironment{
+					Environment: "production",
+					Config: config.EnvironmentConfig{
+						Upstream:         &config.EnvironmentConfigUpstream{Environment: "development"},
+						EnvironmentGroup: &group,
+					},
+				},
+				&CreateApplicationVersion{
+					Application: "foo",
+					Manifests: map[string]string{
+						"development": "foo dev 1",
+						"production":  "foo prod 1",
+					},
+					SourceCommitId: "cafe",
+					SourceAuthor:   "someone",
+					SourceMessage:  "first release",
+					SourceRepoUrl:  "https://example.com/foo",
+					Team:           "team-a",
+					DisplayVersion: "1.0",
+					ArgoCdOverrides: &config.ArgoCdApplicationOverrides{
+						SyncOptions: []string{"ServerSideApply=true"},
+					},
+				},
+				&CreateApplicationVersion{
+					Application: "bar",
+					Manifests: map[string]string{
+						"development": "bar dev 1",
+					},
+				},
+				&CreateUndeployApplicationVersion{
+					Application: "bar",
+				},
+			},
+		},
+		{
+			User: "alice",
+			Transformers: []Transformer{
+				&DeployApplicationVersion{
+					Environment:   "production",
+					Application:   "foo",
+					Version:       1,
+					LockBehaviour: api.LockBehavior_Fail,
+				},
+			},
+		},
+		{
+			User: "bob",
+			Transformers: []Transformer{
+				&CreateApplicationVersion{
+					Application: "foo",
+					Manifests: map[string]string{
+						"development": "foo dev 2",
+						"production":  "foo prod 2",
+					},
+				},
+				&CreateEnvironmentLock{
+					Environment: "production",
+					LockId:      "maintenance",
+					Message:     "database migration",
+				},
+				&DeployApplicationVersion{
+					Environment:   "production",
+					Application:   "foo",
+					Version:       2,
+					LockBehaviour: api.LockBehavior_Record,
+				},
+				&CreateEnvironmentApplicationLock{
+					Environment: "development",
+					Application: "foo",
+					LockId:      "broken",
+					Message:     "don't touch",
+				},
+			},
+		},
+	}
+	repo := setupRepositoryTest(t)
+	for _, step := range steps {
+		stepCtx := ctx
+		switch step.User {
+		case "alice":
+			stepCtx = alice
+		case "bob":
+			stepCtx = bob
+		}
+		if err := repo.Apply(stepCtx, step.Transformers...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := repo.State().Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected.Environments["production"].Applications["foo"].QueuedVersion == nil {
+		t.Fatal("expected a queued version in production")
+	}
+	if !expected.Applications["bar"].Releases[1].Undeploy {
+		t.Fatal("expected the second release of bar to be an undeploy version")
+	}
+
+	// the snapshot has to survive the serialization:
+	buf, err := json.MarshalIndent(expected, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Snapshot
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := setupRepositoryTest(t)
+	if err := restored.Apply(ctx, &RestoreSnapshot{Snapshot: &decoded}); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := restored.State().Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(expected, actual); d != "" {
+		t.Errorf("restored snapshot differs:\n%s", d)
+	}
+
+	// restoring into a repository that is not empty must fail:
+	err = restored.Apply(ctx, &RestoreSnapshot{Snapshot: &decoded})
+	if err == nil {
+		t.Errorf("expected an error when restoring into a non-empty repository")
+	}
+}
+
+func TestRestoreSnapshotVersion(t *testing.T) {
+	repo := setupRepositoryTest(t)
+	err := repo.Apply(testutil.MakeTestContext(), &RestoreSnapshot{Snapshot: &Snapshot{Version: SnapshotFormatVersion + 1}})
+	if err == nil {
+		t.Errorf("expected an error for an unsupported snapshot version")
+	}
+}
@@ -56,3 +56,6 @@ func (fr *failingRepository) StateAt(oid *git.Oid) (*repository.State, error) {
 func (fr *failingRepository) Notify() *notify.Notify {
 	return &fr.notify
 }
+
+func (fr *failingRepository) Fetch() {
+}
@@ -171,6 +171,10 @@ type CreateApplicationVersion struct {
 	SourceRepoUrl  string
 	Team           string
 	DisplayVersion string
+	// ArgoCdOverrides are merged on top of the argocd config of the environments this release is deployed to
+	ArgoCdOverrides *config.ArgoCdApplicationOverrides
+	// Source is set for helm and kustomize releases. The manifests are then the values or the kustomization.yaml per environment.
+	Source *config.ReleaseSource
 }
 
 func GetLastRelease(fs billy.Filesystem, application string) (uint64, error) {
@@ -206,6 +210,16 @@ func (c *CreateApplicationVersion) Transform(ctx context.Context, state *State)
 	if !valid.ApplicationName(c.Application) {
 		return "", nil, grpc.PublicError(ctx, fmt.Errorf("invalid application name: '%s' - must match regexp '%s' and <= %d characters", c.Application, valid.AppNameRegExp, valid.MaxAppNameLen))
 	}
+	if c.ArgoCdOverrides != nil {
+		if err := c.ArgoCdOverrides.Validate(); err != nil {
+			return "", nil, grpc.PublicError(ctx, fmt.Errorf("invalid argocd overrides: %w", err))
+		}
+	}
+	if c.Source != nil {
+		if err := c.Source.Validate(); err != nil {
+			return "", nil, grpc.PublicError(ctx, fmt.Errorf("invalid source: %w", err))
+		}
+	}
 	releaseDir := releasesDirectoryWithVersion(fs, c.Application, version)
 	appDir := applicationDirectory(fs, c.Application)
 	if err = fs.MkdirAll(releaseDir, 0777); err != nil {
@@ -240,6 +254,24 @@ func (c *CreateApplicationVersion) Transform(ctx context.Context, state *State)
 	if err := util.WriteFile(fs, fs.Join(releaseDir, "created_at"), []byte(getTimeNow(ctx).Format(time.RFC3339)), 0666); err != nil {
 		return "", nil, err
 	}
+	if !c.ArgoCdOverrides.IsEmpty() {
+		content, err := json.MarshalIndent(c.ArgoCdOverrides, "", "  ")
+		if err != nil {
+			return "", nil, fmt.Errorf("error writing json: %w", err)
+		}
+		if err := util.WriteFile(fs, fs.Join(releaseDir, "argocd.json"), content, 0666); err != nil {
+			return "", nil, err
+		}
+	}
+	if c.Source != nil {
+		content, err := json.MarshalIndent(c.Source, "", "  ")
+		if err != nil {
+			return "", nil, fmt.Errorf("error writing json: %w", err)
+		}
+		if err := util.WriteFile(fs, fs.Join(releaseDir, "source.json"), content, 0666); err != nil {
+			return "", nil, err
+		}
+	}
 	if c.Team != "" {
 		if err := util.WriteFile(fs, fs.Join(appDir, "team"), []byte(c.Team), 0666); err != nil {
 			return "", nil, err
@@ -281,6 +313,9 @@ func (c *CreateApplicationVersion) Transform(ctx context.Context, state *State)
 		if found {
 			hasUpstream = config.Upstream != nil
 		}
+		if found && config.ArgoCd != nil && c.Source != nil && c.Source.Helm != nil && !config.ArgoCd.AllowsSourceRepo(c.Source.Helm.RepoURL) {
+			return "", nil, grpc.PublicError(ctx, fmt.Errorf("helm repository %q is not in the sourceRepos of environment %q", c.Source.Helm.RepoURL, env))
+		}
 
 		if err = fs.MkdirAll(envDir, 0777); err != nil {
 			return "", nil, err
@@ -961,6 +996,21 @@ func (c *CreateEnvironment) Transform(ctx context.Context, state *State) (string
 	if state.BootstrapMode && c.Config != (config.EnvironmentConfig{}) {
 		return "", nil, fmt.Errorf("Cannot create or update configuration in bootstrap mode. Please update configuration in config map instead.")
 	}
+	if c.Config.Upstream != nil {
+		if err := c.Config.Upstream.Validate(); err != nil {
+			return "", nil, grpc.PublicError(ctx, fmt.Errorf("invalid upstream config for environment %q: %w", c.Environment, err))
+		}
+	}
+	if c.Config.ArgoCd != nil {
+		if err := c.Config.ArgoCd.Validate(); err != nil {
+			return "", nil, grpc.PublicError(ctx, fmt.Errorf("invalid argocd config for environment %q: %w", c.Environment, err))
+		}
+	}
+	if c.Config.Flux != nil {
+		if err := c.Config.Flux.Validate(); err != nil {
+			return "", nil, grpc.PublicError(ctx, fmt.Errorf("invalid flux config for environment %q: %w", c.Environment, err))
+		}
+	}
 	if err := fs.MkdirAll(envDir, 0777); err != nil {
 		return "", nil, err
 	} else {
@@ -1086,7 +1136,20 @@ func (c *DeployApplicationVersion) Transform(ctx context.Context, state *State)
 		return "", nil, err
 	}
 	changes := &TransformerResult{}
-	manifestFilename := fs.Join(manifestsDir, "manifests.yaml")
+	source, err := state.GetApplicationReleaseSource(c.Application, c.Version)
+	if err != nil {
+		return "", nil, err
+	}
+	// argocd and flux decide by the files in the directory how to render it, so the file of the previous release must go
+	for _, name := range []string{config.PlainManifestsFileName, config.HelmValuesFileName, config.KustomizationFileName} {
+		if name == source.ManifestsFileName() {
+			continue
+		}
+		if err := fs.Remove(fs.Join(manifestsDir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", nil, err
+		}
+	}
+	manifestFilename := fs.Join(manifestsDir, source.ManifestsFileName())
 	// note that the manifest is empty here!
 	// but actually it's not quite empty!
 	// The function we are using here is `util.WriteFile`. And that does not allow overwriting files with empty content.
@@ -1141,6 +1204,13 @@ type ReleaseTrain struct {
 	Authentication
 	Target string
 	Team   string
+	// UpstreamHealth is needed for environments with a health gate. Without it, gated applications are never promoted.
+	UpstreamHealth UpstreamHealth
+}
+
+// UpstreamHealth reports since when a version of an application is healthy and synced in an environment.
+type UpstreamHealth interface {
+	HealthySince(environment, application string, version uint64) (time.Time, bool)
 }
 
 func getEnvironmentGroupsEnvironmentsOrEnvironment(configs map[string]config.EnvironmentConfig, targetGroupName string) map[string]config.EnvironmentConfig {
@@ -1189,6 +1259,20 @@ func generateReleaseTrainResponse(envDeployedMsg, envSkippedMsg map[string]strin
 	return resp
 }
 
+// upstreamHealthy returns true if the version has been healthy and synced in the upstream environment for the soak time of the gate
+func (c *ReleaseTrain) upstreamHealthy(ctx context.Context, gate *config.EnvironmentConfigHealthGate, upstreamEnvName, appName string, version uint64) bool {
+	if c.UpstreamHealth == nil {
+		// without the rollout status, we can't tell whether the version is healthy
+		return false
+	}
+	soakTime, err := gate.SoakDuration()
+	if err != nil {
+		return false
+	}
+	since, ok := c.UpstreamHealth.HealthySince(upstreamEnvName, appName, version)
+	return ok && !getTimeNow(ctx).Before(since.Add(soakTime))
+}
+
 func (c *ReleaseTrain) Transform(ctx context.Context, state *State) (string, *TransformerResult, error) {
 	var targetGroupName = c.Target
 
@@ -1305,6 +1389,10 @@ func (c *ReleaseTrain) Transform(ctx context.Context, state *State) (string, *Tr
 				envSkippedMsg[envName] += fmt.Sprintf("%sskipping %q because it is already in the version %d\n", completeMessage, appName, *currentlyDeployedVersion)
 				continue
 			}
+			if gate := envConfig.Upstream.HealthGate; gate != nil && !upstreamLatest && !c.upstreamHealthy(ctx, gate, upstreamEnvName, appName, versionToDeploy) {
+				envSkippedMsg[envName] += fmt.Sprintf("skipped %q: upstream unhealthy, version %d was not healthy and synced in %q for %q\n", appName, versionToDeploy, upstreamEnvName, gate.SoakTime)
+				continue
+			}
 
 			d := &DeployApplicationVersion{
 				Environment:    envName, // here we deploy to the next env
@@ -436,7 +436,7 @@ spec:
   destinations:
   - {}
   sourceRepos:
-  - '*'
+  - %%%REPO%%%
 ---
 apiVersion: argoproj.io/v1alpha1
 kind: Application
@@ -476,7 +476,7 @@ spec:
   destinations:
   - {}
   sourceRepos:
-  - '*'
+  - %%%REPO%%%
 ---
 apiVersion: argoproj.io/v1alpha1
 kind: Application
@@ -538,7 +538,7 @@ spec:
   destinations:
   - {}
   sourceRepos:
-  - '*'
+  - %%%REPO%%%
 ---
 apiVersion: argoproj.io/v1alpha1
 kind: Application
@@ -579,9 +579,255 @@ spec:
   destinations:
   - {}
   sourceRepos:
+  - %%%REPO%%%
+`),
+				},
+			},
+		},
+		{
+			Name: "applies the argocd overrides of the deployed release",
+			Transformers: []Transformer{
+				&CreateEnvironment{
+					Environment: envAcceptance,
+					Config:      testutil.MakeEnvConfigLatest(&config.EnvironmentConfigArgoCd{}),
+				},
+				&CreateApplicationVersion{
+					Application: "app1",
+					Manifests: map[string]string{
+						envAcceptance: "acc1",
+					},
+					ArgoCdOverrides: &config.ArgoCdApplicationOverrides{
+						Labels:               map[string]string{"tier": "backend"},
+						SyncOptions:          []string{"ServerSideApply=true"},
+						DestinationNamespace: ptr.FromString("app1"),
+					},
+				},
+			},
+			Expected: []Expected{
+				{
+					Path: "argocd/v1alpha1/acceptance.yaml",
+					fileData: ptr.FromString(`apiVersion: argoproj.io/v1alpha1
+kind: AppProject
+metadata:
+  name: acceptance
+spec:
+  description: acceptance
+  destinations:
+  - {}
+  sourceRepos:
+  - %%%REPO%%%
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  annotations:
+    argocd.argoproj.io/manifest-generate-paths: /environments/acceptance/applications/app1/manifests
+    com.freiheit.kuberpult/application: app1
+    com.freiheit.kuberpult/environment: acceptance
+    com.freiheit.kuberpult/team: ""
+  finalizers:
+  - resources-finalizer.argocd.argoproj.io
+  labels:
+    com.freiheit.kuberpult/team: ""
+    tier: backend
+  name: acceptance-app1
+spec:
+  destination:
+    namespace: app1
+  project: acceptance
+  source:
+    path: environments/acceptance/applications/app1/manifests
+    repoURL: %%%REPO%%%
+    targetRevision: master
+  syncPolicy:
+    automated:
+      allowEmpty: true
+      prune: true
+      selfHeal: true
+    syncOptions:
+    - ServerSideApply=true
+`),
+				},
+			},
+		},
+		{
+			Name: "renders the helm source of the deployed release",
+			Transformers: []Transformer{
+				&CreateEnvironment{
+					Environment: envAcceptance,
+					Config: testutil.MakeEnvConfigLatest(&config.EnvironmentConfigArgoCd{
+						SourceRepos: []string{"https://charts.example.com", "*"},
+					}),
+				},
+				&CreateApplicationVersion{
+					Application: "app1",
+					Manifests: map[string]string{
+						envAcceptance: "replicas: 2",
+					},
+					Source: &config.ReleaseSource{
+						Helm: &config.HelmSource{
+							RepoURL: "https://charts.example.com",
+							Chart:   "app1",
+							Version: "1.0.0",
+						},
+					},
+				},
+			},
+			Expected: []Expected{
+				{
+					Path:     "environments/acceptance/applications/app1/manifests/values.yaml",
+					fileData: ptr.FromString("replicas: 2"),
+				},
+				{
+					Path:     "environments/acceptance/applications/app1/manifests/manifests.yaml",
+					fileData: nil,
+				},
+				{
+					Path: "argocd/v1alpha1/acceptance.yaml",
+					fileData: ptr.FromString(`apiVersion: argoproj.io/v1alpha1
+kind: AppProject
+metadata:
+  name: acceptance
+spec:
+  description: acceptance
+  destinations:
+  - {}
+  sourceRepos:
+  - https://charts.example.com
   - '*'
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  annotations:
+    argocd.argoproj.io/manifest-generate-paths: /environments/acceptance/applications/app1/manifests
+    com.freiheit.kuberpult/application: app1
+    com.freiheit.kuberpult/environment: acceptance
+    com.freiheit.kuberpult/team: ""
+  finalizers:
+  - resources-finalizer.argocd.argoproj.io
+  labels:
+    com.freiheit.kuberpult/team: ""
+  name: acceptance-app1
+spec:
+  destination: {}
+  project: acceptance
+  sources:
+  - chart: app1
+    helm:
+      releaseName: app1
+      valueFiles:
+      - $values/environments/acceptance/applications/app1/manifests/values.yaml
+    repoURL: https://charts.example.com
+    targetRevision: 1.0.0
+  - ref: values
+    repoURL: %%%REPO%%%
+    targetRevision: master
+  syncPolicy:
+    automated:
+      allowEmpty: true
+      prune: true
+      selfHeal: true
+`),
+				},
+			},
+		},
+		{
+			Name: "removes the kustomization of the previous release",
+			Transformers: []Transformer{
+				&CreateEnvironment{
+					Environment: envAcceptance,
+					Config:      testutil.MakeEnvConfigLatest(&config.EnvironmentConfigArgoCd{}),
+				},
+				&CreateApplicationVersion{
+					Application: "app1",
+					Manifests: map[string]string{
+						envAcceptance: "resources: [deployment.yaml]",
+					},
+					Source: &config.ReleaseSource{Kustomize: &config.KustomizeSource{}},
+				},
+				&CreateApplicationVersion{
+					Application: "app1",
+					Manifests: map[string]string{
+						envAcceptance: "acc2",
+					},
+				},
+			},
+			Expected: []Expected{
+				{
+					Path:     "environments/acceptance/applications/app1/manifests/kustomization.yaml",
+					fileData: nil,
+				},
+				{
+					Path:     "environments/acceptance/applications/app1/manifests/manifests.yaml",
+					fileData: ptr.FromString("acc2"),
+				},
+			},
+		},
+		{
+			Name: "generates flux resources",
+			Transformers: []Transformer{
+				&CreateEnvironment{
+					Environment: envAcceptance,
+					Config: config.EnvironmentConfig{
+						Upstream: &config.EnvironmentConfigUpstream{Latest: true},
+						Flux:     &config.EnvironmentConfigFlux{TargetNamespace: envAcceptance},
+					},
+				},
+				&CreateApplicationVersion{
+					Application: "app1",
+					Manifests: map[string]string{
+						envAcceptance: "acc1",
+					},
+				},
+			},
+			Expected: []Expected{
+				{
+					Path: "flux/v1/acceptance.yaml",
+					fileData: ptr.FromString(`apiVersion: source.toolkit.fluxcd.io/v1
+kind: GitRepository
+metadata:
+  annotations:
+    com.freiheit.kuberpult/environment: acceptance
+  name: acceptance
+  namespace: flux-system
+spec:
+  ignore: |-
+    /*
+    !/environments
+    /environments/*
+    !/environments/acceptance
+  interval: 1m
+  ref:
+    branch: master
+  url: %%%REPO%%%
+---
+apiVersion: kustomize.toolkit.fluxcd.io/v1
+kind: Kustomization
+metadata:
+  annotations:
+    com.freiheit.kuberpult/application: app1
+    com.freiheit.kuberpult/environment: acceptance
+    com.freiheit.kuberpult/team: ""
+  labels:
+    com.freiheit.kuberpult/team: ""
+  name: acceptance-app1
+  namespace: flux-system
+spec:
+  interval: 1m
+  path: ./environments/acceptance/applications/app1/manifests
+  prune: true
+  sourceRef:
+    kind: GitRepository
+    name: acceptance
+  targetNamespace: acceptance
 `),
 				},
+				{
+					// no argocd config, no argocd resources:
+					Path:     "argocd/v1alpha1/acceptance.yaml",
+					fileData: nil,
+				},
 			},
 		},
 	}
@@ -1179,6 +1425,101 @@ Environment "acceptance-de" has both upstream.latest and upstream.environment co
 	}
 }
 
+// fakeUpstreamHealth maps "<env>/<app>/<version>" to the time since when the version is healthy
+type fakeUpstreamHealth map[string]time.Time
+
+func (f fakeUpstreamHealth) HealthySince(environment, application string, version uint64) (time.Time, bool) {
+	since, ok := f[fmt.Sprintf("%s/%s/%d", environment, application, version)]
+	return since, ok
+}
+
+func TestReleaseTrainHealthGate(t *testing.T) {
+	setup := []Transformer{
+		&CreateEnvironment{
+			Environment: envAcceptance,
+			Config:      testutil.MakeEnvConfigLatest(nil),
+		},
+		&CreateEnvironment{
+			Environment: envProduction,
+			Config: config.EnvironmentConfig{
+				Upstream: &config.EnvironmentConfigUpstream{
+					Environment: envAcceptance,
+					HealthGate:  &config.EnvironmentConfigHealthGate{SoakTime: "10m"},
+				},
+			},
+		},
+		&CreateApplicationVersion{
+			Application: "bar",
+			Manifests: map[string]string{
+				envProduction: envProduction,
+				envAcceptance: envAcceptance,
+			},
+		},
+		&CreateApplicationVersion{
+			Application: "foo",
+			Manifests: map[string]string{
+				envProduction: envProduction,
+				envAcceptance: envAcceptance,
+			},
+		},
+	}
+	tcs := []struct {
+		Name            string
+		UpstreamHealth  UpstreamHealth
+		ExpectedChanges []AppEnv
+		ExpectedSkipped []string
+	}{
+		{
+			Name: "promotes only versions that are healthy for the soak time",
+			UpstreamHealth: fakeUpstreamHealth{
+				"acceptance/foo/1": timeNowOld.Add(-time.Hour),
+				"acceptance/bar/1": timeNowOld.Add(-5 * time.Minute),
+			},
+			ExpectedChanges: []AppEnv{{App: "foo", Env: envProduction}},
+			ExpectedSkipped: []string{"bar"},
+		},
+		{
+			Name: "doesn't promote other versions",
+			UpstreamHealth: fakeUpstreamHealth{
+				"acceptance/foo/2": timeNowOld.Add(-time.Hour),
+				"acceptance/bar/2": timeNowOld.Add(-time.Hour),
+			},
+			ExpectedSkipped: []string{"bar", "foo"},
+		},
+		{
+			Name:            "doesn't promote anything without health information",
+			UpstreamHealth:  nil,
+			ExpectedSkipped: []string{"bar", "foo"},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctxWithTime := withTimeNow(testutil.MakeTestContext(), timeNowOld)
+			repo := setupRepositoryTest(t)
+			transformers := append(append([]Transformer{}, setup...), &ReleaseTrain{
+				Target:         envProduction,
+				UpstreamHealth: tc.UpstreamHealth,
+			})
+			commitMsg, _, changes, err := repo.ApplyTransformersInternal(ctxWithTime, transformers...)
+			if err != nil {
+				t.Fatalf("Expected no error: %v", err)
+			}
+			trainChanges := changes[len(changes)-1]
+			if diff := cmp.Diff(tc.ExpectedChanges, trainChanges.ChangedApps); diff != "" {
+				t.Errorf("unexpected changes (-want +got):\n%s", diff)
+			}
+			trainMsg := commitMsg[len(commitMsg)-1]
+			for _, app := range tc.ExpectedSkipped {
+				if !strings.Contains(trainMsg, fmt.Sprintf("skipped %q: upstream unhealthy", app)) {
+					t.Errorf("expected %q to be skipped, got:\n%s", app, trainMsg)
+				}
+			}
+		})
+	}
+}
+
 func TestTransformerChanges(t *testing.T) {
 	tcs := []struct {
 		Name              string
@@ -2693,6 +3034,139 @@ func TestTransformer(t *testing.T) {
 					t.Errorf("expected %q, got %q", ErrReleaseAlreadyExist, err)
 				}
 			},
+		}, {
+			Name: "Create environment with invalid sync policy",
+			Transformers: []Transformer{
+				&CreateEnvironment{
+					Environment: "production",
+					Config: config.EnvironmentConfig{
+						ArgoCd: &config.EnvironmentConfigArgoCd{
+							ApplicationSyncPolicies: map[string]config.ArgoCdSyncPolicy{
+								"migrations": {Finalizer: ptr.FromString("always")},
+							},
+						},
+					},
+				},
+			},
+			ErrorTest: func(t *testing.T, err error) {
+				if err == nil || !strings.Contains(err.Error(), `applicationSyncPolicies["migrations"]: invalid finalizer "always"`) {
+					t.Errorf("expected an invalid finalizer error, got %q", err)
+				}
+			},
+		}, {
+			Name: "Create release with reserved argocd annotation",
+			Transformers: []Transformer{
+				&CreateApplicationVersion{
+					Application: "app1",
+					Manifests: map[string]string{
+						"production": "manifest",
+					},
+					ArgoCdOverrides: &config.ArgoCdApplicationOverrides{
+						Annotations: map[string]string{"com.freiheit.kuberpult/team": "someone-else"},
+					},
+				},
+			},
+			ErrorTest: func(t *testing.T, err error) {
+				if err == nil || !strings.Contains(err.Error(), `annotation "com.freiheit.kuberpult/team" is reserved for kuberpult`) {
+					t.Errorf("expected a reserved annotation error, got %q", err)
+				}
+			},
+		}, {
+			Name: "Create environment with duplicate destinations",
+			Transformers: []Transformer{
+				&CreateEnvironment{
+					Environment: "production",
+					Config: config.EnvironmentConfig{
+						ArgoCd: &config.EnvironmentConfigArgoCd{
+							Destinations: []config.ArgoCdDestination{
+								{Id: "eu", Name: "cluster-eu-1"},
+								{Id: "eu", Name: "cluster-eu-2"},
+							},
+						},
+					},
+				},
+			},
+			ErrorTest: func(t *testing.T, err error) {
+				if err == nil || !strings.Contains(err.Error(), `destinations[1]: duplicate id "eu"`) {
+					t.Errorf("expected a duplicate destination error, got %q", err)
+				}
+			},
+		}, {
+			Name: "Create release with an incomplete helm source",
+			Transformers: []Transformer{
+				&CreateApplicationVersion{
+					Application: "app1",
+					Manifests:   map[string]string{"production": "replicas: 1"},
+					Source:      &config.ReleaseSource{Helm: &config.HelmSource{Chart: "app1"}},
+				},
+			},
+			ErrorTest: func(t *testing.T, err error) {
+				if err == nil || !strings.Contains(err.Error(), "helm: repoURL, chart and version must not be empty") {
+					t.Errorf("expected an invalid source error, got %q", err)
+				}
+			},
+		}, {
+			Name: "Create helm release with a repository that is not in the sourceRepos",
+			Transformers: []Transformer{
+				&CreateEnvironment{
+					Environment: "production",
+					Config: config.EnvironmentConfig{
+						ArgoCd: &config.EnvironmentConfigArgoCd{
+							SourceRepos: []string{"https://charts.example.com/team-a/*"},
+						},
+					},
+				},
+				&CreateApplicationVersion{
+					Application: "app1",
+					Manifests:   map[string]string{"production": "replicas: 1"},
+					Source:      &config.ReleaseSource{Helm: &config.HelmSource{RepoURL: "https://charts.example.com/team-b", Chart: "app1", Version: "1.0.0"}},
+				},
+			},
+			ErrorTest: func(t *testing.T, err error) {
+				if err == nil || !strings.Contains(err.Error(), `helm repository "https://charts.example.com/team-b" is not in the sourceRepos of environment "production"`) {
+					t.Errorf("expected a source repo error, got %q", err)
+				}
+			},
+		}, {
+			Name: "Create environment with a health gate on latest",
+			Transformers: []Transformer{
+				&CreateEnvironment{
+					Environment: "staging",
+					Config: config.EnvironmentConfig{
+						Upstream: &config.EnvironmentConfigUpstream{
+							Latest:     true,
+							HealthGate: &config.EnvironmentConfigHealthGate{SoakTime: "10m"},
+						},
+					},
+				},
+			},
+			ErrorTest: func(t *testing.T, err error) {
+				if err == nil || !strings.Contains(err.Error(), "healthGate requires an upstream environment") {
+					t.Errorf("expected an invalid health gate error, got %q", err)
+				}
+			},
+		}, {
+			Name: "Create environment with an invalid project role",
+			Transformers: []Transformer{
+				&CreateEnvironment{
+					Environment: "production",
+					Config: config.EnvironmentConfig{
+						ArgoCd: &config.EnvironmentConfigArgoCd{
+							Roles: []config.ArgoCdProjectRole{
+								{
+									Name:     "deployer",
+									Policies: []config.ArgoCdProjectRolePolicy{{Resource: "applications", Action: "sync", Permission: "maybe"}},
+								},
+							},
+						},
+					},
+				},
+			},
+			ErrorTest: func(t *testing.T, err error) {
+				if err == nil || !strings.Contains(err.Error(), `roles[0].policies[0]: invalid permission "maybe"`) {
+					t.Errorf("expected an invalid permission error, got %q", err)
+				}
+			},
 		}, {
 			Name: "Creating an older version doesn't auto deploy",
 			Transformers: []Transformer{
@@ -3134,7 +3608,8 @@ func TestTransformer(t *testing.T) {
 					if err != nil {
 						t.Fatalf("unexpected error reading argocd manifest: %q", err)
 					}
-					expected := `apiVersion: argoproj.io/v1alpha1
+					repoURL := sourceRepo(t, content)
+					expected := fmt.Sprintf(`apiVersion: argoproj.io/v1alpha1
 kind: AppProject
 metadata:
   name: staging
@@ -3144,8 +3619,8 @@ spec:
   - namespace: staging
     server: localhost:8080
   sourceRepos:
-  - '*'
-`
+  - %s
+`, repoURL)
 					if string(content) != expected {
 						t.Fatalf("unexpected argocd manifest:\nexpected:\n%s\n\nactual:\n%s", expected, string(content))
 					}
@@ -3157,7 +3632,8 @@ spec:
 					if err != nil {
 						t.Fatalf("unexpected error reading argocd manifest: %q", err)
 					}
-					expected := `apiVersion: argoproj.io/v1alpha1
+					repoURL := sourceRepo(t, content)
+					expected := fmt.Sprintf(`apiVersion: argoproj.io/v1alpha1
 kind: AppProject
 metadata:
   name: production
@@ -3166,8 +3642,8 @@ spec:
   destinations:
   - name: production
   sourceRepos:
-  - '*'
-`
+  - %s
+`, repoURL)
 					if string(content) != expected {
 						t.Fatalf("unexpected argocd manifest:\nexpected:\n%s\n\nactual:\n%s", expected, string(content))
 					}
@@ -3199,7 +3675,8 @@ spec:
 				if err != nil {
 					t.Fatalf("unexpected error reading argocd manifest: %q", err)
 				}
-				expected := `apiVersion: argoproj.io/v1alpha1
+				repoURL := sourceRepo(t, content)
+				expected := fmt.Sprintf(`apiVersion: argoproj.io/v1alpha1
 kind: AppProject
 metadata:
   name: staging
@@ -3209,7 +3686,7 @@ spec:
   - namespace: not-staging
     server: localhost:8080
   sourceRepos:
-  - '*'
+  - %s
   syncWindows:
   - applications:
     - '*'
@@ -3217,7 +3694,7 @@ spec:
     kind: deny
     manualSync: true
     schedule: '* * * * *'
-`
+`, repoURL)
 				if string(content) != expected {
 					t.Fatalf("unexpected argocd manifest:\nexpected:\n%s\n\nactual:\n%s", expected, string(content))
 				}
@@ -3251,7 +3728,8 @@ spec:
 				if err != nil {
 					t.Fatalf("unexpected error reading argocd manifest: %q", err)
 				}
-				expected := `apiVersion: argoproj.io/v1alpha1
+				repoURL := sourceRepo(t, content)
+				expected := fmt.Sprintf(`apiVersion: argoproj.io/v1alpha1
 kind: AppProject
 metadata:
   name: staging
@@ -3266,8 +3744,8 @@ spec:
   - namespace: not-staging
     server: localhost:8080
   sourceRepos:
-  - '*'
-`
+  - %s
+`, repoURL)
 				if string(content) != expected {
 					t.Fatalf("unexpected argocd manifest:\ndiff:\n%s\n\n", godebug.Diff(expected, string(content)))
 				}
@@ -3320,7 +3798,7 @@ spec:
   - namespace: staging
     server: localhost:8080
   sourceRepos:
-  - '*'
+  - %s
 ---
 apiVersion: argoproj.io/v1alpha1
 kind: Application
@@ -3377,7 +3855,7 @@ spec:
       allowEmpty: true
       prune: true
       selfHeal: true
-`, repoURL, repoURL)
+`, repoURL, repoURL, repoURL)
 				if string(content) != expected {
 					t.Fatalf("unexpected argocd manifest:\n%s", godebug.Diff(expected, string(content)))
 				}
@@ -3426,7 +3904,7 @@ spec:
   - namespace: staging
     server: localhost:8080
   sourceRepos:
-  - '*'
+  - %s
 ---
 apiVersion: argoproj.io/v1alpha1
 kind: Application
@@ -3457,7 +3935,7 @@ spec:
       allowEmpty: true
       prune: true
       selfHeal: true
-`, repoURL)
+`, repoURL, repoURL)
 				if string(content) != expected {
 					t.Fatalf("unexpected argocd manifest:\ndiff:\n%s\n\n", godebug.Diff(expected, string(content)))
 				}
@@ -3514,7 +3992,7 @@ spec:
   - namespace: staging
     server: localhost:8080
   sourceRepos:
-  - '*'
+  - %s
 ---
 apiVersion: argoproj.io/v1alpha1
 kind: Application
@@ -3550,7 +4028,7 @@ spec:
       allowEmpty: true
       prune: true
       selfHeal: true
-`, repoURL)
+`, repoURL, repoURL)
 				if string(content) != expected {
 					t.Fatalf("unexpected argocd manifest:\ndiff:\n%s\n\n", godebug.Diff(expected, string(content)))
 				}
@@ -3770,6 +4248,16 @@ func makeTransformersForDelete(numVersions uint64) []Transformer {
 	return res
 }
 
+// sourceRepo returns the repository url rendered into an AppProject.
+// The url changes every time because the repository is in a tmp dir, but it's always the remote repo.
+func sourceRepo(t *testing.T, content []byte) string {
+	m := regexp.MustCompile(`sourceRepos:\n  - ([^\n]+)\n`).FindSubmatch(content)
+	if m == nil || path.Base(string(m[1])) != "remote" {
+		t.Fatalf("expected the manifest repo as source repo:\n%s", content)
+	}
+	return string(m[1])
+}
+
 func setupRepositoryTest(t *testing.T) Repository {
 	repo, _ := setupRepositoryTestWithPath(t)
 	return repo
@@ -0,0 +1,567 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package repository
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	v1alpha1 "github.com/freiheit-com/kuberpult/services/cd-service/pkg/argocd/v1alpha1"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// WebhookFlavour is the git provider that kuberpult pretends to be when it sends webhooks to argoCd.
+// Each flavour uses the payload format and the secret validation that argoCd expects from that provider.
+// See https://argo-cd.readthedocs.io/en/stable/operator-manual/webhook/
+type WebhookFlavour string
+
+const (
+	// the payload is signed with HMAC-SHA1 and HMAC-SHA256 ("webhook.github.secret" in argoCd)
+	WebhookFlavourGitHub WebhookFlavour = "github"
+	// the secret is sent as token ("webhook.gitlab.secret" in argoCd)
+	WebhookFlavourGitLab WebhookFlavour = "gitlab"
+	// the secret is sent as hook uuid ("webhook.bitbucket.uuid" in argoCd)
+	WebhookFlavourBitbucket WebhookFlavour = "bitbucket"
+	// the payload is signed with HMAC-SHA256 ("webhook.bitbucketserver.secret" in argoCd)
+	WebhookFlavourBitbucketServer WebhookFlavour = "bitbucket-server"
+)
+
+const (
+	// a webhook is only a hint for argoCd to refresh earlier, argoCd polls the repository anyway.
+	// So it's fine to give up after a while.
+	maxArgoWebhookAttempts     = 10
+	minArgoWebhookBackoff      = time.Second
+	maxArgoWebhookBackoff      = 5 * time.Minute
+	argoWebhookRequestTimeout  = 30 * time.Second
+	argoWebhookDeliverySuffix  = ".json"
+	argoWebhookTemporaryPrefix = "."
+)
+
+type changeInfo struct {
+	PayloadBefore string `json:"before"`
+	PayloadAfter  string `json:"after"`
+}
+type commit struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+type ArgoWebhookData struct {
+	HtmlUrl       string     `json:"htmlUrl"`
+	GitUrl        string     `json:"gitUrl"`
+	Revision      string     `json:"revision"` // aka "ref"
+	Change        changeInfo `json:"change"`
+	DefaultBranch string     `json:"defaultBranch"`
+	Commits       []commit   `json:"commits"`
+}
+
+func (r *repository) argoWebhookData(changes *TransformerResult) ArgoWebhookData {
+	var modified = []string{}
+	for i := range changes.ChangedApps {
+		change := changes.ChangedApps[i]
+		// we may need to add the root app in some circumstances - so far it doesn't seem necessary, so we just add the manifest.yaml:
+		manifestFilename := fmt.Sprintf("environments/%s/applications/%s/manifests/manifests.yaml", change.Env, change.App)
+		modified = append(modified, manifestFilename)
+	}
+	var deleted = []string{}
+	for i := range changes.DeletedRootApps {
+		change := changes.DeletedRootApps[i]
+		rootAppFilename := fmt.Sprintf("argocd/%s/%s.yaml", "v1alpha1", change.Env)
+		deleted = append(deleted, rootAppFilename)
+	}
+
+	argoResult := ArgoWebhookData{
+		HtmlUrl:  r.config.WebURL, // if this does not match, argo will completely ignore the request and return 200
+		GitUrl:   r.config.URL,
+		Revision: "refs/heads/" + r.config.Branch,
+		Change: changeInfo{
+			PayloadAfter: changes.Commits.Current.String(),
+		},
+		DefaultBranch: r.config.Branch, // this is questionable, because we don't actually know the default branch, but it seems to work fine in practice
+		Commits: []commit{
+			{
+				Added:    []string{},
+				Modified: modified,
+				Removed:  deleted,
+			},
+		},
+	}
+	if changes.Commits.Previous != nil {
+		argoResult.Change.PayloadBefore = changes.Commits.Previous.String()
+	}
+	return argoResult
+}
+
+// webhookDelivery is one pending webhook in the outbox.
+type webhookDelivery struct {
+	Data        ArgoWebhookData `json:"data"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+}
+
+// webhookOutbox sends webhooks to argoCd in the background.
+// Every webhook is stored as a file in the outbox directory until argoCd accepted it, so pending webhooks survive restarts of the process.
+// They are not meant to be durable: a lost webhook only delays the change until argoCd polls the repository.
+// Failed webhooks are retried with an exponential backoff.
+type webhookOutbox struct {
+	config  *RepositoryConfig
+	dir     string
+	trigger chan struct{}
+	client  *http.Client
+
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+}
+
+func newWebhookOutbox(cfg *RepositoryConfig) (*webhookOutbox, error) {
+	if err := os.MkdirAll(cfg.ArgoWebhookOutbox, 0777); err != nil {
+		return nil, fmt.Errorf("creating argocd webhook outbox: %w", err)
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	// we reach argo from within the cluster, so there's no ssl:
+	tr.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: cfg.ArgoInsecure,
+	}
+	return &webhookOutbox{
+		config:      cfg,
+		dir:         cfg.ArgoWebhookOutbox,
+		trigger:     make(chan struct{}, 1),
+		client:      &http.Client{Transport: tr, Timeout: argoWebhookRequestTimeout},
+		minBackoff:  minArgoWebhookBackoff,
+		maxBackoff:  maxArgoWebhookBackoff,
+		maxAttempts: maxArgoWebhookAttempts,
+	}, nil
+}
+
+// enqueue stores the webhook in the outbox. It doesn't wait for the delivery.
+func (o *webhookOutbox) enqueue(ctx context.Context, data ArgoWebhookData) {
+	now := time.Now()
+	name := fmt.Sprintf("%020d-%s%s", now.UnixNano(), data.Change.PayloadAfter, argoWebhookDeliverySuffix)
+	if err := o.write(name, &webhookDelivery{Data: data, NextAttempt: now}); err != nil {
+		logger.FromContext(ctx).Error("argocd.webhook.enqueue", zap.Error(err))
+		return
+	}
+	select {
+	case o.trigger <- struct{}{}:
+	default:
+		// a delivery is already pending
+	}
+}
+
+func (o *webhookOutbox) run(ctx context.Context) {
+	// deliver everything that is left over from the last run
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.trigger:
+		case <-timer.C:
+		}
+		next := o.deliverDue(ctx)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// deliverDue sends all webhooks that are due in the order they were enqueued.
+// It returns the time when the next webhook is due, or the zero time if the outbox is empty.
+func (o *webhookOutbox) deliverDue(ctx context.Context) time.Time {
+	l := logger.FromContext(ctx)
+	var next time.Time
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		l.Error("argocd.webhook.outbox", zap.Error(err))
+		return time.Now().Add(o.maxBackoff)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, argoWebhookTemporaryPrefix) || !strings.HasSuffix(name, argoWebhookDeliverySuffix) {
+			continue
+		}
+		delivery, err := o.read(name)
+		if err != nil {
+			l.Error("argocd.webhook.read", zap.String("webhook", name), zap.Error(err))
+			o.remove(ctx, name)
+			continue
+		}
+		if time.Now().Before(delivery.NextAttempt) {
+			next = earliest(next, delivery.NextAttempt)
+			continue
+		}
+		delivery.Attempts++
+		err, shouldRetry := doWebhookPostRequest(ctx, delivery.Data, o.config, o.client, delivery.Attempts)
+		if ctx.Err() != nil {
+			// we are shutting down, the webhook stays in the outbox for the next start
+			return time.Time{}
+		}
+		if err == nil {
+			l.Info("argocd.webhook.sent", zap.String("webhook", name), zap.Int("attempts", delivery.Attempts))
+			o.remove(ctx, name)
+			continue
+		}
+		if !shouldRetry || delivery.Attempts >= o.maxAttempts {
+			l.Error("argocd.webhook.failed", zap.String("webhook", name), zap.Int("attempts", delivery.Attempts), zap.Error(err))
+			o.remove(ctx, name)
+			continue
+		}
+		delivery.NextAttempt = time.Now().Add(o.backoff(delivery.Attempts))
+		l.Warn("argocd.webhook.retry", zap.String("webhook", name), zap.Int("attempts", delivery.Attempts), zap.Time("next", delivery.NextAttempt), zap.Error(err))
+		if err := o.write(name, delivery); err != nil {
+			l.Error("argocd.webhook.write", zap.String("webhook", name), zap.Error(err))
+			continue
+		}
+		next = earliest(next, delivery.NextAttempt)
+	}
+	return next
+}
+
+// backoff returns the time to wait after the given number of failed attempts.
+func (o *webhookOutbox) backoff(attempts int) time.Duration {
+	d := o.minBackoff
+	for i := 1; i < attempts && d < o.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.maxBackoff {
+		return o.maxBackoff
+	}
+	return d
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func (o *webhookOutbox) read(name string) (*webhookDelivery, error) {
+	content, err := os.ReadFile(filepath.Join(o.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	var result webhookDelivery
+	if err := json.Unmarshal(content, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// write replaces the file atomically, so that a crash never leaves a partial webhook in the outbox.
+func (o *webhookOutbox) write(name string, delivery *webhookDelivery) error {
+	content, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(o.dir, argoWebhookTemporaryPrefix+name)
+	if err := os.WriteFile(tmp, content, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(o.dir, name))
+}
+
+func (o *webhookOutbox) remove(ctx context.Context, name string) {
+	if err := os.Remove(filepath.Join(o.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.FromContext(ctx).Error("argocd.webhook.remove", zap.String("webhook", name), zap.Error(err))
+	}
+}
+
+func contains(s []int, e int) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
+
+func doWebhookPostRequest(ctx context.Context, data ArgoWebhookData, repoConfig *RepositoryConfig, client *http.Client, retryCounter int) (error, bool) {
+	span, ctx := tracer.StartSpanFromContext(ctx, "Webhook")
+	span.SetTag("changeAfter", data.Change.PayloadAfter)
+	span.SetTag("changeBefore", data.Change.PayloadBefore)
+	span.SetTag("try", retryCounter)
+	span.SetTag("flavour", string(repoConfig.ArgoWebhookFlavour))
+	defer span.Finish()
+	url := repoConfig.ArgoWebhookUrl + "/api/webhook"
+	l := logger.FromContext(ctx)
+	l.Info(fmt.Sprintf("doWebhookPostRequest: URL: %s", url))
+
+	jsonBytes, header, err := webhookPayload(data, repoConfig.ArgoWebhookFlavour, repoConfig.ArgoWebhookSecret)
+	if err != nil {
+		return err, false
+	}
+	l.Info(fmt.Sprintf("doWebhookPostRequest %s format: %s", repoConfig.ArgoWebhookFlavour, string(jsonBytes)))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return err, false
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// argo may just be restarting, so it's worth trying again later:
+		return errors.New(fmt.Sprintf("doWebhookPostRequest: could not send request to '%s': %s", url, err.Error())), true
+	}
+	defer resp.Body.Close()
+
+	l.Info(fmt.Sprintf("response headers: %s", resp.Header))
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		// weird but we kinda do not care about the body:
+		l.Warn(fmt.Sprintf("doWebhookPostRequest: could not read body: %s - continuing anyway", err.Error()))
+	}
+	validResponseCodes := []int{200}
+	if resp.StatusCode >= 500 {
+		return errors.New(fmt.Sprintf("doWebhookPostRequest: invalid status code from argo: %d", resp.StatusCode)), true
+	}
+
+	if contains(validResponseCodes, resp.StatusCode) {
+		l.Info(fmt.Sprintf("doWebhookPostRequest: response Body: %s", string(body)))
+		return nil, false
+	}
+	// in any other case we should not do a retry (e.g. status 4xx):
+	l.Warn(fmt.Sprintf("doWebhookPostRequest: response Body: %s", string(body)))
+	return errors.New(fmt.Sprintf("doWebhookPostRequest: invalid status code from argo: %d", resp.StatusCode)), false
+}
+
+// webhookPayload renders the body and the headers that argoCd expects from the git provider of the flavour.
+// Source: function "Handler" in https://github.com/argoproj/argo-cd/blob/master/util/webhook/webhook.go
+func webhookPayload(data ArgoWebhookData, flavour WebhookFlavour, secret string) ([]byte, http.Header, error) {
+	header := http.Header{}
+	var payload interface{}
+	switch flavour {
+	case WebhookFlavourGitHub, "":
+		payload = v1alpha1.PushPayload{
+			Ref:    data.Revision,
+			Before: data.Change.PayloadBefore,
+			After:  data.Change.PayloadAfter,
+			Repository: v1alpha1.Repository{
+				HTMLURL:       data.HtmlUrl,
+				DefaultBranch: data.DefaultBranch,
+			},
+			Commits: toArgoCommits(data.Commits),
+		}
+		// now pretend that we are GitHub by adding this header, otherwise argo will ignore our request:
+		header.Set("X-GitHub-Event", "push")
+	case WebhookFlavourGitLab:
+		payload = gitlabPushPayload{
+			ObjectKind: "push",
+			Ref:        data.Revision,
+			Before:     data.Change.PayloadBefore,
+			After:      data.Change.PayloadAfter,
+			Project: gitlabProject{
+				WebURL:        data.HtmlUrl,
+				DefaultBranch: data.DefaultBranch,
+			},
+			Commits: data.Commits,
+		}
+		header.Set("X-Gitlab-Event", "Push Hook")
+		if secret != "" {
+			header.Set("X-Gitlab-Token", secret)
+		}
+	case WebhookFlavourBitbucket:
+		p := bitbucketPushPayload{}
+		p.Repository.Links.HTML.Href = data.HtmlUrl
+		change := bitbucketChange{}
+		change.New.Type = "branch"
+		change.New.Name = strings.TrimPrefix(data.Revision, "refs/heads/")
+		change.New.Target.Hash = data.Change.PayloadAfter
+		p.Push.Changes = []bitbucketChange{change}
+		payload = p
+		header.Set("X-Event-Key", "repo:push")
+		// argo detects bitbucket cloud by this header, so it's also needed without secret:
+		uuid := secret
+		if uuid == "" {
+			uuid = "kuberpult"
+		}
+		header.Set("X-Hook-UUID", uuid)
+	case WebhookFlavourBitbucketServer:
+		payload = bitbucketServerPushPayload{
+			EventKey: "repo:refs_changed",
+			Repository: bitbucketServerRepository{
+				Links: map[string]interface{}{
+					"clone": []interface{}{
+						map[string]interface{}{"name": "http", "href": data.HtmlUrl},
+						map[string]interface{}{"name": "ssh", "href": data.GitUrl},
+					},
+				},
+			},
+			Changes: []bitbucketServerChange{
+				{
+					Ref: bitbucketServerRef{
+						ID:        data.Revision,
+						DisplayID: strings.TrimPrefix(data.Revision, "refs/heads/"),
+						Type:      "BRANCH",
+					},
+					RefID:    data.Revision,
+					FromHash: data.Change.PayloadBefore,
+					ToHash:   data.Change.PayloadAfter,
+					Type:     "UPDATE",
+				},
+			},
+		}
+		header.Set("X-Event-Key", "repo:refs_changed")
+	default:
+		return nil, nil, fmt.Errorf("unknown webhook flavour %q", flavour)
+	}
+	jsonBytes, err := json.MarshalIndent(payload, " ", " ")
+	if err != nil {
+		return nil, nil, err
+	}
+	if secret != "" {
+		switch flavour {
+		case WebhookFlavourGitHub, "":
+			header.Set("X-Hub-Signature", "sha1="+hmacHex(sha1.New, secret, jsonBytes))
+			header.Set("X-Hub-Signature-256", "sha256="+hmacHex(sha256.New, secret, jsonBytes))
+		case WebhookFlavourBitbucketServer:
+			header.Set("X-Hub-Signature", "sha256="+hmacHex(sha256.New, secret, jsonBytes))
+		}
+	}
+	return jsonBytes, header, nil
+}
+
+func hmacHex(h func() hash.Hash, secret string, body []byte) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func toArgoCommits(commits []commit) []v1alpha1.Commit {
+	var result = []v1alpha1.Commit{}
+	for i := range commits {
+		c := commits[i]
+		result = append(result, v1alpha1.Commit{
+			// ArgoCd ignores most fields, so we can ignore them too.
+			// Source: function "affectedRevisionInfo" in https://github.com/argoproj/argo-cd/blob/master/util/webhook/webhook.go#L141
+			Sha:       "",
+			ID:        "",
+			NodeID:    "",
+			TreeID:    "",
+			Distinct:  false,
+			Message:   "",
+			Timestamp: "",
+			URL:       "",
+			Author: struct {
+				Name     string `json:"name"`
+				Email    string `json:"email"`
+				Username string `json:"username"`
+			}{},
+			Committer: struct {
+				Name     string `json:"name"`
+				Email    string `json:"email"`
+				Username string `json:"username"`
+			}{},
+			Added:    c.Added,
+			Removed:  c.Removed,
+			Modified: c.Modified,
+		})
+	}
+	return result
+}
+
+// The following payloads only contain the fields that argoCd reads.
+// See https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#push-events
+type gitlabPushPayload struct {
+	ObjectKind string        `json:"object_kind"`
+	Ref        string        `json:"ref"`
+	Before     string        `json:"before"`
+	After      string        `json:"after"`
+	Project    gitlabProject `json:"project"`
+	Commits    []commit      `json:"commits"`
+}
+
+type gitlabProject struct {
+	WebURL        string `json:"web_url"`
+	DefaultBranch string `json:"default_branch"`
+}
+
+// See https://support.atlassian.com/bitbucket-cloud/docs/event-payloads/#Push
+type bitbucketPushPayload struct {
+	Repository struct {
+		Links struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+	} `json:"repository"`
+	Push struct {
+		Changes []bitbucketChange `json:"changes"`
+	} `json:"push"`
+}
+
+type bitbucketChange struct {
+	New struct {
+		Type   string `json:"type"`
+		Name   string `json:"name"`
+		Target struct {
+			Hash string `json:"hash"`
+		} `json:"target"`
+	} `json:"new"`
+}
+
+// See https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Push
+type bitbucketServerPushPayload struct {
+	EventKey   string                    `json:"eventKey"`
+	Repository bitbucketServerRepository `json:"repository"`
+	Changes    []bitbucketServerChange   `json:"changes"`
+}
+
+type bitbucketServerRepository struct {
+	Links map[string]interface{} `json:"links"`
+}
+
+type bitbucketServerChange struct {
+	Ref      bitbucketServerRef `json:"ref"`
+	RefID    string             `json:"refId"`
+	FromHash string             `json:"fromHash"`
+	ToHash   string             `json:"toHash"`
+	Type     string             `json:"type"`
+}
+
+type bitbucketServerRef struct {
+	ID        string `json:"id"`
+	DisplayID string `json:"displayId"`
+	Type      string `json:"type"`
+}
@@ -0,0 +1,339 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package repository
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var exampleWebhookData = ArgoWebhookData{
+	HtmlUrl:       "https://example.com/manifests",
+	GitUrl:        "git@example.com:manifests.git",
+	Revision:      "refs/heads/main",
+	Change:        changeInfo{PayloadBefore: "1111", PayloadAfter: "2222"},
+	DefaultBranch: "main",
+	Commits: []commit{
+		{
+			Added:    []string{},
+			Modified: []string{"environments/production/applications/foo/manifests/manifests.yaml"},
+			Removed:  []string{},
+		},
+	},
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+type webhookRecorder struct {
+	mx       sync.Mutex
+	statuses []int
+	received []receivedWebhook
+	done     chan struct{}
+}
+
+// ServeHTTP answers with the configured status codes in order and with 200 afterwards.
+func (w *webhookRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	status := http.StatusOK
+	if len(w.received) < len(w.statuses) {
+		status = w.statuses[len(w.received)]
+	}
+	w.received = append(w.received, receivedWebhook{header: r.Header, body: body})
+	rw.WriteHeader(status)
+	select {
+	case w.done <- struct{}{}:
+	default:
+	}
+}
+
+func (w *webhookRecorder) requests() []receivedWebhook {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return append([]receivedWebhook{}, w.received...)
+}
+
+func TestWebhookPayload(t *testing.T) {
+	tcs := []struct {
+		Name            string
+		Flavour         WebhookFlavour
+		Secret          string
+		ExpectedHeaders func(body []byte) map[string]string
+		ExpectedPayload map[string]interface{}
+	}{
+		{
+			Name:    "github without secret",
+			Flavour: WebhookFlavourGitHub,
+			ExpectedHeaders: func(body []byte) map[string]string {
+				return map[string]string{
+					"X-Github-Event":      "push",
+					"X-Hub-Signature":     "",
+					"X-Hub-Signature-256": "",
+				}
+			},
+			ExpectedPayload: map[string]interface{}{
+				"ref":    "refs/heads/main",
+				"before": "1111",
+				"after":  "2222",
+			},
+		},
+		{
+			Name:    "github with secret",
+			Flavour: WebhookFlavourGitHub,
+			Secret:  "secret",
+			ExpectedHeaders: func(body []byte) map[string]string {
+				return map[string]string{
+					"X-Github-Event":      "push",
+					"X-Hub-Signature":     "sha1=" + hmacHex(sha1.New, "secret", body),
+					"X-Hub-Signature-256": "sha256=" + hmacHex(sha256.New, "secret", body),
+				}
+			},
+			ExpectedPayload: map[string]interface{}{
+				"ref":    "refs/heads/main",
+				"before": "1111",
+				"after":  "2222",
+			},
+		},
+		{
+			Name:    "gitlab with secret",
+			Flavour: WebhookFlavourGitLab,
+			Secret:  "secret",
+			ExpectedHeaders: func(body []byte) map[string]string {
+				return map[string]string{
+					"X-Gitlab-Event":  "Push Hook",
+					"X-Gitlab-Token":  "secret",
+					"X-Hub-Signature": "",
+				}
+			},
+			ExpectedPayload: map[string]interface{}{
+				"object_kind": "push",
+				"ref":         "refs/heads/main",
+				"before":      "1111",
+				"after":       "2222",
+				"project": map[string]interface{}{
+					"web_url":        "https://example.com/manifests",
+					"default_branch": "main",
+				},
+			},
+		},
+		{
+			Name:    "bitbucket with secret",
+			Flavour: WebhookFlavourBitbucket,
+			Secret:  "f3ed1ab2-7a9c-4d55-8a0e-3b5c1c2d9e01",
+			ExpectedHeaders: func(body []byte) map[string]string {
+				return map[string]string{
+					"X-Event-Key": "repo:push",
+					"X-Hook-Uuid": "f3ed1ab2-7a9c-4d55-8a0e-3b5c1c2d9e01",
+				}
+			},
+			ExpectedPayload: map[string]interface{}{
+				"repository": map[string]interface{}{
+					"links": map[string]interface{}{
+						"html": map[string]interface{}{
+							"href": "https://example.com/manifests",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:    "bitbucket server with secret",
+			Flavour: WebhookFlavourBitbucketServer,
+			Secret:  "secret",
+			ExpectedHeaders: func(body []byte) map[string]string {
+				return map[string]string{
+					"X-Event-Key":     "repo:refs_changed",
+					"X-Hub-Signature": "sha256=" + hmacHex(sha256.New, "secret", body),
+				}
+			},
+			ExpectedPayload: map[string]interface{}{
+				"eventKey": "repo:refs_changed",
+			},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			body, header, err := webhookPayload(exampleWebhookData, tc.Flavour, tc.Secret)
+			if err != nil {
+				t.Fatalf("expected no error, but got %q", err)
+			}
+			actualHeaders := map[string]string{}
+			for k := range tc.ExpectedHeaders(body) {
+				actualHeaders[k] = header.Get(k)
+			}
+			if d := cmp.Diff(tc.ExpectedHeaders(body), actualHeaders); d != "" {
+				t.Errorf("unexpected headers:\n%s", d)
+			}
+			var payload map[string]interface{}
+			if err := json.Unmarshal(body, &payload); err != nil {
+				t.Fatalf("expected valid json, but got %q", err)
+			}
+			actualPayload := map[string]interface{}{}
+			for k := range tc.ExpectedPayload {
+				actualPayload[k] = payload[k]
+			}
+			if d := cmp.Diff(tc.ExpectedPayload, actualPayload); d != "" {
+				t.Errorf("unexpected payload:\n%s", d)
+			}
+		})
+	}
+}
+
+func TestWebhookOutbox(t *testing.T) {
+	tcs := []struct {
+		Name             string
+		Statuses         []int
+		ExpectedRequests int
+		// set if the outbox should be empty after that many requests
+		ExpectedEmpty bool
+	}{
+		{
+			Name:             "delivers the webhook",
+			ExpectedRequests: 1,
+			ExpectedEmpty:    true,
+		},
+		{
+			Name:             "retries server errors",
+			Statuses:         []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+			ExpectedRequests: 3,
+			ExpectedEmpty:    true,
+		},
+		{
+			Name:             "gives up after too many attempts",
+			Statuses:         []int{500, 500, 500, 500, 500},
+			ExpectedRequests: 3,
+			ExpectedEmpty:    true,
+		},
+		{
+			Name:             "doesn't retry client errors",
+			Statuses:         []int{http.StatusBadRequest},
+			ExpectedRequests: 1,
+			ExpectedEmpty:    true,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			recorder := &webhookRecorder{statuses: tc.Statuses, done: make(chan struct{}, 10)}
+			server := httptest.NewServer(recorder)
+			defer server.Close()
+			outbox, err := newWebhookOutbox(&RepositoryConfig{
+				ArgoWebhookUrl:     server.URL,
+				ArgoWebhookFlavour: WebhookFlavourGitHub,
+				ArgoWebhookOutbox:  t.TempDir(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			outbox.minBackoff = time.Millisecond
+			outbox.maxBackoff = 5 * time.Millisecond
+			outbox.maxAttempts = 3
+			go outbox.run(ctx)
+			outbox.enqueue(ctx, exampleWebhookData)
+			for i := 0; i < tc.ExpectedRequests; i++ {
+				select {
+				case <-recorder.done:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("expected %d requests, but got %d", tc.ExpectedRequests, i)
+				}
+			}
+			// give the outbox some time to send unexpected requests and to clean up
+			time.Sleep(50 * time.Millisecond)
+			if actual := len(recorder.requests()); actual != tc.ExpectedRequests {
+				t.Errorf("expected %d requests, but got %d", tc.ExpectedRequests, actual)
+			}
+			entries, err := os.ReadDir(outbox.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.ExpectedEmpty && len(entries) != 0 {
+				t.Errorf("expected the outbox to be empty, but got %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestWebhookOutboxSurvivesRestarts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := &webhookRecorder{done: make(chan struct{}, 10)}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	cfg := &RepositoryConfig{
+		ArgoWebhookUrl:     server.URL,
+		ArgoWebhookFlavour: WebhookFlavourGitHub,
+		ArgoWebhookOutbox:  t.TempDir(),
+	}
+	// the first outbox never runs, e.g. because kuberpult was stopped right after the push
+	first, err := newWebhookOutbox(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.enqueue(ctx, exampleWebhookData)
+	if actual := len(recorder.requests()); actual != 0 {
+		t.Fatalf("expected no requests before the outbox runs, but got %d", actual)
+	}
+	second, err := newWebhookOutbox(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go second.run(ctx)
+	select {
+	case <-recorder.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the pending webhook to be delivered")
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(recorder.requests()[0].body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["after"] != "2222" {
+		t.Errorf("expected the pending webhook, but got %v", payload)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	outbox := &webhookOutbox{minBackoff: time.Second, maxBackoff: 10 * time.Second}
+	actual := []time.Duration{}
+	for i := 1; i <= 6; i++ {
+		actual = append(actual, outbox.backoff(i))
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	if d := cmp.Diff(expected, actual); d != "" {
+		t.Errorf("unexpected backoff:\n%s", d)
+	}
+}
@@ -0,0 +1,205 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+// Package rollout follows the rollout status that the rollout-service reports, so that the cd-service can gate release trains on it and show it in the overview.
+package rollout
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/notify"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type key struct {
+	environment string
+	application string
+}
+
+type appHealth struct {
+	version uint64
+	// healthySince is zero while the version is not healthy. It's the last status change that the rollout-service reported, so the soak time survives restarts.
+	healthySince  time.Time
+	rolloutStatus api.RolloutStatus
+	syncRevision  string
+	// lastChange is when the version or the rollout status changed
+	lastChange time.Time
+}
+
+type Health struct {
+	mx    sync.Mutex
+	state map[key]*appHealth
+	// connected is false until the initial snapshot of the rollout-service is complete and while there is no stream, because the state may be outdated then
+	connected bool
+	// sequence is the sequence of the last status, reconnects resume from it
+	sequence uint64
+	now      func() time.Time
+	// notify is triggered whenever the result of Rollout changes
+	notify notify.Notify
+}
+
+func New() *Health {
+	return &Health{
+		state: map[key]*appHealth{},
+		now:   time.Now,
+	}
+}
+
+// Subscribe follows the status stream of the rollout-service and reconnects until the context is done.
+func (h *Health) Subscribe(ctx context.Context, client api.RolloutServiceClient) error {
+	bo := backoff.NewExponentialBackOff()
+	// never give up
+	bo.MaxElapsedTime = 0
+	for {
+		err := h.subscribeOnce(ctx, client, bo)
+		h.disconnect()
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		logger.FromContext(ctx).Warn("rollout.stream", zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(bo.NextBackOff()):
+		}
+	}
+}
+
+func (h *Health) subscribeOnce(ctx context.Context, client api.RolloutServiceClient, bo backoff.BackOff) error {
+	h.mx.Lock()
+	req := &api.StreamStatusRequest{ResumeFromSequence: h.sequence}
+	h.mx.Unlock()
+	stream, err := client.StreamStatus(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		bo.Reset()
+		h.process(ev)
+	}
+}
+
+func (h *Health) process(ev *api.StreamStatusResponse) {
+	if h.update(ev) {
+		h.notify.Notify()
+	}
+}
+
+// update applies the event and returns true if the result of Rollout changed
+func (h *Health) update(ev *api.StreamStatusResponse) bool {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if ev.Sequence > h.sequence {
+		h.sequence = ev.Sequence
+	}
+	if ev.SnapshotComplete {
+		changed := !h.connected
+		h.connected = true
+		return changed
+	}
+	// The rollout-service knows when the status changed, even if the cd-service restarted in between.
+	now := h.now()
+	if ev.LastStatusChange != nil {
+		now = ev.LastStatusChange.AsTime()
+	}
+	k := key{ev.Environment, ev.Application}
+	s := h.state[k]
+	if s == nil {
+		s = &appHealth{}
+		h.state[k] = s
+	}
+	changed := false
+	if s.version != ev.Version || s.rolloutStatus != ev.RolloutStatus || s.lastChange.IsZero() {
+		s.lastChange = now
+		changed = true
+	}
+	if s.version != ev.Version {
+		s.version = ev.Version
+		s.healthySince = time.Time{}
+	}
+	s.rolloutStatus = ev.RolloutStatus
+	// a new sync revision alone is not worth a new overview, it's visible with the next change
+	s.syncRevision = ev.SyncRevision
+	if ev.RolloutStatus != api.RolloutStatus_RolloutStatusSuccesful {
+		s.healthySince = time.Time{}
+	} else if s.healthySince.IsZero() {
+		s.healthySince = now
+	}
+	// nothing is visible until the snapshot is complete
+	return changed && h.connected
+}
+
+func (h *Health) disconnect() {
+	h.mx.Lock()
+	changed := h.connected
+	h.connected = false
+	h.mx.Unlock()
+	if changed {
+		h.notify.Notify()
+	}
+}
+
+// HealthySince returns since when the version of the application is healthy and synced in the environment.
+// It returns false if the version is not healthy or the status is unknown.
+func (h *Health) HealthySince(environment, application string, version uint64) (time.Time, bool) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if !h.connected {
+		return time.Time{}, false
+	}
+	s := h.state[key{environment, application}]
+	if s == nil || s.version != version || s.healthySince.IsZero() {
+		return time.Time{}, false
+	}
+	return s.healthySince, true
+}
+
+// Rollout returns the rollout status of the application in the environment.
+// It returns nil if the status is unknown.
+func (h *Health) Rollout(environment, application string) *api.Environment_Application_Rollout {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if !h.connected {
+		return nil
+	}
+	s := h.state[key{environment, application}]
+	if s == nil {
+		return nil
+	}
+	return &api.Environment_Application_Rollout{
+		RolloutStatus:    s.rolloutStatus,
+		Version:          s.version,
+		SyncRevision:     s.syncRevision,
+		LastStatusChange: timestamppb.New(s.lastChange),
+	}
+}
+
+// Notify is triggered whenever the result of Rollout changes.
+func (h *Health) Notify() *notify.Notify {
+	return &h.notify
+}
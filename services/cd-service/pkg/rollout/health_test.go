@@ -0,0 +1,332 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package rollout
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type step struct {
+	Event *api.StreamStatusResponse
+	// Disconnect simulates a lost stream
+	Disconnect bool
+
+	ExpectedHealthy bool
+	ExpectedSince   time.Time
+}
+
+func TestHealth(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	tcs := []struct {
+		Name  string
+		Steps []step
+	}{
+		{
+			Name: "healthy since the first successful status",
+			Steps: []step{
+				{
+					Event: &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: api.RolloutStatus_RolloutStatusProgressing},
+				},
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful},
+					ExpectedHealthy: true,
+					ExpectedSince:   t0.Add(1 * time.Minute),
+				},
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful},
+					ExpectedHealthy: true,
+					ExpectedSince:   t0.Add(1 * time.Minute),
+				},
+			},
+		},
+		{
+			Name: "an error resets the soak time",
+			Steps: []step{
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful},
+					ExpectedHealthy: true,
+					ExpectedSince:   t0,
+				},
+				{
+					Event: &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: api.RolloutStatus_RolloutStatusError},
+				},
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful},
+					ExpectedHealthy: true,
+					ExpectedSince:   t0.Add(2 * time.Minute),
+				},
+			},
+		},
+		{
+			Name: "another version is not healthy",
+			Steps: []step{
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful},
+					ExpectedHealthy: true,
+					ExpectedSince:   t0,
+				},
+				{
+					Event: &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 2, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful},
+				},
+			},
+		},
+		{
+			Name: "uses the status change of the rollout-service",
+			Steps: []step{
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful, LastStatusChange: timestamppb.New(t0.Add(-time.Hour))},
+					ExpectedHealthy: true,
+					ExpectedSince:   t0.Add(-time.Hour),
+				},
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful, LastStatusChange: timestamppb.New(t0.Add(-time.Hour))},
+					ExpectedHealthy: true,
+					ExpectedSince:   t0.Add(-time.Hour),
+				},
+			},
+		},
+		{
+			Name: "unknown while disconnected",
+			Steps: []step{
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful},
+					ExpectedHealthy: true,
+					ExpectedSince:   t0,
+				},
+				{
+					Disconnect: true,
+				},
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful},
+					ExpectedHealthy: false,
+				},
+				{
+					// reconnects keep the soak time
+					Event:           &api.StreamStatusResponse{SnapshotComplete: true},
+					ExpectedHealthy: true,
+					ExpectedSince:   t0,
+				},
+			},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			h := New()
+			now := t0
+			h.now = func() time.Time { return now }
+			h.process(&api.StreamStatusResponse{SnapshotComplete: true})
+			for i, s := range tc.Steps {
+				if s.Disconnect {
+					h.disconnect()
+				} else {
+					h.process(s.Event)
+				}
+				since, healthy := h.HealthySince("staging", "foo", 1)
+				if healthy != s.ExpectedHealthy {
+					t.Errorf("step %d: expected healthy %t, got %t", i, s.ExpectedHealthy, healthy)
+				}
+				if !since.Equal(s.ExpectedSince) {
+					t.Errorf("step %d: expected healthy since %s, got %s", i, s.ExpectedSince, since)
+				}
+				now = now.Add(time.Minute)
+			}
+		})
+	}
+}
+
+func TestRollout(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	type rolloutStep struct {
+		Event *api.StreamStatusResponse
+		// Disconnect simulates a lost stream
+		Disconnect bool
+
+		ExpectedRollout *api.Environment_Application_Rollout
+		ExpectedNotify  bool
+	}
+	rollout := func(status api.RolloutStatus, version uint64, revision string, minute int) *api.Environment_Application_Rollout {
+		return &api.Environment_Application_Rollout{
+			RolloutStatus:    status,
+			Version:          version,
+			SyncRevision:     revision,
+			LastStatusChange: timestamppb.New(t0.Add(time.Duration(minute) * time.Minute)),
+		}
+	}
+	var (
+		progressing = api.RolloutStatus_RolloutStatusProgressing
+		successful  = api.RolloutStatus_RolloutStatusSuccesful
+	)
+	tcs := []struct {
+		Name  string
+		Steps []rolloutStep
+	}{
+		{
+			Name: "keeps the time of the last status change",
+			Steps: []rolloutStep{
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: progressing, SyncRevision: "1234"},
+					ExpectedRollout: rollout(progressing, 1, "1234", 0),
+					ExpectedNotify:  true,
+				},
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: progressing, SyncRevision: "1234"},
+					ExpectedRollout: rollout(progressing, 1, "1234", 0),
+				},
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: successful, SyncRevision: "1234"},
+					ExpectedRollout: rollout(successful, 1, "1234", 2),
+					ExpectedNotify:  true,
+				},
+				// a new sync revision alone doesn't trigger a new overview
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: successful, SyncRevision: "5678"},
+					ExpectedRollout: rollout(successful, 1, "5678", 2),
+				},
+			},
+		},
+		{
+			Name: "unknown while disconnected",
+			Steps: []rolloutStep{
+				{
+					Event:           &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: successful, SyncRevision: "1234"},
+					ExpectedRollout: rollout(successful, 1, "1234", 0),
+					ExpectedNotify:  true,
+				},
+				{
+					Disconnect:     true,
+					ExpectedNotify: true,
+				},
+				{
+					Event: &api.StreamStatusResponse{Environment: "staging", Application: "foo", Version: 2, RolloutStatus: progressing, SyncRevision: "5678"},
+				},
+				{
+					Event:           &api.StreamStatusResponse{SnapshotComplete: true},
+					ExpectedRollout: rollout(progressing, 2, "5678", 2),
+					ExpectedNotify:  true,
+				},
+			},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			h := New()
+			now := t0
+			h.now = func() time.Time { return now }
+			h.process(&api.StreamStatusResponse{SnapshotComplete: true})
+			ch, unsubscribe := h.Notify().Subscribe()
+			defer unsubscribe()
+			// channels are triggered after subscribing
+			<-ch
+			for i, s := range tc.Steps {
+				if s.Disconnect {
+					h.disconnect()
+				} else {
+					h.process(s.Event)
+				}
+				if d := cmp.Diff(s.ExpectedRollout, h.Rollout("staging", "foo"), protocmp.Transform()); d != "" {
+					t.Errorf("step %d: unexpected rollout: %s", i, d)
+				}
+				notified := false
+				select {
+				case <-ch:
+					notified = true
+				default:
+				}
+				if notified != s.ExpectedNotify {
+					t.Errorf("step %d: expected notify %t, got %t", i, s.ExpectedNotify, notified)
+				}
+				now = now.Add(time.Minute)
+			}
+			if r := h.Rollout("staging", "unknown"); r != nil {
+				t.Errorf("expected no rollout for an unknown application, got %v", r)
+			}
+		})
+	}
+}
+
+type fakeRolloutServer struct {
+	api.UnimplementedRolloutServiceServer
+	events []*api.StreamStatusResponse
+}
+
+func (f *fakeRolloutServer) StreamStatus(req *api.StreamStatusRequest, stream api.RolloutService_StreamStatusServer) error {
+	for _, ev := range f.events {
+		if err := stream.Send(ev); err != nil {
+			return err
+		}
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestSubscribe(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer()
+	api.RegisterRolloutServiceServer(srv, &fakeRolloutServer{
+		events: []*api.StreamStatusResponse{
+			{Environment: "staging", Application: "foo", Version: 1, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful},
+			{SnapshotComplete: true},
+		},
+	})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := New()
+	done := make(chan error)
+	go func() {
+		done <- h.Subscribe(ctx, api.NewRolloutServiceClient(conn))
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		if _, healthy := h.HealthySince("staging", "foo", 1); healthy {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("expected the version to become healthy")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected no error, got %q", err)
+	}
+}
@@ -34,6 +34,8 @@ import (
 type BatchServer struct {
 	Repository repository.Repository
 	RBACConfig auth.RBACConfig
+	// UpstreamHealth is used by release trains to environments with a health gate, it may be nil
+	UpstreamHealth repository.UpstreamHealth
 }
 
 // see maxBatchActions in store.tsx
@@ -196,6 +198,7 @@ func (d *BatchServer) processAction(
 				Target:         in.Target,
 				Team:           in.Team,
 				Authentication: repository.Authentication{RBACConfig: d.RBACConfig},
+				UpstreamHealth: d.UpstreamHealth,
 			}, &api.BatchResult{
 				Result: &api.BatchResult_ReleaseTrain{
 					ReleaseTrain: &api.ReleaseTrainResponse{Target: in.Target, Team: in.Team},
@@ -204,16 +207,18 @@ func (d *BatchServer) processAction(
 	case *api.BatchAction_CreateRelease:
 		in := action.CreateRelease
 		return &repository.CreateApplicationVersion{
-				Version:        in.Version,
-				Application:    in.Application,
-				Manifests:      in.Manifests,
-				SourceCommitId: in.SourceCommitId,
-				SourceAuthor:   in.SourceAuthor,
-				SourceMessage:  in.SourceMessage,
-				SourceRepoUrl:  in.SourceRepoUrl,
-				Team:           in.Team,
-				DisplayVersion: in.DisplayVersion,
-				Authentication: repository.Authentication{RBACConfig: d.RBACConfig},
+				Version:         in.Version,
+				Application:     in.Application,
+				Manifests:       in.Manifests,
+				SourceCommitId:  in.SourceCommitId,
+				SourceAuthor:    in.SourceAuthor,
+				SourceMessage:   in.SourceMessage,
+				SourceRepoUrl:   in.SourceRepoUrl,
+				Team:            in.Team,
+				DisplayVersion:  in.DisplayVersion,
+				ArgoCdOverrides: transformArgoCdOverrides(in.ArgocdOverrides),
+				Source:          transformReleaseSource(in.Source),
+				Authentication:  repository.Authentication{RBACConfig: d.RBACConfig},
 			}, &api.BatchResult{
 				Result: &api.BatchResult_CreateReleaseResponse{
 					CreateReleaseResponse: &api.CreateReleaseResponse{},
@@ -231,12 +236,21 @@ func (d *BatchServer) processAction(
 			clusterResourceWhitelist := transformClusterResourceWhitelistToConfig(conf.Argocd.AccessList)
 			ignoreDifferences := transformIgnoreDifferencesToConfig(conf.Argocd.IgnoreDifferences)
 			argocd = &config.EnvironmentConfigArgoCd{
-				Destination:              transformDestination(conf.Argocd.Destination),
-				SyncWindows:              syncWindows,
-				ClusterResourceWhitelist: clusterResourceWhitelist,
-				ApplicationAnnotations:   conf.Argocd.ApplicationAnnotations,
-				IgnoreDifferences:        ignoreDifferences,
-				SyncOptions:              conf.Argocd.SyncOptions,
+				Destination:                transformDestination(conf.Argocd.Destination),
+				Destinations:               transformDestinations(conf.Argocd.Destinations),
+				SyncWindows:                syncWindows,
+				ClusterResourceWhitelist:   clusterResourceWhitelist,
+				ApplicationAnnotations:     conf.Argocd.ApplicationAnnotations,
+				IgnoreDifferences:          ignoreDifferences,
+				SyncOptions:                conf.Argocd.SyncOptions,
+				SyncPolicy:                 transformSyncPolicy(conf.Argocd.SyncPolicy),
+				ApplicationSyncPolicies:    transformApplicationSyncPolicies(conf.Argocd.ApplicationSyncPolicies),
+				ApplicationSet:             conf.Argocd.ApplicationSet,
+				SourceRepos:                conf.Argocd.SourceRepos,
+				NamespaceResourceBlacklist: transformClusterResourceWhitelistToConfig(conf.Argocd.NamespaceResourceBlacklist),
+				NamespaceResourceWhitelist: transformClusterResourceWhitelistToConfig(conf.Argocd.NamespaceResourceWhitelist),
+				Roles:                      transformProjectRoles(conf.Argocd.Roles),
+				OrphanedResources:          transformOrphanedResources(conf.Argocd.OrphanedResources),
 			}
 		}
 		upstream := transformUpstreamToConfig(conf.Upstream)
@@ -246,6 +260,7 @@ func (d *BatchServer) processAction(
 				Upstream:         upstream,
 				ArgoCd:           argocd,
 				EnvironmentGroup: conf.EnvironmentGroup,
+				Flux:             transformFluxToConfig(conf.Flux),
 			},
 			Authentication: repository.Authentication{RBACConfig: d.RBACConfig},
 		}
@@ -814,6 +814,144 @@ func TestCreateEnvironmentTrain(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name:  "With argocd sync policies",
+			Setup: []repository.Transformer{},
+			Request: &api.BatchRequest{
+				Actions: []*api.BatchAction{
+					{
+						Action: &api.BatchAction_CreateEnvironment{
+							CreateEnvironment: &api.CreateEnvironmentRequest{
+								Environment: "env",
+								Config: &api.EnvironmentConfig{
+									Argocd: &api.EnvironmentConfig_ArgoCD{
+										SyncPolicy: &api.EnvironmentConfig_ArgoCD_SyncPolicy{
+											Automated: ptr.Bool(true),
+											Prune:     ptr.Bool(false),
+											Retry: &api.EnvironmentConfig_ArgoCD_SyncPolicy_Retry{
+												Limit: 3,
+												Backoff: &api.EnvironmentConfig_ArgoCD_SyncPolicy_Retry_Backoff{
+													Duration:    "5s",
+													MaxDuration: "3m",
+												},
+											},
+											Finalizer: ptr.FromString("background"),
+										},
+										ApplicationSyncPolicies: map[string]*api.EnvironmentConfig_ArgoCD_SyncPolicy{
+											"app": {
+												Automated: ptr.Bool(false),
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			ExpectedResponse: &api.BatchResponse{
+				Results: []*api.BatchResult{
+					nil,
+				},
+			},
+			ExpectedEnvironments: map[string]config.EnvironmentConfig{
+				"env": config.EnvironmentConfig{
+					ArgoCd: &config.EnvironmentConfigArgoCd{
+						SyncPolicy: &config.ArgoCdSyncPolicy{
+							Automated: ptr.Bool(true),
+							Prune:     ptr.Bool(false),
+							Retry: &config.ArgoCdRetry{
+								Limit: 3,
+								Backoff: &config.ArgoCdBackoff{
+									Duration:    "5s",
+									MaxDuration: "3m",
+								},
+							},
+							Finalizer: ptr.FromString("background"),
+						},
+						ApplicationSyncPolicies: map[string]config.ArgoCdSyncPolicy{
+							"app": {
+								Automated: ptr.Bool(false),
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "With argocd application set",
+			Setup: []repository.Transformer{},
+			Request: &api.BatchRequest{
+				Actions: []*api.BatchAction{
+					{
+						Action: &api.BatchAction_CreateEnvironment{
+							CreateEnvironment: &api.CreateEnvironmentRequest{
+								Environment: "env",
+								Config: &api.EnvironmentConfig{
+									Argocd: &api.EnvironmentConfig_ArgoCD{
+										ApplicationSet: true,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			ExpectedResponse: &api.BatchResponse{
+				Results: []*api.BatchResult{
+					nil,
+				},
+			},
+			ExpectedEnvironments: map[string]config.EnvironmentConfig{
+				"env": config.EnvironmentConfig{
+					ArgoCd: &config.EnvironmentConfigArgoCd{
+						ApplicationSet: true,
+					},
+				},
+			},
+		},
+		{
+			Name:  "With flux config",
+			Setup: []repository.Transformer{},
+			Request: &api.BatchRequest{
+				Actions: []*api.BatchAction{
+					{
+						Action: &api.BatchAction_CreateEnvironment{
+							CreateEnvironment: &api.CreateEnvironmentRequest{
+								Environment: "env",
+								Config: &api.EnvironmentConfig{
+									Flux: &api.EnvironmentConfig_Flux{
+										Namespace:        "flux",
+										Interval:         "5m",
+										TargetNamespace:  "target",
+										KubeConfigSecret: "kubeconfig",
+										GitSecret:        "git",
+										Prune:            ptr.Bool(false),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			ExpectedResponse: &api.BatchResponse{
+				Results: []*api.BatchResult{
+					nil,
+				},
+			},
+			ExpectedEnvironments: map[string]config.EnvironmentConfig{
+				"env": config.EnvironmentConfig{
+					Flux: &config.EnvironmentConfigFlux{
+						Namespace:        "flux",
+						Interval:         "5m",
+						TargetNamespace:  "target",
+						KubeConfigSecret: "kubeconfig",
+						GitSecret:        "git",
+						Prune:            ptr.Bool(false),
+					},
+				},
+			},
+		},
 	}
 	for _, tc := range tcs {
 		tc := tc
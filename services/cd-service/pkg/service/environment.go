@@ -27,17 +27,42 @@ func transformUpstreamToConfig(upstream *api.EnvironmentConfig_Upstream) *config
 	}
 	if upstream.GetLatest() {
 		return &config.EnvironmentConfigUpstream{
-			Latest: true,
+			Latest:     true,
+			HealthGate: transformHealthGateToConfig(upstream.HealthGate),
 		}
 	}
 	if upstream.GetEnvironment() != "" {
 		return &config.EnvironmentConfigUpstream{
 			Environment: upstream.GetEnvironment(),
+			HealthGate:  transformHealthGateToConfig(upstream.HealthGate),
 		}
 	}
 	return nil
 }
 
+func transformHealthGateToConfig(gate *api.EnvironmentConfig_Upstream_HealthGate) *config.EnvironmentConfigHealthGate {
+	if gate == nil {
+		return nil
+	}
+	return &config.EnvironmentConfigHealthGate{
+		SoakTime: gate.SoakTime,
+	}
+}
+
+func transformFluxToConfig(in *api.EnvironmentConfig_Flux) *config.EnvironmentConfigFlux {
+	if in == nil {
+		return nil
+	}
+	return &config.EnvironmentConfigFlux{
+		Namespace:        in.Namespace,
+		Interval:         in.Interval,
+		TargetNamespace:  in.TargetNamespace,
+		KubeConfigSecret: in.KubeConfigSecret,
+		GitSecret:        in.GitSecret,
+		Prune:            in.Prune,
+	}
+}
+
 func transformSyncWindowsToConfig(syncWindows []*api.EnvironmentConfig_ArgoCD_SyncWindows) []config.ArgoCdSyncWindow {
 	var transformedSyncWindows []config.ArgoCdSyncWindow
 	for _, syncWindow := range syncWindows {
@@ -78,11 +103,93 @@ func transformIgnoreDifferencesToConfig(ignoreDifferences []*api.EnvironmentConf
 	return transformedIgnoreDifferences
 }
 
+func transformProjectRoles(in []*api.EnvironmentConfig_ArgoCD_ProjectRole) []config.ArgoCdProjectRole {
+	var transformedRoles []config.ArgoCdProjectRole
+	for _, role := range in {
+		var policies []config.ArgoCdProjectRolePolicy
+		for _, policy := range role.Policies {
+			policies = append(policies, config.ArgoCdProjectRolePolicy{
+				Resource:   policy.Resource,
+				Action:     policy.Action,
+				Object:     policy.Object,
+				Permission: policy.Permission,
+			})
+		}
+		transformedRoles = append(transformedRoles, config.ArgoCdProjectRole{
+			Name:        role.Name,
+			Description: role.Description,
+			Policies:    policies,
+			Groups:      role.Groups,
+		})
+	}
+	return transformedRoles
+}
+
+func transformOrphanedResources(in *api.EnvironmentConfig_ArgoCD_OrphanedResources) *config.ArgoCdOrphanedResources {
+	if in == nil {
+		return nil
+	}
+	var ignore []config.ArgoCdOrphanedResourceKey
+	for _, key := range in.Ignore {
+		ignore = append(ignore, config.ArgoCdOrphanedResourceKey{
+			Group: key.Group,
+			Kind:  key.Kind,
+			Name:  key.Name,
+		})
+	}
+	return &config.ArgoCdOrphanedResources{
+		Warn:   in.Warn,
+		Ignore: ignore,
+	}
+}
+
+func transformSyncPolicy(in *api.EnvironmentConfig_ArgoCD_SyncPolicy) *config.ArgoCdSyncPolicy {
+	if in == nil {
+		return nil
+	}
+	var retry *config.ArgoCdRetry
+	if in.Retry != nil {
+		retry = &config.ArgoCdRetry{
+			Limit: in.Retry.Limit,
+		}
+		if in.Retry.Backoff != nil {
+			retry.Backoff = &config.ArgoCdBackoff{
+				Duration:    in.Retry.Backoff.Duration,
+				Factor:      in.Retry.Backoff.Factor,
+				MaxDuration: in.Retry.Backoff.MaxDuration,
+			}
+		}
+	}
+	return &config.ArgoCdSyncPolicy{
+		Automated: in.Automated,
+		Prune:     in.Prune,
+		SelfHeal:  in.SelfHeal,
+		Retry:     retry,
+		Finalizer: in.Finalizer,
+	}
+}
+
+func transformApplicationSyncPolicies(in map[string]*api.EnvironmentConfig_ArgoCD_SyncPolicy) map[string]config.ArgoCdSyncPolicy {
+	if len(in) == 0 {
+		return nil
+	}
+	transformedPolicies := make(map[string]config.ArgoCdSyncPolicy, len(in))
+	for app, policy := range in {
+		if p := transformSyncPolicy(policy); p != nil {
+			transformedPolicies[app] = *p
+		} else {
+			transformedPolicies[app] = config.ArgoCdSyncPolicy{}
+		}
+	}
+	return transformedPolicies
+}
+
 func transformDestination(in *api.EnvironmentConfig_ArgoCD_Destination) config.ArgoCdDestination {
 	if in == nil {
 		return config.ArgoCdDestination{}
 	}
 	return config.ArgoCdDestination{
+		Id:                   in.Id,
 		Name:                 in.Name,
 		Server:               in.Server,
 		Namespace:            in.Namespace,
@@ -90,3 +197,48 @@ func transformDestination(in *api.EnvironmentConfig_ArgoCD_Destination) config.A
 		ApplicationNamespace: in.ApplicationNamespace,
 	}
 }
+
+func transformDestinations(in []*api.EnvironmentConfig_ArgoCD_Destination) []config.ArgoCdDestination {
+	var transformedDestinations []config.ArgoCdDestination
+	for _, destination := range in {
+		transformedDestinations = append(transformedDestinations, transformDestination(destination))
+	}
+	return transformedDestinations
+}
+
+func transformArgoCdOverrides(in *api.ArgoCdOverrides) *config.ArgoCdApplicationOverrides {
+	if in == nil {
+		return nil
+	}
+	return &config.ArgoCdApplicationOverrides{
+		Annotations:          in.Annotations,
+		Labels:               in.Labels,
+		IgnoreDifferences:    transformIgnoreDifferencesToConfig(in.IgnoreDifferences),
+		SyncOptions:          in.SyncOptions,
+		DestinationNamespace: in.DestinationNamespace,
+	}
+}
+
+func transformReleaseSource(in *api.ReleaseSource) *config.ReleaseSource {
+	switch source := in.GetSource().(type) {
+	case *api.ReleaseSource_Helm_:
+		return &config.ReleaseSource{
+			Helm: &config.HelmSource{
+				RepoURL:     source.Helm.RepoURL,
+				Chart:       source.Helm.Chart,
+				Version:     source.Helm.Version,
+				ReleaseName: source.Helm.ReleaseName,
+			},
+		}
+	case *api.ReleaseSource_Kustomize_:
+		return &config.ReleaseSource{
+			Kustomize: &config.KustomizeSource{
+				NamePrefix:   source.Kustomize.NamePrefix,
+				NameSuffix:   source.Kustomize.NameSuffix,
+				CommonLabels: source.Kustomize.CommonLabels,
+				Images:       source.Kustomize.Images,
+			},
+		}
+	}
+	return nil
+}
@@ -26,6 +26,7 @@ import (
 	"regexp"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/mapper"
 
@@ -33,6 +34,7 @@ import (
 	git "github.com/libgit2/git2go/v34"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/freiheit-com/kuberpult/pkg/api"
@@ -40,13 +42,27 @@ import (
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/repository"
 )
 
+// rolloutPublishDelay collects changes of the rollout status, so that busy environments don't send a new overview for every change
+var rolloutPublishDelay = time.Second
+
+// RolloutStatus is implemented by rollout.Health
+type RolloutStatus interface {
+	// Rollout returns nil if the status is unknown
+	Rollout(environment, application string) *api.Environment_Application_Rollout
+	Notify() *notify.Notify
+}
+
 type OverviewServiceServer struct {
 	Repository repository.Repository
 	Shutdown   <-chan struct{}
+	// RolloutStatus is optional, if it's set the overview of the current state contains the rollout status of all applications
+	RolloutStatus RolloutStatus
 
 	notify notify.Notify
 
-	init     sync.Once
+	init sync.Once
+	// overview is the last overview computed from the repository, it's only used by the goroutine started in subscribe
+	overview *api.GetOverviewResponse
 	response atomic.Value
 }
 
@@ -54,23 +70,82 @@ func (o *OverviewServiceServer) GetOverview(
 	ctx context.Context,
 	in *api.GetOverviewRequest) (*api.GetOverviewResponse, error) {
 	if in.GitRevision != "" {
-		oid, err := git.NewOid(in.GitRevision)
+		state, err := o.stateAt(in.GitRevision)
 		if err != nil {
 			return nil, err
 		}
-		state, err := o.Repository.StateAt(oid)
-		if err != nil {
-			var gerr *git.GitError
-			if errors.As(err, &gerr) {
-				if gerr.Code == git.ErrNotFound {
-					return nil, status.Error(codes.NotFound, "not found")
-				}
+		return o.getOverview(ctx, state)
+	}
+	result, err := o.getOverview(ctx, o.Repository.State())
+	if err != nil {
+		return nil, err
+	}
+	o.addRolloutStatus(result)
+	return result, nil
+}
+
+// addRolloutStatus embeds the current rollout status into the overview.
+// It's only meaningful for the current state of the repository, so overviews of older revisions don't contain it.
+func (o *OverviewServiceServer) addRolloutStatus(overview *api.GetOverviewResponse) {
+	if o.RolloutStatus == nil {
+		return
+	}
+	for _, group := range overview.EnvironmentGroups {
+		for _, env := range group.Environments {
+			for _, app := range env.Applications {
+				app.Rollout = o.RolloutStatus.Rollout(env.Name, app.Name)
 			}
-			return nil, err
 		}
-		return o.getOverview(ctx, state)
 	}
-	return o.getOverview(ctx, o.Repository.State())
+}
+
+func (o *OverviewServiceServer) stateAt(revision string) (*repository.State, error) {
+	oid, err := git.NewOid(revision)
+	if err != nil {
+		return nil, err
+	}
+	state, err := o.Repository.StateAt(oid)
+	if err != nil {
+		var gerr *git.GitError
+		if errors.As(err, &gerr) {
+			if gerr.Code == git.ErrNotFound {
+				return nil, status.Error(codes.NotFound, "not found")
+			}
+		}
+		return nil, err
+	}
+	return state, nil
+}
+
+// GetAppVersionAtRevision only reads the version and deployment time of one application.
+// Clients that only need this should prefer it over GetOverview, which has to read the whole repository.
+func (o *OverviewServiceServer) GetAppVersionAtRevision(
+	ctx context.Context,
+	in *api.GetAppVersionAtRevisionRequest) (*api.GetAppVersionAtRevisionResponse, error) {
+	if in.GitRevision == "" || in.Environment == "" || in.Application == "" {
+		return nil, status.Error(codes.InvalidArgument, "git revision, environment and application must not be empty")
+	}
+	s, err := o.stateAt(in.GitRevision)
+	if err != nil {
+		return nil, err
+	}
+	result := &api.GetAppVersionAtRevisionResponse{}
+	version, err := s.GetEnvironmentApplicationVersion(in.Environment, in.Application)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, grpc.InternalError(ctx, err)
+	}
+	if version == nil {
+		return result, nil
+	}
+	result.Version = *version
+	_, deployTime, err := s.GetDeploymentMetaData(ctx, in.Environment, in.Application)
+	if err != nil {
+		return nil, grpc.InternalError(ctx, err)
+	}
+	if !deployTime.IsZero() {
+		result.DeployedAt = timestamppb.New(deployTime)
+	}
+	return result, nil
 }
 
 func (o *OverviewServiceServer) getOverview(
@@ -396,14 +471,33 @@ func (o *OverviewServiceServer) subscribe() (<-chan struct{}, notify.Unsubscribe
 		case <-ch:
 			o.update(o.Repository.State())
 		}
+		// a nil channel never fires, so this is a noop without rollout status
+		var rolloutCh <-chan struct{}
+		unsubRollout := func() {}
+		if o.RolloutStatus != nil {
+			rolloutCh, unsubRollout = o.RolloutStatus.Notify().Subscribe()
+		}
 		go func() {
 			defer unsub()
+			defer unsubRollout()
+			// delay is set while changes of the rollout status wait to be published
+			var delay <-chan time.Time
 			for {
 				select {
 				case <-o.Shutdown:
 					return
 				case <-ch:
 					o.update(o.Repository.State())
+					// the new overview already contains the current rollout status
+					delay = nil
+				case <-rolloutCh:
+					if delay == nil {
+						delay = time.After(rolloutPublishDelay)
+					}
+				case <-delay:
+					delay = nil
+					// the rollout status changes much more often than the repository, so the overview is not computed again
+					o.publish()
 				}
 			}
 		}()
@@ -416,6 +510,17 @@ func (o *OverviewServiceServer) update(s *repository.State) {
 	if err != nil {
 		panic(err)
 	}
+	o.overview = r
+	o.publish()
+}
+
+func (o *OverviewServiceServer) publish() {
+	r := o.overview
+	if o.RolloutStatus != nil {
+		// streams may still send the previous response, so it must not be modified
+		r = proto.Clone(r).(*api.GetOverviewResponse)
+		o.addRolloutStatus(r)
+	}
 	o.response.Store(r)
 	o.notify.Notify()
 }
@@ -25,9 +25,14 @@ import (
 
 	"github.com/freiheit-com/kuberpult/pkg/api"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/notify"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/repository"
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
 )
 
 type mockOverviewService_StreamOverviewServer struct {
@@ -763,6 +768,244 @@ func TestOverviewServiceFromCommit(t *testing.T) {
 	}
 }
 
+type fakeRolloutStatus struct {
+	mx       sync.Mutex
+	rollouts map[string]*api.Environment_Application_Rollout
+	notify   notify.Notify
+}
+
+func (f *fakeRolloutStatus) Rollout(environment, application string) *api.Environment_Application_Rollout {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.rollouts[environment+"/"+application]
+}
+
+func (f *fakeRolloutStatus) Notify() *notify.Notify {
+	return &f.notify
+}
+
+func (f *fakeRolloutStatus) set(environment, application string, rollout *api.Environment_Application_Rollout) {
+	f.mx.Lock()
+	f.rollouts[environment+"/"+application] = rollout
+	f.mx.Unlock()
+	f.notify.Notify()
+}
+
+func TestOverviewServiceRolloutStatus(t *testing.T) {
+	shutdown := make(chan struct{}, 1)
+	defer close(shutdown)
+	repo, err := setupRepositoryTest(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformers := []repository.Transformer{
+		&repository.CreateEnvironment{
+			Environment: "development",
+			Config:      config.EnvironmentConfig{},
+		},
+		&repository.CreateApplicationVersion{
+			Application: "test",
+			Manifests: map[string]string{
+				"development": "v1",
+			},
+		},
+		&repository.DeployApplicationVersion{
+			Application: "test",
+			Environment: "development",
+			Version:     1,
+		},
+	}
+	for _, tr := range transformers {
+		if err := repo.Apply(testutil.MakeTestContext(), tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	progressing := &api.Environment_Application_Rollout{
+		RolloutStatus: api.RolloutStatus_RolloutStatusProgressing,
+		Version:       1,
+		SyncRevision:  "1234",
+	}
+	successful := &api.Environment_Application_Rollout{
+		RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful,
+		Version:       1,
+		SyncRevision:  "1234",
+	}
+	rs := &fakeRolloutStatus{rollouts: map[string]*api.Environment_Application_Rollout{
+		"development/test": progressing,
+	}}
+	svc := &OverviewServiceServer{
+		Repository:    repo,
+		Shutdown:      shutdown,
+		RolloutStatus: rs,
+	}
+	rolloutOf := func(ov *api.GetOverviewResponse) *api.Environment_Application_Rollout {
+		return ov.GetEnvironmentGroups()[0].GetEnvironments()[0].GetApplications()["test"].GetRollout()
+	}
+
+	ov, err := svc.GetOverview(testutil.MakeTestContext(), &api.GetOverviewRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(progressing, rolloutOf(ov), protocmp.Transform()); d != "" {
+		t.Errorf("unexpected rollout status: %s", d)
+	}
+	ov, err = svc.GetOverview(testutil.MakeTestContext(), &api.GetOverviewRequest{GitRevision: ov.GitRevision})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rolloutOf(ov); r != nil {
+		t.Errorf("expected no rollout status for an explicit revision, got %v", r)
+	}
+
+	ctx, cancel := context.WithCancel(testutil.MakeTestContext())
+	ch := make(chan *api.GetOverviewResponse)
+	stream := mockOverviewService_StreamOverviewServer{
+		Results: ch,
+		Ctx:     ctx,
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- svc.StreamOverview(&api.GetOverviewRequest{}, &stream)
+	}()
+	overview1 := <-ch
+	if d := cmp.Diff(progressing, rolloutOf(overview1), protocmp.Transform()); d != "" {
+		t.Errorf("unexpected rollout status: %s", d)
+	}
+	rs.set("development", "test", successful)
+	// the overview is sent again with the new status, there may be further overviews with the old status until then
+	for {
+		overview2 := <-ch
+		if overview2.GitRevision != overview1.GitRevision {
+			t.Errorf("expected the same git revision, got %q and %q", overview1.GitRevision, overview2.GitRevision)
+		}
+		if proto.Equal(successful, rolloutOf(overview2)) {
+			break
+		}
+	}
+	if d := cmp.Diff(progressing, rolloutOf(overview1), protocmp.Transform()); d != "" {
+		t.Errorf("expected the previous overview to be unchanged: %s", d)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected no error, got %q", err)
+	}
+}
+
+func TestGetAppVersionAtRevision(t *testing.T) {
+	shutdown := make(chan struct{}, 1)
+	defer close(shutdown)
+	repo, err := setupRepositoryTest(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &OverviewServiceServer{
+		Repository: repo,
+		Shutdown:   shutdown,
+	}
+	revision := func() string {
+		ov, err := svc.GetOverview(testutil.MakeTestContext(), &api.GetOverviewRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ov.GitRevision
+	}
+	transformers := []repository.Transformer{
+		&repository.CreateEnvironment{
+			Environment: "development",
+			Config:      config.EnvironmentConfig{},
+		},
+		&repository.CreateApplicationVersion{
+			Application: "test",
+			Manifests: map[string]string{
+				"development": "dev",
+			},
+		},
+		&repository.CreateApplicationVersion{
+			Application: "test",
+			Manifests: map[string]string{
+				"development": "dev",
+			},
+		},
+	}
+	for _, tr := range transformers {
+		if err := repo.Apply(testutil.MakeTestContext(), tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notDeployed := revision()
+	if err := repo.Apply(testutil.MakeTestContext(), &repository.DeployApplicationVersion{
+		Application: "test",
+		Environment: "development",
+		Version:     1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	deployed := revision()
+	if err := repo.Apply(testutil.MakeTestContext(), &repository.DeployApplicationVersion{
+		Application: "test",
+		Environment: "development",
+		Version:     2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		Name            string
+		Request         *api.GetAppVersionAtRevisionRequest
+		ExpectedVersion uint64
+		ExpectedCode    codes.Code
+	}{
+		{
+			Name:            "not deployed yet",
+			Request:         &api.GetAppVersionAtRevisionRequest{GitRevision: notDeployed, Environment: "development", Application: "test"},
+			ExpectedVersion: 0,
+		},
+		{
+			Name:            "deployed version at an older revision",
+			Request:         &api.GetAppVersionAtRevisionRequest{GitRevision: deployed, Environment: "development", Application: "test"},
+			ExpectedVersion: 1,
+		},
+		{
+			Name:            "deployed version at the latest revision",
+			Request:         &api.GetAppVersionAtRevisionRequest{GitRevision: revision(), Environment: "development", Application: "test"},
+			ExpectedVersion: 2,
+		},
+		{
+			Name:            "unknown application",
+			Request:         &api.GetAppVersionAtRevisionRequest{GitRevision: deployed, Environment: "development", Application: "unknown"},
+			ExpectedVersion: 0,
+		},
+		{
+			Name:         "unknown revision",
+			Request:      &api.GetAppVersionAtRevisionRequest{GitRevision: "0000000000000000000000000000000000000001", Environment: "development", Application: "test"},
+			ExpectedCode: codes.NotFound,
+		},
+		{
+			Name:         "missing application",
+			Request:      &api.GetAppVersionAtRevisionRequest{GitRevision: deployed, Environment: "development"},
+			ExpectedCode: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			resp, err := svc.GetAppVersionAtRevision(testutil.MakeTestContext(), tc.Request)
+			if status.Code(err) != tc.ExpectedCode {
+				t.Fatalf("expected code %s, got %v", tc.ExpectedCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if resp.Version != tc.ExpectedVersion {
+				t.Errorf("expected version %d, got %d", tc.ExpectedVersion, resp.Version)
+			}
+			if (resp.DeployedAt != nil) != (tc.ExpectedVersion != 0) {
+				t.Errorf("expected a deployment time only for deployed versions, got %v", resp.DeployedAt)
+			}
+		})
+	}
+}
+
 func groupFromEnvs(environments []*api.Environment) []*api.EnvironmentGroup {
 	return []*api.EnvironmentGroup{
 		{
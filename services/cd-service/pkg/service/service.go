@@ -18,9 +18,10 @@ package service
 
 import (
 	"fmt"
+	"net/http"
+
 	xpath "github.com/freiheit-com/kuberpult/pkg/path"
 	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/repository"
-	"net/http"
 )
 
 type Service struct {
@@ -32,6 +33,8 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch head {
 	case "health":
 		s.ServeHTTPHealth(w, r)
+	case "fetch":
+		s.ServeHTTPFetch(w, r)
 	case "release":
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "release endpoint is now only provided in the frontend-service")
@@ -44,4 +47,16 @@ func (s *Service) ServeHTTPHealth(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "ok\n")
 }
 
+// ServeHTTPFetch can be used as a push webhook of the manifest repo, so that read-only instances pick up changes immediately.
+// The endpoint is not authenticated, so the repository merges triggers and fetches at most once per MinTriggeredFetchInterval.
+func (s *Service) ServeHTTPFetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.Repository.Fetch()
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "fetch scheduled\n")
+}
+
 var _ http.Handler = (*Service)(nil)
@@ -0,0 +1,74 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/pkg/auth"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/repository"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SnapshotServer exports and restores the complete state of kuberpult.
+// Both calls contain all manifests, so they require the ExportSnapshot and RestoreSnapshot permissions when dex is enabled.
+type SnapshotServer struct {
+	Repository repository.Repository
+	RBACConfig auth.RBACConfig
+}
+
+func (s *SnapshotServer) ExportSnapshot(ctx context.Context, in *api.ExportSnapshotRequest) (*api.ExportSnapshotResponse, error) {
+	if s.RBACConfig.DexEnabled {
+		user, err := auth.ReadUserFromContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := auth.CheckUserPermissions(s.RBACConfig, user, "*", "", "*", "*", auth.PermissionExportSnapshot); err != nil {
+			return nil, err
+		}
+	}
+	snapshot, err := s.Repository.State().Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &api.ExportSnapshotResponse{Snapshot: buf}, nil
+}
+
+func (s *SnapshotServer) RestoreSnapshot(ctx context.Context, in *api.RestoreSnapshotRequest) (*api.RestoreSnapshotResponse, error) {
+	var snapshot repository.Snapshot
+	if err := json.Unmarshal(in.Snapshot, &snapshot); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid snapshot: %v", err))
+	}
+	err := s.Repository.Apply(ctx, &repository.RestoreSnapshot{
+		Authentication: repository.Authentication{RBACConfig: s.RBACConfig},
+		Snapshot:       &snapshot,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &api.RestoreSnapshotResponse{}, nil
+}
+
+var _ api.SnapshotServiceServer = (*SnapshotServer)(nil)
@@ -0,0 +1,122 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package service
+
+import (
+	"testing"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/pkg/auth"
+	"github.com/freiheit-com/kuberpult/pkg/testutil"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/repository"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSnapshotServer(t *testing.T) {
+	setup := []repository.Transformer{
+		&repository.CreateEnvironment{
+			Environment: "production",
+			Config:      config.EnvironmentConfig{Upstream: &config.EnvironmentConfigUpstream{Latest: true}},
+		},
+		&repository.CreateApplicationVersion{
+			Application: "test",
+			Manifests: map[string]string{
+				"production": "manifest",
+			},
+		},
+	}
+	tcs := []struct {
+		Name         string
+		RBACConfig   auth.RBACConfig
+		ExpectedCode codes.Code
+	}{
+		{
+			Name:         "without dex",
+			RBACConfig:   auth.RBACConfig{DexEnabled: false},
+			ExpectedCode: codes.OK,
+		},
+		{
+			Name: "dex without permissions",
+			RBACConfig: auth.RBACConfig{
+				DexEnabled: true,
+				Policy: map[string]*auth.Permission{
+					"developer,DeployRelease,*:*,*,allow": {Role: "developer"},
+				},
+			},
+			ExpectedCode: codes.PermissionDenied,
+		},
+		{
+			Name: "dex with permissions",
+			RBACConfig: auth.RBACConfig{
+				DexEnabled: true,
+				Policy: map[string]*auth.Permission{
+					"developer,ExportSnapshot,*:*,*,allow":  {Role: "developer"},
+					"developer,RestoreSnapshot,*:*,*,allow": {Role: "developer"},
+				},
+			},
+			ExpectedCode: codes.OK,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := testutil.MakeTestContextDexEnabled()
+			repo, err := setupRepositoryTest(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.Apply(ctx, setup...); err != nil {
+				t.Fatal(err)
+			}
+			svc := &SnapshotServer{Repository: repo, RBACConfig: tc.RBACConfig}
+			exported, err := svc.ExportSnapshot(ctx, &api.ExportSnapshotRequest{})
+			if status.Code(err) != tc.ExpectedCode {
+				t.Fatalf("expected code %s for export, but got %v", tc.ExpectedCode, err)
+			}
+			restoredRepo, err := setupRepositoryTest(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			restoreSvc := &SnapshotServer{Repository: restoredRepo, RBACConfig: tc.RBACConfig}
+			if tc.ExpectedCode != codes.OK {
+				// even a valid snapshot must be rejected
+				_, err := restoreSvc.RestoreSnapshot(ctx, &api.RestoreSnapshotRequest{Snapshot: []byte(`{"version": 1}`)})
+				if status.Code(err) != tc.ExpectedCode {
+					t.Fatalf("expected code %s for restore, but got %v", tc.ExpectedCode, err)
+				}
+				return
+			}
+			if _, err := restoreSvc.RestoreSnapshot(ctx, &api.RestoreSnapshotRequest{Snapshot: exported.Snapshot}); err != nil {
+				t.Fatal(err)
+			}
+			expected, err := repo.State().Snapshot(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := restoredRepo.State().Snapshot(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(expected, actual); d != "" {
+				t.Errorf("restored snapshot differs:\n%s", d)
+			}
+		})
+	}
+}
@@ -19,6 +19,9 @@ Copyright 2023 freiheit.com*/
 #include <string.h>
 #include "sqlite.h"
 
+/* readers wait this long while a compaction holds the database lock */
+#define KP_BUSY_TIMEOUT_MS 10000
+
 typedef struct {
 	git_odb_backend parent;
 	sqlite3 *db;
@@ -187,6 +190,7 @@ int kp_backend_sqlite(git_odb_backend **backend_out, const char *sqlite_db, cons
 	  kp_backend__free((git_odb_backend *)backend);
 	  return error;
         }
+	sqlite3_busy_timeout(backend->db, KP_BUSY_TIMEOUT_MS);
 
 	error = create_table_if_not_exists(backend->db);
 	if (error != SQLITE_OK){
@@ -213,3 +217,66 @@ int kp_backend_sqlite(git_odb_backend **backend_out, const char *sqlite_db, cons
 	*backend_out = (git_odb_backend *)backend;
         return SQLITE_OK;
 }
+
+int kp_sqlite_compact(const char *sqlite_db, const git_oid *keep, size_t keep_len, int *removed_out, char **err_out)
+{
+	sqlite3 *db = NULL;
+	sqlite3_stmt *insert = NULL;
+	int error = SQLITE_ERROR;
+	size_t i;
+
+	error = sqlite3_open(sqlite_db, &db);
+	if (error != SQLITE_OK) {
+		goto done;
+	}
+	sqlite3_busy_timeout(db, KP_BUSY_TIMEOUT_MS);
+
+	error = sqlite3_exec(db,
+		"CREATE TEMP TABLE 'keep' ('oid' CHARACTER(20) PRIMARY KEY NOT NULL);"
+		"BEGIN;", NULL, NULL, NULL);
+	if (error != SQLITE_OK) {
+		goto done;
+	}
+	error = sqlite3_prepare_v2(db, "INSERT OR IGNORE INTO 'keep' VALUES (?);", -1, &insert, NULL);
+	if (error != SQLITE_OK) {
+		goto rollback;
+	}
+	for (i = 0; i < keep_len; i++) {
+		error = sqlite3_bind_text(insert, 1, (char *)keep[i].id, 20, SQLITE_TRANSIENT);
+		if (error != SQLITE_OK) {
+			goto rollback;
+		}
+		error = sqlite3_step(insert);
+		sqlite3_reset(insert);
+		if (error != SQLITE_DONE) {
+			goto rollback;
+		}
+	}
+	error = sqlite3_exec(db, "DELETE FROM 'odb' WHERE oid NOT IN (SELECT oid FROM 'keep');", NULL, NULL, NULL);
+	if (error != SQLITE_OK) {
+		goto rollback;
+	}
+	*removed_out = sqlite3_changes(db);
+	error = sqlite3_exec(db, "COMMIT;", NULL, NULL, NULL);
+	if (error != SQLITE_OK) {
+		goto rollback;
+	}
+	/* the deleted objects only leave free pages behind, vacuum gives them back to the filesystem */
+	error = sqlite3_exec(db, "VACUUM;", NULL, NULL, NULL);
+	goto done;
+
+rollback:
+	*err_out = sqlite3_mprintf("%s", sqlite3_errmsg(db));
+	sqlite3_exec(db, "ROLLBACK;", NULL, NULL, NULL);
+	sqlite3_finalize(insert);
+	sqlite3_close(db);
+	return error;
+
+done:
+	if (error != SQLITE_OK) {
+		*err_out = sqlite3_mprintf("%s", sqlite3_errmsg(db));
+	}
+	sqlite3_finalize(insert);
+	sqlite3_close(db);
+	return error;
+}
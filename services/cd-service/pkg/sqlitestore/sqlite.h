@@ -16,3 +16,4 @@ Copyright 2023 freiheit.com*/
 #include <git2/sys/odb_backend.h>
 
 int kp_backend_sqlite(git_odb_backend **backend_out, const char *sqlite_db, const char **err_out);
+int kp_sqlite_compact(const char *sqlite_db, const git_oid *keep, size_t keep_len, int *removed_out, char **err_out);
@@ -19,6 +19,7 @@ package sqlitestore
 /*
 #include <git2.h>
 #include <sqlite3.h>
+#include <stdlib.h>
 #include "sqlite.h"
 */
 import "C"
@@ -41,3 +42,25 @@ func NewOdbBackend(name string) (*git.OdbBackend, error) {
 	}
 	return git.NewOdbBackendFromC(unsafe.Pointer(result)), nil
 }
+
+// Compact deletes all objects except the ones in keep from the sqlite database and returns the number of deleted objects.
+func Compact(name string, keep []git.Oid) (int, error) {
+	var (
+		removed C.int
+		err_out *C.char
+		keepPtr *C.git_oid
+	)
+	if len(keep) > 0 {
+		// git.Oid has the same memory layout as git_oid
+		keepPtr = (*C.git_oid)(unsafe.Pointer(&keep[0]))
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	err := C.kp_sqlite_compact(cname, keepPtr, C.size_t(len(keep)), &removed, &err_out)
+	if err != C.SQLITE_OK {
+		defer C.sqlite3_free(unsafe.Pointer(err_out))
+		str := C.GoString(C.sqlite3_errstr(err))
+		return 0, fmt.Errorf("sqlitestore: compact: %d %s %s", err, str, C.GoString(err_out))
+	}
+	return int(removed), nil
+}
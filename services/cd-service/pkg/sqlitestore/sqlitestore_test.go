@@ -16,6 +16,7 @@ Copyright 2023 freiheit.com*/
 package sqlitestore
 
 import (
+	"path/filepath"
 	"testing"
 
 	git "github.com/libgit2/git2go/v34"
@@ -47,3 +48,53 @@ func TestWriteAndRead(t *testing.T) {
 		t.Errorf("unexpected result, expected: %q, actual: %q", data, string(result.Data()))
 	}
 }
+
+func TestCompact(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "odb.sqlite")
+	be, err := NewOdbBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = odb.AddBackend(be, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := odb.Write([]byte("kept"), git.ObjectBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := odb.Write([]byte("removed"), git.ObjectBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := Compact(name, []git.Oid{*kept})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 removed object, but got %d", count)
+	}
+	// a fresh odb makes sure that nothing is served from a cache
+	be, err = NewOdbBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	odb, err = git.NewOdb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = odb.AddBackend(be, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !odb.Exists(kept) {
+		t.Errorf("expected %s to be kept", kept)
+	}
+	if odb.Exists(removed) {
+		t.Errorf("expected %s to be removed", removed)
+	}
+}
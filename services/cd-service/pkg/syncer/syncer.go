@@ -0,0 +1,193 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+// Package syncer asks argocd to sync applications right after kuberpult changed them,
+// instead of waiting for argocd to notice the change in the manifest repo.
+package syncer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	argoapplication "github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	argoappv1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	"github.com/freiheit-com/kuberpult/pkg/ptr"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/argocd"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+const (
+	syncTimeout = 60 * time.Second
+	// queueSize limits the syncs that wait for a worker. Further syncs are dropped, argocd still notices the change in the manifest repo on its own.
+	queueSize = 1000
+)
+
+// this is a simpler version of the ApplicationServiceClient of argocd
+type SimplifiedApplicationInterface interface {
+	Get(ctx context.Context, in *argoapplication.ApplicationQuery, opts ...grpc.CallOption) (*argoappv1.Application, error)
+	Sync(ctx context.Context, in *argoapplication.ApplicationSyncRequest, opts ...grpc.CallOption) (*argoappv1.Application, error)
+}
+
+// type assertion
+var (
+	_ SimplifiedApplicationInterface = (argoapplication.ApplicationServiceClient)(nil)
+)
+
+type AppEnv struct {
+	Environment string
+	Application string
+}
+
+type Syncer struct {
+	client SimplifiedApplicationInterface
+	queue  chan syncJob
+	// pending counts the queued and running syncs
+	pending sync.WaitGroup
+}
+
+type syncJob struct {
+	ctx     context.Context
+	app     AppEnv
+	name    string
+	allowed bool
+}
+
+// New starts concurrencyLimit workers that sync the applications for the lifetime of the process.
+func New(client SimplifiedApplicationInterface, concurrencyLimit int) *Syncer {
+	return newSyncer(client, concurrencyLimit, queueSize)
+}
+
+func newSyncer(client SimplifiedApplicationInterface, concurrencyLimit, queueSize int) *Syncer {
+	s := &Syncer{
+		client: client,
+		queue:  make(chan syncJob, queueSize),
+	}
+	for i := 0; i < concurrencyLimit; i++ {
+		go func() {
+			for job := range s.queue {
+				s.syncApp(job.ctx, job.app, job.name, job.allowed)
+				s.pending.Done()
+			}
+		}()
+	}
+	return s
+}
+
+// SyncApps queues a sync of the argocd applications of the changed apps. It never blocks, because it's called by the writer of the repository.
+// Applications that are blocked by a sync window of their environment or that have no automated sync policy are only refreshed.
+// Environments without argocd config (e.g. flux environments) are ignored.
+func (s *Syncer) SyncApps(ctx context.Context, configs map[string]config.EnvironmentConfig, apps []AppEnv) {
+	seen := map[string]bool{}
+	for _, app := range apps {
+		envConfig, ok := configs[app.Environment]
+		if !ok || envConfig.ArgoCd == nil {
+			continue
+		}
+		windows := syncWindows(envConfig.ArgoCd.SyncWindows)
+		automated := envConfig.ArgoCd.SyncPolicyForApp(app.Application).IsAutomated()
+		for _, name := range argocd.ApplicationNames(envConfig.ArgoCd, app.Environment, app.Application) {
+			if seen[name] {
+				// one push can change an app several times
+				continue
+			}
+			seen[name] = true
+			// a manual sync policy means that someone else decides when to sync
+			allowed := automated && canSync(windows, name)
+			s.pending.Add(1)
+			select {
+			case s.queue <- syncJob{ctx: ctx, app: app, name: name, allowed: allowed}:
+			default:
+				s.pending.Done()
+				logger.FromContext(ctx).Warn("argocd.sync.dropped", zap.String("environment", app.Environment), zap.String("application", app.Application), zap.String("argocd.application", name))
+			}
+		}
+	}
+}
+
+// Wait blocks until all queued syncs are done.
+func (s *Syncer) Wait() {
+	s.pending.Wait()
+}
+
+func (s *Syncer) syncApp(ctx context.Context, app AppEnv, name string, allowed bool) {
+	var err error
+	span, ctx := tracer.StartSpanFromContext(ctx, "argocd.sync")
+	defer func() { span.Finish(tracer.WithError(err)) }()
+	span.SetTag("environment", app.Environment)
+	span.SetTag("application", app.Application)
+	span.SetTag("argocd.application", name)
+	span.SetTag("allowed", allowed)
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+	l := logger.FromContext(ctx).With(zap.String("environment", app.Environment), zap.String("application", app.Application), zap.String("argocd.application", name))
+	if !allowed {
+		// argocd picks up the change once the sync window opens or someone syncs manually, so a refresh is all we can do:
+		l.Info("argocd.sync.blocked")
+		_, err = s.client.Get(ctx, &argoapplication.ApplicationQuery{
+			Name:    ptr.FromString(name),
+			Refresh: ptr.FromString(string(argoappv1.RefreshTypeNormal)),
+		})
+		if err != nil {
+			l.Error("argocd.refresh", zap.Error(err))
+		}
+		return
+	}
+	_, err = s.client.Sync(ctx, &argoapplication.ApplicationSyncRequest{
+		Name: ptr.FromString(name),
+	})
+	if err != nil {
+		l.Error("argocd.sync", zap.Error(err))
+	}
+}
+
+// syncWindows converts the kuberpult sync windows to the argocd ones in the same way as they are rendered into the AppProject.
+func syncWindows(windows []config.ArgoCdSyncWindow) argoappv1.SyncWindows {
+	result := argoappv1.SyncWindows{}
+	for _, w := range windows {
+		apps := []string{"*"}
+		if len(w.Apps) > 0 {
+			apps = w.Apps
+		}
+		result = append(result, &argoappv1.SyncWindow{
+			Applications: apps,
+			Schedule:     w.Schedule,
+			Duration:     w.Duration,
+			Kind:         w.Kind,
+			// kuberpult syncs like argocd's automated sync would, so it must not bypass deny windows.
+			ManualSync: false,
+		})
+	}
+	return result
+}
+
+func canSync(windows argoappv1.SyncWindows, name string) bool {
+	matching := windows.Matches(applicationNamed(name))
+	if matching == nil {
+		return true
+	}
+	return matching.CanSync(false)
+}
+
+func applicationNamed(name string) *argoappv1.Application {
+	app := &argoappv1.Application{}
+	app.Name = name
+	return app
+}
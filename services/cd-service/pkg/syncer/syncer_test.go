@@ -0,0 +1,247 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package syncer
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	argoapplication "github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	argoappv1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/freiheit-com/kuberpult/pkg/ptr"
+	"github.com/freiheit-com/kuberpult/services/cd-service/pkg/config"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeApplicationServer is a fake argocd ApplicationService that records all calls
+type fakeApplicationServer struct {
+	argoapplication.UnimplementedApplicationServiceServer
+	mx        sync.Mutex
+	synced    []string
+	refreshed []string
+}
+
+func (f *fakeApplicationServer) Sync(ctx context.Context, req *argoapplication.ApplicationSyncRequest) (*argoappv1.Application, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.synced = append(f.synced, req.GetName())
+	return applicationNamed(req.GetName()), nil
+}
+
+func (f *fakeApplicationServer) Get(ctx context.Context, req *argoapplication.ApplicationQuery) (*argoappv1.Application, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if req.GetRefresh() != string(argoappv1.RefreshTypeNormal) {
+		return nil, nil
+	}
+	f.refreshed = append(f.refreshed, req.GetName())
+	return applicationNamed(req.GetName()), nil
+}
+
+func startFakeArgoCd(t *testing.T) (*fakeApplicationServer, argoapplication.ApplicationServiceClient) {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer()
+	fake := &fakeApplicationServer{}
+	argoapplication.RegisterApplicationServiceServer(srv, fake)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return fake, argoapplication.NewApplicationServiceClient(conn)
+}
+
+// blockingClient blocks all syncs until it's released
+type blockingClient struct {
+	started chan struct{}
+	release chan struct{}
+	mx      sync.Mutex
+	synced  []string
+}
+
+func (b *blockingClient) Get(ctx context.Context, in *argoapplication.ApplicationQuery, opts ...grpc.CallOption) (*argoappv1.Application, error) {
+	return applicationNamed(in.GetName()), nil
+}
+
+func (b *blockingClient) Sync(ctx context.Context, in *argoapplication.ApplicationSyncRequest, opts ...grpc.CallOption) (*argoappv1.Application, error) {
+	b.started <- struct{}{}
+	<-b.release
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.synced = append(b.synced, in.GetName())
+	return applicationNamed(in.GetName()), nil
+}
+
+func TestSyncAppsDoesntBlock(t *testing.T) {
+	t.Parallel()
+	client := &blockingClient{started: make(chan struct{}, 4), release: make(chan struct{})}
+	s := newSyncer(client, 1, 2)
+	configs := map[string]config.EnvironmentConfig{
+		"development": {ArgoCd: &config.EnvironmentConfigArgoCd{}},
+	}
+	s.SyncApps(context.Background(), configs, []AppEnv{{Environment: "development", Application: "a"}})
+	<-client.started
+	done := make(chan struct{})
+	go func() {
+		// one sync is running, two are queued and the last one is dropped
+		for _, app := range []string{"b", "c", "d"} {
+			s.SyncApps(context.Background(), configs, []AppEnv{{Environment: "development", Application: app}})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SyncApps blocked while all workers were busy")
+	}
+	close(client.release)
+	s.Wait()
+	if len(client.synced) != 3 {
+		t.Errorf("expected 3 syncs and one dropped, got %v", client.synced)
+	}
+}
+
+func TestSyncApps(t *testing.T) {
+	tcs := []struct {
+		Name              string
+		Configs           map[string]config.EnvironmentConfig
+		Apps              []AppEnv
+		ExpectedSynced    []string
+		ExpectedRefreshed []string
+	}{
+		{
+			Name: "syncs all changed apps",
+			Configs: map[string]config.EnvironmentConfig{
+				"development": {ArgoCd: &config.EnvironmentConfigArgoCd{}},
+				"staging":     {ArgoCd: &config.EnvironmentConfigArgoCd{}},
+			},
+			Apps: []AppEnv{
+				{Environment: "development", Application: "foo"},
+				{Environment: "staging", Application: "foo"},
+				{Environment: "staging", Application: "bar"},
+				{Environment: "staging", Application: "foo"},
+			},
+			ExpectedSynced: []string{"development-foo", "staging-bar", "staging-foo"},
+		},
+		{
+			Name: "syncs every destination",
+			Configs: map[string]config.EnvironmentConfig{
+				"production": {ArgoCd: &config.EnvironmentConfigArgoCd{
+					Destinations: []config.ArgoCdDestination{{Id: "eu"}, {Id: "us"}},
+				}},
+			},
+			Apps: []AppEnv{
+				{Environment: "production", Application: "foo"},
+			},
+			ExpectedSynced: []string{"production-foo-eu", "production-foo-us"},
+		},
+		{
+			Name: "ignores environments without argocd",
+			Configs: map[string]config.EnvironmentConfig{
+				"development": {Flux: &config.EnvironmentConfigFlux{}},
+			},
+			Apps: []AppEnv{
+				{Environment: "development", Application: "foo"},
+				{Environment: "unknown", Application: "foo"},
+			},
+		},
+		{
+			Name: "only refreshes apps blocked by a deny window",
+			Configs: map[string]config.EnvironmentConfig{
+				"production": {ArgoCd: &config.EnvironmentConfigArgoCd{
+					SyncWindows: []config.ArgoCdSyncWindow{
+						{Kind: "deny", Schedule: "* * * * *", Duration: "1h", Apps: []string{"production-foo"}},
+					},
+				}},
+			},
+			Apps: []AppEnv{
+				{Environment: "production", Application: "foo"},
+				{Environment: "production", Application: "bar"},
+			},
+			ExpectedSynced:    []string{"production-bar"},
+			ExpectedRefreshed: []string{"production-foo"},
+		},
+		{
+			Name: "only refreshes apps without automated sync",
+			Configs: map[string]config.EnvironmentConfig{
+				"production": {ArgoCd: &config.EnvironmentConfigArgoCd{
+					SyncPolicy: &config.ArgoCdSyncPolicy{Automated: ptr.Bool(false)},
+					ApplicationSyncPolicies: map[string]config.ArgoCdSyncPolicy{
+						"bar": {Automated: ptr.Bool(true)},
+					},
+				}},
+				"staging": {ArgoCd: &config.EnvironmentConfigArgoCd{
+					ApplicationSyncPolicies: map[string]config.ArgoCdSyncPolicy{
+						"foo": {Automated: ptr.Bool(false)},
+					},
+				}},
+			},
+			Apps: []AppEnv{
+				{Environment: "production", Application: "foo"},
+				{Environment: "production", Application: "bar"},
+				{Environment: "staging", Application: "foo"},
+				{Environment: "staging", Application: "bar"},
+			},
+			ExpectedSynced:    []string{"production-bar", "staging-bar"},
+			ExpectedRefreshed: []string{"production-foo", "staging-foo"},
+		},
+		{
+			Name: "syncs apps in an active allow window",
+			Configs: map[string]config.EnvironmentConfig{
+				"production": {ArgoCd: &config.EnvironmentConfigArgoCd{
+					SyncWindows: []config.ArgoCdSyncWindow{
+						{Kind: "allow", Schedule: "* * * * *", Duration: "1h"},
+					},
+				}},
+			},
+			Apps: []AppEnv{
+				{Environment: "production", Application: "foo"},
+			},
+			ExpectedSynced: []string{"production-foo"},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			fake, client := startFakeArgoCd(t)
+			s := New(client, 2)
+			s.SyncApps(context.Background(), tc.Configs, tc.Apps)
+			s.Wait()
+			sort.Strings(fake.synced)
+			sort.Strings(fake.refreshed)
+			if d := cmp.Diff(tc.ExpectedSynced, fake.synced); d != "" {
+				t.Errorf("unexpected syncs:\n%s", d)
+			}
+			if d := cmp.Diff(tc.ExpectedRefreshed, fake.refreshed); d != "" {
+				t.Errorf("unexpected refreshes:\n%s", d)
+			}
+		})
+	}
+}
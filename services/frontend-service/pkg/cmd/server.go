@@ -201,10 +201,12 @@ func runServer(ctx context.Context) error {
 		OverviewClient:       api.NewOverviewServiceClient(cdCon),
 		BatchClient:          batchClient,
 		RolloutServiceClient: rolloutClient,
+		SnapshotClient:       api.NewSnapshotServiceClient(cdCon),
 	}
 	api.RegisterOverviewServiceServer(gsrv, gproxy)
 	api.RegisterBatchServiceServer(gsrv, gproxy)
 	api.RegisterRolloutServiceServer(gsrv, gproxy)
+	api.RegisterSnapshotServiceServer(gsrv, gproxy)
 
 	frontendConfigService := &service.FrontendConfigServiceServer{
 		Config: config.FrontendConfig{
@@ -427,6 +429,7 @@ type GrpcProxy struct {
 	OverviewClient       api.OverviewServiceClient
 	BatchClient          api.BatchServiceClient
 	RolloutServiceClient api.RolloutServiceClient
+	SnapshotClient       api.SnapshotServiceClient
 }
 
 func (p *GrpcProxy) ProcessBatch(
@@ -449,6 +452,12 @@ func (p *GrpcProxy) GetOverview(
 	return p.OverviewClient.GetOverview(ctx, in)
 }
 
+func (p *GrpcProxy) GetAppVersionAtRevision(
+	ctx context.Context,
+	in *api.GetAppVersionAtRevisionRequest) (*api.GetAppVersionAtRevisionResponse, error) {
+	return p.OverviewClient.GetAppVersionAtRevision(ctx, in)
+}
+
 func (p *GrpcProxy) StreamOverview(
 	in *api.GetOverviewRequest,
 	stream api.OverviewService_StreamOverviewServer) error {
@@ -467,6 +476,18 @@ func (p *GrpcProxy) StreamOverview(
 	}
 }
 
+func (p *GrpcProxy) ExportSnapshot(
+	ctx context.Context,
+	in *api.ExportSnapshotRequest) (*api.ExportSnapshotResponse, error) {
+	return p.SnapshotClient.ExportSnapshot(ctx, in)
+}
+
+func (p *GrpcProxy) RestoreSnapshot(
+	ctx context.Context,
+	in *api.RestoreSnapshotRequest) (*api.RestoreSnapshotResponse, error) {
+	return p.SnapshotClient.RestoreSnapshot(ctx, in)
+}
+
 func (p *GrpcProxy) StreamStatus(in *api.StreamStatusRequest, stream api.RolloutService_StreamStatusServer) error {
 	if p.RolloutServiceClient == nil {
 		return status.Error(codes.Unimplemented, "rollout status not implemented")
@@ -486,3 +507,24 @@ func (p *GrpcProxy) StreamStatus(in *api.StreamStatusRequest, stream api.Rollout
 		}
 	}
 }
+
+func (p *GrpcProxy) WaitForRollout(ctx context.Context, in *api.WaitForRolloutRequest) (*api.WaitForRolloutResponse, error) {
+	if p.RolloutServiceClient == nil {
+		return nil, status.Error(codes.Unimplemented, "rollout status not implemented")
+	}
+	return p.RolloutServiceClient.WaitForRollout(ctx, in)
+}
+
+func (p *GrpcProxy) GetRolloutHistory(ctx context.Context, in *api.GetRolloutHistoryRequest) (*api.GetRolloutHistoryResponse, error) {
+	if p.RolloutServiceClient == nil {
+		return nil, status.Error(codes.Unimplemented, "rollout status not implemented")
+	}
+	return p.RolloutServiceClient.GetRolloutHistory(ctx, in)
+}
+
+func (p *GrpcProxy) GetDoraMetrics(ctx context.Context, in *api.GetDoraMetricsRequest) (*api.GetDoraMetricsResponse, error) {
+	if p.RolloutServiceClient == nil {
+		return nil, status.Error(codes.Unimplemented, "rollout status not implemented")
+	}
+	return p.RolloutServiceClient.GetDoraMetrics(ctx, in)
+}
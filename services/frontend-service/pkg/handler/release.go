@@ -33,6 +33,7 @@ import (
 	"github.com/freiheit-com/kuberpult/pkg/logger"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 var (
@@ -209,6 +210,36 @@ func (s Server) HandleRelease(w http.ResponseWriter, r *http.Request, tail strin
 
 	}
 
+	if argocdOverrides, ok := form.Value["argocd_overrides"]; ok {
+		if len(argocdOverrides) != 1 {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid number of argocd overrides provided: %d", len(argocdOverrides))
+			return
+		}
+		var overrides api.ArgoCdOverrides
+		if err := protojson.Unmarshal([]byte(argocdOverrides[0]), &overrides); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid argocd overrides: %s", err)
+			return
+		}
+		tf.ArgocdOverrides = &overrides
+	}
+
+	if source, ok := form.Value["source"]; ok {
+		if len(source) != 1 {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid number of sources provided: %d", len(source))
+			return
+		}
+		var releaseSource api.ReleaseSource
+		if err := protojson.Unmarshal([]byte(source[0]), &releaseSource); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid source: %s", err)
+			return
+		}
+		tf.Source = &releaseSource
+	}
+
 	response, err := s.BatchClient.ProcessBatch(ctx, &api.BatchRequest{Actions: []*api.BatchAction{
 		{
 			Action: &api.BatchAction_CreateRelease{
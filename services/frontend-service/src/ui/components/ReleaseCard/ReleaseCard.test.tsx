@@ -292,6 +292,12 @@ describe('Release Card Rollout Status', () => {
                     application: 'test1',
                     version: 2,
                     rolloutStatus: RolloutStatus.RolloutStatusSuccesful,
+                    sequence: 0,
+                    snapshotComplete: false,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
                 },
             ],
 
@@ -61,6 +61,22 @@ const RolloutStatusDescription: React.FC<{ status: RolloutStatus }> = (props) =>
     return <span className="rollout__description_unknown">? Unkwown</span>;
 };
 
+// explains why a rollout failed, see `Diagnostics.Reason` in the rollout service
+const rolloutStatusReason = (status: StreamStatusResponse): string => {
+    if (status.rolloutStatus !== RolloutStatus.RolloutStatusError) {
+        return '';
+    }
+    if ((status.operationPhase === 'Failed' || status.operationPhase === 'Error') && status.operationMessage) {
+        return status.operationMessage;
+    }
+    const resource = status.unhealthyResources[0];
+    if (!resource) {
+        return '';
+    }
+    const description = `${resource.kind} ${resource.name} is ${resource.healthStatus}`;
+    return resource.message ? `${description}: ${resource.message}` : description;
+};
+
 // note that the order is important here.
 // "most interesting" must come first.
 // see `calculateDeploymentStatus`
@@ -90,6 +106,12 @@ const calculateDeploymentStatus = (
                     rolloutStatus: RolloutStatus.RolloutStatusUnknown,
                     version: 0,
                     application: app,
+                    sequence: 0,
+                    snapshotComplete: false,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
                 };
             }
             if (
@@ -158,6 +180,9 @@ export const ReleaseCard: React.FC<ReleaseCardProps> = (props) => {
                                 <td>{env.environment}</td>
                                 <td>
                                     <RolloutStatusDescription status={env.rolloutStatus} />
+                                    {!!rolloutStatusReason(env) && (
+                                        <div className="rollout__reason">{rolloutStatusReason(env)}</div>
+                                    )}
                                 </td>
                             </tr>
                         ))}
@@ -35,6 +35,7 @@ import {
     EnvironmentGroup,
     LockBehavior,
     Priority,
+    ResourceHealth,
     RolloutStatus,
     StreamStatusResponse,
 } from '../../api/api';
@@ -342,6 +343,12 @@ describe('Rollout Status', () => {
             environment: string;
             version: number;
             rolloutStatus: RolloutStatus;
+            sequence: number;
+            snapshotComplete: boolean;
+            operationPhase: string;
+            operationMessage: string;
+            syncRevision: string;
+            unhealthyResources: ResourceHealth[];
         }>;
     };
 
@@ -357,6 +364,12 @@ describe('Rollout Status', () => {
                     environment: 'env1',
                     version: 0,
                     rolloutStatus: RolloutStatus.RolloutStatusSuccesful,
+                    sequence: 0,
+                    snapshotComplete: false,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
                 },
             ],
         },
@@ -368,6 +381,12 @@ describe('Rollout Status', () => {
                     application: 'app1',
                     version: 1,
                     rolloutStatus: RolloutStatus.RolloutStatusSuccesful,
+                    sequence: 0,
+                    snapshotComplete: false,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
                 },
             ],
 
@@ -378,6 +397,12 @@ describe('Rollout Status', () => {
                     environment: 'env1',
                     version: 1,
                     rolloutStatus: RolloutStatus.RolloutStatusSuccesful,
+                    sequence: 0,
+                    snapshotComplete: false,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
                 },
             ],
         },
@@ -389,12 +414,24 @@ describe('Rollout Status', () => {
                     application: 'app1',
                     version: 1,
                     rolloutStatus: RolloutStatus.RolloutStatusSuccesful,
+                    sequence: 0,
+                    snapshotComplete: false,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
                 },
                 {
                     environment: 'env1',
                     application: 'app1',
                     version: 2,
                     rolloutStatus: RolloutStatus.RolloutStatusSuccesful,
+                    sequence: 0,
+                    snapshotComplete: false,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
                 },
             ],
 
@@ -405,6 +442,57 @@ describe('Rollout Status', () => {
                     environment: 'env1',
                     version: 0,
                     rolloutStatus: RolloutStatus.RolloutStatusSuccesful,
+                    sequence: 0,
+                    snapshotComplete: false,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
+                },
+            ],
+        },
+        {
+            name: 'ignores the end of the snapshot',
+            events: [
+                {
+                    environment: 'env1',
+                    application: 'app1',
+                    version: 1,
+                    rolloutStatus: RolloutStatus.RolloutStatusSuccesful,
+                    sequence: 1,
+                    snapshotComplete: false,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
+                },
+                {
+                    environment: '',
+                    application: '',
+                    version: 0,
+                    rolloutStatus: RolloutStatus.RolloutStatusUnknown,
+                    sequence: 1,
+                    snapshotComplete: true,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
+                },
+            ],
+
+            expectedEnabled: true,
+            expectedApps: [
+                {
+                    application: 'app1',
+                    environment: 'env1',
+                    version: 1,
+                    rolloutStatus: RolloutStatus.RolloutStatusSuccesful,
+                    sequence: 1,
+                    snapshotComplete: false,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
                 },
             ],
         },
@@ -416,6 +504,12 @@ describe('Rollout Status', () => {
                     application: 'app1',
                     version: 1,
                     rolloutStatus: RolloutStatus.RolloutStatusSuccesful,
+                    sequence: 0,
+                    snapshotComplete: false,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
                 },
                 { error: true },
             ],
@@ -427,6 +521,12 @@ describe('Rollout Status', () => {
                     environment: 'env1',
                     version: 0,
                     rolloutStatus: RolloutStatus.RolloutStatusSuccesful,
+                    sequence: 0,
+                    snapshotComplete: false,
+                    operationPhase: '',
+                    operationMessage: '',
+                    syncRevision: '',
+                    unhealthyResources: [],
                 },
             ],
         },
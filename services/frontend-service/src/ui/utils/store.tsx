@@ -713,6 +713,10 @@ export const useRolloutStatus = (application: string): [boolean, RolloutStatusAp
 };
 
 export const UpdateRolloutStatus = (ev: StreamStatusResponse): void => {
+    if (ev.snapshotComplete) {
+        // marks the end of the initial snapshot and doesn't belong to any application
+        return;
+    }
     rolloutStatus.set((data: RolloutStatusStore) => ({
         enabled: true,
         applications: {
@@ -0,0 +1,325 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	argoio "github.com/argoproj/argo-cd/v2/util/io"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/filters"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/service"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// ArgocdInstance is one argocd that the rollout-service watches.
+type ArgocdInstance struct {
+	// Name is empty for the instance configured with KUBERPULT_ARGOCD_SERVER
+	Name     string `json:"name"`
+	Server   string `json:"server"`
+	Token    string `json:"token"`
+	Insecure bool   `json:"insecure"`
+	// Environments are the kuberpult environments that this instance deploys.
+	// An instance without environments deploys all environments that no other instance lists.
+	Environments []string `json:"environments"`
+}
+
+func (i *ArgocdInstance) ClientConfig() (apiclient.ClientOptions, error) {
+	var opts apiclient.ClientOptions
+	opts.ConfigPath = ""
+	u, err := url.ParseRequestURI(i.Server)
+	if err != nil {
+		return opts, fmt.Errorf("invalid argocd server url: %w", err)
+	}
+	opts.ServerAddr = u.Host
+	opts.PlainText = u.Scheme == "http"
+	opts.UserAgent = "kuberpult"
+	opts.Insecure = i.Insecure
+	opts.AuthToken = i.Token
+	return opts, nil
+}
+
+// describe returns the name of the instance for errors and the health check
+func (i *ArgocdInstance) describe() string {
+	if i.Name == "" {
+		return "argocd"
+	}
+	return fmt.Sprintf("argocd instance %q", i.Name)
+}
+
+func (i *ArgocdInstance) wrap(err error) error {
+	if err == nil || i.Name == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %w", i.describe(), err)
+}
+
+// ArgocdInstances reads the instances from the file in ArgocdInstancesConfig.
+// ArgocdServer is added as an instance without a name and without environments.
+func (config *Config) ArgocdInstances() ([]ArgocdInstance, error) {
+	var result []ArgocdInstance
+	if config.ArgocdInstancesConfig != "" {
+		data, err := os.ReadFile(config.ArgocdInstancesConfig)
+		if err != nil {
+			return nil, fmt.Errorf("reading argocd instances: %w", err)
+		}
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("parsing argocd instances: %w", err)
+		}
+		for _, i := range result {
+			if i.Name == "" {
+				return nil, fmt.Errorf("argocd instances must have a name")
+			}
+		}
+	}
+	// Flux can replace argocd entirely, otherwise argocd is required
+	if config.ArgocdServer != "" || (len(result) == 0 && !config.FluxEnabled) {
+		result = append(result, ArgocdInstance{
+			Server:   config.ArgocdServer,
+			Token:    config.ArgocdToken,
+			Insecure: config.ArgocdInsecure,
+		})
+	}
+	names := map[string]bool{}
+	owners := map[string]string{}
+	catchAll := ""
+	for _, i := range result {
+		if names[i.Name] {
+			return nil, fmt.Errorf("%s is configured twice", i.describe())
+		}
+		names[i.Name] = true
+		if len(i.Environments) == 0 {
+			if catchAll != "" {
+				return nil, fmt.Errorf("%s and %s both have no environments, only one instance can deploy the remaining environments", catchAll, i.describe())
+			}
+			catchAll = i.describe()
+		}
+		for _, env := range i.Environments {
+			if owner, ok := owners[env]; ok {
+				return nil, fmt.Errorf("environment %q is deployed by %s and %s", env, owner, i.describe())
+			}
+			owners[env] = i.describe()
+		}
+	}
+	return result, nil
+}
+
+// owns returns whether the instance deploys the environment
+func owns(instances []ArgocdInstance, instance *ArgocdInstance, environment string) bool {
+	if len(instance.Environments) != 0 {
+		return filters.Match(instance.Environments, environment)
+	}
+	// an instance without environments deploys those that no other instance claims
+	for _, other := range instances {
+		if len(other.Environments) != 0 && filters.Match(other.Environments, environment) {
+			return false
+		}
+	}
+	return true
+}
+
+// argocdConnection is an argocd instance that is connected in the background.
+// Until the connection is established, all calls fail with codes.Unavailable.
+type argocdConnection struct {
+	instance *ArgocdInstance
+	dial     func(ctx context.Context, instance *ArgocdInstance) (application.ApplicationServiceClient, io.Closer, error)
+	backOff  func() backoff.BackOff
+
+	mx        sync.Mutex
+	appClient application.ApplicationServiceClient
+	closer    io.Closer
+}
+
+func newArgocdConnection(instance *ArgocdInstance) *argocdConnection {
+	return &argocdConnection{
+		instance: instance,
+		dial:     dialArgocd,
+		backOff: func() backoff.BackOff {
+			bo := backoff.NewExponentialBackOff()
+			bo.MaxInterval = time.Minute
+			// an instance can be unavailable for a long time, but it must not stop the others
+			bo.MaxElapsedTime = 0
+			return bo
+		},
+	}
+}
+
+func dialArgocd(ctx context.Context, instance *ArgocdInstance) (application.ApplicationServiceClient, io.Closer, error) {
+	opts, err := instance.ClientConfig()
+	if err != nil {
+		return nil, nil, instance.wrap(err)
+	}
+	l := logger.FromContext(ctx).With(zap.String("argocd.name", instance.Name))
+	l.Info("argocd.connecting", zap.String("argocd.addr", opts.ServerAddr))
+	client, err := apiclient.NewClient(&opts)
+	if err != nil {
+		return nil, nil, instance.wrap(fmt.Errorf("connecting to argocd %s: %w", opts.ServerAddr, err))
+	}
+	versionCloser, versionClient, err := client.NewVersionClient()
+	if err != nil {
+		return nil, nil, instance.wrap(fmt.Errorf("connecting to argocd version: %w", err))
+	}
+	defer argoio.Close(versionCloser)
+	version, err := versionClient.Version(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, nil, instance.wrap(fmt.Errorf("retrieving argocd version: %w", err))
+	}
+	l.Info("argocd.connected", zap.String("argocd.version", version.Version))
+	appCloser, appClient, err := client.NewApplicationClient()
+	if err != nil {
+		return nil, nil, instance.wrap(fmt.Errorf("connecting to argocd app: %w", err))
+	}
+	return appClient, appCloser, nil
+}
+
+func (c *argocdConnection) client() (application.ApplicationServiceClient, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.appClient == nil {
+		return nil, status.Errorf(codes.Unavailable, "%s is not connected", c.instance.describe())
+	}
+	return c.appClient, nil
+}
+
+func (c *argocdConnection) Get(ctx context.Context, in *application.ApplicationQuery, opts ...grpc.CallOption) (*v1alpha1.Application, error) {
+	client, err := c.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.Get(ctx, in, opts...)
+}
+
+func (c *argocdConnection) Watch(ctx context.Context, in *application.ApplicationQuery, opts ...grpc.CallOption) (application.ApplicationService_WatchClient, error) {
+	client, err := c.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.Watch(ctx, in, opts...)
+}
+
+// run connects to the instance and calls consume until the context is done.
+// Failures are retried with a backoff and reported with setConnected, they never stop the other instances.
+func (c *argocdConnection) run(ctx context.Context, consume func(ctx context.Context) error, setConnected func(connected bool)) error {
+	bo := c.backOff()
+	for {
+		err := c.connect(ctx, bo)
+		if err == nil {
+			err = consume(ctx)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		setConnected(false)
+		logger.FromContext(ctx).Warn("argocd.connection", zap.String("argocd.name", c.instance.Name), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(bo.NextBackOff()):
+		}
+	}
+}
+
+// connect dials the instance once. The grpc connection reconnects by itself afterwards.
+func (c *argocdConnection) connect(ctx context.Context, bo backoff.BackOff) error {
+	if _, err := c.client(); err == nil {
+		return nil
+	}
+	appClient, closer, err := c.dial(ctx, c.instance)
+	if err != nil {
+		return err
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.appClient = appClient
+	c.closer = closer
+	bo.Reset()
+	return nil
+}
+
+func (c *argocdConnection) close() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closer != nil {
+		argoio.Close(c.closer)
+	}
+}
+
+// environmentFilter only forwards the events of the environments that an instance deploys
+type environmentFilter struct {
+	owns func(environment string) bool
+	sink service.ArgoEventProcessor
+}
+
+func (f *environmentFilter) ProcessArgoEvent(ctx context.Context, ev service.ArgoEvent) {
+	if f.owns(ev.Environment) {
+		f.sink.ProcessArgoEvent(ctx, ev)
+	}
+}
+
+// connections tracks the connection health of all argocd instances and flux for the readiness check
+type connections struct {
+	mx        sync.Mutex
+	connected map[string]bool
+}
+
+func newConnections(names ...string) *connections {
+	c := &connections{connected: map[string]bool{}}
+	for _, n := range names {
+		c.connected[n] = false
+	}
+	return c
+}
+
+func (c *connections) set(name string, connected bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.connected[name] = connected
+}
+
+// check returns an error that lists all disconnected instances
+func (c *connections) check() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	var disconnected []string
+	for name, connected := range c.connected {
+		if !connected {
+			disconnected = append(disconnected, name)
+		}
+	}
+	if len(disconnected) == 0 {
+		return nil
+	}
+	sort.Strings(disconnected)
+	return fmt.Errorf("not connected: %s", strings.Join(disconnected, ", "))
+}
@@ -0,0 +1,249 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/service"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestArgocdInstances(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		Name      string
+		Config    Config
+		Instances string
+
+		ExpectedError     string
+		ExpectedInstances []ArgocdInstance
+	}{
+		{
+			Name:   "single argocd",
+			Config: Config{ArgocdServer: "http://argocd", ArgocdToken: "token"},
+			ExpectedInstances: []ArgocdInstance{
+				{Server: "http://argocd", Token: "token"},
+			},
+		},
+		{
+			Name:              "flux only",
+			Config:            Config{FluxEnabled: true},
+			ExpectedInstances: nil,
+		},
+		{
+			Name:      "multiple instances",
+			Config:    Config{ArgocdServer: "http://argocd"},
+			Instances: `[{"name": "eu", "server": "http://argocd-eu", "token": "eu-token", "environments": ["production-eu"]}, {"name": "us", "server": "http://argocd-us", "insecure": true, "environments": ["production-us"]}]`,
+			ExpectedInstances: []ArgocdInstance{
+				{Name: "eu", Server: "http://argocd-eu", Token: "eu-token", Environments: []string{"production-eu"}},
+				{Name: "us", Server: "http://argocd-us", Insecure: true, Environments: []string{"production-us"}},
+				{Server: "http://argocd"},
+			},
+		},
+		{
+			Name:      "instances without a default",
+			Instances: `[{"name": "eu", "server": "http://argocd-eu", "environments": ["production-eu"]}]`,
+			ExpectedInstances: []ArgocdInstance{
+				{Name: "eu", Server: "http://argocd-eu", Environments: []string{"production-eu"}},
+			},
+		},
+		{
+			Name:          "missing name",
+			Instances:     `[{"server": "http://argocd-eu"}]`,
+			ExpectedError: "argocd instances must have a name",
+		},
+		{
+			Name:          "duplicate name",
+			Instances:     `[{"name": "eu", "server": "http://argocd-eu", "environments": ["a"]}, {"name": "eu", "server": "http://argocd-eu2", "environments": ["b"]}]`,
+			ExpectedError: `argocd instance "eu" is configured twice`,
+		},
+		{
+			Name:          "environment in two instances",
+			Instances:     `[{"name": "eu", "server": "http://argocd-eu", "environments": ["a"]}, {"name": "us", "server": "http://argocd-us", "environments": ["a"]}]`,
+			ExpectedError: `environment "a" is deployed by argocd instance "eu" and argocd instance "us"`,
+		},
+		{
+			Name:          "two instances without environments",
+			Config:        Config{ArgocdServer: "http://argocd"},
+			Instances:     `[{"name": "eu", "server": "http://argocd-eu"}]`,
+			ExpectedError: `argocd instance "eu" and argocd both have no environments, only one instance can deploy the remaining environments`,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			config := tc.Config
+			if tc.Instances != "" {
+				config.ArgocdInstancesConfig = path.Join(t.TempDir(), "instances.json")
+				if err := os.WriteFile(config.ArgocdInstancesConfig, []byte(tc.Instances), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			instances, err := config.ArgocdInstances()
+			if tc.ExpectedError != "" {
+				if err == nil || err.Error() != tc.ExpectedError {
+					t.Fatalf("expected error %q, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.ExpectedInstances, instances); d != "" {
+				t.Errorf("unexpected instances: %s", d)
+			}
+		})
+	}
+}
+
+type recordingSink struct {
+	environments []string
+}
+
+func (r *recordingSink) ProcessArgoEvent(ctx context.Context, ev service.ArgoEvent) {
+	r.environments = append(r.environments, ev.Environment)
+}
+
+func TestEnvironmentFilter(t *testing.T) {
+	t.Parallel()
+	instances := []ArgocdInstance{
+		{Name: "eu", Environments: []string{"production-eu"}},
+		{Name: "us", Environments: []string{"production-us"}},
+		{},
+	}
+	expected := map[string][]string{
+		"eu": {"production-eu"},
+		"us": {"production-us"},
+		"":   {"staging"},
+	}
+	for i := range instances {
+		instance := &instances[i]
+		sink := &recordingSink{}
+		filter := &environmentFilter{
+			owns: func(environment string) bool { return owns(instances, instance, environment) },
+			sink: sink,
+		}
+		for _, env := range []string{"production-eu", "production-us", "staging"} {
+			filter.ProcessArgoEvent(context.Background(), service.ArgoEvent{Environment: env})
+		}
+		if d := cmp.Diff(expected[instance.Name], sink.environments); d != "" {
+			t.Errorf("unexpected environments for %s: %s", instance.describe(), d)
+		}
+	}
+}
+
+func TestConnections(t *testing.T) {
+	t.Parallel()
+	c := newConnections(`argocd instance "eu"`, `argocd instance "us"`, "flux")
+	if err := c.check(); err == nil || err.Error() != `not connected: argocd instance "eu", argocd instance "us", flux` {
+		t.Errorf("expected all instances to be disconnected, got %v", err)
+	}
+	c.set(`argocd instance "eu"`, true)
+	c.set(`argocd instance "us"`, true)
+	c.set("flux", true)
+	if err := c.check(); err != nil {
+		t.Errorf("expected all instances to be connected, got %v", err)
+	}
+	c.set(`argocd instance "us"`, false)
+	if err := c.check(); err == nil || err.Error() != `not connected: argocd instance "us"` {
+		t.Errorf("expected us to be disconnected, got %v", err)
+	}
+}
+
+type mockApplicationClient struct {
+	application.ApplicationServiceClient
+}
+
+func (m *mockApplicationClient) Get(ctx context.Context, in *application.ApplicationQuery, opts ...grpc.CallOption) (*v1alpha1.Application, error) {
+	return &v1alpha1.Application{}, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+func TestArgocdConnectionRetries(t *testing.T) {
+	t.Parallel()
+	dials := 0
+	conn := &argocdConnection{
+		instance: &ArgocdInstance{Name: "eu"},
+		dial: func(ctx context.Context, instance *ArgocdInstance) (application.ApplicationServiceClient, io.Closer, error) {
+			dials++
+			if dials < 3 {
+				return nil, nil, fmt.Errorf("connection refused")
+			}
+			return &mockApplicationClient{}, nopCloser{}, nil
+		},
+		backOff: func() backoff.BackOff { return &backoff.ZeroBackOff{} },
+	}
+	defer conn.close()
+	if _, err := conn.Get(context.Background(), &application.ApplicationQuery{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected unavailable before the connection is established, got %v", err)
+	}
+
+	var mx sync.Mutex
+	var connected []bool
+	setConnected := func(c bool) {
+		mx.Lock()
+		defer mx.Unlock()
+		connected = append(connected, c)
+	}
+	consumed := 0
+	consuming := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- conn.run(ctx, func(ctx context.Context) error {
+			consumed++
+			if consumed == 1 {
+				return fmt.Errorf("watching applications: unavailable")
+			}
+			setConnected(true)
+			close(consuming)
+			<-ctx.Done()
+			return nil
+		}, setConnected)
+	}()
+	<-consuming
+	if _, err := conn.Get(ctx, &application.ApplicationQuery{}); err != nil {
+		t.Errorf("expected the connection to be established, got %v", err)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected no error on shutdown, got %v", err)
+	}
+	if dials != 3 {
+		t.Errorf("expected 3 dials, got %d", dials)
+	}
+	if d := cmp.Diff([]bool{false, false, false, true}, connected); d != "" {
+		t.Errorf("unexpected connection states:\n%s", d)
+	}
+}
@@ -20,10 +20,9 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"net/url"
+	"time"
 
 	"github.com/argoproj/argo-cd/v2/pkg/apiclient"
-	argoio "github.com/argoproj/argo-cd/v2/util/io"
 
 	"github.com/freiheit-com/kuberpult/pkg/api"
 	"github.com/freiheit-com/kuberpult/pkg/logger"
@@ -31,7 +30,9 @@ import (
 	"github.com/freiheit-com/kuberpult/pkg/setup"
 	"github.com/freiheit-com/kuberpult/pkg/tracing"
 	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/metrics"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/notifications"
 	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/notifier"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/rollback"
 	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/service"
 	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/versions"
 	"github.com/kelseyhightower/envconfig"
@@ -40,8 +41,9 @@ import (
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
-	"google.golang.org/protobuf/types/known/emptypb"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
 
 	grpctrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/google.golang.org/grpc"
 )
@@ -55,21 +57,33 @@ type Config struct {
 	ArgocdToken              string `split_words:"true"`
 	ArgocdRefreshEnabled     bool   `split_words:"true"`
 	ArgocdRefreshConcurrency int    `default:"50" split_words:"true"`
+	// ArgocdInstancesConfig is a json file with a list of ArgocdInstance for setups with multiple argocds
+	ArgocdInstancesConfig string `split_words:"true"`
+
+	FluxEnabled   bool   `default:"false" split_words:"true"`
+	FluxNamespace string `default:"flux-system" split_words:"true"`
+
+	// HistoryPath is the file in which the rollout history is persisted, the history is disabled if it's empty
+	HistoryPath string `split_words:"true"`
+	// DoraWindow is the time span that GetDoraMetrics covers
+	DoraWindow time.Duration `default:"720h" split_words:"true"`
+	// NotificationsConfig is the json file with the routes of the notifications, the notifications are disabled if it's empty
+	NotificationsConfig string `split_words:"true"`
+	// RollbackConfig is the json file with the rules for automatic rollbacks, rollbacks are disabled if it's empty
+	RollbackConfig string `split_words:"true"`
 }
 
 func (config *Config) ClientConfig() (apiclient.ClientOptions, error) {
-	var opts apiclient.ClientOptions
-	opts.ConfigPath = ""
-	u, err := url.ParseRequestURI(config.ArgocdServer)
-	if err != nil {
-		return opts, fmt.Errorf("invalid argocd server url: %w", err)
-	}
-	opts.ServerAddr = u.Host
-	opts.PlainText = u.Scheme == "http"
-	opts.UserAgent = "kuberpult"
-	opts.Insecure = config.ArgocdInsecure
-	opts.AuthToken = config.ArgocdToken
-	return opts, nil
+	instance := config.defaultArgocdInstance()
+	return instance.ClientConfig()
+}
+
+func (config *Config) defaultArgocdInstance() ArgocdInstance {
+	return ArgocdInstance{
+		Server:   config.ArgocdServer,
+		Token:    config.ArgocdToken,
+		Insecure: config.ArgocdInsecure,
+	}
 }
 
 func RunServer() {
@@ -86,7 +100,7 @@ func RunServer() {
 	}
 }
 
-func getGrpcClient(ctx context.Context, config Config) (api.OverviewServiceClient, error) {
+func getGrpcClient(ctx context.Context, config Config) (*grpc.ClientConn, error) {
 	grpcClientOpts := []grpc.DialOption{
 		grpc.WithInsecure(),
 	}
@@ -106,7 +120,7 @@ func getGrpcClient(ctx context.Context, config Config) (api.OverviewServiceClien
 		return nil, fmt.Errorf("error dialing %s: %w", config.CdServer, err)
 	}
 
-	return api.NewOverviewServiceClient(con), nil
+	return con, nil
 }
 
 func runServer(ctx context.Context, config Config) error {
@@ -129,48 +143,62 @@ func runServer(ctx context.Context, config Config) error {
 		)
 	}
 
-	opts, err := config.ClientConfig()
+	instances, err := config.ArgocdInstances()
 	if err != nil {
 		return err
 	}
-
-	logger.FromContext(ctx).Info("argocd.connecting", zap.String("argocd.addr", opts.ServerAddr))
-	client, err := apiclient.NewClient(&opts)
-	if err != nil {
-		return fmt.Errorf("connecting to argocd %s: %w", opts.ServerAddr, err)
-	}
-	closer, versionClient, err := client.NewVersionClient()
-	if err != nil {
-		return fmt.Errorf("connecting to argocd version: %w", err)
-	}
-	defer argoio.Close(closer)
-	version, err := versionClient.Version(ctx, &emptypb.Empty{})
-	if err != nil {
-		return fmt.Errorf("retrieving argocd version: %w", err)
+	var argocds []*argocdConnection
+	for i := range instances {
+		// invalid configurations are not retried
+		if _, err := instances[i].ClientConfig(); err != nil {
+			return instances[i].wrap(err)
+		}
+		conn := newArgocdConnection(&instances[i])
+		defer conn.close()
+		argocds = append(argocds, conn)
 	}
-	logger.FromContext(ctx).Info("argocd.connected", zap.String("argocd.version", version.Version))
-	closer, appClient, err := client.NewApplicationClient()
-	if err != nil {
-		return fmt.Errorf("connecting to argocd app: %w", err)
+
+	var kustomizations dynamic.ResourceInterface
+	if config.FluxEnabled {
+		kubeConfig, err := rest.InClusterConfig()
+		if err != nil {
+			return fmt.Errorf("reading kubernetes config: %w", err)
+		}
+		dynamicClient, err := dynamic.NewForConfig(kubeConfig)
+		if err != nil {
+			return fmt.Errorf("connecting to kubernetes: %w", err)
+		}
+		kustomizations = dynamicClient.Resource(service.KustomizationResource).Namespace(config.FluxNamespace)
 	}
-	defer argoio.Close(closer)
 
-	overview, err := getGrpcClient(ctx, config)
+	cdCon, err := getGrpcClient(ctx, config)
 	if err != nil {
 		return fmt.Errorf("connecting to cd service %q: %w", config.CdServer, err)
 	}
 	broadcast := service.New()
+	if config.HistoryPath != "" {
+		history, err := service.OpenHistory(config.HistoryPath)
+		if err != nil {
+			return err
+		}
+		defer history.Close()
+		if err := history.Restore(broadcast); err != nil {
+			return err
+		}
+		broadcast.History = history
+	}
 	shutdownCh := make(chan struct{})
-	ready := false
-	versionC := versions.New(overview)
+	var connectionNames []string
+	for _, conn := range argocds {
+		connectionNames = append(connectionNames, conn.instance.describe())
+	}
+	if config.FluxEnabled {
+		connectionNames = append(connectionNames, "flux")
+	}
+	conns := newConnections(connectionNames...)
+	versionC := versions.New(api.NewOverviewServiceClient(cdCon))
 
 	backgroundTasks := []setup.BackgroundTaskConfig{
-		{
-			Name: "consume argocd events",
-			Run: func(ctx context.Context) error {
-				return service.ConsumeEvents(ctx, appClient, versionC, broadcast, func() { ready = true })
-			},
-		},
 		{
 			Name: "consume kuberpult events",
 			Run: func(ctx context.Context) error {
@@ -179,13 +207,85 @@ func runServer(ctx context.Context, config Config) error {
 		},
 	}
 
-	if config.ArgocdRefreshEnabled {
+	for _, conn := range argocds {
+		conn := conn
+		sink := &environmentFilter{
+			owns: func(environment string) bool { return owns(instances, conn.instance, environment) },
+			sink: broadcast,
+		}
+		backgroundTasks = append(backgroundTasks, setup.BackgroundTaskConfig{
+			Name: fmt.Sprintf("consume %s events", conn.instance.describe()),
+			Run: func(ctx context.Context) error {
+				setConnected := func(connected bool) { conns.set(conn.instance.describe(), connected) }
+				return conn.run(ctx, func(ctx context.Context) error {
+					return service.ConsumeEvents(ctx, conn, versionC, sink, setConnected)
+				}, setConnected)
+			},
+		})
+	}
 
+	if config.FluxEnabled {
+		backgroundTasks = append(backgroundTasks, setup.BackgroundTaskConfig{
+			Name: "consume flux events",
+			Run: func(ctx context.Context) error {
+				return service.ConsumeFluxEvents(ctx, kustomizations, versionC, broadcast, func() { conns.set("flux", true) })
+			},
+		})
+	}
+
+	if len(argocds) != 0 && config.ArgocdRefreshEnabled {
+		// refreshes go to the instance that deploys the environment
+		byEnvironment := map[string]notifier.Notifier{}
+		var fallback notifier.Notifier
+		for _, conn := range argocds {
+			notify := notifier.New(conn, config.ArgocdRefreshConcurrency)
+			if len(conn.instance.Environments) == 0 {
+				fallback = notify
+			}
+			for _, env := range conn.instance.Environments {
+				byEnvironment[env] = notify
+			}
+		}
 		backgroundTasks = append(backgroundTasks, setup.BackgroundTaskConfig{
 			Name: "refresh argocd",
 			Run: func(ctx context.Context) error {
-				notify := notifier.New(appClient, config.ArgocdRefreshConcurrency)
-				return notifier.Subscribe(ctx, notify, broadcast)
+				return notifier.Subscribe(ctx, notifier.Route(byEnvironment, fallback), broadcast)
+			},
+		})
+	}
+
+	if config.NotificationsConfig != "" {
+		notificationsConfig, err := notifications.LoadConfig(config.NotificationsConfig)
+		if err != nil {
+			return err
+		}
+		backgroundTasks = append(backgroundTasks, setup.BackgroundTaskConfig{
+			Name: "send notifications",
+			Run: func(ctx context.Context) error {
+				return notifications.Subscribe(ctx, notificationsConfig, broadcast)
+			},
+		})
+	}
+
+	if config.RollbackConfig != "" {
+		rollbackConfig, err := rollback.LoadConfig(config.RollbackConfig)
+		if err != nil {
+			return err
+		}
+		batchClient := api.NewBatchServiceClient(cdCon)
+		backgroundTasks = append(backgroundTasks, setup.BackgroundTaskConfig{
+			Name: "roll back failed rollouts",
+			Run: func(ctx context.Context) error {
+				return rollback.Subscribe(ctx, rollbackConfig, batchClient, broadcast)
+			},
+		})
+	}
+
+	if broadcast.History != nil {
+		backgroundTasks = append(backgroundTasks, setup.BackgroundTaskConfig{
+			Name: "record rollout history",
+			Run: func(ctx context.Context) error {
+				return broadcast.History.Record(ctx, broadcast)
 			},
 		})
 	}
@@ -200,17 +300,37 @@ func runServer(ctx context.Context, config Config) error {
 			return metrics.Metrics(ctx, broadcast, meter, nil)
 		},
 	})
+	var doraStore metrics.DoraStore
+	if broadcast.History != nil {
+		doraStore = broadcast.History
+	}
+	dora, err := metrics.NewDora(meter, config.DoraWindow, nil, doraStore)
+	if err != nil {
+		return err
+	}
+	broadcast.Dora = dora
+	backgroundTasks = append(backgroundTasks, setup.BackgroundTaskConfig{
+		Name: "compute dora metrics",
+		Run: func(ctx context.Context) error {
+			return dora.Run(ctx, broadcast)
+		},
+	})
 
 	setup.Run(ctx, setup.ServerConfig{
 		HTTP: []setup.HTTPConfig{
 			{
 				Port: "8080",
 				Register: func(mux *http.ServeMux) {
+					// liveness must not depend on argocd or flux, otherwise an outage of them restarts the rollout-service
 					mux.Handle("/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-						if ready {
-							w.WriteHeader(200)
-						} else {
+						w.WriteHeader(200)
+					}))
+					mux.Handle("/ready", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						if err := conns.check(); err != nil {
 							w.WriteHeader(500)
+							fmt.Fprintln(w, err)
+						} else {
+							w.WriteHeader(200)
 						}
 					}))
 					mux.Handle("/metrics", handler)
@@ -0,0 +1,56 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package filters
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		Name     string
+		Filter   []string
+		Value    string
+		Expected bool
+	}{
+		{
+			Name:     "empty filter matches everything",
+			Value:    "production",
+			Expected: true,
+		},
+		{
+			Name:     "value in the filter",
+			Filter:   []string{"staging", "production"},
+			Value:    "production",
+			Expected: true,
+		},
+		{
+			Name:     "value not in the filter",
+			Filter:   []string{"staging"},
+			Value:    "production",
+			Expected: false,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			if actual := Match(tc.Filter, tc.Value); actual != tc.Expected {
+				t.Errorf("expected %t, got %t", tc.Expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,515 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/filters"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/service"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultDoraWindow is the time span that GetDoraMetrics covers by default
+const DefaultDoraWindow = 30 * 24 * time.Hour
+
+// persistInterval is how often the changed records are written to the DoraStore
+var persistInterval = 30 * time.Second
+
+// DoraStore persists the deployments and restores of the dora metrics, so that they survive restarts.
+type DoraStore interface {
+	LoadDora() (map[service.Key][]byte, error)
+	StoreDora(records map[service.Key][]byte) error
+}
+
+// Dora computes the DORA metrics per team and environment:
+//
+//   - the deployment frequency counts new versions deployed in kuberpult,
+//   - the lead time for changes is the time from the creation of a release until it is healthy,
+//   - the change failure rate is the share of deployments that failed in argocd or were rolled back,
+//   - the time to restore is the time from a failure until the application is healthy again.
+//
+// Deployments that happened before the records in the DoraStore, or before the rollout-service started if there is no store, are not counted.
+type Dora struct {
+	mx      sync.Mutex
+	clock   func() time.Time
+	window  time.Duration
+	started time.Time
+	apps    map[service.Key]*doraApp
+	store   DoraStore
+	// dirty are the applications that changed since the last write to the store
+	dirty map[service.Key]struct{}
+
+	deployments        metric.Int64Counter
+	failedDeployments  metric.Int64Counter
+	leadTime           metric.Float64Histogram
+	timeToRestore      metric.Float64Histogram
+	changeFailureRate  metric.Float64ObservableGauge
+	changeFailureRates metric.Registration
+}
+
+type doraApp struct {
+	// since is when the application was seen first
+	since   time.Time
+	current *doraDeployment
+	// failingSince is set while the current deployment is failing
+	failingSince time.Time
+	// deployments and restores within the window
+	deployments []*doraDeployment
+	restores    []doraRestore
+}
+
+type doraDeployment struct {
+	team       string
+	version    uint64
+	deployedAt time.Time
+	createdAt  time.Time
+	// counted is false for the deployment that was already there when the rollout-service started
+	counted  bool
+	healthy  bool
+	leadTime time.Duration
+	failed   bool
+}
+
+type doraRestore struct {
+	team       string
+	restoredAt time.Time
+	duration   time.Duration
+}
+
+type doraGroup struct {
+	team        string
+	environment string
+}
+
+// NewDora returns a Dora that continues with the records in the store. The store is optional.
+func NewDora(meterProvider metric.MeterProvider, window time.Duration, clock func() time.Time, store DoraStore) (*Dora, error) {
+	if clock == nil {
+		clock = time.Now
+	}
+	if window <= 0 {
+		window = DefaultDoraWindow
+	}
+	d := &Dora{
+		clock:   clock,
+		window:  window,
+		started: clock(),
+		apps:    map[service.Key]*doraApp{},
+		store:   store,
+		dirty:   map[service.Key]struct{}{},
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	meter := meterProvider.Meter("kuberpult")
+	var err error
+	if d.deployments, err = meter.Int64Counter("dora_deployments"); err != nil {
+		return nil, fmt.Errorf("registering meter: %w", err)
+	}
+	if d.failedDeployments, err = meter.Int64Counter("dora_failed_deployments"); err != nil {
+		return nil, fmt.Errorf("registering meter: %w", err)
+	}
+	if d.leadTime, err = meter.Float64Histogram("dora_lead_time_seconds"); err != nil {
+		return nil, fmt.Errorf("registering meter: %w", err)
+	}
+	if d.timeToRestore, err = meter.Float64Histogram("dora_time_to_restore_seconds"); err != nil {
+		return nil, fmt.Errorf("registering meter: %w", err)
+	}
+	if d.changeFailureRate, err = meter.Float64ObservableGauge("dora_change_failure_rate"); err != nil {
+		return nil, fmt.Errorf("registering meter: %w", err)
+	}
+	d.changeFailureRates, err = meter.RegisterCallback(
+		func(_ context.Context, o metric.Observer) error {
+			for _, m := range d.metrics(nil, nil).Metrics {
+				if m.Deployments > 0 {
+					o.ObserveFloat64(d.changeFailureRate, m.ChangeFailureRate, metric.WithAttributeSet(doraAttributes(m.Team, m.Environment)))
+				}
+			}
+			return nil
+		},
+		d.changeFailureRate,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("registering callback: %w", err)
+	}
+	return d, nil
+}
+
+// Run follows the broadcast until the context is done.
+func (d *Dora) Run(ctx context.Context, bc *service.Broadcast) error {
+	defer d.changeFailureRates.Unregister()
+	defer d.persist(ctx)
+	for {
+		d.runOnce(ctx, bc)
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+	}
+}
+
+func (d *Dora) runOnce(ctx context.Context, bc *service.Broadcast) {
+	initial, ch, unsubscribe := bc.Start()
+	defer unsubscribe()
+	for _, ev := range initial {
+		d.process(ctx, ev, true)
+	}
+	ticker := time.NewTicker(persistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-ch:
+			if ev == nil {
+				return
+			}
+			d.process(ctx, ev, false)
+		case <-ticker.C:
+			d.persist(ctx)
+		}
+	}
+}
+
+func (d *Dora) process(ctx context.Context, ev *service.BroadcastEvent, initial bool) {
+	if ev.KuberpultVersion == nil || ev.KuberpultVersion.Version == 0 {
+		// Without a version in kuberpult there is no deployment to attribute the status to
+		return
+	}
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	now := d.clock()
+	app := d.apps[ev.Key]
+	if app == nil {
+		app = &doraApp{since: now}
+		d.apps[ev.Key] = app
+	}
+	d.dirty[ev.Key] = struct{}{}
+	version := ev.KuberpultVersion
+	if app.current == nil || app.current.version != version.Version {
+		dep := &doraDeployment{
+			team:       ev.Team,
+			version:    version.Version,
+			deployedAt: version.DeployedAt,
+			createdAt:  version.ReleaseCreatedAt,
+			// Applications in the initial snapshot are either new or were deployed while we weren't subscribed
+			counted: app.current != nil || !initial,
+		}
+		if dep.deployedAt.IsZero() {
+			dep.deployedAt = now
+		}
+		if app.current != nil && dep.version < app.current.version {
+			// A rollback means that the previous deployment failed
+			d.fail(ctx, ev.Key, app, app.current, now)
+		}
+		if dep.counted {
+			app.deployments = append(app.deployments, dep)
+			d.deployments.Add(ctx, 1, metric.WithAttributeSet(doraAttributes(dep.team, ev.Environment)))
+		}
+		app.current = dep
+	}
+	dep := app.current
+	if ev.ArgocdVersion != nil && ev.ArgocdVersion.Version == dep.version {
+		switch ev.RolloutStatus {
+		case api.RolloutStatus_RolloutStatusSuccesful:
+			if !dep.healthy {
+				dep.healthy = true
+				if dep.counted && !dep.createdAt.IsZero() {
+					dep.leadTime = now.Sub(dep.createdAt)
+					d.leadTime.Record(ctx, dep.leadTime.Seconds(), metric.WithAttributeSet(doraAttributes(dep.team, ev.Environment)))
+				}
+			}
+			if !app.failingSince.IsZero() {
+				restore := doraRestore{team: dep.team, restoredAt: now, duration: now.Sub(app.failingSince)}
+				app.restores = append(app.restores, restore)
+				app.failingSince = time.Time{}
+				d.timeToRestore.Record(ctx, restore.duration.Seconds(), metric.WithAttributeSet(doraAttributes(dep.team, ev.Environment)))
+			}
+		case api.RolloutStatus_RolloutStatusError:
+			d.fail(ctx, ev.Key, app, dep, now)
+		}
+	}
+	app.prune(now.Add(-d.window))
+}
+
+func (d *Dora) fail(ctx context.Context, key service.Key, app *doraApp, dep *doraDeployment, now time.Time) {
+	if app.failingSince.IsZero() {
+		app.failingSince = now
+	}
+	if dep.failed || !dep.counted {
+		return
+	}
+	dep.failed = true
+	d.failedDeployments.Add(ctx, 1, metric.WithAttributeSet(doraAttributes(dep.team, key.Environment)))
+}
+
+type doraRecord struct {
+	Since        time.Time              `json:"since"`
+	Current      *doraDeploymentRecord  `json:"current,omitempty"`
+	FailingSince time.Time              `json:"failingSince"`
+	Deployments  []doraDeploymentRecord `json:"deployments,omitempty"`
+	Restores     []doraRestoreRecord    `json:"restores,omitempty"`
+}
+
+type doraDeploymentRecord struct {
+	Team       string        `json:"team"`
+	Version    uint64        `json:"version"`
+	DeployedAt time.Time     `json:"deployedAt"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	Counted    bool          `json:"counted,omitempty"`
+	Healthy    bool          `json:"healthy,omitempty"`
+	LeadTime   time.Duration `json:"leadTime,omitempty"`
+	Failed     bool          `json:"failed,omitempty"`
+}
+
+type doraRestoreRecord struct {
+	Team       string        `json:"team"`
+	RestoredAt time.Time     `json:"restoredAt"`
+	Duration   time.Duration `json:"duration"`
+}
+
+func (a *doraApp) record() *doraRecord {
+	result := &doraRecord{
+		Since:        a.since,
+		FailingSince: a.failingSince,
+	}
+	if a.current != nil {
+		result.Current = a.current.record()
+	}
+	for _, dep := range a.deployments {
+		result.Deployments = append(result.Deployments, *dep.record())
+	}
+	for _, r := range a.restores {
+		result.Restores = append(result.Restores, doraRestoreRecord{Team: r.team, RestoredAt: r.restoredAt, Duration: r.duration})
+	}
+	return result
+}
+
+func (d *doraDeployment) record() *doraDeploymentRecord {
+	return &doraDeploymentRecord{
+		Team:       d.team,
+		Version:    d.version,
+		DeployedAt: d.deployedAt,
+		CreatedAt:  d.createdAt,
+		Counted:    d.counted,
+		Healthy:    d.healthy,
+		LeadTime:   d.leadTime,
+		Failed:     d.failed,
+	}
+}
+
+func (r *doraDeploymentRecord) deployment() *doraDeployment {
+	return &doraDeployment{
+		team:       r.Team,
+		version:    r.Version,
+		deployedAt: r.DeployedAt,
+		createdAt:  r.CreatedAt,
+		counted:    r.Counted,
+		healthy:    r.Healthy,
+		leadTime:   r.LeadTime,
+		failed:     r.Failed,
+	}
+}
+
+func (r *doraRecord) app() *doraApp {
+	result := &doraApp{
+		since:        r.Since,
+		failingSince: r.FailingSince,
+	}
+	for i := range r.Deployments {
+		result.deployments = append(result.deployments, r.Deployments[i].deployment())
+	}
+	for _, restore := range r.Restores {
+		result.restores = append(result.restores, doraRestore{team: restore.Team, restoredAt: restore.RestoredAt, duration: restore.Duration})
+	}
+	if r.Current != nil {
+		result.current = r.Current.deployment()
+		// the current deployment is also the last one in the window, unless it was pruned
+		if last := len(result.deployments) - 1; r.Current.Counted && last >= 0 && result.deployments[last].version == r.Current.Version {
+			result.current = result.deployments[last]
+		}
+	}
+	return result
+}
+
+// load continues with the records in the store.
+func (d *Dora) load() error {
+	if d.store == nil {
+		return nil
+	}
+	records, err := d.store.LoadDora()
+	if err != nil {
+		return err
+	}
+	since := d.clock().Add(-d.window)
+	for key, data := range records {
+		var r doraRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return fmt.Errorf("parsing the dora metrics of %s in %s: %w", key.Application, key.Environment, err)
+		}
+		app := r.app()
+		app.prune(since)
+		if app.since.Before(d.started) {
+			d.started = app.since
+		}
+		d.apps[key] = app
+	}
+	return nil
+}
+
+// persist writes the records of the applications that changed since the last call to the store.
+func (d *Dora) persist(ctx context.Context) {
+	if d.store == nil {
+		return
+	}
+	d.mx.Lock()
+	records := make(map[service.Key][]byte, len(d.dirty))
+	for key := range d.dirty {
+		data, err := json.Marshal(d.apps[key].record())
+		if err != nil {
+			logger.FromContext(ctx).Warn("dora.persist", zap.Error(err))
+			continue
+		}
+		records[key] = data
+	}
+	d.dirty = map[service.Key]struct{}{}
+	d.mx.Unlock()
+	if len(records) == 0 {
+		return
+	}
+	if err := d.store.StoreDora(records); err != nil {
+		logger.FromContext(ctx).Warn("dora.persist", zap.Error(err))
+		d.mx.Lock()
+		for key := range records {
+			d.dirty[key] = struct{}{}
+		}
+		d.mx.Unlock()
+	}
+}
+
+func (a *doraApp) prune(since time.Time) {
+	for len(a.deployments) > 0 && a.deployments[0].deployedAt.Before(since) {
+		a.deployments = a.deployments[1:]
+	}
+	for len(a.restores) > 0 && a.restores[0].restoredAt.Before(since) {
+		a.restores = a.restores[1:]
+	}
+}
+
+// GetDoraMetrics implements service.DoraMetrics
+func (d *Dora) GetDoraMetrics(ctx context.Context, req *api.GetDoraMetricsRequest) (*api.GetDoraMetricsResponse, error) {
+	return d.metrics(req.Environments, req.Teams), nil
+}
+
+func (d *Dora) metrics(environments, teams []string) *api.GetDoraMetricsResponse {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	now := d.clock()
+	since := now.Add(-d.window)
+	if d.started.After(since) {
+		since = d.started
+	}
+	metrics := map[doraGroup]*api.DoraMetrics{}
+	leadTimes := map[doraGroup][]time.Duration{}
+	restoreTimes := map[doraGroup][]time.Duration{}
+	get := func(team, environment string) (doraGroup, *api.DoraMetrics) {
+		g := doraGroup{team: team, environment: environment}
+		if metrics[g] == nil {
+			metrics[g] = &api.DoraMetrics{Team: team, Environment: environment}
+		}
+		return g, metrics[g]
+	}
+	for key, app := range d.apps {
+		if !filters.Match(environments, key.Environment) {
+			continue
+		}
+		for _, dep := range app.deployments {
+			if dep.deployedAt.Before(since) || !filters.Match(teams, dep.team) {
+				continue
+			}
+			g, m := get(dep.team, key.Environment)
+			m.Deployments++
+			if dep.failed {
+				m.FailedDeployments++
+			}
+			if dep.healthy && !dep.createdAt.IsZero() {
+				leadTimes[g] = append(leadTimes[g], dep.leadTime)
+			}
+		}
+		for _, r := range app.restores {
+			if r.restoredAt.Before(since) || !filters.Match(teams, r.team) {
+				continue
+			}
+			g, _ := get(r.team, key.Environment)
+			restoreTimes[g] = append(restoreTimes[g], r.duration)
+		}
+	}
+	// The frequency is computed over at least one day, so that it doesn't explode right after a start
+	days := now.Sub(since).Hours() / 24
+	if days < 1 {
+		days = 1
+	}
+	result := &api.GetDoraMetricsResponse{Since: timestamppb.New(since)}
+	for g, m := range metrics {
+		m.DeploymentsPerDay = float64(m.Deployments) / days
+		if m.Deployments > 0 {
+			m.ChangeFailureRate = float64(m.FailedDeployments) / float64(m.Deployments)
+		}
+		m.LeadTime = median(leadTimes[g])
+		m.TimeToRestore = median(restoreTimes[g])
+		result.Metrics = append(result.Metrics, m)
+	}
+	sort.Slice(result.Metrics, func(i, j int) bool {
+		a, b := result.Metrics[i], result.Metrics[j]
+		if a.Team != b.Team {
+			return a.Team < b.Team
+		}
+		return a.Environment < b.Environment
+	})
+	return result
+}
+
+func median(durations []time.Duration) *durationpb.Duration {
+	if len(durations) == 0 {
+		return nil
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	m := len(durations) / 2
+	if len(durations)%2 == 0 {
+		return durationpb.New((durations[m-1] + durations[m]) / 2)
+	}
+	return durationpb.New(durations[m])
+}
+
+func doraAttributes(team, environment string) attribute.Set {
+	return attribute.NewSet(
+		attribute.String("kuberpult_team", team),
+		attribute.String("kuberpult_environment", environment),
+	)
+}
@@ -0,0 +1,325 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	pkgmetrics "github.com/freiheit-com/kuberpult/pkg/metrics"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/service"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/versions"
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/metric/noop"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestDora(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	type step struct {
+		// Minute is the time of the step relative to t0
+		Minute int
+		Event  *service.BroadcastEvent
+		// Initial marks events from the snapshot of a subscription
+		Initial bool
+	}
+	var (
+		successful  = api.RolloutStatus_RolloutStatusSuccesful
+		progressing = api.RolloutStatus_RolloutStatusProgressing
+		failed      = api.RolloutStatus_RolloutStatusError
+	)
+	// event creates an event for version in kuberpult that was deployed at the given minute and created one hour before t0
+	event := func(env string, argocd, kuberpult uint64, deployedAt int, status api.RolloutStatus) *service.BroadcastEvent {
+		return &service.BroadcastEvent{
+			Key:              service.Key{Environment: env, Application: "foo"},
+			Team:             "team-a",
+			ArgocdVersion:    &versions.VersionInfo{Version: argocd},
+			KuberpultVersion: &versions.VersionInfo{Version: kuberpult, DeployedAt: t0.Add(time.Duration(deployedAt) * time.Minute), ReleaseCreatedAt: t0.Add(-time.Hour)},
+			RolloutStatus:    status,
+		}
+	}
+	tcs := []struct {
+		Name    string
+		Steps   []step
+		Request *api.GetDoraMetricsRequest
+		// Now is the minute at which the metrics are requested
+		Now int
+
+		ExpectedMetrics []*api.DoraMetrics
+	}{
+		{
+			Name: "doesn't count the deployments from before the start",
+			Steps: []step{
+				{Minute: 0, Event: event("production", 1, 1, -100, successful), Initial: true},
+				{Minute: 1, Event: event("production", 1, 1, -100, progressing)},
+			},
+			Now:             10,
+			ExpectedMetrics: nil,
+		},
+		{
+			Name: "lead time and frequency",
+			Steps: []step{
+				{Minute: 0, Event: event("production", 1, 1, -100, successful), Initial: true},
+				{Minute: 10, Event: event("production", 1, 2, 10, progressing)},
+				{Minute: 20, Event: event("production", 2, 2, 10, successful)},
+				{Minute: 30, Event: event("production", 2, 3, 30, progressing)},
+				{Minute: 60, Event: event("production", 3, 3, 30, successful)},
+			},
+			Now: 60,
+			ExpectedMetrics: []*api.DoraMetrics{
+				{
+					Team:              "team-a",
+					Environment:       "production",
+					Deployments:       2,
+					DeploymentsPerDay: 2,
+					LeadTime:          durationpb.New(100 * time.Minute),
+				},
+			},
+		},
+		{
+			Name: "failures and time to restore",
+			Steps: []step{
+				{Minute: 0, Event: event("production", 1, 1, -100, successful), Initial: true},
+				{Minute: 10, Event: event("production", 2, 2, 10, failed)},
+				{Minute: 15, Event: event("production", 2, 2, 10, progressing)},
+				{Minute: 20, Event: event("production", 2, 2, 10, successful)},
+				// the rollback marks version 3 as failed
+				{Minute: 30, Event: event("production", 3, 3, 30, successful)},
+				{Minute: 40, Event: event("production", 3, 2, 40, progressing)},
+				{Minute: 70, Event: event("production", 2, 2, 40, successful)},
+			},
+			Now: 70,
+			ExpectedMetrics: []*api.DoraMetrics{
+				{
+					Team:              "team-a",
+					Environment:       "production",
+					Deployments:       3,
+					DeploymentsPerDay: 3,
+					LeadTime:          durationpb.New(90 * time.Minute),
+					FailedDeployments: 2,
+					ChangeFailureRate: 2.0 / 3.0,
+					TimeToRestore:     durationpb.New(20 * time.Minute),
+				},
+			},
+		},
+		{
+			Name: "filters environments and teams",
+			Steps: []step{
+				{Minute: 10, Event: event("production", 1, 1, 10, successful)},
+				{Minute: 10, Event: event("staging", 1, 1, 10, successful)},
+			},
+			Request: &api.GetDoraMetricsRequest{Environments: []string{"staging"}, Teams: []string{"team-a"}},
+			Now:     10,
+			ExpectedMetrics: []*api.DoraMetrics{
+				{
+					Team:              "team-a",
+					Environment:       "staging",
+					Deployments:       1,
+					DeploymentsPerDay: 1,
+					LeadTime:          durationpb.New(70 * time.Minute),
+				},
+			},
+		},
+		{
+			Name: "forgets deployments outside of the window",
+			Steps: []step{
+				{Minute: 10, Event: event("production", 1, 1, 10, successful)},
+				{Minute: 3 * 24 * 60, Event: event("production", 2, 2, 3*24*60, successful)},
+			},
+			Now: 3 * 24 * 60,
+			ExpectedMetrics: []*api.DoraMetrics{
+				{
+					Team:              "team-a",
+					Environment:       "production",
+					Deployments:       1,
+					DeploymentsPerDay: 0.5,
+					LeadTime:          durationpb.New(3*24*time.Hour + time.Hour),
+				},
+			},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			now := t0
+			d, err := NewDora(noop.NewMeterProvider(), 2*24*time.Hour, func() time.Time { return now }, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tc.Steps {
+				now = t0.Add(time.Duration(s.Minute) * time.Minute)
+				d.process(ctx, s.Event, s.Initial)
+			}
+			now = t0.Add(time.Duration(tc.Now) * time.Minute)
+			req := tc.Request
+			if req == nil {
+				req = &api.GetDoraMetricsRequest{}
+			}
+			resp, err := d.GetDoraMetrics(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := &api.GetDoraMetricsResponse{
+				Since:   timestamppb.New(t0),
+				Metrics: tc.ExpectedMetrics,
+			}
+			if tc.Now > 2*24*60 {
+				expected.Since = timestamppb.New(now.Add(-2 * 24 * time.Hour))
+			}
+			if d := cmp.Diff(expected, resp, protocmp.Transform()); d != "" {
+				t.Errorf("unexpected metrics: %s", d)
+			}
+		})
+	}
+}
+
+type memoryDoraStore map[service.Key][]byte
+
+func (m memoryDoraStore) LoadDora() (map[service.Key][]byte, error) {
+	return m, nil
+}
+
+func (m memoryDoraStore) StoreDora(records map[service.Key][]byte) error {
+	for key, data := range records {
+		m[key] = data
+	}
+	return nil
+}
+
+func TestDoraStore(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := t0
+	clock := func() time.Time { return now }
+	event := func(argocd, kuberpult uint64, deployedAt int, status api.RolloutStatus) *service.BroadcastEvent {
+		return &service.BroadcastEvent{
+			Key:              service.Key{Environment: "production", Application: "foo"},
+			Team:             "team-a",
+			ArgocdVersion:    &versions.VersionInfo{Version: argocd},
+			KuberpultVersion: &versions.VersionInfo{Version: kuberpult, DeployedAt: t0.Add(time.Duration(deployedAt) * time.Minute), ReleaseCreatedAt: t0.Add(-time.Hour)},
+			RolloutStatus:    status,
+		}
+	}
+	store := memoryDoraStore{}
+	d, err := NewDora(noop.NewMeterProvider(), 0, clock, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.process(ctx, event(1, 1, -100, api.RolloutStatus_RolloutStatusSuccesful), true)
+	now = t0.Add(10 * time.Minute)
+	d.process(ctx, event(2, 2, 10, api.RolloutStatus_RolloutStatusError), false)
+	d.persist(ctx)
+
+	// the rollout-service restarts, version 2 recovered and version 3 was deployed in between
+	now = t0.Add(60 * time.Minute)
+	d, err = NewDora(noop.NewMeterProvider(), 0, clock, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.process(ctx, event(2, 2, 10, api.RolloutStatus_RolloutStatusSuccesful), true)
+	d.process(ctx, event(2, 3, 50, api.RolloutStatus_RolloutStatusProgressing), true)
+	resp, err := d.GetDoraMetrics(ctx, &api.GetDoraMetricsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &api.GetDoraMetricsResponse{
+		Since: timestamppb.New(t0),
+		Metrics: []*api.DoraMetrics{
+			{
+				Team:              "team-a",
+				Environment:       "production",
+				Deployments:       2,
+				DeploymentsPerDay: 2,
+				LeadTime:          durationpb.New(2 * time.Hour),
+				FailedDeployments: 1,
+				ChangeFailureRate: 0.5,
+				TimeToRestore:     durationpb.New(50 * time.Minute),
+			},
+		},
+	}
+	if d := cmp.Diff(expected, resp, protocmp.Transform()); d != "" {
+		t.Errorf("unexpected metrics: %s", d)
+	}
+}
+
+func TestDoraExport(t *testing.T) {
+	ctx := context.Background()
+	mpv, handler, _ := pkgmetrics.Init()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	d, err := NewDora(mpv, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []uint64{2, 1} {
+		d.process(ctx, &service.BroadcastEvent{
+			Key:              service.Key{Environment: "production", Application: "foo"},
+			Team:             "team-a",
+			KuberpultVersion: &versions.VersionInfo{Version: version, DeployedAt: time.Now()},
+		}, false)
+	}
+	resp, err := srv.Client().Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`dora_deployments_total{kuberpult_environment="production",kuberpult_team="team-a"} 2`,
+		`dora_failed_deployments_total{kuberpult_environment="production",kuberpult_team="team-a"} 1`,
+		`dora_change_failure_rate{kuberpult_environment="production",kuberpult_team="team-a"} 0.5`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected %q in the metrics, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestGetDoraMetricsDisabled(t *testing.T) {
+	bc := service.New()
+	_, err := bc.GetDoraMetrics(context.Background(), &api.GetDoraMetricsRequest{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected unimplemented, got %q", err)
+	}
+	d, err := NewDora(noop.NewMeterProvider(), 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.Dora = d
+	resp, err := bc.GetDoraMetrics(context.Background(), &api.GetDoraMetricsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Metrics) != 0 {
+		t.Errorf("expected no metrics, got %v", resp.Metrics)
+	}
+}
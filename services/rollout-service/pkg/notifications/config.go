@@ -0,0 +1,133 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/filters"
+)
+
+type Event string
+
+const (
+	EventSuccess Event = "success"
+	EventFailure Event = "failure"
+	// EventStuck is sent when a rollout is progressing for longer than Config.StuckAfter
+	EventStuck Event = "stuck"
+)
+
+type Type string
+
+const (
+	// TypeWebhook posts the message and its details as json
+	TypeWebhook Type = "webhook"
+	// TypeSlack posts to a slack compatible incoming webhook
+	TypeSlack Type = "slack"
+	// TypeTeams posts to a microsoft teams incoming webhook
+	TypeTeams Type = "teams"
+)
+
+const defaultStuckAfter = 15 * time.Minute
+
+// Config is read from the json file in KUBERPULT_NOTIFICATIONS_CONFIG.
+type Config struct {
+	// StuckAfter defaults to 15 minutes
+	StuckAfter Duration `json:"stuckAfter"`
+	Routes     []Route  `json:"routes"`
+}
+
+// A Route sends the matching events to one webhook.
+// Teams, environments and events match everything if they are empty.
+type Route struct {
+	Teams        []string `json:"teams"`
+	Environments []string `json:"environments"`
+	Events       []Event  `json:"events"`
+	Type         Type     `json:"type"`
+	URL          string   `json:"url"`
+	// Template overrides the text of the message, it's executed with a Message
+	Template string `json:"template"`
+
+	template *template.Template
+}
+
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading notifications config: %w", err)
+	}
+	return ParseConfig(data)
+}
+
+func ParseConfig(data []byte) (*Config, error) {
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing notifications config: %w", err)
+	}
+	if cfg.StuckAfter <= 0 {
+		cfg.StuckAfter = Duration(defaultStuckAfter)
+	}
+	for i := range cfg.Routes {
+		r := &cfg.Routes[i]
+		switch r.Type {
+		case TypeWebhook, TypeSlack, TypeTeams:
+		default:
+			return nil, fmt.Errorf("route %d: unknown type %q, must be one of %q, %q or %q", i, r.Type, TypeWebhook, TypeSlack, TypeTeams)
+		}
+		if r.URL == "" {
+			return nil, fmt.Errorf("route %d: url must not be empty", i)
+		}
+		for _, ev := range r.Events {
+			switch ev {
+			case EventSuccess, EventFailure, EventStuck:
+			default:
+				return nil, fmt.Errorf("route %d: unknown event %q, must be one of %q, %q or %q", i, ev, EventSuccess, EventFailure, EventStuck)
+			}
+		}
+		if r.Template != "" {
+			t, err := template.New(fmt.Sprintf("route %d", i)).Parse(r.Template)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			r.template = t
+		}
+	}
+	return &cfg, nil
+}
+
+func (r *Route) matches(msg *Message) bool {
+	return filters.Match(r.Teams, msg.Team) && filters.Match(r.Environments, msg.Environment) && filters.Match(r.Events, msg.Event)
+}
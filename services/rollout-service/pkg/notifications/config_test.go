@@ -0,0 +1,88 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package notifications
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		Name   string
+		Config string
+
+		ExpectedError      string
+		ExpectedStuckAfter time.Duration
+	}{
+		{
+			Name:               "defaults",
+			Config:             `{"routes": [{"type": "webhook", "url": "http://example.com"}]}`,
+			ExpectedStuckAfter: 15 * time.Minute,
+		},
+		{
+			Name:               "stuck after",
+			Config:             `{"stuckAfter": "1h", "routes": []}`,
+			ExpectedStuckAfter: time.Hour,
+		},
+		{
+			Name:          "invalid duration",
+			Config:        `{"stuckAfter": "soon"}`,
+			ExpectedError: `parsing notifications config: time: invalid duration "soon"`,
+		},
+		{
+			Name:          "unknown type",
+			Config:        `{"routes": [{"type": "email", "url": "http://example.com"}]}`,
+			ExpectedError: `route 0: unknown type "email", must be one of "webhook", "slack" or "teams"`,
+		},
+		{
+			Name:          "missing url",
+			Config:        `{"routes": [{"type": "slack"}]}`,
+			ExpectedError: `route 0: url must not be empty`,
+		},
+		{
+			Name:          "unknown event",
+			Config:        `{"routes": [{"type": "slack", "url": "http://example.com", "events": ["deleted"]}]}`,
+			ExpectedError: `route 0: unknown event "deleted", must be one of "success", "failure" or "stuck"`,
+		},
+		{
+			Name:          "invalid template",
+			Config:        `{"routes": [{"type": "slack", "url": "http://example.com", "template": "{{.Application"}]}`,
+			ExpectedError: `route 0: template: route 0:1: unclosed action`,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			cfg, err := ParseConfig([]byte(tc.Config))
+			if tc.ExpectedError != "" {
+				if err == nil || err.Error() != tc.ExpectedError {
+					t.Fatalf("expected error %q, got %v", tc.ExpectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if time.Duration(cfg.StuckAfter) != tc.ExpectedStuckAfter {
+				t.Errorf("expected stuck after %s, got %s", tc.ExpectedStuckAfter, time.Duration(cfg.StuckAfter))
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Message contains the details of an event, they are available in templates.
+type Message struct {
+	Event       Event
+	Environment string
+	Application string
+	Team        string
+	Version     uint64
+	// Reason explains why a rollout failed or is stuck, it can be empty
+	Reason string
+	// Duration is the time since the rollout started
+	Duration time.Duration
+}
+
+var defaultTemplates = map[Event]*template.Template{
+	EventSuccess: template.Must(template.New("success").Parse(`{{.Application}} version {{.Version}} was rolled out to {{.Environment}}`)),
+	EventFailure: template.Must(template.New("failure").Parse(`Rollout of {{.Application}} version {{.Version}} to {{.Environment}} failed{{with .Reason}}: {{.}}{{end}}`)),
+	EventStuck:   template.Must(template.New("stuck").Parse(`Rollout of {{.Application}} version {{.Version}} to {{.Environment}} is progressing for {{.Duration}}{{with .Reason}}: {{.}}{{end}}`)),
+}
+
+var teamsColors = map[Event]string{
+	EventSuccess: "2EB886",
+	EventFailure: "D93F0B",
+	EventStuck:   "FBCA04",
+}
+
+type webhookPayload struct {
+	Event       Event  `json:"event"`
+	Environment string `json:"environment"`
+	Application string `json:"application"`
+	Team        string `json:"team"`
+	Version     uint64 `json:"version"`
+	Reason      string `json:"reason"`
+	Text        string `json:"text"`
+}
+
+type slackPayload struct {
+	Text string `json:"text"`
+}
+
+type teamsPayload struct {
+	Type       string `json:"@type"`
+	Context    string `json:"@context"`
+	ThemeColor string `json:"themeColor"`
+	Summary    string `json:"summary"`
+	Text       string `json:"text"`
+}
+
+func (r *Route) text(msg *Message) (string, error) {
+	t := r.template
+	if t == nil {
+		t = defaultTemplates[msg.Event]
+	}
+	var buf strings.Builder
+	if err := t.Execute(&buf, msg); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (r *Route) payload(msg *Message) (any, error) {
+	text, err := r.text(msg)
+	if err != nil {
+		return nil, fmt.Errorf("rendering template: %w", err)
+	}
+	switch r.Type {
+	case TypeSlack:
+		return slackPayload{Text: text}, nil
+	case TypeTeams:
+		return teamsPayload{
+			Type:       "MessageCard",
+			Context:    "https://schema.org/extensions",
+			ThemeColor: teamsColors[msg.Event],
+			Summary:    text,
+			Text:       text,
+		}, nil
+	default:
+		return webhookPayload{
+			Event:       msg.Event,
+			Environment: msg.Environment,
+			Application: msg.Application,
+			Team:        msg.Team,
+			Version:     msg.Version,
+			Reason:      msg.Reason,
+			Text:        text,
+		}, nil
+	}
+}
+
+func (r *Route) send(ctx context.Context, client *http.Client, msg *Message) error {
+	payload, err := r.payload(msg)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package notifications
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/service"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// checkInterval is how often progressing rollouts are checked whether they are stuck
+var checkInterval = 10 * time.Second
+
+const (
+	sendTimeout      = 30 * time.Second
+	concurrencyLimit = 10
+	// queueSize limits the messages that wait for a worker, further messages are dropped instead of blocking the broadcast
+	queueSize = 100
+)
+
+// Subscribe sends notifications for the changes of the broadcast until the context is done.
+// The rollouts that are already finished when it subscribes are not notified.
+func Subscribe(ctx context.Context, cfg *Config, broadcast *service.Broadcast) error {
+	s := newSubscriber(cfg, &http.Client{Timeout: sendTimeout}, time.Now)
+	s.start(ctx)
+	defer s.group.Wait()
+	for {
+		s.subscribeOnce(ctx, broadcast)
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+	}
+}
+
+type subscriber struct {
+	config *Config
+	client *http.Client
+	now    func() time.Time
+	apps   map[service.Key]*appState
+	group  errgroup.Group
+	queue  chan delivery
+	// pending counts the queued messages that weren't delivered yet
+	pending sync.WaitGroup
+}
+
+type delivery struct {
+	route *Route
+	msg   *Message
+}
+
+type appState struct {
+	version   uint64
+	startedAt time.Time
+	status    api.RolloutStatus
+	// succeeded is set once the version was rolled out successfully
+	succeeded bool
+	// failureNotified is set once a failure of the version was notified, until it succeeds
+	failureNotified bool
+	// progressingSince is set while the rollout is progressing
+	progressingSince time.Time
+	stuck            bool
+	last             *service.BroadcastEvent
+}
+
+func newSubscriber(cfg *Config, client *http.Client, now func() time.Time) *subscriber {
+	s := &subscriber{
+		config: cfg,
+		client: client,
+		now:    now,
+		apps:   map[service.Key]*appState{},
+		queue:  make(chan delivery, queueSize),
+	}
+	return s
+}
+
+// start runs the workers that deliver the queued messages until the context is done
+func (s *subscriber) start(ctx context.Context) {
+	for i := 0; i < concurrencyLimit; i++ {
+		s.group.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case d := <-s.queue:
+					s.deliver(ctx, d)
+					s.pending.Done()
+				}
+			}
+		})
+	}
+}
+
+func (s *subscriber) subscribeOnce(ctx context.Context, broadcast *service.Broadcast) {
+	initial, ch, unsubscribe := broadcast.Start()
+	defer unsubscribe()
+	for _, ev := range initial {
+		s.process(ctx, ev, true)
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-ch:
+			if ev == nil {
+				return
+			}
+			s.process(ctx, ev, false)
+		case <-ticker.C:
+			s.checkStuck(ctx)
+		}
+	}
+}
+
+func (s *subscriber) process(ctx context.Context, ev *service.BroadcastEvent, initial bool) {
+	if ev.KuberpultVersion == nil || ev.KuberpultVersion.Version == 0 {
+		// the application was removed or isn't deployed yet
+		delete(s.apps, ev.Key)
+		return
+	}
+	now := s.now()
+	st := s.apps[ev.Key]
+	// Applications in the initial snapshot are either unchanged or changed while we weren't subscribed
+	silent := initial && st == nil
+	if st == nil || st.version != ev.KuberpultVersion.Version {
+		st = &appState{
+			version:   ev.KuberpultVersion.Version,
+			startedAt: ev.KuberpultVersion.DeployedAt,
+		}
+		if st.startedAt.IsZero() {
+			st.startedAt = now
+		}
+		s.apps[ev.Key] = st
+	}
+	st.last = ev
+	if st.status == ev.RolloutStatus {
+		return
+	}
+	previous := st.status
+	st.status = ev.RolloutStatus
+	st.progressingSince = time.Time{}
+	switch ev.RolloutStatus {
+	case api.RolloutStatus_RolloutStatusProgressing:
+		st.progressingSince = now
+		st.stuck = false
+	case api.RolloutStatus_RolloutStatusSuccesful:
+		// Only notify the first success and recoveries from errors
+		notify := !st.succeeded || previous == api.RolloutStatus_RolloutStatusError
+		st.succeeded = true
+		st.failureNotified = false
+		if notify && !silent {
+			s.send(ctx, st.message(EventSuccess, now))
+		}
+	case api.RolloutStatus_RolloutStatusError:
+		// Flapping between progressing and failed is only notified once
+		if !silent && !st.failureNotified {
+			s.send(ctx, st.message(EventFailure, now))
+		}
+		st.failureNotified = true
+	}
+}
+
+func (s *subscriber) checkStuck(ctx context.Context) {
+	now := s.now()
+	for _, st := range s.apps {
+		if st.progressingSince.IsZero() || st.stuck || now.Sub(st.progressingSince) < time.Duration(s.config.StuckAfter) {
+			continue
+		}
+		st.stuck = true
+		s.send(ctx, st.message(EventStuck, now))
+	}
+}
+
+func (a *appState) message(event Event, now time.Time) *Message {
+	return &Message{
+		Event:       event,
+		Environment: a.last.Environment,
+		Application: a.last.Application,
+		Team:        a.last.Team,
+		Version:     a.version,
+		Reason:      a.last.Diagnostics.Reason(),
+		Duration:    now.Sub(a.startedAt).Round(time.Second),
+	}
+}
+
+func (s *subscriber) send(ctx context.Context, msg *Message) {
+	for i := range s.config.Routes {
+		r := &s.config.Routes[i]
+		if !r.matches(msg) {
+			continue
+		}
+		s.pending.Add(1)
+		select {
+		case s.queue <- delivery{route: r, msg: msg}:
+		default:
+			s.pending.Done()
+			logger.FromContext(ctx).Warn("notifications.dropped",
+				zap.String("environment", msg.Environment),
+				zap.String("application", msg.Application),
+				zap.String("event", string(msg.Event)),
+				zap.String("type", string(r.Type)))
+		}
+	}
+}
+
+func (s *subscriber) deliver(ctx context.Context, d delivery) {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	if err := d.route.send(ctx, s.client, d.msg); err != nil {
+		logger.FromContext(ctx).Warn("notifications.send",
+			zap.String("environment", d.msg.Environment),
+			zap.String("application", d.msg.Application),
+			zap.String("event", string(d.msg.Event)),
+			zap.String("type", string(d.route.Type)),
+			zap.Error(err))
+	}
+}
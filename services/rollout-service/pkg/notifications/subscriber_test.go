@@ -0,0 +1,310 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/argoproj/gitops-engine/pkg/health"
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/service"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/versions"
+	"github.com/google/go-cmp/cmp"
+)
+
+type request struct {
+	Path string
+	Body map[string]any
+}
+
+// testServer is a stand-in for the webhooks that records all requests
+type testServer struct {
+	*httptest.Server
+	requests chan request
+}
+
+func newTestServer(t *testing.T) *testServer {
+	ts := &testServer{requests: make(chan request, 100)}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading body: %s", err)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("expected a json content type, got %q", r.Header.Get("Content-Type"))
+		}
+		body := map[string]any{}
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("invalid json %q: %s", data, err)
+		}
+		ts.requests <- request{Path: r.URL.Path, Body: body}
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (ts *testServer) received() []request {
+	var result []request
+	for {
+		select {
+		case r := <-ts.requests:
+			result = append(result, r)
+		default:
+			sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+			return result
+		}
+	}
+}
+
+func TestSubscriberDropsWhenTheQueueIsFull(t *testing.T) {
+	t.Parallel()
+	cfg, err := ParseConfig([]byte(`{"routes": [{"type": "slack", "url": "http://localhost/slack"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSubscriber(cfg, http.DefaultClient, time.Now)
+	// without workers nothing is delivered, but sending must not block
+	for i := 0; i < queueSize+10; i++ {
+		s.send(context.Background(), &Message{Event: EventFailure, Environment: "production", Application: "foo"})
+	}
+	if len(s.queue) != queueSize {
+		t.Errorf("expected a full queue of %d messages, got %d", queueSize, len(s.queue))
+	}
+}
+
+func TestSubscriber(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	type step struct {
+		// Minute is the time of the step relative to t0
+		Minute int
+		Event  *service.BroadcastEvent
+		// Initial marks events from the snapshot of a subscription
+		Initial    bool
+		CheckStuck bool
+
+		ExpectedRequests []request
+	}
+	var (
+		successful  = api.RolloutStatus_RolloutStatusSuccesful
+		progressing = api.RolloutStatus_RolloutStatusProgressing
+		failed      = api.RolloutStatus_RolloutStatusError
+	)
+	event := func(env, team string, version uint64, status api.RolloutStatus) *service.BroadcastEvent {
+		return &service.BroadcastEvent{
+			Key:              service.Key{Environment: env, Application: "foo"},
+			Team:             team,
+			KuberpultVersion: &versions.VersionInfo{Version: version, DeployedAt: t0},
+			ArgocdVersion:    &versions.VersionInfo{Version: version},
+			RolloutStatus:    status,
+		}
+	}
+	slack := func(text string) request {
+		return request{Path: "/slack", Body: map[string]any{"text": text}}
+	}
+	defaultConfig := `{"routes": [{"type": "slack", "url": "%s/slack"}]}`
+	tcs := []struct {
+		Name   string
+		Config string
+		Steps  []step
+	}{
+		{
+			Name:   "notifies success and failure",
+			Config: defaultConfig,
+			Steps: []step{
+				{Minute: 0, Event: event("production", "team-a", 1, progressing)},
+				{Minute: 2, Event: event("production", "team-a", 1, successful), ExpectedRequests: []request{
+					slack("foo version 1 was rolled out to production"),
+				}},
+				// resyncs of the same version are not a new rollout
+				{Minute: 3, Event: event("production", "team-a", 1, progressing)},
+				{Minute: 4, Event: event("production", "team-a", 1, successful)},
+				{Minute: 5, Event: event("production", "team-a", 2, progressing)},
+				{Minute: 6, Event: event("production", "team-a", 2, failed), ExpectedRequests: []request{
+					slack("Rollout of foo version 2 to production failed"),
+				}},
+				// recovering from an error is worth a notification
+				{Minute: 7, Event: event("production", "team-a", 2, successful), ExpectedRequests: []request{
+					slack("foo version 2 was rolled out to production"),
+				}},
+			},
+		},
+		{
+			Name:   "notifies failures once per version",
+			Config: defaultConfig,
+			Steps: []step{
+				{Minute: 0, Event: event("production", "team-a", 1, failed), ExpectedRequests: []request{
+					slack("Rollout of foo version 1 to production failed"),
+				}},
+				{Minute: 1, Event: event("production", "team-a", 1, progressing)},
+				{Minute: 2, Event: event("production", "team-a", 1, failed)},
+				{Minute: 3, Event: event("production", "team-a", 1, successful), ExpectedRequests: []request{
+					slack("foo version 1 was rolled out to production"),
+				}},
+				// failing again after a success is a new failure
+				{Minute: 4, Event: event("production", "team-a", 1, failed), ExpectedRequests: []request{
+					slack("Rollout of foo version 1 to production failed"),
+				}},
+				{Minute: 5, Event: event("production", "team-a", 2, failed), ExpectedRequests: []request{
+					slack("Rollout of foo version 2 to production failed"),
+				}},
+			},
+		},
+		{
+			Name:   "includes the reason of failures",
+			Config: defaultConfig,
+			Steps: []step{
+				{Minute: 0, Event: &service.BroadcastEvent{
+					Key:              service.Key{Environment: "production", Application: "foo"},
+					KuberpultVersion: &versions.VersionInfo{Version: 1},
+					ArgocdVersion:    &versions.VersionInfo{Version: 1},
+					RolloutStatus:    failed,
+					Diagnostics: service.Diagnostics{
+						UnhealthyResources: []service.ResourceHealth{{Kind: "Deployment", Name: "foo", Health: health.HealthStatusDegraded, Message: "crashloop"}},
+					},
+				}, ExpectedRequests: []request{
+					slack("Rollout of foo version 1 to production failed: Deployment foo is Degraded: crashloop"),
+				}},
+			},
+		},
+		{
+			Name:   "doesn't notify for the initial state",
+			Config: defaultConfig,
+			Steps: []step{
+				{Minute: 0, Event: event("production", "team-a", 1, successful), Initial: true},
+				{Minute: 0, Event: event("staging", "team-a", 1, failed), Initial: true},
+				// the snapshot after a reconnect only notifies changes
+				{Minute: 1, Event: event("production", "team-a", 1, successful), Initial: true},
+				{Minute: 1, Event: event("staging", "team-a", 2, successful), Initial: true, ExpectedRequests: []request{
+					slack("foo version 2 was rolled out to staging"),
+				}},
+			},
+		},
+		{
+			Name:   "notifies stuck rollouts once",
+			Config: `{"stuckAfter": "10m", "routes": [{"type": "slack", "url": "%s/slack"}]}`,
+			Steps: []step{
+				{Minute: 0, Event: event("production", "team-a", 1, progressing)},
+				{Minute: 9, CheckStuck: true},
+				{Minute: 10, CheckStuck: true, ExpectedRequests: []request{
+					slack("Rollout of foo version 1 to production is progressing for 10m0s"),
+				}},
+				{Minute: 11, CheckStuck: true},
+				{Minute: 12, Event: event("production", "team-a", 1, successful), ExpectedRequests: []request{
+					slack("foo version 1 was rolled out to production"),
+				}},
+				{Minute: 30, CheckStuck: true},
+			},
+		},
+		{
+			Name: "routes by team, environment and event",
+			Config: `{"routes": [
+				{"type": "slack", "url": "%[1]s/a-production", "teams": ["team-a"], "environments": ["production"]},
+				{"type": "slack", "url": "%[1]s/b-failures", "teams": ["team-b"], "events": ["failure"]},
+				{"type": "slack", "url": "%[1]s/all"}
+			]}`,
+			Steps: []step{
+				{Minute: 0, Event: event("production", "team-a", 1, successful), ExpectedRequests: []request{
+					{Path: "/a-production", Body: map[string]any{"text": "foo version 1 was rolled out to production"}},
+					{Path: "/all", Body: map[string]any{"text": "foo version 1 was rolled out to production"}},
+				}},
+				{Minute: 0, Event: event("staging", "team-a", 1, failed), ExpectedRequests: []request{
+					{Path: "/all", Body: map[string]any{"text": "Rollout of foo version 1 to staging failed"}},
+				}},
+				{Minute: 0, Event: &service.BroadcastEvent{
+					Key:              service.Key{Environment: "staging", Application: "bar"},
+					Team:             "team-b",
+					KuberpultVersion: &versions.VersionInfo{Version: 1},
+					ArgocdVersion:    &versions.VersionInfo{Version: 1},
+					RolloutStatus:    failed,
+				}, ExpectedRequests: []request{
+					{Path: "/all", Body: map[string]any{"text": "Rollout of bar version 1 to staging failed"}},
+					{Path: "/b-failures", Body: map[string]any{"text": "Rollout of bar version 1 to staging failed"}},
+				}},
+			},
+		},
+		{
+			Name: "webhook, teams and custom templates",
+			Config: `{"routes": [
+				{"type": "webhook", "url": "%[1]s/webhook"},
+				{"type": "teams", "url": "%[1]s/teams", "template": "{{.Team}}: {{.Application}} is broken in {{.Environment}}"},
+				{"type": "slack", "url": "%[1]s/broken"}
+			]}`,
+			Steps: []step{
+				{Minute: 3, Event: event("production", "team-a", 1, failed), ExpectedRequests: []request{
+					// failing webhooks are only logged
+					{Path: "/broken", Body: map[string]any{"text": "Rollout of foo version 1 to production failed"}},
+					{Path: "/teams", Body: map[string]any{
+						"@type":      "MessageCard",
+						"@context":   "https://schema.org/extensions",
+						"themeColor": "D93F0B",
+						"summary":    "team-a: foo is broken in production",
+						"text":       "team-a: foo is broken in production",
+					}},
+					{Path: "/webhook", Body: map[string]any{
+						"event":       "failure",
+						"environment": "production",
+						"application": "foo",
+						"team":        "team-a",
+						"version":     float64(1),
+						"reason":      "",
+						"text":        "Rollout of foo version 1 to production failed",
+					}},
+				}},
+			},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ts := newTestServer(t)
+			cfg, err := ParseConfig([]byte(fmt.Sprintf(tc.Config, ts.URL)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := t0
+			s := newSubscriber(cfg, ts.Client(), func() time.Time { return now })
+			s.start(ctx)
+			for i, st := range tc.Steps {
+				now = t0.Add(time.Duration(st.Minute) * time.Minute)
+				if st.Event != nil {
+					s.process(ctx, st.Event, st.Initial)
+				}
+				if st.CheckStuck {
+					s.checkStuck(ctx)
+				}
+				s.pending.Wait()
+				if d := cmp.Diff(st.ExpectedRequests, ts.received()); d != "" {
+					t.Errorf("unexpected requests in step %d: %s", i, d)
+				}
+			}
+		})
+	}
+}
@@ -36,7 +36,8 @@ type SimplifiedApplicationInterface interface {
 }
 
 type Notifier interface {
-	NotifyArgoCd(ctx context.Context, environment, application string)
+	// NotifyArgoCd refreshes the application. The destination is only set for environments with multiple destinations.
+	NotifyArgoCd(ctx context.Context, environment, application, destination string)
 }
 
 func New(client SimplifiedApplicationInterface, concurrencyLimit int) Notifier {
@@ -56,18 +57,23 @@ type notifier struct {
 	errGroup errgroup.Group
 }
 
-func (n *notifier) NotifyArgoCd(ctx context.Context, environment, application string) {
+func (n *notifier) NotifyArgoCd(ctx context.Context, environment, application, destination string) {
 	n.errGroup.Go(func() error {
 		var err error
 		span, ctx := tracer.StartSpanFromContext(ctx, "argocd.refresh")
 		span.SetTag("environment", environment)
 		span.SetTag("application", application)
+		name := fmt.Sprintf("%s-%s", environment, application)
+		if destination != "" {
+			span.SetTag("destination", destination)
+			name = fmt.Sprintf("%s-%s", name, destination)
+		}
 		ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 		defer cancel()
 		l := logger.FromContext(ctx).With(zap.String("environment", environment), zap.String("application", application))
 
 		_, err = n.client.Get(ctx, &argoapplication.ApplicationQuery{
-			Name:    ptr.FromString(fmt.Sprintf("%s-%s", environment, application)),
+			Name:    ptr.FromString(name),
 			Refresh: ptr.FromString(string(argoappv1.RefreshTypeNormal)),
 		})
 		if err != nil {
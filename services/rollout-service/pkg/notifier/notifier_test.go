@@ -55,7 +55,7 @@ func TestNotifier(t *testing.T) {
 			ma := &mockApplicationClient{ch}
 			nf := New(ma, tc.ConcurrencyLimit)
 			for i := 0; i < tc.ConcurrencyLimit; i = i + 1 {
-				nf.NotifyArgoCd(ctx, "foo", "bar")
+				nf.NotifyArgoCd(ctx, "foo", "bar", "")
 			}
 
 			for i := 0; i < tc.ConcurrencyLimit; i = i + 1 {
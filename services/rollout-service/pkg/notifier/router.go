@@ -0,0 +1,47 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package notifier
+
+import (
+	"context"
+
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Route returns a notifier that refreshes each environment in the argocd instance that deploys it.
+// Environments that are not in byEnvironment are refreshed by the fallback, which can be nil.
+func Route(byEnvironment map[string]Notifier, fallback Notifier) Notifier {
+	return &router{byEnvironment: byEnvironment, fallback: fallback}
+}
+
+type router struct {
+	byEnvironment map[string]Notifier
+	fallback      Notifier
+}
+
+func (r *router) NotifyArgoCd(ctx context.Context, environment, application, destination string) {
+	n := r.byEnvironment[environment]
+	if n == nil {
+		n = r.fallback
+	}
+	if n == nil {
+		logger.FromContext(ctx).Warn("argocd.refresh.unknown_environment", zap.String("environment", environment), zap.String("application", application))
+		return
+	}
+	n.NotifyArgoCd(ctx, environment, application, destination)
+}
@@ -0,0 +1,80 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package notifier
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type recordingNotifier struct {
+	name          string
+	notifications *[]string
+}
+
+func (r *recordingNotifier) NotifyArgoCd(ctx context.Context, environment, application, destination string) {
+	*r.notifications = append(*r.notifications, r.name+":"+environment+"/"+application)
+}
+
+func TestRoute(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		Name        string
+		Fallback    bool
+		Environment string
+
+		ExpectedNotifications []string
+	}{
+		{
+			Name:                  "routes to the instance of the environment",
+			Fallback:              true,
+			Environment:           "production-eu",
+			ExpectedNotifications: []string{"eu:production-eu/foo"},
+		},
+		{
+			Name:                  "uses the fallback for other environments",
+			Fallback:              true,
+			Environment:           "staging",
+			ExpectedNotifications: []string{"default:staging/foo"},
+		},
+		{
+			Name:        "drops unknown environments without fallback",
+			Environment: "staging",
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			var notifications []string
+			var fallback Notifier
+			if tc.Fallback {
+				fallback = &recordingNotifier{"default", &notifications}
+			}
+			n := Route(map[string]Notifier{
+				"production-eu": &recordingNotifier{"eu", &notifications},
+				"production-us": &recordingNotifier{"us", &notifications},
+			}, fallback)
+			n.NotifyArgoCd(context.Background(), tc.Environment, "foo", "")
+			if d := cmp.Diff(tc.ExpectedNotifications, notifications); d != "" {
+				t.Errorf("unexpected notifications: %s", d)
+			}
+		})
+	}
+}
@@ -111,5 +111,11 @@ func (s *subscriber) maybeSend(ctx context.Context, ev *service.BroadcastEvent)
 		targetVersion: ev.KuberpultVersion.Version,
 	}
 	// finally send the request
-	s.notifier.NotifyArgoCd(ctx, ev.Environment, ev.Application)
+	if len(ev.Destinations) == 0 {
+		s.notifier.NotifyArgoCd(ctx, ev.Environment, ev.Application, "")
+		return
+	}
+	for _, destination := range ev.Destinations {
+		s.notifier.NotifyArgoCd(ctx, ev.Environment, ev.Application, destination)
+	}
 }
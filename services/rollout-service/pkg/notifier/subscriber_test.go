@@ -30,14 +30,15 @@ import (
 type expectedNotification struct {
 	Application string
 	Environment string
+	Destination string
 }
 
 type mockArgocdNotifier struct {
 	ch chan<- expectedNotification
 }
 
-func (m *mockArgocdNotifier) NotifyArgoCd(ctx context.Context, environment, application string) {
-	m.ch <- expectedNotification{application, environment}
+func (m *mockArgocdNotifier) NotifyArgoCd(ctx context.Context, environment, application, destination string) {
+	m.ch <- expectedNotification{application, environment, destination}
 }
 
 func TestSubscribe(t *testing.T) {
@@ -47,6 +48,8 @@ func TestSubscribe(t *testing.T) {
 		VersionEvent *versions.KuberpultEvent
 
 		ExpectedNotification *expectedNotification
+		// for environments with multiple destinations
+		ExpectedNotifications []expectedNotification
 	}
 	tcs := []struct {
 		Name  string
@@ -142,12 +145,52 @@ func TestSubscribe(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name: "notifies every destination",
+			Steps: []step{
+				{
+					ArgoEvent: &service.ArgoEvent{
+						Application: "foo",
+						Environment: "bar",
+						Destination: "us",
+						Version:     &versions.VersionInfo{Version: 1},
+					},
+				},
+				{
+					ArgoEvent: &service.ArgoEvent{
+						Application: "foo",
+						Environment: "bar",
+						Destination: "eu",
+						Version:     &versions.VersionInfo{Version: 1},
+					},
+				},
+				{
+					VersionEvent: &versions.KuberpultEvent{
+						Application: "foo",
+						Environment: "bar",
+						Version:     &versions.VersionInfo{Version: 2},
+					},
+					ExpectedNotifications: []expectedNotification{
+						{
+							Application: "foo",
+							Environment: "bar",
+							Destination: "eu",
+						},
+						{
+							Application: "foo",
+							Environment: "bar",
+							Destination: "us",
+						},
+					},
+				},
+			},
+		},
 	}
 	for _, tc := range tcs {
 		tc := tc
 		t.Run(tc.Name, func(t *testing.T) {
 			ctx := context.Background()
-			notifications := make(chan expectedNotification, len(tc.Steps))
+			notifications := make(chan expectedNotification, 2*len(tc.Steps))
 			mn := &mockArgocdNotifier{notifications}
 			bc := service.New()
 			ctx, cancel := context.WithCancel(ctx)
@@ -162,10 +205,16 @@ func TestSubscribe(t *testing.T) {
 				} else {
 					bc.ProcessKuberpultEvent(ctx, *s.VersionEvent)
 				}
+				expected := s.ExpectedNotifications
 				if s.ExpectedNotification != nil {
-					notification := <-notifications
-					if !cmp.Equal(notification, *s.ExpectedNotification) {
-						t.Errorf("expected notification %v, but got %v", s.ExpectedNotification, notification)
+					expected = append([]expectedNotification{*s.ExpectedNotification}, expected...)
+				}
+				if len(expected) > 0 {
+					for _, e := range expected {
+						notification := <-notifications
+						if !cmp.Equal(notification, e) {
+							t.Errorf("expected notification %v, but got %v", e, notification)
+						}
 					}
 				} else {
 					select {
@@ -0,0 +1,97 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package rollback
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/filters"
+)
+
+const defaultFailedFor = 5 * time.Minute
+
+// Config is read from the json file in KUBERPULT_ROLLBACK_CONFIG.
+type Config struct {
+	Rules []Rule `json:"rules"`
+	// Role is sent to the cd-service as the role of the RollbackUser, it's only required if Dex is enabled
+	Role string `json:"role"`
+}
+
+// A Rule enables automatic rollbacks for the matching applications.
+// Environments and applications match everything if they are empty, but at least one of them must be set.
+type Rule struct {
+	Environments []string `json:"environments"`
+	Applications []string `json:"applications"`
+	// FailedFor is how long a version has to stay in error before it's rolled back, it defaults to 5 minutes
+	FailedFor string `json:"failedFor"`
+	// Deadline is how long a new version can take to become healthy, versions are only rolled back on errors if it's empty
+	Deadline string `json:"deadline"`
+
+	failedFor time.Duration
+	deadline  time.Duration
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading rollback config: %w", err)
+	}
+	return ParseConfig(data)
+}
+
+func ParseConfig(data []byte) (*Config, error) {
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing rollback config: %w", err)
+	}
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if len(r.Environments) == 0 && len(r.Applications) == 0 {
+			return nil, fmt.Errorf("rule %d: environments or applications must be set", i)
+		}
+		r.failedFor = defaultFailedFor
+		if r.FailedFor != "" {
+			d, err := time.ParseDuration(r.FailedFor)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("rule %d: invalid failedFor %q", i, r.FailedFor)
+			}
+			r.failedFor = d
+		}
+		if r.Deadline != "" {
+			d, err := time.ParseDuration(r.Deadline)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("rule %d: invalid deadline %q", i, r.Deadline)
+			}
+			r.deadline = d
+		}
+	}
+	return &cfg, nil
+}
+
+// rule returns the first rule that matches the application or nil
+func (c *Config) rule(environment, application string) *Rule {
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if filters.Match(r.Environments, environment) && filters.Match(r.Applications, application) {
+			return r
+		}
+	}
+	return nil
+}
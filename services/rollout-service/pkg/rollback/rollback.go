@@ -0,0 +1,329 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package rollback
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/pkg/auth"
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/service"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+)
+
+// LockId is the id of the application locks that are created with every rollback
+const LockId = "rollout-service-rollback"
+
+// RollbackUser is the author of the rollbacks in the repository.
+var RollbackUser auth.User = auth.User{
+	Email: "kuberpult-rollout-service@local",
+	Name:  "kuberpult-rollout-service",
+}
+
+// checkInterval is how often the applications are checked whether they need a rollback
+var checkInterval = 10 * time.Second
+
+const (
+	batchTimeout     = time.Minute
+	concurrencyLimit = 10
+	// queueSize limits the rollbacks that wait for a worker, further rollbacks are tried again with the next check
+	queueSize = 100
+	// failed rollbacks are retried after retryDelay, which doubles with every failure up to maxRetryDelay
+	retryDelay    = time.Minute
+	maxRetryDelay = time.Hour
+)
+
+// this is a simpler version of BatchServiceClient from the api package
+type SimplifiedBatchServiceClient interface {
+	ProcessBatch(ctx context.Context, in *api.BatchRequest, opts ...grpc.CallOption) (*api.BatchResponse, error)
+}
+
+// Subscribe rolls back applications that match a rule of the config until the context is done.
+func Subscribe(ctx context.Context, cfg *Config, client SimplifiedBatchServiceClient, broadcast *service.Broadcast) error {
+	r := newRoller(cfg, client, time.Now)
+	r.start(ctx)
+	defer r.group.Wait()
+	for {
+		r.subscribeOnce(ctx, broadcast)
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+	}
+}
+
+type roller struct {
+	config *Config
+	client SimplifiedBatchServiceClient
+	now    func() time.Time
+	apps   map[service.Key]*appState
+	group  errgroup.Group
+	queue  chan rollbackJob
+	// pending counts the queued rollbacks that aren't done yet
+	pending sync.WaitGroup
+
+	// Mutex guarding results, in which the workers report the outcome of the rollbacks
+	mx      sync.Mutex
+	results map[service.Key]rollbackResult
+}
+
+type rollbackJob struct {
+	key    service.Key
+	from   uint64
+	to     uint64
+	reason string
+}
+
+type rollbackResult struct {
+	version uint64
+	err     error
+}
+
+type appState struct {
+	version uint64
+	// deployedAt is when the version was first seen
+	deployedAt time.Time
+	status     api.RolloutStatus
+	healthy    bool
+	// failingSince is set while the version is in error
+	failingSince time.Time
+	// previousHealthy is the last other version that was healthy
+	previousHealthy uint64
+	rolledBack      bool
+	// rollingBack is set while a rollback is queued or running
+	rollingBack bool
+	// failedRollbacks counts the failed attempts, the next attempt is not before retryAt
+	failedRollbacks int
+	retryAt         time.Time
+	last            *service.BroadcastEvent
+}
+
+func newRoller(cfg *Config, client SimplifiedBatchServiceClient, now func() time.Time) *roller {
+	r := &roller{
+		config:  cfg,
+		client:  client,
+		now:     now,
+		apps:    map[service.Key]*appState{},
+		queue:   make(chan rollbackJob, queueSize),
+		results: map[service.Key]rollbackResult{},
+	}
+	return r
+}
+
+// start runs the workers that roll back the queued applications until the context is done
+func (r *roller) start(ctx context.Context) {
+	for i := 0; i < concurrencyLimit; i++ {
+		r.group.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case job := <-r.queue:
+					err := r.rollback(ctx, job)
+					r.mx.Lock()
+					r.results[job.key] = rollbackResult{version: job.from, err: err}
+					r.mx.Unlock()
+					r.pending.Done()
+				}
+			}
+		})
+	}
+}
+
+func (r *roller) subscribeOnce(ctx context.Context, broadcast *service.Broadcast) {
+	initial, ch, unsubscribe := broadcast.Start()
+	defer unsubscribe()
+	for _, ev := range initial {
+		r.process(ev)
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-ch:
+			if ev == nil {
+				return
+			}
+			r.process(ev)
+		case <-ticker.C:
+			r.check(ctx)
+		}
+	}
+}
+
+func (r *roller) process(ev *service.BroadcastEvent) {
+	if ev.KuberpultVersion == nil || ev.KuberpultVersion.Version == 0 {
+		// the application was removed or isn't deployed yet
+		delete(r.apps, ev.Key)
+		return
+	}
+	now := r.now()
+	st := r.apps[ev.Key]
+	if st == nil || st.version != ev.KuberpultVersion.Version {
+		next := &appState{
+			version:    ev.KuberpultVersion.Version,
+			deployedAt: now,
+		}
+		if st != nil {
+			next.previousHealthy = st.previousHealthy
+			if st.healthy {
+				next.previousHealthy = st.version
+			}
+		}
+		st = next
+		r.apps[ev.Key] = st
+	}
+	st.last = ev
+	st.status = ev.RolloutStatus
+	if ev.ArgocdVersion == nil || ev.ArgocdVersion.Version != st.version {
+		// the status belongs to an older version
+		st.failingSince = time.Time{}
+		return
+	}
+	switch ev.RolloutStatus {
+	case api.RolloutStatus_RolloutStatusSuccesful:
+		st.healthy = true
+		st.failingSince = time.Time{}
+	case api.RolloutStatus_RolloutStatusError:
+		if st.failingSince.IsZero() {
+			st.failingSince = now
+		}
+	default:
+		st.failingSince = time.Time{}
+	}
+}
+
+// collect applies the results of the finished rollbacks
+func (r *roller) collect(now time.Time) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for key, res := range r.results {
+		delete(r.results, key)
+		st := r.apps[key]
+		if st == nil || st.version != res.version {
+			// another version was deployed in the meantime
+			continue
+		}
+		st.rollingBack = false
+		if res.err == nil {
+			st.rolledBack = true
+			continue
+		}
+		delay := retryDelay
+		for i := 0; i < st.failedRollbacks && delay < maxRetryDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+		st.failedRollbacks++
+		st.retryAt = now.Add(delay)
+	}
+}
+
+func (r *roller) check(ctx context.Context) {
+	now := r.now()
+	r.collect(now)
+	for key, st := range r.apps {
+		if st.rolledBack || st.rollingBack || now.Before(st.retryAt) || st.previousHealthy == 0 || st.previousHealthy == st.version {
+			continue
+		}
+		rule := r.config.rule(key.Environment, key.Application)
+		if rule == nil {
+			continue
+		}
+		var reason string
+		if !st.failingSince.IsZero() && now.Sub(st.failingSince) >= rule.failedFor {
+			reason = fmt.Sprintf("version %d failed for %s", st.version, rule.failedFor)
+			if diagnostics := st.last.Diagnostics.Reason(); diagnostics != "" {
+				reason = fmt.Sprintf("%s: %s", reason, diagnostics)
+			}
+		} else if rule.deadline != 0 && !st.healthy && st.status != api.RolloutStatus_RolloutStatusUnknown && now.Sub(st.deployedAt) >= rule.deadline {
+			reason = fmt.Sprintf("version %d did not become healthy within %s", st.version, rule.deadline)
+		} else {
+			continue
+		}
+		r.pending.Add(1)
+		select {
+		case r.queue <- rollbackJob{key: key, from: st.version, to: st.previousHealthy, reason: reason}:
+			st.rollingBack = true
+		default:
+			// the next check tries again
+			r.pending.Done()
+			logger.FromContext(ctx).Warn("rollback.queue.full",
+				zap.String("environment", key.Environment),
+				zap.String("application", key.Application),
+			)
+		}
+	}
+}
+
+// rollback deploys the previous healthy version and locks the application
+func (r *roller) rollback(ctx context.Context, job rollbackJob) error {
+	ctx = auth.WriteUserToGrpcContext(ctx, RollbackUser)
+	if r.config.Role != "" {
+		ctx = auth.WriteUserRoleToGrpcContext(ctx, r.config.Role)
+	}
+	ctx, cancel := context.WithTimeout(ctx, batchTimeout)
+	defer cancel()
+	l := logger.FromContext(ctx).With(
+		zap.String("environment", job.key.Environment),
+		zap.String("application", job.key.Application),
+		zap.Uint64("from", job.from),
+		zap.Uint64("to", job.to),
+	)
+	_, err := r.client.ProcessBatch(ctx, &api.BatchRequest{
+		Actions: []*api.BatchAction{
+			{
+				Action: &api.BatchAction_Deploy{
+					Deploy: &api.DeployRequest{
+						Environment: job.key.Environment,
+						Application: job.key.Application,
+						Version:     job.to,
+						// locks mean that someone else is taking care of the application
+						LockBehavior: api.LockBehavior_Fail,
+					},
+				},
+			},
+			{
+				Action: &api.BatchAction_CreateEnvironmentApplicationLock{
+					CreateEnvironmentApplicationLock: &api.CreateEnvironmentApplicationLockRequest{
+						Environment: job.key.Environment,
+						Application: job.key.Application,
+						LockId:      LockId,
+						Message:     fmt.Sprintf("Automatic rollback to version %d because %s. Delete this lock to deploy again.", job.to, job.reason),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		l.Error("rollback.failed", zap.String("reason", job.reason), zap.Error(err))
+	} else {
+		l.Info("rollback.done", zap.String("reason", job.reason))
+	}
+	return err
+}
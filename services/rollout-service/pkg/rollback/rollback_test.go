@@ -0,0 +1,388 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package rollback
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/argoproj/gitops-engine/pkg/health"
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/service"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/versions"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+type mockBatchClient struct {
+	mx       sync.Mutex
+	requests []*api.BatchRequest
+	roles    []string
+	err      error
+	t        *testing.T
+}
+
+func (m *mockBatchClient) ProcessBatch(ctx context.Context, in *api.BatchRequest, opts ...grpc.CallOption) (*api.BatchResponse, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if len(md.Get("author-email")) == 0 {
+		m.t.Errorf("expected the rollback user in the context, got %v", md)
+	}
+	m.roles = append(m.roles, md.Get("author-role")...)
+	m.requests = append(m.requests, in)
+	return &api.BatchResponse{}, m.err
+}
+
+func (m *mockBatchClient) received() []*api.BatchRequest {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	result := m.requests
+	m.requests = nil
+	return result
+}
+
+func rollbackRequest(env, app string, to uint64, message string) *api.BatchRequest {
+	return &api.BatchRequest{
+		Actions: []*api.BatchAction{
+			{
+				Action: &api.BatchAction_Deploy{
+					Deploy: &api.DeployRequest{
+						Environment:  env,
+						Application:  app,
+						Version:      to,
+						LockBehavior: api.LockBehavior_Fail,
+					},
+				},
+			},
+			{
+				Action: &api.BatchAction_CreateEnvironmentApplicationLock{
+					CreateEnvironmentApplicationLock: &api.CreateEnvironmentApplicationLockRequest{
+						Environment: env,
+						Application: app,
+						LockId:      LockId,
+						Message:     message,
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestRollback(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	type step struct {
+		// Minute is the time of the step relative to t0
+		Minute int
+		Event  *service.BroadcastEvent
+		Check  bool
+
+		ExpectedRequests []*api.BatchRequest
+	}
+	var (
+		successful  = api.RolloutStatus_RolloutStatusSuccesful
+		progressing = api.RolloutStatus_RolloutStatusProgressing
+		failed      = api.RolloutStatus_RolloutStatusError
+	)
+	event := func(env string, argocd, kuberpult uint64, status api.RolloutStatus) *service.BroadcastEvent {
+		return &service.BroadcastEvent{
+			Key:              service.Key{Environment: env, Application: "foo"},
+			KuberpultVersion: &versions.VersionInfo{Version: kuberpult},
+			ArgocdVersion:    &versions.VersionInfo{Version: argocd},
+			RolloutStatus:    status,
+		}
+	}
+	defaultConfig := `{"rules": [{"environments": ["production"], "deadline": "30m"}]}`
+	tcs := []struct {
+		Name   string
+		Config string
+		Steps  []step
+	}{
+		{
+			Name:   "rolls back versions that stay in error",
+			Config: defaultConfig,
+			Steps: []step{
+				{Minute: 0, Event: event("production", 1, 1, successful)},
+				{Minute: 10, Event: event("production", 1, 2, progressing)},
+				{Minute: 11, Event: event("production", 2, 2, failed)},
+				{Minute: 15, Check: true},
+				{Minute: 16, Check: true, ExpectedRequests: []*api.BatchRequest{
+					rollbackRequest("production", "foo", 1, "Automatic rollback to version 1 because version 2 failed for 5m0s. Delete this lock to deploy again."),
+				}},
+				// only once
+				{Minute: 17, Check: true},
+				// the rollback itself is not rolled back
+				{Minute: 18, Event: event("production", 2, 1, progressing)},
+				{Minute: 60, Check: true},
+			},
+		},
+		{
+			Name:   "rolls back versions that don't get healthy in time",
+			Config: defaultConfig,
+			Steps: []step{
+				{Minute: 0, Event: event("production", 1, 1, successful)},
+				{Minute: 10, Event: event("production", 1, 2, progressing)},
+				{Minute: 39, Check: true},
+				{Minute: 40, Check: true, ExpectedRequests: []*api.BatchRequest{
+					rollbackRequest("production", "foo", 1, "Automatic rollback to version 1 because version 2 did not become healthy within 30m0s. Delete this lock to deploy again."),
+				}},
+			},
+		},
+		{
+			Name:   "includes the diagnostics",
+			Config: defaultConfig,
+			Steps: []step{
+				{Minute: 0, Event: event("production", 1, 1, successful)},
+				{Minute: 10, Event: &service.BroadcastEvent{
+					Key:              service.Key{Environment: "production", Application: "foo"},
+					KuberpultVersion: &versions.VersionInfo{Version: 2},
+					ArgocdVersion:    &versions.VersionInfo{Version: 2},
+					RolloutStatus:    failed,
+					Diagnostics: service.Diagnostics{
+						UnhealthyResources: []service.ResourceHealth{{Kind: "Deployment", Name: "foo", Health: health.HealthStatusDegraded}},
+					},
+				}},
+				{Minute: 15, Check: true, ExpectedRequests: []*api.BatchRequest{
+					rollbackRequest("production", "foo", 1, "Automatic rollback to version 1 because version 2 failed for 5m0s: Deployment foo is Degraded. Delete this lock to deploy again."),
+				}},
+			},
+		},
+		{
+			Name:   "doesn't roll back healthy versions on short errors",
+			Config: defaultConfig,
+			Steps: []step{
+				{Minute: 0, Event: event("production", 1, 1, successful)},
+				{Minute: 10, Event: event("production", 2, 2, successful)},
+				{Minute: 20, Event: event("production", 2, 2, failed)},
+				{Minute: 22, Event: event("production", 2, 2, successful)},
+				{Minute: 60, Check: true},
+				// but if the error stays
+				{Minute: 70, Event: event("production", 2, 2, failed)},
+				{Minute: 75, Check: true, ExpectedRequests: []*api.BatchRequest{
+					rollbackRequest("production", "foo", 1, "Automatic rollback to version 1 because version 2 failed for 5m0s. Delete this lock to deploy again."),
+				}},
+			},
+		},
+		{
+			Name:   "only applications that match a rule",
+			Config: `{"rules": [{"environments": ["production"], "applications": ["bar"]}]}`,
+			Steps: []step{
+				{Minute: 0, Event: event("production", 1, 1, successful)},
+				{Minute: 10, Event: event("production", 2, 2, failed)},
+				{Minute: 60, Check: true},
+			},
+		},
+		{
+			Name:   "needs a healthy version to roll back to",
+			Config: defaultConfig,
+			Steps: []step{
+				{Minute: 0, Event: event("production", 1, 1, failed)},
+				{Minute: 10, Event: event("production", 2, 2, failed)},
+				{Minute: 60, Check: true},
+			},
+		},
+		{
+			Name:   "ignores the deadline without argocd status",
+			Config: defaultConfig,
+			Steps: []step{
+				{Minute: 0, Event: event("production", 1, 1, successful)},
+				{Minute: 10, Event: event("production", 2, 2, api.RolloutStatus_RolloutStatusUnknown)},
+				{Minute: 60, Check: true},
+			},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			cfg, err := ParseConfig([]byte(tc.Config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &mockBatchClient{t: t}
+			now := t0
+			r := newRoller(cfg, client, func() time.Time { return now })
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r.start(ctx)
+			for i, s := range tc.Steps {
+				now = t0.Add(time.Duration(s.Minute) * time.Minute)
+				if s.Event != nil {
+					r.process(s.Event)
+				}
+				if s.Check {
+					r.check(ctx)
+				}
+				r.pending.Wait()
+				if d := cmp.Diff(s.ExpectedRequests, client.received(), protocmp.Transform()); d != "" {
+					t.Errorf("unexpected requests in step %d: %s", i, d)
+				}
+			}
+		})
+	}
+}
+
+func TestRollbackFailure(t *testing.T) {
+	t.Parallel()
+	cfg, err := ParseConfig([]byte(`{"rules": [{"applications": ["foo"], "failedFor": "1m"}], "role": "deployer"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &mockBatchClient{t: t, err: fmt.Errorf("locked")}
+	now := time.Unix(0, 0)
+	r := newRoller(cfg, client, func() time.Time { return now })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.start(ctx)
+	key := service.Key{Environment: "production", Application: "foo"}
+	r.process(&service.BroadcastEvent{Key: key, KuberpultVersion: &versions.VersionInfo{Version: 1}, ArgocdVersion: &versions.VersionInfo{Version: 1}, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful})
+	r.process(&service.BroadcastEvent{Key: key, KuberpultVersion: &versions.VersionInfo{Version: 2}, ArgocdVersion: &versions.VersionInfo{Version: 2}, RolloutStatus: api.RolloutStatus_RolloutStatusError})
+	// failed rollbacks are retried with an increasing delay until they succeed
+	steps := []struct {
+		After    time.Duration
+		Err      error
+		Attempts int
+	}{
+		{After: time.Hour, Err: fmt.Errorf("locked"), Attempts: 1},
+		{After: 0, Err: fmt.Errorf("locked"), Attempts: 0},
+		{After: time.Minute, Err: fmt.Errorf("locked"), Attempts: 1},
+		{After: time.Minute, Err: fmt.Errorf("locked"), Attempts: 0},
+		{After: 2 * time.Minute, Attempts: 1},
+		{After: time.Hour, Attempts: 0},
+	}
+	for i, s := range steps {
+		now = now.Add(s.After)
+		client.mx.Lock()
+		client.err = s.Err
+		client.mx.Unlock()
+		r.check(ctx)
+		r.pending.Wait()
+		if n := len(client.received()); n != s.Attempts {
+			t.Errorf("expected %d rollback attempts in step %d, got %d", s.Attempts, i, n)
+		}
+	}
+	// the role is base64 encoded
+	if d := cmp.Diff([]string{"ZGVwbG95ZXI=", "ZGVwbG95ZXI=", "ZGVwbG95ZXI="}, client.roles); d != "" {
+		t.Errorf("unexpected roles: %s", d)
+	}
+}
+
+type blockingBatchClient struct {
+	release chan struct{}
+}
+
+func (b *blockingBatchClient) ProcessBatch(ctx context.Context, in *api.BatchRequest, opts ...grpc.CallOption) (*api.BatchResponse, error) {
+	select {
+	case <-b.release:
+		return &api.BatchResponse{}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestRollbackDoesntBlock(t *testing.T) {
+	t.Parallel()
+	cfg, err := ParseConfig([]byte(`{"rules": [{"environments": ["production"], "failedFor": "1m"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &blockingBatchClient{release: make(chan struct{})}
+	now := time.Unix(0, 0)
+	r := newRoller(cfg, client, func() time.Time { return now })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.start(ctx)
+	apps := concurrencyLimit + queueSize + 10
+	for i := 0; i < apps; i++ {
+		key := service.Key{Environment: "production", Application: fmt.Sprintf("app-%d", i)}
+		r.process(&service.BroadcastEvent{Key: key, KuberpultVersion: &versions.VersionInfo{Version: 1}, ArgocdVersion: &versions.VersionInfo{Version: 1}, RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful})
+		r.process(&service.BroadcastEvent{Key: key, KuberpultVersion: &versions.VersionInfo{Version: 2}, ArgocdVersion: &versions.VersionInfo{Version: 2}, RolloutStatus: api.RolloutStatus_RolloutStatusError})
+	}
+	now = now.Add(time.Hour)
+	checked := make(chan struct{})
+	go func() {
+		// more rollbacks than workers and queue must not block the subscriber
+		r.check(ctx)
+		r.check(ctx)
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(10 * time.Second):
+		t.Fatal("check blocked on the running rollbacks")
+	}
+	close(client.release)
+	r.pending.Wait()
+	// the applications that didn't fit into the queue are rolled back with a later check
+	r.check(ctx)
+	r.pending.Wait()
+	r.check(ctx)
+	for key, st := range r.apps {
+		if !st.rolledBack {
+			t.Errorf("expected %s to be rolled back", key.Application)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		Name   string
+		Config string
+
+		ExpectedError string
+	}{
+		{
+			Name:   "valid",
+			Config: `{"rules": [{"environments": ["production"], "failedFor": "1m", "deadline": "1h"}]}`,
+		},
+		{
+			Name:          "rule without filter",
+			Config:        `{"rules": [{"deadline": "1h"}]}`,
+			ExpectedError: "rule 0: environments or applications must be set",
+		},
+		{
+			Name:          "invalid failedFor",
+			Config:        `{"rules": [{"applications": ["foo"], "failedFor": "-1m"}]}`,
+			ExpectedError: `rule 0: invalid failedFor "-1m"`,
+		},
+		{
+			Name:          "invalid deadline",
+			Config:        `{"rules": [{"applications": ["foo"], "deadline": "soon"}]}`,
+			ExpectedError: `rule 0: invalid deadline "soon"`,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			_, err := ParseConfig([]byte(tc.Config))
+			if tc.ExpectedError == "" {
+				if err != nil {
+					t.Errorf("expected no error, got %q", err)
+				}
+			} else if err == nil || err.Error() != tc.ExpectedError {
+				t.Errorf("expected error %q, got %v", tc.ExpectedError, err)
+			}
+		})
+	}
+}
@@ -19,14 +19,20 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"reflect"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/filters"
 	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/versions"
 
 	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
 	"github.com/argoproj/gitops-engine/pkg/health"
 	"github.com/argoproj/gitops-engine/pkg/sync/common"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type Key struct {
@@ -38,23 +44,200 @@ type appState struct {
 	argocdVersion    *versions.VersionInfo
 	kuberpultVersion *versions.VersionInfo
 	rolloutStatus    api.RolloutStatus
+	diagnostics      Diagnostics
 	environmentGroup string
+	team             string
+	// sequence is the sequence of the last event of this app
+	sequence uint64
+	// lastStatusChange is when the published version or rollout status changed
+	lastStatusChange time.Time
+	publishedVersion uint64
+	publishedStatus  api.RolloutStatus
+	// destinations contains the state per destination, argocdVersion and rolloutStatus are the aggregate of all destinations.
+	// Environments with a single destination only have the destination "".
+	destinations map[string]*destinationState
+	// configuredDestinations are the ids of the destinations that kuberpult renders, empty for environments with a single destination
+	configuredDestinations []string
+}
+
+type destinationState struct {
+	argocdVersion *versions.VersionInfo
+	rolloutStatus api.RolloutStatus
+	diagnostics   Diagnostics
+}
+
+// Diagnostics explain the rollout status of an application
+type Diagnostics struct {
+	OperationPhase   common.OperationPhase
+	OperationMessage string
+	SyncRevision     string
+	// UnhealthyResources are the degraded or missing resources
+	UnhealthyResources []ResourceHealth
+}
+
+type ResourceHealth struct {
+	// Destination is empty unless the environment has multiple destinations
+	Destination string
+	Group       string
+	Kind        string
+	Namespace   string
+	Name        string
+	Health      health.HealthStatusCode
+	Message     string
+}
+
+func diagnostics(ev *ArgoEvent) Diagnostics {
+	result := Diagnostics{
+		SyncRevision: ev.SyncRevision,
+	}
+	if ev.OperationState != nil {
+		result.OperationPhase = ev.OperationState.Phase
+		result.OperationMessage = ev.OperationState.Message
+	}
+	for _, r := range ev.Resources {
+		if r.Health == nil {
+			continue
+		}
+		switch r.Health.Status {
+		case health.HealthStatusDegraded, health.HealthStatusMissing:
+			result.UnhealthyResources = append(result.UnhealthyResources, ResourceHealth{
+				Destination: ev.Destination,
+				Group:       r.Group,
+				Kind:        r.Kind,
+				Namespace:   r.Namespace,
+				Name:        r.Name,
+				Health:      r.Health.Status,
+				Message:     r.Health.Message,
+			})
+		}
+	}
+	return result
+}
+
+// Reason returns a short explanation why a rollout failed
+func (d *Diagnostics) Reason() string {
+	switch d.OperationPhase {
+	case common.OperationError, common.OperationFailed:
+		if d.OperationMessage != "" {
+			return d.OperationMessage
+		}
+	}
+	if len(d.UnhealthyResources) == 0 {
+		return ""
+	}
+	r := d.UnhealthyResources[0]
+	if r.Message == "" {
+		return fmt.Sprintf("%s %s is %s", r.Kind, r.Name, r.Health)
+	}
+	return fmt.Sprintf("%s %s is %s: %s", r.Kind, r.Name, r.Health, r.Message)
 }
 
 func (a *appState) applyArgoEvent(ev *ArgoEvent) *BroadcastEvent {
-	status := rolloutStatus(ev)
-	if a.rolloutStatus != status || a.argocdVersion == nil || a.argocdVersion.Version != ev.Version.Version {
+	if a.destinations == nil {
+		a.destinations = map[string]*destinationState{}
+	}
+	if ev.Version != nil && ev.Version.Version == 0 && len(a.destinations) > 1 {
+		// the app was removed from this destination, but is still deployed to the others
+		delete(a.destinations, ev.Destination)
+	} else {
+		a.destinations[ev.Destination] = &destinationState{
+			argocdVersion: ev.Version,
+			rolloutStatus: rolloutStatus(ev),
+			diagnostics:   diagnostics(ev),
+		}
+	}
+	status, version := a.aggregateDestinations()
+	diag := a.aggregateDiagnostics(status)
+	// A new sync revision alone doesn't change the rollout, it's published with the next change.
+	if a.rolloutStatus != status || a.argocdVersion == nil || a.argocdVersion.Version != version.Version || a.diagnostics.Reason() != diag.Reason() {
 		a.rolloutStatus = status
-		a.argocdVersion = ev.Version
+		a.argocdVersion = version
+		a.diagnostics = diag
 		return a.getEvent(ev.Application, ev.Environment)
 	}
 	return nil
 }
 
+// aggregateDestinations returns the worst status and the lowest version of all destinations.
+// Destinations that run different versions are still progressing. Configured destinations that haven't reported yet are unknown.
+func (a *appState) aggregateDestinations() (api.RolloutStatus, *versions.VersionInfo) {
+	var status api.RolloutStatus
+	var version *versions.VersionInfo
+	first := true
+	for _, d := range a.destinations {
+		if first {
+			status, version = d.rolloutStatus, d.argocdVersion
+			first = false
+			continue
+		}
+		status = worseRolloutStatus(status, d.rolloutStatus)
+		if version == nil || d.argocdVersion == nil {
+			if version != d.argocdVersion {
+				status = worseRolloutStatus(status, api.RolloutStatus_RolloutStatusProgressing)
+			}
+			version = nil
+		} else if version.Version != d.argocdVersion.Version {
+			status = worseRolloutStatus(status, api.RolloutStatus_RolloutStatusProgressing)
+			if d.argocdVersion.Version < version.Version {
+				version = d.argocdVersion
+			}
+		}
+	}
+	for _, id := range a.configuredDestinations {
+		if _, ok := a.destinations[id]; !ok {
+			status = worseRolloutStatus(status, api.RolloutStatus_RolloutStatusUnknown)
+		}
+	}
+	return status, version
+}
+
+// aggregateDiagnostics returns the operation and revision of the first destination with the given status and the unhealthy resources of all destinations.
+func (a *appState) aggregateDiagnostics(status api.RolloutStatus) Diagnostics {
+	ids := make([]string, 0, len(a.destinations))
+	for id := range a.destinations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var result Diagnostics
+	found := false
+	for _, id := range ids {
+		d := a.destinations[id]
+		if !found && d.rolloutStatus == status {
+			result.OperationPhase = d.diagnostics.OperationPhase
+			result.OperationMessage = d.diagnostics.OperationMessage
+			result.SyncRevision = d.diagnostics.SyncRevision
+			found = true
+		}
+		result.UnhealthyResources = append(result.UnhealthyResources, d.diagnostics.UnhealthyResources...)
+	}
+	return result
+}
+
+var rolloutStatusSeverity = map[api.RolloutStatus]int{
+	api.RolloutStatus_RolloutStatusSuccesful:   0,
+	api.RolloutStatus_RolloutStatusUnknown:     1,
+	api.RolloutStatus_RolloutStatusProgressing: 2,
+	api.RolloutStatus_RolloutStatusError:       3,
+}
+
+func worseRolloutStatus(a, b api.RolloutStatus) api.RolloutStatus {
+	if rolloutStatusSeverity[b] > rolloutStatusSeverity[a] {
+		return b
+	}
+	return a
+}
+
 func (a *appState) applyKuberpultEvent(ev *versions.KuberpultEvent) *BroadcastEvent {
-	if a.kuberpultVersion == nil || a.kuberpultVersion.Version != ev.Version.Version {
+	destinationsChanged := !reflect.DeepEqual(a.configuredDestinations, ev.Destinations)
+	if a.kuberpultVersion == nil || a.kuberpultVersion.Version != ev.Version.Version || a.team != ev.Team || destinationsChanged {
 		a.kuberpultVersion = ev.Version
 		a.environmentGroup = ev.EnvironmentGroup
+		a.team = ev.Team
+		a.configuredDestinations = ev.Destinations
+		if destinationsChanged && len(a.destinations) > 0 {
+			a.rolloutStatus, a.argocdVersion = a.aggregateDestinations()
+			a.diagnostics = a.aggregateDiagnostics(a.rolloutStatus)
+		}
 		return a.getEvent(ev.Application, ev.Environment)
 	}
 	return nil
@@ -71,22 +254,49 @@ func (a *appState) getEvent(application, environment string) *BroadcastEvent {
 			Application: application,
 		},
 		EnvironmentGroup: a.environmentGroup,
+		Team:             a.team,
 		ArgocdVersion:    a.argocdVersion,
 		RolloutStatus:    rs,
+		Diagnostics:      a.diagnostics,
 		KuberpultVersion: a.kuberpultVersion,
+		Destinations:     a.destinationIds(),
+		Sequence:         a.sequence,
+		LastStatusChange: a.lastStatusChange,
 	}
 }
 
+// destinationIds returns the sorted ids of all destinations, or nil for environments with a single destination
+func (a *appState) destinationIds() []string {
+	var result []string
+	for id := range a.destinations {
+		if id != "" {
+			result = append(result, id)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
 type Broadcast struct {
 	state    map[Key]*appState
 	mx       sync.Mutex
 	listener map[chan *BroadcastEvent]struct{}
+	// sequence is the sequence of the last event
+	sequence uint64
+	// History is optional and serves GetRolloutHistory
+	History *History
+	// Dora is optional and serves GetDoraMetrics
+	Dora DoraMetrics
+	now  func() time.Time
 }
 
 func New() *Broadcast {
 	return &Broadcast{
 		state:    map[Key]*appState{},
 		listener: map[chan *BroadcastEvent]struct{}{},
+		now:      time.Now,
+		// Starting at the current time keeps the sequence increasing across restarts, so clients that resume after a restart get all changes.
+		sequence: uint64(time.Now().UnixNano()),
 	}
 }
 
@@ -101,22 +311,7 @@ func (b *Broadcast) ProcessArgoEvent(ctx context.Context, ev ArgoEvent) {
 	if b.state[k] == nil {
 		b.state[k] = &appState{}
 	}
-	msg := b.state[k].applyArgoEvent(&ev)
-	if msg == nil {
-		return
-	}
-	desub := []chan *BroadcastEvent{}
-	for l := range b.listener {
-		select {
-		case l <- msg:
-		default:
-			close(l)
-			desub = append(desub, l)
-		}
-	}
-	for _, l := range desub {
-		delete(b.listener, l)
-	}
+	b.publish(b.state[k], b.state[k].applyArgoEvent(&ev))
 }
 
 func (b *Broadcast) ProcessKuberpultEvent(ctx context.Context, ev versions.KuberpultEvent) {
@@ -129,10 +324,27 @@ func (b *Broadcast) ProcessKuberpultEvent(ctx context.Context, ev versions.Kuber
 	if b.state[k] == nil {
 		b.state[k] = &appState{}
 	}
-	msg := b.state[k].applyKuberpultEvent(&ev)
+	b.publish(b.state[k], b.state[k].applyKuberpultEvent(&ev))
+}
+
+// publish assigns the next sequence to the event and sends it to all listeners. It must be called with the lock held.
+func (b *Broadcast) publish(app *appState, msg *BroadcastEvent) {
 	if msg == nil {
 		return
 	}
+	b.sequence += 1
+	app.sequence = b.sequence
+	msg.Sequence = b.sequence
+	var version uint64
+	if msg.ArgocdVersion != nil {
+		version = msg.ArgocdVersion.Version
+	}
+	if app.lastStatusChange.IsZero() || app.publishedVersion != version || app.publishedStatus != msg.RolloutStatus {
+		app.lastStatusChange = b.now()
+		app.publishedVersion = version
+		app.publishedStatus = msg.RolloutStatus
+	}
+	msg.LastStatusChange = app.lastStatusChange
 	desub := []chan *BroadcastEvent{}
 	for l := range b.listener {
 		select {
@@ -158,10 +370,24 @@ func (b *Broadcast) DisconnectAll() {
 }
 
 func (b *Broadcast) StreamStatus(req *api.StreamStatusRequest, svc api.RolloutService_StreamStatusServer) error {
-	resp, ch, unsubscribe := b.Start()
+	filter := newStreamFilter(req)
+	sequence, resp, ch, unsubscribe := b.start()
 	defer unsubscribe()
+	// A client that resumes from a sequence in the future can't have seen this broadcast, so it gets everything.
+	resume := req.ResumeFromSequence
+	if resume > sequence {
+		resume = 0
+	}
 	for _, r := range resp {
-		svc.Send(streamStatus(r))
+		if r.Sequence <= resume || !filter.matches(r) {
+			continue
+		}
+		if err := svc.Send(streamStatus(r)); err != nil {
+			return err
+		}
+	}
+	if err := svc.Send(&api.StreamStatusResponse{Sequence: sequence, SnapshotComplete: true}); err != nil {
+		return err
 	}
 	for {
 		select {
@@ -170,6 +396,9 @@ func (b *Broadcast) StreamStatus(req *api.StreamStatusRequest, svc api.RolloutSe
 				// closed
 				return nil
 			}
+			if !filter.matches(r) {
+				continue
+			}
 			err := svc.Send(streamStatus(r))
 			if err != nil {
 				return err
@@ -187,6 +416,12 @@ func (b *Broadcast) StreamStatus(req *api.StreamStatusRequest, svc api.RolloutSe
 type unsubscribe func()
 
 func (b *Broadcast) Start() ([]*BroadcastEvent, <-chan *BroadcastEvent, unsubscribe) {
+	_, result, ch, unsub := b.start()
+	return result, ch, unsub
+}
+
+// start additionally returns the sequence of the last event that is contained in the state.
+func (b *Broadcast) start() (uint64, []*BroadcastEvent, <-chan *BroadcastEvent, unsubscribe) {
 	b.mx.Lock()
 	defer b.mx.Unlock()
 	result := make([]*BroadcastEvent, 0, len(b.state))
@@ -195,7 +430,7 @@ func (b *Broadcast) Start() ([]*BroadcastEvent, <-chan *BroadcastEvent, unsubscr
 	}
 	ch := make(chan *BroadcastEvent, 100)
 	b.listener[ch] = struct{}{}
-	return result, ch, func() {
+	return b.sequence, result, ch, func() {
 		b.mx.Lock()
 		defer b.mx.Unlock()
 		delete(b.listener, ch)
@@ -205,20 +440,77 @@ func (b *Broadcast) Start() ([]*BroadcastEvent, <-chan *BroadcastEvent, unsubscr
 type BroadcastEvent struct {
 	Key
 	EnvironmentGroup string
+	Team             string
 	ArgocdVersion    *versions.VersionInfo
 	KuberpultVersion *versions.VersionInfo
 	RolloutStatus    api.RolloutStatus
+	Diagnostics      Diagnostics
+	// Destinations are the ids of the destinations, if the environment has more than one
+	Destinations []string
+	Sequence     uint64
+	// LastStatusChange is when the version or the rollout status changed last
+	LastStatusChange time.Time
 }
 
 func streamStatus(b *BroadcastEvent) *api.StreamStatusResponse {
+	var version uint64
+	// the argocd version is unknown until argocd reported the app
+	if b.ArgocdVersion != nil {
+		version = b.ArgocdVersion.Version
+	}
+	var lastStatusChange *timestamppb.Timestamp
+	if !b.LastStatusChange.IsZero() {
+		lastStatusChange = timestamppb.New(b.LastStatusChange)
+	}
+	var resources []*api.ResourceHealth
+	for _, r := range b.Diagnostics.UnhealthyResources {
+		resources = append(resources, &api.ResourceHealth{
+			Destination:  r.Destination,
+			Group:        r.Group,
+			Kind:         r.Kind,
+			Namespace:    r.Namespace,
+			Name:         r.Name,
+			HealthStatus: string(r.Health),
+			Message:      r.Message,
+		})
+	}
 	return &api.StreamStatusResponse{
-		Environment:   b.Environment,
-		Application:   b.Application,
-		Version:       b.ArgocdVersion.Version,
-		RolloutStatus: b.RolloutStatus,
+		Environment:        b.Environment,
+		Application:        b.Application,
+		Version:            version,
+		RolloutStatus:      b.RolloutStatus,
+		Sequence:           b.Sequence,
+		OperationPhase:     string(b.Diagnostics.OperationPhase),
+		OperationMessage:   b.Diagnostics.OperationMessage,
+		SyncRevision:       b.Diagnostics.SyncRevision,
+		UnhealthyResources: resources,
+		LastStatusChange:   lastStatusChange,
+	}
+}
+
+type streamFilter struct {
+	environments      []string
+	environmentGroups []string
+	applications      []string
+	teams             []string
+}
+
+func newStreamFilter(req *api.StreamStatusRequest) streamFilter {
+	return streamFilter{
+		environments:      req.Environments,
+		environmentGroups: req.EnvironmentGroups,
+		applications:      req.Applications,
+		teams:             req.Teams,
 	}
 }
 
+func (f streamFilter) matches(ev *BroadcastEvent) bool {
+	return filters.Match(f.environments, ev.Environment) &&
+		filters.Match(f.environmentGroups, ev.EnvironmentGroup) &&
+		filters.Match(f.applications, ev.Application) &&
+		filters.Match(f.teams, ev.Team)
+}
+
 func rolloutStatus(ev *ArgoEvent) api.RolloutStatus {
 	switch ev.HealthStatusCode {
 	case health.HealthStatusDegraded, health.HealthStatusMissing:
@@ -19,6 +19,7 @@ package service
 import (
 	"context"
 	"fmt"
+	"sort"
 	"testing"
 	"time"
 
@@ -27,7 +28,9 @@ import (
 	"github.com/argoproj/gitops-engine/pkg/sync/common"
 	"github.com/freiheit-com/kuberpult/pkg/api"
 	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/versions"
+	"github.com/google/go-cmp/cmp"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/testing/protocmp"
 )
 
 type testSrv struct {
@@ -62,6 +65,7 @@ func (t *errSrv) Context() context.Context {
 func TestBroadcast(t *testing.T) {
 	t.Parallel()
 	var (
+		RolloutStatusUnknown     = api.RolloutStatus_RolloutStatusUnknown
 		RolloutStatusSuccesful   = api.RolloutStatus_RolloutStatusSuccesful
 		RolloutStatusProgressing = api.RolloutStatus_RolloutStatusProgressing
 		RolloutStatusError       = api.RolloutStatus_RolloutStatusError
@@ -264,6 +268,151 @@ func TestBroadcast(t *testing.T) {
 						HealthStatusCode: health.HealthStatusHealthy,
 					},
 
+					ExpectStatus: &RolloutStatusSuccesful,
+				},
+			},
+		},
+		{
+			Name: "multiple destinations are aggregated",
+			Steps: []step{
+				{
+					ArgoEvent: &ArgoEvent{
+						Application:      "foo",
+						Environment:      "bar",
+						Destination:      "eu",
+						Version:          &versions.VersionInfo{Version: 1},
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusHealthy,
+					},
+
+					ExpectStatus: &RolloutStatusSuccesful,
+				},
+				{
+					ArgoEvent: &ArgoEvent{
+						Application:      "foo",
+						Environment:      "bar",
+						Destination:      "us",
+						Version:          &versions.VersionInfo{Version: 1},
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusHealthy,
+					},
+
+					ExpectStatus: nil,
+				},
+				{
+					ArgoEvent: &ArgoEvent{
+						Application:      "foo",
+						Environment:      "bar",
+						Destination:      "eu",
+						Version:          &versions.VersionInfo{Version: 2},
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusHealthy,
+					},
+
+					ExpectStatus: &RolloutStatusProgressing,
+				},
+				{
+					ArgoEvent: &ArgoEvent{
+						Application:      "foo",
+						Environment:      "bar",
+						Destination:      "us",
+						Version:          &versions.VersionInfo{Version: 2},
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusDegraded,
+					},
+
+					ExpectStatus: &RolloutStatusError,
+				},
+				{
+					ArgoEvent: &ArgoEvent{
+						Application:      "foo",
+						Environment:      "bar",
+						Destination:      "us",
+						Version:          &versions.VersionInfo{Version: 2},
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusHealthy,
+					},
+
+					ExpectStatus: &RolloutStatusSuccesful,
+				},
+			},
+		},
+		{
+			Name: "configured destinations that haven't reported are unknown",
+			Steps: []step{
+				{
+					VersionEvent: &versions.KuberpultEvent{
+						Application:  "foo",
+						Environment:  "bar",
+						Version:      &versions.VersionInfo{Version: 1},
+						Destinations: []string{"eu", "us"},
+					},
+
+					ExpectStatus: &RolloutStatusUnknown,
+				},
+				{
+					ArgoEvent: &ArgoEvent{
+						Application:      "foo",
+						Environment:      "bar",
+						Destination:      "eu",
+						Version:          &versions.VersionInfo{Version: 1},
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusHealthy,
+					},
+
+					ExpectStatus: &RolloutStatusUnknown,
+				},
+				{
+					ArgoEvent: &ArgoEvent{
+						Application:      "foo",
+						Environment:      "bar",
+						Destination:      "us",
+						Version:          &versions.VersionInfo{Version: 1},
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusHealthy,
+					},
+
+					ExpectStatus: &RolloutStatusSuccesful,
+				},
+			},
+		},
+		{
+			Name: "removed destinations are ignored",
+			Steps: []step{
+				{
+					ArgoEvent: &ArgoEvent{
+						Application:      "foo",
+						Environment:      "bar",
+						Destination:      "eu",
+						Version:          &versions.VersionInfo{Version: 1},
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusHealthy,
+					},
+
+					ExpectStatus: &RolloutStatusSuccesful,
+				},
+				{
+					ArgoEvent: &ArgoEvent{
+						Application:      "foo",
+						Environment:      "bar",
+						Destination:      "us",
+						Version:          &versions.VersionInfo{Version: 1},
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusDegraded,
+					},
+
+					ExpectStatus: &RolloutStatusError,
+				},
+				{
+					ArgoEvent: &ArgoEvent{
+						Application:      "foo",
+						Environment:      "bar",
+						Destination:      "us",
+						Version:          &versions.VersionInfo{Version: 0},
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusMissing,
+					},
+
 					ExpectStatus: &RolloutStatusSuccesful,
 				},
 			},
@@ -278,6 +427,9 @@ func TestBroadcast(t *testing.T) {
 			ch := make(chan *api.StreamStatusResponse)
 			srv := testSrv{ctx: ctx, ch: ch}
 			go bc.StreamStatus(&api.StreamStatusRequest{}, &srv)
+			if marker := <-ch; !marker.SnapshotComplete {
+				t.Errorf("expected the end of the snapshot, got %#v", marker)
+			}
 			for i, s := range tc.Steps {
 				if s.ArgoEvent != nil {
 					bc.ProcessArgoEvent(context.Background(), *s.ArgoEvent)
@@ -368,6 +520,9 @@ func TestBroadcastDoesntGetStuck(t *testing.T) {
 				ech2 <- bc.StreamStatus(&api.StreamStatusRequest{}, &srv2)
 			}()
 			defer cancel2()
+			if marker := <-ch2; !marker.SnapshotComplete {
+				t.Errorf("expected the end of the snapshot, got %#v", marker)
+			}
 			// srv3 will just return an error
 			ctx3, cancel3 := context.WithCancel(context.Background())
 			ech3 := make(chan error, 1)
@@ -421,3 +576,357 @@ func TestBroadcastDoesntGetStuck(t *testing.T) {
 
 	}
 }
+
+func TestStreamStatusFilter(t *testing.T) {
+	t.Parallel()
+	apps := []versions.KuberpultEvent{
+		{Environment: "staging", Application: "foo", EnvironmentGroup: "staging-group", Team: "team-a"},
+		{Environment: "production", Application: "foo", EnvironmentGroup: "production-group", Team: "team-a"},
+		{Environment: "production", Application: "bar", EnvironmentGroup: "production-group", Team: "team-b"},
+	}
+	tcs := []struct {
+		Name    string
+		Request *api.StreamStatusRequest
+
+		ExpectedApps []string
+	}{
+		{
+			Name:         "no filter",
+			Request:      &api.StreamStatusRequest{},
+			ExpectedApps: []string{"production/bar", "production/foo", "staging/foo"},
+		},
+		{
+			Name:         "environments",
+			Request:      &api.StreamStatusRequest{Environments: []string{"production"}},
+			ExpectedApps: []string{"production/bar", "production/foo"},
+		},
+		{
+			Name:         "environment groups",
+			Request:      &api.StreamStatusRequest{EnvironmentGroups: []string{"staging-group"}},
+			ExpectedApps: []string{"staging/foo"},
+		},
+		{
+			Name:         "applications and environments",
+			Request:      &api.StreamStatusRequest{Environments: []string{"production", "staging"}, Applications: []string{"foo"}},
+			ExpectedApps: []string{"production/foo", "staging/foo"},
+		},
+		{
+			Name:         "teams",
+			Request:      &api.StreamStatusRequest{Teams: []string{"team-b"}},
+			ExpectedApps: []string{"production/bar"},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			bc := New()
+			for _, app := range apps {
+				app.Version = &versions.VersionInfo{Version: 1}
+				bc.ProcessKuberpultEvent(context.Background(), app)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := make(chan *api.StreamStatusResponse, 10)
+			go bc.StreamStatus(tc.Request, &testSrv{ctx: ctx, ch: ch})
+			snapshot := []string{}
+			for resp := <-ch; !resp.SnapshotComplete; resp = <-ch {
+				snapshot = append(snapshot, resp.Environment+"/"+resp.Application)
+			}
+			sort.Strings(snapshot)
+			if d := cmp.Diff(tc.ExpectedApps, snapshot); d != "" {
+				t.Errorf("unexpected snapshot: %s", d)
+			}
+			// the same filter applies to changes
+			for _, app := range apps {
+				app.Version = &versions.VersionInfo{Version: 2}
+				bc.ProcessKuberpultEvent(context.Background(), app)
+			}
+			changes := []string{}
+			for range tc.ExpectedApps {
+				resp := <-ch
+				changes = append(changes, resp.Environment+"/"+resp.Application)
+			}
+			sort.Strings(changes)
+			if d := cmp.Diff(tc.ExpectedApps, changes); d != "" {
+				t.Errorf("unexpected changes: %s", d)
+			}
+			select {
+			case resp := <-ch:
+				t.Errorf("didn't expect another change but got %#v", resp)
+			case <-time.After(10 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestStreamStatusResume(t *testing.T) {
+	t.Parallel()
+	bc := New()
+	snapshot := func(req *api.StreamStatusRequest) ([]string, uint64) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch := make(chan *api.StreamStatusResponse, 10)
+		go bc.StreamStatus(req, &testSrv{ctx: ctx, ch: ch})
+		result := []string{}
+		for resp := range ch {
+			if resp.SnapshotComplete {
+				sort.Strings(result)
+				return result, resp.Sequence
+			}
+			result = append(result, resp.Application)
+		}
+		return nil, 0
+	}
+	deploy := func(application string) {
+		bc.ProcessArgoEvent(context.Background(), ArgoEvent{
+			Application:      application,
+			Environment:      "production",
+			Version:          &versions.VersionInfo{Version: 1},
+			SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+			HealthStatusCode: health.HealthStatusHealthy,
+		})
+	}
+
+	deploy("foo")
+	apps, first := snapshot(&api.StreamStatusRequest{})
+	if d := cmp.Diff([]string{"foo"}, apps); d != "" {
+		t.Errorf("unexpected initial snapshot: %s", d)
+	}
+	deploy("bar")
+	apps, second := snapshot(&api.StreamStatusRequest{ResumeFromSequence: first})
+	if d := cmp.Diff([]string{"bar"}, apps); d != "" {
+		t.Errorf("unexpected snapshot after resuming: %s", d)
+	}
+	if second <= first {
+		t.Errorf("expected the sequence to increase, got %d after %d", second, first)
+	}
+	apps, _ = snapshot(&api.StreamStatusRequest{ResumeFromSequence: second})
+	if d := cmp.Diff([]string{}, apps); d != "" {
+		t.Errorf("unexpected snapshot without changes: %s", d)
+	}
+	// a sequence from the future can't belong to this broadcast
+	apps, _ = snapshot(&api.StreamStatusRequest{ResumeFromSequence: second + 1000})
+	if d := cmp.Diff([]string{"bar", "foo"}, apps); d != "" {
+		t.Errorf("unexpected snapshot for an unknown sequence: %s", d)
+	}
+}
+
+func TestBroadcastIgnoresSyncRevisions(t *testing.T) {
+	t.Parallel()
+	event := func(revision string, health health.HealthStatusCode) *ArgoEvent {
+		return &ArgoEvent{
+			Application:      "foo",
+			Environment:      "production",
+			Version:          &versions.VersionInfo{Version: 1},
+			SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+			HealthStatusCode: health,
+			SyncRevision:     revision,
+		}
+	}
+	app := &appState{}
+	if ev := app.applyArgoEvent(event("1234", health.HealthStatusHealthy)); ev == nil {
+		t.Fatalf("expected an event for the first status")
+	}
+	if ev := app.applyArgoEvent(event("5678", health.HealthStatusHealthy)); ev != nil {
+		t.Errorf("expected no event for a new sync revision, got %#v", ev)
+	}
+	ev := app.applyArgoEvent(event("5678", health.HealthStatusDegraded))
+	if ev == nil {
+		t.Fatalf("expected an event for the new status")
+	}
+	if ev.Diagnostics.SyncRevision != "5678" {
+		t.Errorf("expected the new sync revision with the status change, got %q", ev.Diagnostics.SyncRevision)
+	}
+}
+
+func TestBroadcastLastStatusChange(t *testing.T) {
+	t.Parallel()
+	t0 := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	now := t0
+	bc := New()
+	bc.now = func() time.Time { return now }
+	process := func(version uint64, health health.HealthStatusCode, revision string) *BroadcastEvent {
+		bc.ProcessArgoEvent(context.Background(), ArgoEvent{
+			Application:      "foo",
+			Environment:      "production",
+			Version:          &versions.VersionInfo{Version: version},
+			SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+			HealthStatusCode: health,
+			SyncRevision:     revision,
+		})
+		events, _, unsubscribe := bc.Start()
+		unsubscribe()
+		if len(events) != 1 {
+			t.Fatalf("expected one event, got %d", len(events))
+		}
+		return events[0]
+	}
+	steps := []struct {
+		Name     string
+		Version  uint64
+		Health   health.HealthStatusCode
+		Revision string
+		Expected time.Time
+	}{
+		{Name: "first status", Version: 1, Health: health.HealthStatusProgressing, Revision: "a", Expected: t0},
+		{Name: "status changes", Version: 1, Health: health.HealthStatusHealthy, Revision: "a", Expected: t0.Add(time.Minute)},
+		{Name: "only the revision changes", Version: 1, Health: health.HealthStatusHealthy, Revision: "b", Expected: t0.Add(time.Minute)},
+		{Name: "version changes", Version: 2, Health: health.HealthStatusHealthy, Revision: "b", Expected: t0.Add(3 * time.Minute)},
+	}
+	for i, s := range steps {
+		now = t0.Add(time.Duration(i) * time.Minute)
+		ev := process(s.Version, s.Health, s.Revision)
+		if !ev.LastStatusChange.Equal(s.Expected) {
+			t.Errorf("%s: expected last status change %s, got %s", s.Name, s.Expected, ev.LastStatusChange)
+		}
+		if resp := streamStatus(ev); !resp.LastStatusChange.AsTime().Equal(s.Expected) {
+			t.Errorf("%s: expected streamed last status change %s, got %s", s.Name, s.Expected, resp.LastStatusChange.AsTime())
+		}
+	}
+}
+
+func TestBroadcastDiagnostics(t *testing.T) {
+	t.Parallel()
+	degraded := func(destination, name string) ArgoEvent {
+		return ArgoEvent{
+			Application:      "foo",
+			Environment:      "production",
+			Destination:      destination,
+			Version:          &versions.VersionInfo{Version: 2},
+			SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+			HealthStatusCode: health.HealthStatusDegraded,
+			SyncRevision:     "abcd",
+			OperationState: &v1alpha1.OperationState{
+				Phase:   common.OperationSucceeded,
+				Message: "successfully synced (all tasks run)",
+			},
+			Resources: []v1alpha1.ResourceStatus{
+				{
+					Kind:   "ConfigMap",
+					Name:   "healthy",
+					Health: &v1alpha1.HealthStatus{Status: health.HealthStatusHealthy},
+				},
+				{
+					Group:     "apps",
+					Kind:      "Deployment",
+					Namespace: "foo",
+					Name:      name,
+					Health:    &v1alpha1.HealthStatus{Status: health.HealthStatusDegraded, Message: "exceeded its progress deadline"},
+				},
+				{
+					Kind: "Secret",
+					Name: "unknown",
+				},
+			},
+		}
+	}
+	failed := ArgoEvent{
+		Application:      "foo",
+		Environment:      "production",
+		Destination:      "us",
+		Version:          &versions.VersionInfo{Version: 2},
+		SyncStatusCode:   v1alpha1.SyncStatusCodeOutOfSync,
+		HealthStatusCode: health.HealthStatusHealthy,
+		SyncRevision:     "abcd",
+		OperationState: &v1alpha1.OperationState{
+			Phase:   common.OperationFailed,
+			Message: "one or more objects failed to apply",
+		},
+	}
+	tcs := []struct {
+		Name   string
+		Events []ArgoEvent
+
+		ExpectedResponse *api.StreamStatusResponse
+		ExpectedReason   string
+	}{
+		{
+			Name:   "unhealthy resources",
+			Events: []ArgoEvent{degraded("", "foo")},
+			ExpectedResponse: &api.StreamStatusResponse{
+				Environment:      "production",
+				Application:      "foo",
+				Version:          2,
+				RolloutStatus:    api.RolloutStatus_RolloutStatusError,
+				OperationPhase:   "Succeeded",
+				OperationMessage: "successfully synced (all tasks run)",
+				SyncRevision:     "abcd",
+				UnhealthyResources: []*api.ResourceHealth{
+					{
+						Group:        "apps",
+						Kind:         "Deployment",
+						Namespace:    "foo",
+						Name:         "foo",
+						HealthStatus: "Degraded",
+						Message:      "exceeded its progress deadline",
+					},
+				},
+			},
+			ExpectedReason: "Deployment foo is Degraded: exceeded its progress deadline",
+		},
+		{
+			Name:   "the first failing destination explains the status",
+			Events: []ArgoEvent{degraded("eu", "foo-eu"), failed},
+			ExpectedResponse: &api.StreamStatusResponse{
+				Environment:      "production",
+				Application:      "foo",
+				Version:          2,
+				RolloutStatus:    api.RolloutStatus_RolloutStatusError,
+				OperationPhase:   "Succeeded",
+				OperationMessage: "successfully synced (all tasks run)",
+				SyncRevision:     "abcd",
+				UnhealthyResources: []*api.ResourceHealth{
+					{
+						Destination:  "eu",
+						Group:        "apps",
+						Kind:         "Deployment",
+						Namespace:    "foo",
+						Name:         "foo-eu",
+						HealthStatus: "Degraded",
+						Message:      "exceeded its progress deadline",
+					},
+				},
+			},
+			ExpectedReason: "Deployment foo-eu is Degraded: exceeded its progress deadline",
+		},
+		{
+			Name:   "failed operation",
+			Events: []ArgoEvent{failed},
+			ExpectedResponse: &api.StreamStatusResponse{
+				Environment:      "production",
+				Application:      "foo",
+				Version:          2,
+				RolloutStatus:    api.RolloutStatus_RolloutStatusError,
+				OperationPhase:   "Failed",
+				OperationMessage: "one or more objects failed to apply",
+				SyncRevision:     "abcd",
+			},
+			ExpectedReason: "one or more objects failed to apply",
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			bc := New()
+			for _, ev := range tc.Events {
+				bc.ProcessArgoEvent(context.Background(), ev)
+			}
+			events, _, unsubscribe := bc.Start()
+			unsubscribe()
+			if len(events) != 1 {
+				t.Fatalf("expected one event, got %d", len(events))
+			}
+			resp := streamStatus(events[0])
+			resp.Sequence = 0
+			resp.LastStatusChange = nil
+			if d := cmp.Diff(tc.ExpectedResponse, resp, protocmp.Transform()); d != "" {
+				t.Errorf("unexpected response: %s", d)
+			}
+			if reason := events[0].Diagnostics.Reason(); reason != tc.ExpectedReason {
+				t.Errorf("expected reason %q, got %q", tc.ExpectedReason, reason)
+			}
+		})
+	}
+}
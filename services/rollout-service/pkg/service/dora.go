@@ -0,0 +1,38 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package service
+
+import (
+	"context"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DoraMetrics computes the DORA metrics from the events of the broadcast.
+type DoraMetrics interface {
+	GetDoraMetrics(ctx context.Context, req *api.GetDoraMetricsRequest) (*api.GetDoraMetricsResponse, error)
+}
+
+// GetDoraMetrics implements api.RolloutServiceServer
+func (b *Broadcast) GetDoraMetrics(ctx context.Context, req *api.GetDoraMetricsRequest) (*api.GetDoraMetricsResponse, error) {
+	if b.Dora == nil {
+		return nil, status.Error(codes.Unimplemented, "the dora metrics are not enabled")
+	}
+	return b.Dora.GetDoraMetrics(ctx, req)
+}
@@ -0,0 +1,189 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/gitops-engine/pkg/health"
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/versions"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+var KustomizationResource = schema.GroupVersionResource{
+	Group:    "kustomize.toolkit.fluxcd.io",
+	Version:  "v1",
+	Resource: "kustomizations",
+}
+
+// this is a simpler version of the dynamic.ResourceInterface of the kubernetes client
+type SimplifiedKustomizationClient interface {
+	Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+}
+
+// type assertion
+var (
+	_ SimplifiedKustomizationClient = (dynamic.ResourceInterface)(nil)
+)
+
+// ConsumeFluxEvents watches the Flux Kustomizations rendered by the cd-service and translates their status into the same events that Argo CD produces.
+func ConsumeFluxEvents(ctx context.Context, client SimplifiedKustomizationClient, version versions.VersionClient, sink ArgoEventProcessor, ready func()) error {
+	for {
+		w, err := client.Watch(ctx, metav1.ListOptions{})
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				// context is cancelled -> we are shutting down
+				return nil
+			}
+			return fmt.Errorf("watching kustomizations: %w", err)
+		}
+		ready()
+		err = consumeFluxWatch(ctx, w, version, sink)
+		w.Stop()
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+			// the api server closes watches regularly, so we just start a new one
+		}
+	}
+}
+
+func consumeFluxWatch(ctx context.Context, w watch.Interface, version versions.VersionClient, sink ArgoEventProcessor) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return nil
+			}
+			switch ev.Type {
+			case watch.Added, watch.Modified, watch.Deleted:
+			case watch.Bookmark:
+				continue
+			case watch.Error:
+				logger.FromContext(ctx).Warn("flux.kustomization.error", zap.Any("object", ev.Object))
+				continue
+			default:
+				logger.FromContext(ctx).Warn("flux.kustomization.unknown_type", zap.String("event.type", string(ev.Type)))
+				continue
+			}
+			obj, ok := ev.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			environment, application := getEnvironmentAndName(obj.GetAnnotations())
+			if application == "" {
+				continue
+			}
+			status := kustomizationStatus(obj)
+			argoEvent := ArgoEvent{
+				Application:      application,
+				Environment:      environment,
+				SyncStatusCode:   status.sync,
+				HealthStatusCode: status.health,
+				Version:          &versions.VersionInfo{Version: 0},
+			}
+			if ev.Type != watch.Deleted && status.revision != "" {
+				v, err := version.GetVersion(ctx, status.revision, environment, application)
+				if err != nil {
+					logger.FromContext(ctx).Warn("version.getversion", zap.String("revision", status.revision), zap.Error(err))
+				}
+				if v != nil {
+					argoEvent.Version = v
+				}
+			}
+			sink.ProcessArgoEvent(ctx, argoEvent)
+		}
+	}
+}
+
+type fluxStatus struct {
+	sync     v1alpha1.SyncStatusCode
+	health   health.HealthStatusCode
+	revision string
+}
+
+// kustomizationStatus maps the conditions of a Kustomization to the argo cd status codes.
+// See https://fluxcd.io/flux/components/kustomize/kustomizations/#kustomization-status
+func kustomizationStatus(obj *unstructured.Unstructured) fluxStatus {
+	result := fluxStatus{
+		sync:   v1alpha1.SyncStatusCodeUnknown,
+		health: health.HealthStatusUnknown,
+	}
+	lastApplied, _, _ := unstructured.NestedString(obj.Object, "status", "lastAppliedRevision")
+	lastAttempted, _, _ := unstructured.NestedString(obj.Object, "status", "lastAttemptedRevision")
+	result.revision = commitFromRevision(lastApplied)
+	if lastApplied != "" {
+		if lastAttempted == "" || lastAttempted == lastApplied {
+			result.sync = v1alpha1.SyncStatusCodeSynced
+		} else {
+			result.sync = v1alpha1.SyncStatusCodeOutOfSync
+		}
+	}
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != "Ready" {
+			continue
+		}
+		switch condition["status"] {
+		case "True":
+			result.health = health.HealthStatusHealthy
+		case "Unknown":
+			result.health = health.HealthStatusProgressing
+		case "False":
+			switch condition["reason"] {
+			case "Progressing", "DependencyNotReady":
+				result.health = health.HealthStatusProgressing
+			default:
+				// e.g. HealthCheckFailed, ReconciliationFailed, BuildFailed
+				result.health = health.HealthStatusDegraded
+			}
+		}
+	}
+	if suspended, _, _ := unstructured.NestedBool(obj.Object, "spec", "suspend"); suspended {
+		result.health = health.HealthStatusSuspended
+	}
+	return result
+}
+
+// commitFromRevision extracts the commit hash from a flux revision.
+// Flux 2.0 uses "<branch>@sha1:<commit>", older versions use "<branch>/<commit>".
+func commitFromRevision(revision string) string {
+	if i := strings.LastIndex(revision, "sha1:"); i >= 0 {
+		return revision[i+len("sha1:"):]
+	}
+	if i := strings.LastIndex(revision, "/"); i >= 0 {
+		return revision[i+1:]
+	}
+	return revision
+}
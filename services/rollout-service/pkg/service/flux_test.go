@@ -0,0 +1,273 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/gitops-engine/pkg/health"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/versions"
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+type fluxEventCollector struct {
+	events chan ArgoEvent
+}
+
+func (f *fluxEventCollector) ProcessArgoEvent(ctx context.Context, ev ArgoEvent) {
+	f.events <- ev
+}
+
+func kustomization(env, app string, status map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kustomize.toolkit.fluxcd.io/v1",
+		"kind":       "Kustomization",
+		"metadata": map[string]interface{}{
+			"name":      env + "-" + app,
+			"namespace": "flux-system",
+			"annotations": map[string]interface{}{
+				"com.freiheit.kuberpult/environment": env,
+				"com.freiheit.kuberpult/application": app,
+			},
+		},
+	}}
+	if status != nil {
+		obj.Object["status"] = status
+	}
+	return obj
+}
+
+func readyCondition(status, reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"conditions": []interface{}{
+			map[string]interface{}{
+				"type":   "Ready",
+				"status": status,
+				"reason": reason,
+			},
+		},
+	}
+}
+
+func withRevision(status map[string]interface{}, applied, attempted string) map[string]interface{} {
+	status["lastAppliedRevision"] = applied
+	status["lastAttemptedRevision"] = attempted
+	return status
+}
+
+func TestFluxConnection(t *testing.T) {
+	type fluxStep struct {
+		Create *unstructured.Unstructured
+		Update *unstructured.Unstructured
+		Delete *unstructured.Unstructured
+
+		ExpectedEvent *ArgoEvent
+	}
+	tcs := []struct {
+		Name     string
+		Versions []version
+		Steps    []fluxStep
+	}{
+		{
+			Name: "reports healthy kustomizations with their version",
+			Versions: []version{
+				{
+					Revision:        "1234",
+					Environment:     "production",
+					Application:     "foo",
+					DeployedVersion: 2,
+				},
+			},
+			Steps: []fluxStep{
+				{
+					Create: kustomization("production", "foo", withRevision(readyCondition("True", "ReconciliationSucceeded"), "master@sha1:1234", "master@sha1:1234")),
+					ExpectedEvent: &ArgoEvent{
+						Environment:      "production",
+						Application:      "foo",
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusHealthy,
+						Version:          &versions.VersionInfo{Version: 2},
+					},
+				},
+				{
+					Delete: kustomization("production", "foo", nil),
+					ExpectedEvent: &ArgoEvent{
+						Environment:      "production",
+						Application:      "foo",
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusHealthy,
+						Version:          &versions.VersionInfo{Version: 0},
+					},
+				},
+			},
+		},
+		{
+			Name: "maps the ready condition",
+			Versions: []version{
+				{
+					Revision:        "1234",
+					Environment:     "production",
+					Application:     "foo",
+					DeployedVersion: 1,
+				},
+				{
+					Revision:        "5678",
+					Environment:     "production",
+					Application:     "foo",
+					DeployedVersion: 2,
+				},
+			},
+			Steps: []fluxStep{
+				{
+					Create: kustomization("production", "foo", readyCondition("Unknown", "Progressing")),
+					ExpectedEvent: &ArgoEvent{
+						Environment:      "production",
+						Application:      "foo",
+						SyncStatusCode:   v1alpha1.SyncStatusCodeUnknown,
+						HealthStatusCode: health.HealthStatusProgressing,
+						Version:          &versions.VersionInfo{Version: 0},
+					},
+				},
+				{
+					Update: kustomization("production", "foo", withRevision(readyCondition("False", "HealthCheckFailed"), "master/1234", "master/1234")),
+					ExpectedEvent: &ArgoEvent{
+						Environment:      "production",
+						Application:      "foo",
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusDegraded,
+						Version:          &versions.VersionInfo{Version: 1},
+					},
+				},
+				{
+					Update: kustomization("production", "foo", withRevision(readyCondition("False", "Progressing"), "master@sha1:1234", "master@sha1:5678")),
+					ExpectedEvent: &ArgoEvent{
+						Environment:      "production",
+						Application:      "foo",
+						SyncStatusCode:   v1alpha1.SyncStatusCodeOutOfSync,
+						HealthStatusCode: health.HealthStatusProgressing,
+						Version:          &versions.VersionInfo{Version: 1},
+					},
+				},
+				{
+					Update: kustomization("production", "foo", withRevision(readyCondition("True", "ReconciliationSucceeded"), "master@sha1:5678", "master@sha1:5678")),
+					ExpectedEvent: &ArgoEvent{
+						Environment:      "production",
+						Application:      "foo",
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusHealthy,
+						Version:          &versions.VersionInfo{Version: 2},
+					},
+				},
+			},
+		},
+		{
+			Name: "ignores kustomizations not managed by kuberpult",
+			Steps: []fluxStep{
+				{
+					Create: &unstructured.Unstructured{Object: map[string]interface{}{
+						"apiVersion": "kustomize.toolkit.fluxcd.io/v1",
+						"kind":       "Kustomization",
+						"metadata": map[string]interface{}{
+							"name":      "infrastructure",
+							"namespace": "flux-system",
+						},
+					}},
+				},
+				{
+					Create: kustomization("production", "foo", readyCondition("True", "ReconciliationSucceeded")),
+					ExpectedEvent: &ArgoEvent{
+						Environment:      "production",
+						Application:      "foo",
+						SyncStatusCode:   v1alpha1.SyncStatusCodeUnknown,
+						HealthStatusCode: health.HealthStatusHealthy,
+						Version:          &versions.VersionInfo{Version: 0},
+					},
+				},
+			},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+				KustomizationResource: "KustomizationList",
+			})
+			client := dynamicClient.Resource(KustomizationResource).Namespace("flux-system")
+			sink := &fluxEventCollector{events: make(chan ArgoEvent, len(tc.Steps))}
+			readyCh := make(chan struct{}, 1)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- ConsumeFluxEvents(ctx, client, &mockVersionClient{versions: tc.Versions}, sink, func() {
+					select {
+					case readyCh <- struct{}{}:
+					default:
+					}
+				})
+			}()
+			select {
+			case <-readyCh:
+			case <-time.After(5 * time.Second):
+				t.Fatal("flux consumer didn't become ready")
+			}
+			for i, s := range tc.Steps {
+				var err error
+				switch {
+				case s.Create != nil:
+					_, err = client.Create(ctx, s.Create, metav1.CreateOptions{})
+				case s.Update != nil:
+					_, err = client.Update(ctx, s.Update, metav1.UpdateOptions{})
+				case s.Delete != nil:
+					err = client.Delete(ctx, s.Delete.GetName(), metav1.DeleteOptions{})
+				}
+				if err != nil {
+					t.Fatalf("step %d: %s", i, err)
+				}
+				if s.ExpectedEvent == nil {
+					continue
+				}
+				select {
+				case ev := <-sink.events:
+					if d := cmp.Diff(*s.ExpectedEvent, ev); d != "" {
+						t.Errorf("step %d: unexpected event:\n%s", i, d)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("step %d: expected an event, but got none", i)
+				}
+			}
+			cancel()
+			select {
+			case err := <-errCh:
+				if err != nil {
+					t.Errorf("expected no error, but got %q", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("flux consumer didn't stop")
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/pkg/logger"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/versions"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxTransitions is the number of transitions that are kept per application
+const maxTransitions = 1000
+
+var (
+	historyBucket = []byte("rollouts")
+	// doraBucket contains the records of the dora metrics, in one bucket per environment keyed by the application
+	doraBucket = []byte("dora")
+)
+
+// History persists the changes of the rollout status of all applications, so that they survive restarts.
+// The transitions are stored in one bucket per environment and application, keyed by a sequence number.
+type History struct {
+	db  *bolt.DB
+	now func() time.Time
+}
+
+type transition struct {
+	Time time.Time `json:"time"`
+	// Version is the version in argocd
+	Version          uint64            `json:"version"`
+	KuberpultVersion uint64            `json:"kuberpultVersion"`
+	DeployedAt       time.Time         `json:"deployedAt"`
+	RolloutStatus    api.RolloutStatus `json:"rolloutStatus"`
+}
+
+func OpenHistory(path string) (*History, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening history %q: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(historyBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(doraBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing history %q: %w", path, err)
+	}
+	return &History{db: db, now: time.Now}, nil
+}
+
+func (h *History) Close() error {
+	return h.db.Close()
+}
+
+// Record persists all changes of the broadcast until the context is done.
+func (h *History) Record(ctx context.Context, bc *Broadcast) error {
+	for {
+		h.recordOnce(ctx, bc)
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+	}
+}
+
+func (h *History) recordOnce(ctx context.Context, bc *Broadcast) {
+	initial, ch, unsubscribe := bc.Start()
+	defer unsubscribe()
+	h.record(ctx, initial...)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-ch:
+			if ev == nil {
+				// closed, changes in between are lost
+				return
+			}
+			events, closed := drain(ch, ev)
+			h.record(ctx, events...)
+			if closed {
+				return
+			}
+		}
+	}
+}
+
+// drain returns the event and all events that are already waiting, so that they are written in one transaction.
+// Every transaction syncs the file, which is slower than argocd can send events after a restart.
+func drain(ch <-chan *BroadcastEvent, ev *BroadcastEvent) ([]*BroadcastEvent, bool) {
+	events := []*BroadcastEvent{ev}
+	for {
+		select {
+		case ev := <-ch:
+			if ev == nil {
+				return events, true
+			}
+			events = append(events, ev)
+		default:
+			return events, false
+		}
+	}
+}
+
+// Restore sets the state of all applications to their last transition, so that a restart neither resets the time of the last status change nor looks like a new rollout.
+// It must be called before the broadcast processes any events.
+func (h *History) Restore(bc *Broadcast) error {
+	last := map[Key]transition{}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(historyBucket)
+		return root.ForEach(func(environment, _ []byte) error {
+			envBucket := root.Bucket(environment)
+			if envBucket == nil {
+				return nil
+			}
+			return envBucket.ForEach(func(application, _ []byte) error {
+				b := envBucket.Bucket(application)
+				if b == nil {
+					return nil
+				}
+				_, data := b.Cursor().Last()
+				if data == nil {
+					return nil
+				}
+				var t transition
+				if err := json.Unmarshal(data, &t); err != nil {
+					return err
+				}
+				last[Key{Environment: string(environment), Application: string(application)}] = t
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("restoring the rollout history: %w", err)
+	}
+	bc.mx.Lock()
+	defer bc.mx.Unlock()
+	for key, t := range last {
+		app := &appState{
+			rolloutStatus:    t.RolloutStatus,
+			lastStatusChange: t.Time,
+			publishedVersion: t.Version,
+			publishedStatus:  t.RolloutStatus,
+		}
+		if t.Version != 0 {
+			app.argocdVersion = &versions.VersionInfo{Version: t.Version}
+		}
+		if t.KuberpultVersion != 0 {
+			app.kuberpultVersion = &versions.VersionInfo{Version: t.KuberpultVersion, DeployedAt: t.DeployedAt}
+		}
+		bc.state[key] = app
+		bc.publish(app, app.getEvent(key.Application, key.Environment))
+	}
+	return nil
+}
+
+func (h *History) record(ctx context.Context, events ...*BroadcastEvent) {
+	now := h.now()
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		for _, ev := range events {
+			if err := recordTransition(tx, ev, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.FromContext(ctx).Warn("history.record", zap.Error(err))
+	}
+}
+
+func recordTransition(tx *bolt.Tx, ev *BroadcastEvent, now time.Time) error {
+	if ev.Environment == "" || ev.Application == "" {
+		return nil
+	}
+	envBucket, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(ev.Environment))
+	if err != nil {
+		return err
+	}
+	b, err := envBucket.CreateBucketIfNotExists([]byte(ev.Application))
+	if err != nil {
+		return err
+	}
+	t := transition{
+		Time:          now,
+		RolloutStatus: ev.RolloutStatus,
+	}
+	if ev.ArgocdVersion != nil {
+		t.Version = ev.ArgocdVersion.Version
+	}
+	if ev.KuberpultVersion != nil {
+		t.KuberpultVersion = ev.KuberpultVersion.Version
+		t.DeployedAt = ev.KuberpultVersion.DeployedAt
+	}
+	// Events that only change details, or the snapshot after a restart, are not a transition
+	if _, last := b.Cursor().Last(); last != nil {
+		var prev transition
+		if err := json.Unmarshal(last, &prev); err == nil && prev.Version == t.Version && prev.KuberpultVersion == t.KuberpultVersion && prev.RolloutStatus == t.RolloutStatus {
+			return nil
+		}
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(sequenceKey(seq), data); err != nil {
+		return err
+	}
+	if seq > maxTransitions {
+		return b.Delete(sequenceKey(seq - maxTransitions))
+	}
+	return nil
+}
+
+// LoadDora returns the records of the dora metrics of all applications.
+func (h *History) LoadDora() (map[Key][]byte, error) {
+	result := map[Key][]byte{}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(doraBucket)
+		return root.ForEach(func(environment, _ []byte) error {
+			envBucket := root.Bucket(environment)
+			if envBucket == nil {
+				return nil
+			}
+			return envBucket.ForEach(func(application, data []byte) error {
+				// the data is only valid during the transaction
+				result[Key{Environment: string(environment), Application: string(application)}] = append([]byte(nil), data...)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loading the dora metrics: %w", err)
+	}
+	return result, nil
+}
+
+// StoreDora persists the records of the dora metrics of the given applications in one transaction.
+func (h *History) StoreDora(records map[Key][]byte) error {
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		for key, data := range records {
+			envBucket, err := tx.Bucket(doraBucket).CreateBucketIfNotExists([]byte(key.Environment))
+			if err != nil {
+				return err
+			}
+			if err := envBucket.Put([]byte(key.Application), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("storing the dora metrics: %w", err)
+	}
+	return nil
+}
+
+func sequenceKey(seq uint64) []byte {
+	result := make([]byte, 8)
+	binary.BigEndian.PutUint64(result, seq)
+	return result
+}
+
+// GetRolloutHistory returns the recorded rollouts of an application, newest first.
+func (h *History) GetRolloutHistory(environment, application string) ([]*api.RolloutHistoryEntry, error) {
+	var transitions []transition
+	err := h.db.View(func(tx *bolt.Tx) error {
+		envBucket := tx.Bucket(historyBucket).Bucket([]byte(environment))
+		if envBucket == nil {
+			return nil
+		}
+		b := envBucket.Bucket([]byte(application))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var t transition
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			transitions = append(transitions, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rollouts(transitions), nil
+}
+
+// rollouts groups the transitions by the version in kuberpult.
+// Transitions from before kuberpult reported a version are assigned to the version in argocd.
+func rollouts(transitions []transition) []*api.RolloutHistoryEntry {
+	var result []*api.RolloutHistoryEntry
+	var current *api.RolloutHistoryEntry
+	var deployedAt time.Time
+	for _, t := range transitions {
+		version := t.KuberpultVersion
+		if version == 0 {
+			version = t.Version
+		}
+		if current == nil || current.Version != version {
+			deployedAt = t.DeployedAt
+			if deployedAt.IsZero() {
+				deployedAt = t.Time
+			}
+			current = &api.RolloutHistoryEntry{
+				Version:    version,
+				DeployedAt: timestamppb.New(deployedAt),
+			}
+			result = append(result, current)
+		}
+		current.Transitions = append(current.Transitions, &api.RolloutTransition{
+			Time:          timestamppb.New(t.Time),
+			Version:       t.Version,
+			RolloutStatus: t.RolloutStatus,
+		})
+		if current.HealthyAt == nil && t.RolloutStatus == api.RolloutStatus_RolloutStatusSuccesful && t.Version == version {
+			current.HealthyAt = timestamppb.New(t.Time)
+			current.TimeToHealthy = durationpb.New(t.Time.Sub(deployedAt))
+		}
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+// GetRolloutHistory implements api.RolloutServiceServer
+func (b *Broadcast) GetRolloutHistory(ctx context.Context, req *api.GetRolloutHistoryRequest) (*api.GetRolloutHistoryResponse, error) {
+	if b.History == nil {
+		return nil, status.Error(codes.Unimplemented, "the rollout history is not enabled")
+	}
+	if req.Environment == "" || req.Application == "" {
+		return nil, status.Error(codes.InvalidArgument, "environment and application must not be empty")
+	}
+	result, err := b.History.GetRolloutHistory(req.Environment, req.Application)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "reading the rollout history: %s", err)
+	}
+	return &api.GetRolloutHistoryResponse{Rollouts: result}, nil
+}
@@ -0,0 +1,346 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package service
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/gitops-engine/pkg/health"
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/versions"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestHistory(t *testing.T) {
+	t.Parallel()
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	type step struct {
+		// Minute is the time of the step relative to t0
+		Minute int
+		Event  *BroadcastEvent
+		// Reopen closes and opens the history to simulate a restart
+		Reopen bool
+	}
+	event := func(argocd, kuberpult uint64, deployedAt int, status api.RolloutStatus) *BroadcastEvent {
+		ev := &BroadcastEvent{
+			Key:           Key{Environment: "production", Application: "foo"},
+			RolloutStatus: status,
+		}
+		if argocd != 0 {
+			ev.ArgocdVersion = &versions.VersionInfo{Version: argocd}
+		}
+		if kuberpult != 0 {
+			ev.KuberpultVersion = &versions.VersionInfo{Version: kuberpult, DeployedAt: t0.Add(time.Duration(deployedAt) * time.Minute)}
+		}
+		return ev
+	}
+	at := func(minute int) *timestamppb.Timestamp {
+		return timestamppb.New(t0.Add(time.Duration(minute) * time.Minute))
+	}
+	transition := func(minute int, version uint64, status api.RolloutStatus) *api.RolloutTransition {
+		return &api.RolloutTransition{Time: at(minute), Version: version, RolloutStatus: status}
+	}
+	var (
+		successful  = api.RolloutStatus_RolloutStatusSuccesful
+		progressing = api.RolloutStatus_RolloutStatusProgressing
+		failed      = api.RolloutStatus_RolloutStatusError
+	)
+	tcs := []struct {
+		Name  string
+		Steps []step
+
+		ExpectedRollouts []*api.RolloutHistoryEntry
+	}{
+		{
+			Name: "time to healthy per deployment",
+			Steps: []step{
+				{Minute: 1, Event: event(1, 1, 0, progressing)},
+				{Minute: 3, Event: event(1, 1, 0, successful)},
+				{Minute: 10, Event: event(1, 2, 10, progressing)},
+				{Minute: 11, Event: event(2, 2, 10, failed)},
+				{Minute: 15, Event: event(2, 2, 10, successful)},
+			},
+			ExpectedRollouts: []*api.RolloutHistoryEntry{
+				{
+					Version:       2,
+					DeployedAt:    at(10),
+					HealthyAt:     at(15),
+					TimeToHealthy: durationpb.New(5 * time.Minute),
+					Transitions: []*api.RolloutTransition{
+						transition(10, 1, progressing),
+						transition(11, 2, failed),
+						transition(15, 2, successful),
+					},
+				},
+				{
+					Version:       1,
+					DeployedAt:    at(0),
+					HealthyAt:     at(3),
+					TimeToHealthy: durationpb.New(3 * time.Minute),
+					Transitions: []*api.RolloutTransition{
+						transition(1, 1, progressing),
+						transition(3, 1, successful),
+					},
+				},
+			},
+		},
+		{
+			Name: "survives restarts",
+			Steps: []step{
+				{Minute: 1, Event: event(1, 1, 0, progressing)},
+				{Minute: 2, Reopen: true},
+				// the snapshot after the restart doesn't change anything
+				{Minute: 3, Event: event(1, 1, 0, progressing)},
+				{Minute: 4, Event: event(1, 1, 0, successful)},
+			},
+			ExpectedRollouts: []*api.RolloutHistoryEntry{
+				{
+					Version:       1,
+					DeployedAt:    at(0),
+					HealthyAt:     at(4),
+					TimeToHealthy: durationpb.New(4 * time.Minute),
+					Transitions: []*api.RolloutTransition{
+						transition(1, 1, progressing),
+						transition(4, 1, successful),
+					},
+				},
+			},
+		},
+		{
+			Name: "status before kuberpult reported the version",
+			Steps: []step{
+				{Minute: 1, Event: event(1, 0, 0, successful)},
+				{Minute: 2, Event: event(1, 1, 0, successful)},
+				{Minute: 5, Event: event(1, 2, 0, progressing)},
+			},
+			ExpectedRollouts: []*api.RolloutHistoryEntry{
+				{
+					Version:    2,
+					DeployedAt: at(0),
+					Transitions: []*api.RolloutTransition{
+						transition(5, 1, progressing),
+					},
+				},
+				{
+					Version:       1,
+					DeployedAt:    at(1),
+					HealthyAt:     at(1),
+					TimeToHealthy: durationpb.New(0),
+					Transitions: []*api.RolloutTransition{
+						transition(1, 1, successful),
+						transition(2, 1, successful),
+					},
+				},
+			},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			dbPath := path.Join(t.TempDir(), "history.db")
+			h, err := OpenHistory(dbPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tc.Steps {
+				if s.Reopen {
+					if err := h.Close(); err != nil {
+						t.Fatal(err)
+					}
+					h, err = OpenHistory(dbPath)
+					if err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				now := t0.Add(time.Duration(s.Minute) * time.Minute)
+				h.now = func() time.Time { return now }
+				h.record(ctx, s.Event)
+			}
+			defer h.Close()
+			bc := New()
+			bc.History = h
+			resp, err := bc.GetRolloutHistory(ctx, &api.GetRolloutHistoryRequest{Environment: "production", Application: "foo"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.ExpectedRollouts, resp.Rollouts, protocmp.Transform()); d != "" {
+				t.Errorf("unexpected history: %s", d)
+			}
+		})
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	t.Parallel()
+	h, err := OpenHistory(path.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	events := []*BroadcastEvent{}
+	for i := uint64(1); i <= maxTransitions+10; i++ {
+		events = append(events, &BroadcastEvent{
+			Key:           Key{Environment: "production", Application: "foo"},
+			ArgocdVersion: &versions.VersionInfo{Version: i},
+			RolloutStatus: api.RolloutStatus_RolloutStatusSuccesful,
+		})
+	}
+	h.record(context.Background(), events...)
+	rollouts, err := h.GetRolloutHistory("production", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rollouts) != maxTransitions {
+		t.Fatalf("expected %d rollouts, got %d", maxTransitions, len(rollouts))
+	}
+	if rollouts[0].Version != maxTransitions+10 || rollouts[len(rollouts)-1].Version != 11 {
+		t.Errorf("expected the oldest transitions to be removed, got versions %d to %d", rollouts[len(rollouts)-1].Version, rollouts[0].Version)
+	}
+}
+
+func TestHistoryRestore(t *testing.T) {
+	t.Parallel()
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	h, err := OpenHistory(path.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.now = func() time.Time { return t0 }
+	h.record(ctx, &BroadcastEvent{
+		Key:              Key{Environment: "production", Application: "foo"},
+		ArgocdVersion:    &versions.VersionInfo{Version: 2},
+		KuberpultVersion: &versions.VersionInfo{Version: 2, DeployedAt: t0.Add(-time.Minute)},
+		RolloutStatus:    api.RolloutStatus_RolloutStatusSuccesful,
+	})
+
+	bc := New()
+	bc.now = func() time.Time { return t0.Add(time.Hour) }
+	if err := h.Restore(bc); err != nil {
+		t.Fatal(err)
+	}
+	// argocd reports the same status after the restart
+	bc.ProcessArgoEvent(ctx, ArgoEvent{
+		Application:      "foo",
+		Environment:      "production",
+		Version:          &versions.VersionInfo{Version: 2},
+		SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+		HealthStatusCode: health.HealthStatusHealthy,
+	})
+	events, _, unsubscribe := bc.Start()
+	unsubscribe()
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %d", len(events))
+	}
+	ev := events[0]
+	if ev.RolloutStatus != api.RolloutStatus_RolloutStatusSuccesful {
+		t.Errorf("expected the restored status, got %s", ev.RolloutStatus)
+	}
+	if ev.ArgocdVersion == nil || ev.ArgocdVersion.Version != 2 || ev.KuberpultVersion == nil || ev.KuberpultVersion.Version != 2 {
+		t.Errorf("expected the restored versions, got %#v and %#v", ev.ArgocdVersion, ev.KuberpultVersion)
+	}
+	if !ev.LastStatusChange.Equal(t0) {
+		t.Errorf("expected the last status change from the history, got %s", ev.LastStatusChange)
+	}
+	if ev.Sequence == 0 {
+		t.Errorf("expected the restored state to have a sequence")
+	}
+}
+
+func TestHistoryDora(t *testing.T) {
+	t.Parallel()
+	dbPath := path.Join(t.TempDir(), "history.db")
+	h, err := OpenHistory(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := map[Key][]byte{
+		{Environment: "production", Application: "foo"}: []byte(`{"since":"2023-01-01T12:00:00Z"}`),
+		{Environment: "staging", Application: "foo"}:    []byte(`{"since":"2023-01-02T12:00:00Z"}`),
+	}
+	if err := h.StoreDora(records); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h, err = OpenHistory(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	loaded, err := h.LoadDora()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(records, loaded); d != "" {
+		t.Errorf("unexpected records: %s", d)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	t.Parallel()
+	first := &BroadcastEvent{Sequence: 1}
+	ch := make(chan *BroadcastEvent, 10)
+	ch <- &BroadcastEvent{Sequence: 2}
+	ch <- &BroadcastEvent{Sequence: 3}
+	events, closed := drain(ch, first)
+	if len(events) != 3 || closed {
+		t.Errorf("expected three events from an open channel, got %d (closed: %t)", len(events), closed)
+	}
+	ch <- &BroadcastEvent{Sequence: 4}
+	close(ch)
+	events, closed = drain(ch, first)
+	if len(events) != 2 || !closed {
+		t.Errorf("expected two events from a closed channel, got %d (closed: %t)", len(events), closed)
+	}
+}
+
+func TestGetRolloutHistoryDisabled(t *testing.T) {
+	t.Parallel()
+	_, err := New().GetRolloutHistory(context.Background(), &api.GetRolloutHistoryRequest{Environment: "production", Application: "foo"})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected unimplemented, got %q", err)
+	}
+	h, err := OpenHistory(path.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	bc := New()
+	bc.History = h
+	resp, err := bc.GetRolloutHistory(context.Background(), &api.GetRolloutHistoryRequest{Environment: "production", Application: "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rollouts) != 0 {
+		t.Errorf("expected no rollouts for an unknown application, got %v", resp.Rollouts)
+	}
+}
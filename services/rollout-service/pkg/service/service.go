@@ -45,7 +45,8 @@ type ArgoEventProcessor interface {
 	ProcessArgoEvent(ctx context.Context, ev ArgoEvent)
 }
 
-func ConsumeEvents(ctx context.Context, appClient SimplifiedApplicationServiceClient, version versions.VersionClient, sink ArgoEventProcessor, ready func()) error {
+// ConsumeEvents watches the applications of one argocd. It reports whether the watch is connected with setConnected.
+func ConsumeEvents(ctx context.Context, appClient SimplifiedApplicationServiceClient, version versions.VersionClient, sink ArgoEventProcessor, setConnected func(connected bool)) error {
 	for {
 		watch, err := appClient.Watch(ctx, &application.ApplicationQuery{})
 		if err != nil {
@@ -55,7 +56,7 @@ func ConsumeEvents(ctx context.Context, appClient SimplifiedApplicationServiceCl
 			}
 			return fmt.Errorf("watching applications: %w", err)
 		}
-		ready()
+		setConnected(true)
 	recv:
 		for {
 			ev, err := watch.Recv()
@@ -65,12 +66,14 @@ func ConsumeEvents(ctx context.Context, appClient SimplifiedApplicationServiceCl
 					return nil
 				}
 				logger.FromContext(ctx).Warn("argocd.application.recv", zap.Error(err))
+				setConnected(false)
 				break
 			}
 			environment, application := getEnvironmentAndName(ev.Application.Annotations)
 			if application == "" {
 				continue
 			}
+			destination := getDestination(ev.Application.Annotations)
 			switch ev.Type {
 			case "ADDED", "MODIFIED":
 				version, err := version.GetVersion(ctx, ev.Application.Status.Sync.Revision, environment, application)
@@ -80,15 +83,19 @@ func ConsumeEvents(ctx context.Context, appClient SimplifiedApplicationServiceCl
 				sink.ProcessArgoEvent(ctx, ArgoEvent{
 					Application:      application,
 					Environment:      environment,
+					Destination:      destination,
 					SyncStatusCode:   ev.Application.Status.Sync.Status,
 					HealthStatusCode: ev.Application.Status.Health.Status,
 					OperationState:   ev.Application.Status.OperationState,
+					SyncRevision:     ev.Application.Status.Sync.Revision,
+					Resources:        ev.Application.Status.Resources,
 					Version:          version,
 				})
 			case "DELETED":
 				sink.ProcessArgoEvent(ctx, ArgoEvent{
 					Application:      application,
 					Environment:      environment,
+					Destination:      destination,
 					SyncStatusCode:   ev.Application.Status.Sync.Status,
 					HealthStatusCode: ev.Application.Status.Health.Status,
 
@@ -109,11 +116,21 @@ func getEnvironmentAndName(annotations map[string]string) (string, string) {
 	return annotations["com.freiheit.kuberpult/environment"], annotations["com.freiheit.kuberpult/application"]
 }
 
+// getDestination returns the destination of an application, if the environment is deployed to multiple destinations
+func getDestination(annotations map[string]string) string {
+	return annotations["com.freiheit.kuberpult/destination"]
+}
+
 type ArgoEvent struct {
-	Environment      string
-	Application      string
+	Environment string
+	Application string
+	// Destination is empty unless the environment has multiple destinations
+	Destination      string
 	SyncStatusCode   v1alpha1.SyncStatusCode
 	HealthStatusCode health.HealthStatusCode
 	OperationState   *v1alpha1.OperationState
-	Version          *versions.VersionInfo
+	// SyncRevision is the git revision that argocd compares the application with
+	SyncRevision string
+	Resources    []v1alpha1.ResourceStatus
+	Version      *versions.VersionInfo
 }
@@ -24,6 +24,8 @@ import (
 
 	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
 	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/gitops-engine/pkg/health"
+	"github.com/argoproj/gitops-engine/pkg/sync/common"
 	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/versions"
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/grpc"
@@ -228,9 +230,134 @@ func TestArgoConection(t *testing.T) {
 						},
 					},
 					ExpectedEvent: &ArgoEvent{
-						Application: "bar",
-						Environment: "foo",
-						Version:     &versions.VersionInfo{Version: 42},
+						Application:  "bar",
+						Environment:  "foo",
+						SyncRevision: "1234",
+						Version:      &versions.VersionInfo{Version: 42},
+					},
+				},
+				{
+					RecvErr: status.Error(codes.Canceled, "context cancelled"),
+				},
+			},
+			ExpectedReady: true,
+		},
+		{
+			Name: "passes the destination of applications",
+			Versions: []version{
+				{
+					Revision:        "1234",
+					Environment:     "foo",
+					Application:     "bar",
+					DeployedVersion: 42,
+				},
+			},
+			Steps: []step{
+				{
+					Event: &v1alpha1.ApplicationWatchEvent{
+						Type: "ADDED",
+						Application: v1alpha1.Application{
+							ObjectMeta: metav1.ObjectMeta{
+								Name: "foo-bar-eu",
+								Annotations: map[string]string{
+									"com.freiheit.kuberpult/environment": "foo",
+									"com.freiheit.kuberpult/application": "bar",
+									"com.freiheit.kuberpult/destination": "eu",
+								},
+							},
+							Spec: v1alpha1.ApplicationSpec{
+								Project: "foo",
+							},
+							Status: v1alpha1.ApplicationStatus{
+								Sync:   v1alpha1.SyncStatus{Revision: "1234"},
+								Health: v1alpha1.HealthStatus{},
+							},
+						},
+					},
+					ExpectedEvent: &ArgoEvent{
+						Application:  "bar",
+						Environment:  "foo",
+						Destination:  "eu",
+						SyncRevision: "1234",
+						Version:      &versions.VersionInfo{Version: 42},
+					},
+				},
+				{
+					RecvErr: status.Error(codes.Canceled, "context cancelled"),
+				},
+			},
+			ExpectedReady: true,
+		},
+		{
+			Name: "passes the operation state and resources",
+			Versions: []version{
+				{
+					Revision:        "1234",
+					Environment:     "foo",
+					Application:     "bar",
+					DeployedVersion: 42,
+				},
+			},
+			Steps: []step{
+				{
+					Event: &v1alpha1.ApplicationWatchEvent{
+						Type: "MODIFIED",
+						Application: v1alpha1.Application{
+							ObjectMeta: metav1.ObjectMeta{
+								Name: "foo-bar",
+								Annotations: map[string]string{
+									"com.freiheit.kuberpult/environment": "foo",
+									"com.freiheit.kuberpult/application": "bar",
+								},
+							},
+							Spec: v1alpha1.ApplicationSpec{
+								Project: "foo",
+							},
+							Status: v1alpha1.ApplicationStatus{
+								Sync:   v1alpha1.SyncStatus{Revision: "1234", Status: v1alpha1.SyncStatusCodeSynced},
+								Health: v1alpha1.HealthStatus{Status: health.HealthStatusDegraded},
+								OperationState: &v1alpha1.OperationState{
+									Phase:   common.OperationSucceeded,
+									Message: "successfully synced (all tasks run)",
+								},
+								Resources: []v1alpha1.ResourceStatus{
+									{
+										Group:     "apps",
+										Kind:      "Deployment",
+										Namespace: "foo",
+										Name:      "bar",
+										Health: &v1alpha1.HealthStatus{
+											Status:  health.HealthStatusDegraded,
+											Message: "Deployment \"bar\" exceeded its progress deadline",
+										},
+									},
+								},
+							},
+						},
+					},
+					ExpectedEvent: &ArgoEvent{
+						Application:      "bar",
+						Environment:      "foo",
+						SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+						HealthStatusCode: health.HealthStatusDegraded,
+						OperationState: &v1alpha1.OperationState{
+							Phase:   common.OperationSucceeded,
+							Message: "successfully synced (all tasks run)",
+						},
+						SyncRevision: "1234",
+						Resources: []v1alpha1.ResourceStatus{
+							{
+								Group:     "apps",
+								Kind:      "Deployment",
+								Namespace: "foo",
+								Name:      "bar",
+								Health: &v1alpha1.HealthStatus{
+									Status:  health.HealthStatusDegraded,
+									Message: "Deployment \"bar\" exceeded its progress deadline",
+								},
+							},
+						},
+						Version: &versions.VersionInfo{Version: 42},
 					},
 				},
 				{
@@ -293,7 +420,7 @@ func TestArgoConection(t *testing.T) {
 				t:     t,
 			}
 			ready := false
-			err := ConsumeEvents(ctx, &as, &mockVersionClient{versions: tc.Versions}, &as, func() { ready = true })
+			err := ConsumeEvents(ctx, &as, &mockVersionClient{versions: tc.Versions}, &as, func(connected bool) { ready = connected })
 			if tc.ExpectedError == "" {
 				if err != nil {
 					t.Errorf("expected no error, but got %q", err)
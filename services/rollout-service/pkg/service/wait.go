@@ -0,0 +1,99 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultWaitForRolloutTimeout = 10 * time.Minute
+
+// WaitForRollout blocks until the requested version is healthy and synced, the rollout of it failed or the timeout is reached.
+func (b *Broadcast) WaitForRollout(ctx context.Context, req *api.WaitForRolloutRequest) (*api.WaitForRolloutResponse, error) {
+	if req.Environment == "" || req.Application == "" {
+		return nil, status.Error(codes.InvalidArgument, "environment and application must not be empty")
+	}
+	timeout := defaultWaitForRolloutTimeout
+	if req.Timeout != nil {
+		if err := req.Timeout.CheckValid(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid timeout: %s", err)
+		}
+		timeout = req.Timeout.AsDuration()
+		if timeout <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "timeout must be positive")
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	key := Key{Application: req.Application, Environment: req.Environment}
+	initial, ch, unsubscribe := b.Start()
+	defer unsubscribe()
+	for _, ev := range initial {
+		if ev.Key != key {
+			continue
+		}
+		if resp, err := waitResult(ev, req.Version); resp != nil || err != nil {
+			return resp, err
+		}
+	}
+	for {
+		select {
+		case ev := <-ch:
+			if ev == nil {
+				// closed
+				return nil, status.Error(codes.Unavailable, "rollout status subscription closed")
+			}
+			if ev.Key != key {
+				continue
+			}
+			if resp, err := waitResult(ev, req.Version); resp != nil || err != nil {
+				return resp, err
+			}
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, status.Errorf(codes.DeadlineExceeded, "version %d of %q was not rolled out in %q within %s", req.Version, req.Application, req.Environment, timeout)
+			}
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// waitResult returns a response if the version is successfully rolled out and an error if it failed.
+// It returns neither while the rollout is still going on or another version is deployed.
+func waitResult(ev *BroadcastEvent, version uint64) (*api.WaitForRolloutResponse, error) {
+	if ev.ArgocdVersion == nil || ev.ArgocdVersion.Version != version {
+		return nil, nil
+	}
+	switch ev.RolloutStatus {
+	case api.RolloutStatus_RolloutStatusSuccesful:
+		return &api.WaitForRolloutResponse{RolloutStatus: ev.RolloutStatus}, nil
+	case api.RolloutStatus_RolloutStatusError:
+		reason := ev.Diagnostics.Reason()
+		if reason == "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "rollout of version %d of %q in %q failed", version, ev.Application, ev.Environment)
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "rollout of version %d of %q in %q failed: %s", version, ev.Application, ev.Environment, reason)
+	}
+	return nil, nil
+}
@@ -0,0 +1,172 @@
+/*This file is part of kuberpult.
+
+Kuberpult is free software: you can redistribute it and/or modify
+it under the terms of the Expat(MIT) License as published by
+the Free Software Foundation.
+
+Kuberpult is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+MIT License for more details.
+
+You should have received a copy of the MIT License
+along with kuberpult. If not, see <https://directory.fsf.org/wiki/License:Expat>.
+
+Copyright 2023 freiheit.com*/
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/gitops-engine/pkg/health"
+	"github.com/argoproj/gitops-engine/pkg/sync/common"
+	"github.com/freiheit-com/kuberpult/pkg/api"
+	"github.com/freiheit-com/kuberpult/services/rollout-service/pkg/versions"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestWaitForRollout(t *testing.T) {
+	t.Parallel()
+	event := func(application string, version uint64, h health.HealthStatusCode) ArgoEvent {
+		return ArgoEvent{
+			Application:      application,
+			Environment:      "production",
+			Version:          &versions.VersionInfo{Version: version},
+			SyncStatusCode:   v1alpha1.SyncStatusCodeSynced,
+			HealthStatusCode: h,
+		}
+	}
+	failed := event("foo", 2, health.HealthStatusHealthy)
+	failed.SyncStatusCode = v1alpha1.SyncStatusCodeOutOfSync
+	failed.OperationState = &v1alpha1.OperationState{
+		Phase:   common.OperationFailed,
+		Message: "one or more objects failed to apply",
+	}
+
+	tcs := []struct {
+		Name    string
+		Timeout *durationpb.Duration
+		// Before are processed before the request starts
+		Before []ArgoEvent
+		// After are processed once the request is waiting
+		After []ArgoEvent
+
+		ExpectedCode    codes.Code
+		ExpectedMessage string
+	}{
+		{
+			Name: "already rolled out",
+			Before: []ArgoEvent{
+				event("foo", 2, health.HealthStatusHealthy),
+			},
+			ExpectedCode: codes.OK,
+		},
+		{
+			Name: "waits until the version is healthy",
+			Before: []ArgoEvent{
+				event("foo", 1, health.HealthStatusHealthy),
+			},
+			After: []ArgoEvent{
+				event("foo", 2, health.HealthStatusProgressing),
+				event("bar", 2, health.HealthStatusHealthy),
+				event("foo", 2, health.HealthStatusHealthy),
+			},
+			ExpectedCode: codes.OK,
+		},
+		{
+			Name: "fails with the operation message",
+			After: []ArgoEvent{
+				event("foo", 2, health.HealthStatusProgressing),
+				failed,
+			},
+			ExpectedCode:    codes.FailedPrecondition,
+			ExpectedMessage: `rollout of version 2 of "foo" in "production" failed: one or more objects failed to apply`,
+		},
+		{
+			Name: "ignores errors of other versions",
+			Before: []ArgoEvent{
+				event("foo", 1, health.HealthStatusDegraded),
+			},
+			After: []ArgoEvent{
+				event("foo", 2, health.HealthStatusHealthy),
+			},
+			ExpectedCode: codes.OK,
+		},
+		{
+			Name:    "times out",
+			Timeout: durationpb.New(50 * time.Millisecond),
+			After: []ArgoEvent{
+				event("foo", 2, health.HealthStatusProgressing),
+			},
+			ExpectedCode:    codes.DeadlineExceeded,
+			ExpectedMessage: `version 2 of "foo" was not rolled out in "production" within 50ms`,
+		},
+		{
+			Name:            "invalid timeout",
+			Timeout:         durationpb.New(-time.Second),
+			ExpectedCode:    codes.InvalidArgument,
+			ExpectedMessage: "timeout must be positive",
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			bc := New()
+			ctx := context.Background()
+			for _, ev := range tc.Before {
+				bc.ProcessArgoEvent(ctx, ev)
+			}
+			listeners := len(bc.listener)
+			done := make(chan error, 1)
+			go func() {
+				_, err := bc.WaitForRollout(ctx, &api.WaitForRolloutRequest{
+					Environment: "production",
+					Application: "foo",
+					Version:     2,
+					Timeout:     tc.Timeout,
+				})
+				done <- err
+			}()
+			if len(tc.After) > 0 {
+				waitForListener(t, bc, listeners+1)
+			}
+			for _, ev := range tc.After {
+				bc.ProcessArgoEvent(ctx, ev)
+			}
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the request to finish")
+			}
+			s := status.Convert(err)
+			if s.Code() != tc.ExpectedCode {
+				t.Errorf("expected code %s, got %s (%q)", tc.ExpectedCode, s.Code(), s.Message())
+			}
+			if s.Message() != tc.ExpectedMessage {
+				t.Errorf("expected message %q, got %q", tc.ExpectedMessage, s.Message())
+			}
+		})
+	}
+}
+
+func waitForListener(t *testing.T, bc *Broadcast, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		bc.mx.Lock()
+		l := len(bc.listener)
+		bc.mx.Unlock()
+		if l >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("expected the request to subscribe")
+}
@@ -51,37 +51,38 @@ type versionClient struct {
 type VersionInfo struct {
 	Version    uint64
 	DeployedAt time.Time
+	// ReleaseCreatedAt is when the release was created in kuberpult, it's only known for kuberpult events
+	ReleaseCreatedAt time.Time
+}
+
+// cacheKey identifies the version of one application in one environment at a revision of the manifest repository
+type cacheKey struct {
+	Revision    string
+	Environment string
+	Application string
 }
 
 // GetVersion implements VersionClient
 func (v *versionClient) GetVersion(ctx context.Context, revision, environment, application string) (*VersionInfo, error) {
-	var overview *api.GetOverviewResponse
-	entry, ok := v.cache.Get(revision)
-	if !ok {
-		var err error
-		ctx = auth.WriteUserToGrpcContext(ctx, RolloutServiceUser)
-		overview, err = v.client.GetOverview(ctx, &api.GetOverviewRequest{
-			GitRevision: revision,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("requesting overview %q: %w", revision, err)
-		}
-		v.cache.Add(revision, overview)
-	} else {
-		overview = entry.(*api.GetOverviewResponse)
+	k := cacheKey{Revision: revision, Environment: environment, Application: application}
+	if entry, ok := v.cache.Get(k); ok {
+		return entry.(*VersionInfo), nil
 	}
-	for _, group := range overview.GetEnvironmentGroups() {
-		for _, env := range group.GetEnvironments() {
-			if env.Name == environment {
-				app := env.Applications[application]
-				if app == nil {
-					return &VersionInfo{}, nil
-				}
-				return &VersionInfo{Version: app.Version, DeployedAt: deployedAt(app)}, nil
-			}
-		}
+	ctx = auth.WriteUserToGrpcContext(ctx, RolloutServiceUser)
+	resp, err := v.client.GetAppVersionAtRevision(ctx, &api.GetAppVersionAtRevisionRequest{
+		GitRevision: revision,
+		Environment: environment,
+		Application: application,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("requesting version of %s/%s at %q: %w", environment, application, revision, err)
+	}
+	result := &VersionInfo{Version: resp.Version}
+	if resp.DeployedAt != nil {
+		result.DeployedAt = resp.DeployedAt.AsTime()
 	}
-	return &VersionInfo{}, nil
+	v.cache.Add(k, result)
+	return result, nil
 }
 
 func deployedAt(app *api.Environment_Application) time.Time {
@@ -99,11 +100,23 @@ func deployedAt(app *api.Environment_Application) time.Time {
 	return time.Time{}
 }
 
+func releaseCreatedAt(overview *api.GetOverviewResponse, application string, version uint64) time.Time {
+	for _, r := range overview.Applications[application].GetReleases() {
+		if r.Version == version && r.CreatedAt != nil {
+			return r.CreatedAt.AsTime()
+		}
+	}
+	return time.Time{}
+}
+
 type KuberpultEvent struct {
 	Environment      string
 	Application      string
 	EnvironmentGroup string
+	Team             string
 	Version          *VersionInfo
+	// Destinations are the ids of the configured destinations, empty for environments with a single destination
+	Destinations []string
 }
 
 type VersionEventProcessor interface {
@@ -126,6 +139,9 @@ outer:
 		}
 		versions := map[key]uint64{}
 		environmentGroups := map[key]string{}
+		teams := map[key]string{}
+		destinations := map[key][]string{}
+		revision := ""
 		for {
 			select {
 			case <-ctx.Done():
@@ -146,31 +162,42 @@ outer:
 				}
 				continue
 			}
+			if overview.GitRevision != "" && overview.GitRevision == revision {
+				// the cd-service also sends the overview when only the rollout status in it changed, this doesn't change any version
+				continue
+			}
+			revision = overview.GitRevision
 			l := logger.FromContext(ctx).With(zap.String("git.revision", overview.GitRevision))
-			v.cache.Add(overview.GitRevision, overview)
 			l.Info("overview.get")
 			seen := make(map[key]uint64, len(versions))
 			for _, envGroup := range overview.EnvironmentGroups {
 				for _, env := range envGroup.Environments {
+					envDestinations := destinationIds(env)
 					for _, app := range env.Applications {
 						dt := deployedAt(app)
+						v.cache.Add(cacheKey{Revision: overview.GitRevision, Environment: env.Name, Application: app.Name}, &VersionInfo{Version: app.Version, DeployedAt: dt})
 
 						l.Info("version.process", zap.String("application", app.Name), zap.String("environment", env.Name), zap.Uint64("version", app.Version), zap.Time("deployedAt", dt))
 						k := key{env.Name, app.Name}
 						seen[k] = app.Version
 						environmentGroups[k] = envGroup.EnvironmentGroupName
-						if versions[k] == app.Version {
+						teams[k] = overview.Applications[app.Name].GetTeam()
+						if versions[k] == app.Version && equalStrings(destinations[k], envDestinations) {
 							continue
 						}
+						destinations[k] = envDestinations
 
 						processor.ProcessKuberpultEvent(ctx, KuberpultEvent{
 							Application:      app.Name,
 							Environment:      env.Name,
 							EnvironmentGroup: envGroup.EnvironmentGroupName,
+							Team:             teams[k],
 							Version: &VersionInfo{
-								Version:    app.Version,
-								DeployedAt: dt,
+								Version:          app.Version,
+								DeployedAt:       dt,
+								ReleaseCreatedAt: releaseCreatedAt(overview, app.Name, app.Version),
 							},
+							Destinations: envDestinations,
 						})
 					}
 				}
@@ -183,6 +210,7 @@ outer:
 						Application:      k.Application,
 						Environment:      k.Environment,
 						EnvironmentGroup: environmentGroups[k],
+						Team:             teams[k],
 						Version:          &VersionInfo{},
 					})
 				}
@@ -193,9 +221,29 @@ outer:
 
 }
 
+func destinationIds(env *api.Environment) []string {
+	var result []string
+	for _, d := range env.GetConfig().GetArgocd().GetDestinations() {
+		result = append(result, d.Id)
+	}
+	return result
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func New(client api.OverviewServiceClient) VersionClient {
 	result := &versionClient{
-		cache:  lru.New(20),
+		cache:  lru.New(10000),
 		client: client,
 	}
 	return result
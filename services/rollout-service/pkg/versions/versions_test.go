@@ -29,6 +29,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type step struct {
@@ -75,6 +76,27 @@ func (m *mockOverviewClient) GetOverview(ctx context.Context, in *api.GetOvervie
 	return nil, status.Error(codes.Unknown, "no")
 }
 
+// GetAppVersionAtRevision implements api.OverviewServiceClient
+func (m *mockOverviewClient) GetAppVersionAtRevision(ctx context.Context, in *api.GetAppVersionAtRevisionRequest, opts ...grpc.CallOption) (*api.GetAppVersionAtRevisionResponse, error) {
+	m.LastMetadata, _ = metadata.FromOutgoingContext(ctx)
+	resp := m.Responses[in.GitRevision]
+	if resp == nil {
+		return nil, status.Error(codes.Unknown, "no")
+	}
+	for _, group := range resp.EnvironmentGroups {
+		for _, env := range group.Environments {
+			if app := env.Applications[in.Application]; env.Name == in.Environment && app != nil {
+				result := &api.GetAppVersionAtRevisionResponse{Version: app.Version}
+				if dt := deployedAt(app); !dt.IsZero() {
+					result.DeployedAt = timestamppb.New(dt)
+				}
+				return result, nil
+			}
+		}
+	}
+	return &api.GetAppVersionAtRevisionResponse{}, nil
+}
+
 // StreamOverview implements api.OverviewServiceClient
 func (m *mockOverviewClient) StreamOverview(ctx context.Context, in *api.GetOverviewRequest, opts ...grpc.CallOption) (api.OverviewService_StreamOverviewClient, error) {
 	if m.current >= len(m.Steps) {
@@ -261,7 +283,38 @@ func TestVersionClientStream(t *testing.T) {
 				},
 			},
 		},
-		GitRevision: "1234",
+		GitRevision: "5678",
+	}
+	testOverviewWithDestinations := &api.GetOverviewResponse{
+		EnvironmentGroups: []*api.EnvironmentGroup{
+			{
+
+				EnvironmentGroupName: "staging-group",
+				Environments: []*api.Environment{
+					{
+						Name: "staging",
+						Config: &api.EnvironmentConfig{
+							Argocd: &api.EnvironmentConfig_ArgoCD{
+								Destinations: []*api.EnvironmentConfig_ArgoCD_Destination{
+									{Id: "eu"},
+									{Id: "us"},
+								},
+							},
+						},
+						Applications: map[string]*api.Environment_Application{
+							"foo": {
+								Name:    "foo",
+								Version: 1,
+								DeploymentMetaData: &api.Environment_Application_DeploymentMetaData{
+									DeployTime: "123456789",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		GitRevision: "9012",
 	}
 	emptyTestOverview := &api.GetOverviewResponse{
 		EnvironmentGroups: []*api.EnvironmentGroup{},
@@ -316,6 +369,39 @@ func TestVersionClientStream(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name: "Passes the creation time of the release",
+			Steps: []step{
+				{
+					Overview: &api.GetOverviewResponse{
+						EnvironmentGroups: testOverview.EnvironmentGroups,
+						Applications: map[string]*api.Application{
+							"foo": {
+								Name: "foo",
+								Team: "team-a",
+								Releases: []*api.Release{
+									{Version: 2, CreatedAt: timestamppb.New(time.Unix(1000, 0))},
+									{Version: 1, CreatedAt: timestamppb.New(time.Unix(500, 0))},
+								},
+							},
+						},
+						GitRevision: "1234",
+					},
+				},
+				{
+					RecvErr: status.Error(codes.Canceled, "context cancelled"),
+				},
+			},
+			ExpectedEvents: []KuberpultEvent{
+				{
+					Environment:      "staging",
+					Application:      "foo",
+					EnvironmentGroup: "staging-group",
+					Team:             "team-a",
+					Version:          &VersionInfo{Version: 1, DeployedAt: time.Unix(123456789, 0).UTC(), ReleaseCreatedAt: time.Unix(500, 0).UTC()},
+				},
+			},
+		},
 		{
 			Name: "Don't notify twice for the same version",
 			Steps: []step{
@@ -338,6 +424,31 @@ func TestVersionClientStream(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name: "Ignores overviews of the same revision",
+			Steps: []step{
+				{
+					Overview: testOverview,
+				},
+				{
+					Overview: &api.GetOverviewResponse{
+						EnvironmentGroups: testOverviewWithDifferentEnvgroup.EnvironmentGroups,
+						GitRevision:       "1234",
+					},
+				},
+				{
+					RecvErr: status.Error(codes.Canceled, "context cancelled"),
+				},
+			},
+			ExpectedEvents: []KuberpultEvent{
+				{
+					Environment:      "staging",
+					Application:      "foo",
+					EnvironmentGroup: "staging-group",
+					Version:          &VersionInfo{Version: 1, DeployedAt: time.Unix(123456789, 0).UTC()},
+				},
+			},
+		},
 		{
 			Name: "Notify for apps that are deleted",
 			Steps: []step{
@@ -394,6 +505,35 @@ func TestVersionClientStream(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name: "Notify when the destinations change",
+			Steps: []step{
+				{
+					Overview: testOverview,
+				},
+				{
+					Overview: testOverviewWithDestinations,
+				},
+				{
+					RecvErr: status.Error(codes.Canceled, "context cancelled"),
+				},
+			},
+			ExpectedEvents: []KuberpultEvent{
+				{
+					Environment:      "staging",
+					Application:      "foo",
+					EnvironmentGroup: "staging-group",
+					Version:          &VersionInfo{Version: 1, DeployedAt: time.Unix(123456789, 0).UTC()},
+				},
+				{
+					Environment:      "staging",
+					Application:      "foo",
+					EnvironmentGroup: "staging-group",
+					Version:          &VersionInfo{Version: 1, DeployedAt: time.Unix(123456789, 0).UTC()},
+					Destinations:     []string{"eu", "us"},
+				},
+			},
+		},
 	}
 	for _, tc := range tcs {
 		tc := tc